@@ -1,23 +1,142 @@
 package main
 
 import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"os"
 
 	"github.com/robertgontarski/sync/internal/cli"
+	"github.com/robertgontarski/sync/internal/fs"
+	"github.com/robertgontarski/sync/internal/hooks"
 	"github.com/robertgontarski/sync/internal/logger"
+	"github.com/robertgontarski/sync/internal/metrics"
+	"github.com/robertgontarski/sync/internal/progress"
 	"github.com/robertgontarski/sync/internal/syncer"
+	"golang.org/x/term"
 )
 
 func main() {
 	config := cli.Parse()
-	log := logger.New()
 
-	s := syncer.New(config, log)
+	var prog *progress.Progress
+	stdout, stderr := io.Writer(os.Stdout), io.Writer(os.Stderr)
+	if config.Progress {
+		fd := int(os.Stderr.Fd())
+		width, _, _ := term.GetSize(fd)
+		prog = progress.New(os.Stderr, term.IsTerminal(fd), width)
+		stdout, stderr = prog.Writer(stdout), prog.Writer(stderr)
+	}
+
+	// JSON output stays on stdout as a whole, so it can be piped.
+	var log *logger.Logger
+	if config.Output == "json" {
+		log = logger.NewJSON(stdout)
+	} else {
+		log = logger.NewWithWriter(stdout)
+		log.SetErrorWriter(stderr)
+	}
+	switch {
+	case config.Verbosity < 0:
+		log.SetLevel(logger.WARN)
+	case config.Verbosity > 0:
+		log.SetLevel(logger.DEBUG)
+	}
+
+	var logFile *logger.RotatingFile
+	if config.LogFile != "" {
+		var err error
+		logFile, err = logger.OpenRotatingFile(config.LogFile, int64(config.LogMaxSize)<<20, config.LogKeep)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: cannot open log file: %v\n", err)
+			os.Exit(cli.ExitUsage)
+		}
+		log.SetFile(logFile)
+	}
+
+	var m *metrics.Metrics
+	if config.MetricsAddr != "" || config.MetricsFile != "" {
+		m = metrics.New()
+	}
+	if config.MetricsFile != "" {
+		if err := m.Restore(config.MetricsFile); err != nil {
+			log.Warn("cannot read previous metrics: %v", err)
+		}
+	}
+	if config.MetricsAddr != "" {
+		if config.MetricsFile == "" {
+			log.Warn("--metrics-addr serves metrics only until this run exits; use --metrics-file for scheduled runs")
+		}
+		listener, err := net.Listen("tcp", config.MetricsAddr)
+		if err != nil {
+			log.Error("cannot serve metrics: %v", err)
+			os.Exit(cli.ExitFatal)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", m.Handler())
+		go http.Serve(listener, mux)
+	}
 
-	if err := s.Sync(); err != nil {
+	s := syncer.New(syncOptions(config), log)
+	s.SetProgress(prog)
+	s.SetMetrics(m)
+
+	runner := hooks.New(config, log)
+	var result syncer.Result
+	err := runner.Before()
+	if err == nil {
+		result, err = s.Sync()
+	}
+	runner.After(result, err)
+
+	switch {
+	case log.JSON():
+		log.Event(syncer.NewSummary(result, err))
+	case syncer.ExitCode(err) == cli.ExitPartial:
+		log.Error("Synchronization completed with failures: %s", result)
+		log.Error("%v", err)
+	case err != nil:
 		log.Error("Synchronization failed: %v", err)
-		os.Exit(1)
+	default:
+		log.Info("Synchronization completed: %s", result)
 	}
 
-	log.Info("Synchronization completed")
+	if config.MetricsFile != "" {
+		if err := m.WriteFile(config.MetricsFile); err != nil {
+			log.Error("cannot write metrics: %v", err)
+		}
+	}
+	if logFile != nil {
+		logFile.Close()
+	}
+	os.Exit(syncer.ExitCode(err))
+}
+
+// syncOptions returns the syncer settings given on the command line.
+func syncOptions(config *cli.Config) syncer.Options {
+	ssh := func(opts cli.SSHOptions) syncer.SSHOptions {
+		return syncer.SSHOptions{Port: opts.Port, IdentityFile: opts.IdentityFile, Password: opts.Password}
+	}
+	return syncer.Options{
+		Source: syncer.Endpoint{Path: config.SourceDir, SSH: ssh(config.SourceSSHOptions()), CryptKey: config.SourceCryptKey},
+		Target: syncer.Endpoint{Path: config.TargetDir, SSH: ssh(config.TargetSSHOptions()), CryptKey: config.TargetCryptKey},
+		Backend: fs.Options{
+			FTPPassword:         config.FTPPassword,
+			WebDAVPassword:      config.WebDAVPassword,
+			WebDAVAllowHTTPAuth: config.WebDAVAllowHTTPAuth,
+			PasswordPrompt:      config.PasswordPrompt,
+			QuestionPrompt:      config.QuestionPrompt,
+			KeepAlive:           config.KeepAlive,
+			Retries:             config.Retries,
+		},
+		DeleteMissing: config.DeleteMissing,
+		MaxDelete:     config.MaxDelete,
+		Checksum:      config.UseChecksum,
+		CryptNames:    config.CryptNames,
+		Compress:      config.Compress,
+		Decompress:    config.Decompress,
+		BWLimit:       config.BWLimit,
+		ListUpToDate:  config.Verbosity >= 2,
+	}
 }
@@ -0,0 +1,126 @@
+package fs
+
+import (
+	"io"
+	"os"
+	"time"
+
+	ifs "github.com/robertgontarski/sync/internal/fs"
+)
+
+// ErrInjected is returned by FaultFS for stream faults that don't set their
+// own error.
+var ErrInjected = ifs.ErrInjected
+
+// FaultRule describes a fault FaultFS injects into matching calls.
+type FaultRule struct {
+	// Op is the FileSystem method to affect, e.g. "Create". Empty matches any.
+	Op string
+	// Path is a path.Match pattern, matched against the slash-separated path,
+	// or against the base name when it contains no slash. Empty matches any.
+	// For Walk it is matched against every visited entry.
+	Path string
+	// Nth fires the rule only on the nth matching call, counting from 1.
+	// Zero fires it on every matching call.
+	Nth int
+	// Probability fires the rule on a random share of matching calls.
+	// Zero means always.
+	Probability float64
+
+	// Latency delays the call.
+	Latency time.Duration
+	// Err is returned by the call. For stream faults it is the error the
+	// stream fails with, ErrInjected if unset.
+	Err error
+	// ShortWrite makes files returned from Create accept only this many
+	// bytes; later writes are cut short with io.ErrShortWrite.
+	ShortWrite int64
+	// DisconnectAfter makes streams returned from Open and Create fail
+	// after this many bytes, like a connection dropping mid-transfer.
+	DisconnectAfter int64
+}
+
+// FaultFS wraps a FileSystem and injects errors, latency, short writes and
+// mid-stream disconnects according to its rules, to test how callers cope
+// with an unreliable filesystem. Random decisions use a fixed seed so runs
+// are reproducible; see Seed.
+//
+// Copy, Checksum and CreateWithInfo are forwarded to the wrapped
+// filesystem, or report errors.ErrUnsupported, or fall back to Create, when
+// it lacks them. Copy rules match the destination path, and CreateWithInfo
+// is subject to the rules for Create.
+type FaultFS struct {
+	fault *ifs.FaultFS
+}
+
+// NewFaultFS returns inner wrapped with the given rules.
+func NewFaultFS(inner FileSystem, rules ...FaultRule) *FaultFS {
+	f := &FaultFS{fault: ifs.NewFaultFS(inner)}
+	for _, rule := range rules {
+		f.AddRule(rule)
+	}
+	return f
+}
+
+// AddRule adds a rule. Rules are checked in the order they were added.
+func (f *FaultFS) AddRule(rule FaultRule) {
+	f.fault.AddRule(ifs.FaultRule(rule))
+}
+
+// Seed reseeds the random source used for Probability.
+func (f *FaultFS) Seed(seed uint64) {
+	f.fault.Seed(seed)
+}
+
+func (f *FaultFS) Stat(path string) (FileInfo, error) {
+	return f.fault.Stat(path)
+}
+
+func (f *FaultFS) Walk(root string, fn WalkFunc) error {
+	return f.fault.Walk(root, fn)
+}
+
+func (f *FaultFS) Open(path string) (io.ReadCloser, error) {
+	return f.fault.Open(path)
+}
+
+func (f *FaultFS) Create(path string) (io.WriteCloser, error) {
+	return f.fault.Create(path)
+}
+
+func (f *FaultFS) CreateWithInfo(path string, info FileInfo) (io.WriteCloser, error) {
+	return f.fault.CreateWithInfo(path, info)
+}
+
+func (f *FaultFS) Copy(src, dst string) error {
+	return f.fault.Copy(src, dst)
+}
+
+func (f *FaultFS) Checksum(path string) (string, error) {
+	return f.fault.Checksum(path)
+}
+
+func (f *FaultFS) Remove(path string) error {
+	return f.fault.Remove(path)
+}
+
+func (f *FaultFS) MkdirAll(path string, perm os.FileMode) error {
+	return f.fault.MkdirAll(path, perm)
+}
+
+func (f *FaultFS) Chmod(path string, mode os.FileMode) error {
+	return f.fault.Chmod(path, mode)
+}
+
+func (f *FaultFS) Chtimes(path string, atime, mtime time.Time) error {
+	return f.fault.Chtimes(path, atime, mtime)
+}
+
+func (f *FaultFS) Close() error {
+	return f.fault.Close()
+}
+
+// Separator returns the separator of the wrapped filesystem.
+func (f *FaultFS) Separator() byte {
+	return f.fault.Separator()
+}
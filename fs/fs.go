@@ -0,0 +1,145 @@
+// Package fs is the filesystem abstraction the sync engine works on. Local
+// directories, SFTP, S3, FTP, WebDAV and archives all implement FileSystem,
+// and so can any backend of your own.
+package fs
+
+import (
+	"io"
+	"os"
+	"time"
+
+	ifs "github.com/robertgontarski/sync/internal/fs"
+)
+
+type (
+	// FileSystem is a tree of files the engine reads from or writes to.
+	// Paths are absolute within the filesystem and use its separator.
+	FileSystem = ifs.FileSystem
+	FileInfo   = ifs.FileInfo
+	WalkFunc   = ifs.WalkFunc
+
+	// Optional interfaces a FileSystem may implement to be synced more
+	// efficiently. See the documentation of each for details.
+	Copier      = ifs.Copier
+	Checksummer = ifs.Checksummer
+	InfoCreator = ifs.InfoCreator
+	Aborter     = ifs.Aborter
+	Separator   = ifs.Separator
+)
+
+// NewLocalFS returns the local filesystem.
+func NewLocalFS() FileSystem {
+	return ifs.NewLocalFS()
+}
+
+// MemFS is an in-memory FileSystem, e.g. for tests. Paths use "/".
+type MemFS struct {
+	mem *ifs.MemFS
+}
+
+// NewMemFS returns an empty in-memory filesystem.
+func NewMemFS() *MemFS {
+	return &MemFS{mem: ifs.NewMemFS()}
+}
+
+// WriteFile creates or replaces the file at path, creating parent
+// directories.
+func (m *MemFS) WriteFile(path string, data []byte, mode os.FileMode, modTime time.Time) error {
+	return m.mem.WriteFile(path, data, mode, modTime)
+}
+
+// ReadFile returns the contents of the file at path.
+func (m *MemFS) ReadFile(path string) ([]byte, error) {
+	return m.mem.ReadFile(path)
+}
+
+func (m *MemFS) Stat(path string) (FileInfo, error) {
+	return m.mem.Stat(path)
+}
+
+func (m *MemFS) Walk(root string, fn WalkFunc) error {
+	return m.mem.Walk(root, fn)
+}
+
+func (m *MemFS) Open(path string) (io.ReadCloser, error) {
+	return m.mem.Open(path)
+}
+
+func (m *MemFS) Create(path string) (io.WriteCloser, error) {
+	return m.mem.Create(path)
+}
+
+func (m *MemFS) Remove(path string) error {
+	return m.mem.Remove(path)
+}
+
+func (m *MemFS) MkdirAll(path string, perm os.FileMode) error {
+	return m.mem.MkdirAll(path, perm)
+}
+
+func (m *MemFS) Chmod(path string, mode os.FileMode) error {
+	return m.mem.Chmod(path, mode)
+}
+
+func (m *MemFS) Chtimes(path string, atime, mtime time.Time) error {
+	return m.mem.Chtimes(path, atime, mtime)
+}
+
+func (m *MemFS) Close() error {
+	return m.mem.Close()
+}
+
+// Separator reports that MemFS paths use forward slashes.
+func (m *MemFS) Separator() byte {
+	return m.mem.Separator()
+}
+
+// Options holds the connection settings for Open. Settings in the
+// endpoint itself, such as a port in its URL, take precedence over them.
+type Options struct {
+	// Port is the SSH port for SFTP endpoints. 0 means 22.
+	Port         int
+	IdentityFile string
+	// Password is the SSH password.
+	Password string
+	// FTPPassword is the password for FTP endpoints with a user name.
+	FTPPassword string
+	// WebDAVPassword is the password for WebDAV endpoints with a user name.
+	// WebDAVAllowHTTPAuth lets it be sent over plain http.
+	WebDAVPassword      string
+	WebDAVAllowHTTPAuth bool
+	// KeepAlive is the interval between SSH keepalive requests. 0
+	// disables them.
+	KeepAlive time.Duration
+	// Retries is how many times an SSH operation is retried after
+	// reconnecting when the connection drops.
+	Retries int
+}
+
+// Open opens an endpoint as accepted by the sync command, e.g. "/data",
+// "user@host:/backup" or "s3://bucket/prefix". It returns the filesystem
+// and the path of the endpoint within it. The caller closes the
+// filesystem.
+func Open(endpoint string, opts Options) (FileSystem, string, error) {
+	info, err := ifs.ParsePath(endpoint)
+	if err != nil {
+		return nil, "", err
+	}
+	if opts.Port == 0 {
+		opts.Port = 22
+	}
+	filesystem, err := ifs.Open(info, ifs.Options{
+		Port:                opts.Port,
+		IdentityFile:        opts.IdentityFile,
+		Password:            opts.Password,
+		FTPPassword:         opts.FTPPassword,
+		WebDAVPassword:      opts.WebDAVPassword,
+		WebDAVAllowHTTPAuth: opts.WebDAVAllowHTTPAuth,
+		KeepAlive:           opts.KeepAlive,
+		Retries:             opts.Retries,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return filesystem, info.Path, nil
+}
@@ -3,8 +3,11 @@ module github.com/robertgontarski/sync
 go 1.24.4
 
 require (
+	github.com/klauspost/compress v1.19.2
 	github.com/pkg/sftp v1.13.10
 	golang.org/x/crypto v0.48.0
+	golang.org/x/net v0.50.0
+	golang.org/x/term v0.40.0
 )
 
 require (
@@ -1,10 +1,43 @@
 package cli
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
 	"os"
 	"strings"
+	"time"
+
+	"github.com/robertgontarski/sync/internal/ratelimit"
+	"golang.org/x/term"
+)
+
+// PasswordEnv is the environment variable read for the SSH password when no
+// password flag or file is given.
+const PasswordEnv = "SYNC_PASSWORD"
+
+// FTPPasswordEnv is the environment variable read for the FTP password when
+// --ftp-password-file isn't given.
+const FTPPasswordEnv = "SYNC_FTP_PASSWORD"
+
+// WebDAVPasswordEnv is the environment variable read for the WebDAV
+// password when --webdav-password-file isn't given.
+const WebDAVPasswordEnv = "SYNC_WEBDAV_PASSWORD"
+
+// Exit codes of the sync command.
+const (
+	ExitOK = 0
+	// ExitFatal means the run stopped early, e.g. because an endpoint
+	// couldn't be reached.
+	ExitFatal = 1
+	// ExitUsage means the command line or configuration was invalid, so
+	// nothing was done.
+	ExitUsage = 2
+	// ExitPartial means the run finished but some files failed.
+	ExitPartial = 3
+	// ExitSafetyLimit means the run was stopped by a safety limit such as
+	// --max-delete.
+	ExitSafetyLimit = 4
 )
 
 type Config struct {
@@ -15,6 +48,118 @@ type Config struct {
 	IdentityFile  string
 	Port          int
 	Password      string
+	PasswordFile  string
+	SourceSSH     SSHOptions
+	TargetSSH     SSHOptions
+	KeepAlive     time.Duration
+	Retries       int
+	// FTPPassword is the password for FTP endpoints with a user name. The
+	// SSH password is never sent to FTP servers.
+	FTPPassword string
+	// WebDAVPassword is the password for WebDAV endpoints with a user name.
+	// WebDAVAllowHTTPAuth allows sending it over plain http.
+	WebDAVPassword      string
+	WebDAVAllowHTTPAuth bool
+	// SourceCryptKey and TargetCryptKey are the passphrases of endpoints
+	// stored encrypted. Empty means the endpoint is not encrypted.
+	SourceCryptKey string
+	TargetCryptKey string
+	CryptNames     bool
+	// Compress is the compression format for files on the target, empty
+	// for none. Decompress reads a source written that way.
+	Compress   string
+	Decompress bool
+	// BWLimit limits the bandwidth of file transfers and checksum reads.
+	// An empty schedule means unlimited.
+	BWLimit ratelimit.Schedule
+	// Progress shows how far the sync has got while it runs.
+	Progress bool
+	// MaxDelete stops the run before deleting anything if DeleteMissing
+	// would delete more files than this. 0 means no limit.
+	MaxDelete int
+	// Output is the output format, "text" or "json".
+	Output string
+	// Verbosity is -1 with -q, showing only warnings and errors, 0 by
+	// default, 1 with -v for debug output and 2 with -vv to include files
+	// that are up to date.
+	Verbosity int
+	// LogFile receives a copy of the output, rotated once it reaches
+	// LogMaxSize MiB, keeping LogKeep old files.
+	LogFile    string
+	LogMaxSize int
+	LogKeep    int
+	// MetricsAddr is the address /metrics is served on during the run. The
+	// server exits with the run, so scheduled runs should use MetricsFile.
+	MetricsAddr string
+	// MetricsFile receives the metrics at the end of the run, for the
+	// node_exporter textfile collector.
+	MetricsFile string
+	// PreSyncHooks, PostSyncHooks and FailureHooks are commands or
+	// http(s) webhook URLs run before the sync, after it and when it
+	// fails. PostSyncIfChanged skips the post-sync hooks when nothing
+	// changed.
+	PreSyncHooks      []string
+	PostSyncHooks     []string
+	FailureHooks      []string
+	PostSyncIfChanged bool
+	// PasswordPrompt asks for an SSH password interactively. It is nil when
+	// no terminal is attached.
+	PasswordPrompt func(user, host string) (string, error)
+	// QuestionPrompt asks other SSH keyboard-interactive questions, such as
+	// one-time codes. It is nil when no terminal is attached.
+	QuestionPrompt func(question string, echo bool) (string, error)
+}
+
+// SSHOptions holds the SSH settings for a single endpoint.
+// Zero values mean "not set" and fall back to the global options.
+type SSHOptions struct {
+	IdentityFile string
+	Port         int
+	Password     string
+	PasswordFile string
+}
+
+func (o SSHOptions) withDefaults(defaults SSHOptions) SSHOptions {
+	if o.IdentityFile == "" {
+		o.IdentityFile = defaults.IdentityFile
+	}
+	if o.Port == 0 {
+		o.Port = defaults.Port
+	}
+	if o.Password == "" {
+		o.Password = defaults.Password
+	}
+	return o
+}
+
+func (c *Config) globalSSH() SSHOptions {
+	return SSHOptions{
+		IdentityFile: c.IdentityFile,
+		Port:         c.Port,
+		Password:     c.Password,
+	}
+}
+
+// SourceSSHOptions returns the SSH settings for the source endpoint.
+func (c *Config) SourceSSHOptions() SSHOptions {
+	return c.SourceSSH.withDefaults(c.globalSSH())
+}
+
+// TargetSSHOptions returns the SSH settings for the target endpoint.
+func (c *Config) TargetSSHOptions() SSHOptions {
+	return c.TargetSSH.withDefaults(c.globalSSH())
+}
+
+// stringList is a flag that may be given several times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
 }
 
 func reorderArgs() {
@@ -27,7 +172,16 @@ func reorderArgs() {
 			flags = append(flags, args[i])
 			// If this flag takes a value (not a boolean flag), include the next arg too
 			switch args[i] {
-			case "-i", "--identity", "-p", "--port", "--password":
+			case "-i", "--identity", "-p", "--port", "--password",
+				"--password-file",
+				"--src-identity", "--src-port", "--src-password", "--src-password-file",
+				"--dst-identity", "--dst-port", "--dst-password", "--dst-password-file",
+				"--keepalive", "--retries",
+				"--src-crypt-key", "--dst-crypt-key", "--compress",
+				"--bwlimit", "--max-delete", "--output",
+				"--log-file", "--log-max-size", "--log-keep",
+				"--metrics-addr", "--metrics-file",
+				"--pre-sync", "--post-sync", "--on-failure":
 				if i+1 < len(args) {
 					i++
 					flags = append(flags, args[i])
@@ -41,6 +195,58 @@ func reorderArgs() {
 	os.Args = append([]string{os.Args[0]}, append(flags, positional...)...)
 }
 
+// readPasswordFile reads a password from path, dropping the trailing newline.
+func readPasswordFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// resolvePassword fills in opts.Password from opts.PasswordFile, if set.
+func resolvePassword(opts *SSHOptions) error {
+	if opts.PasswordFile == "" {
+		return nil
+	}
+	password, err := readPasswordFile(opts.PasswordFile)
+	if err != nil {
+		return fmt.Errorf("cannot read password file: %w", err)
+	}
+	opts.Password = password
+	return nil
+}
+
+// PromptPassword asks for a password on the terminal without echoing it.
+func PromptPassword(user, host string) (string, error) {
+	fmt.Fprintf(os.Stderr, "%s@%s's password: ", user, host)
+	password, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return string(password), nil
+}
+
+// PromptQuestion asks a question from an SSH server on the terminal,
+// echoing the answer only if echo is set.
+func PromptQuestion(question string, echo bool) (string, error) {
+	fmt.Fprint(os.Stderr, question)
+	if echo {
+		answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(answer, "\r\n"), nil
+	}
+	answer, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return string(answer), nil
+}
+
 func Parse() *Config {
 	config := &Config{}
 
@@ -52,26 +258,131 @@ func Parse() *Config {
 	flag.StringVar(&config.IdentityFile, "i", "", "Path to SSH private key (shorthand)")
 	flag.IntVar(&config.Port, "port", 22, "SSH port")
 	flag.IntVar(&config.Port, "p", 22, "SSH port (shorthand)")
-	flag.StringVar(&config.Password, "password", "", "SSH password (prefer key-based auth)")
+	flag.StringVar(&config.Password, "password", "", "SSH password (deprecated, use --password-file)")
+	flag.StringVar(&config.PasswordFile, "password-file", "", "Read SSH password from file")
+	flag.StringVar(&config.SourceSSH.IdentityFile, "src-identity", "", "Path to SSH private key for the source")
+	flag.IntVar(&config.SourceSSH.Port, "src-port", 0, "SSH port for the source")
+	flag.StringVar(&config.SourceSSH.Password, "src-password", "", "SSH password for the source (deprecated)")
+	flag.StringVar(&config.SourceSSH.PasswordFile, "src-password-file", "", "Read SSH password for the source from file")
+	flag.StringVar(&config.TargetSSH.IdentityFile, "dst-identity", "", "Path to SSH private key for the target")
+	flag.IntVar(&config.TargetSSH.Port, "dst-port", 0, "SSH port for the target")
+	flag.StringVar(&config.TargetSSH.Password, "dst-password", "", "SSH password for the target (deprecated)")
+	flag.StringVar(&config.TargetSSH.PasswordFile, "dst-password-file", "", "Read SSH password for the target from file")
+	flag.DurationVar(&config.KeepAlive, "keepalive", 30*time.Second, "Interval between SSH keepalive requests (0 disables)")
+	flag.IntVar(&config.Retries, "retries", 3, "Reconnect attempts after an SSH connection drops")
+	var ftpPasswordFile string
+	flag.StringVar(&ftpPasswordFile, "ftp-password-file", "", "Read FTP password from file")
+	var webdavPasswordFile string
+	flag.StringVar(&webdavPasswordFile, "webdav-password-file", "", "Read WebDAV password from file")
+	flag.BoolVar(&config.WebDAVAllowHTTPAuth, "webdav-allow-http-auth", false, "Allow sending the WebDAV password over plain http")
+	var srcCryptKeyFile, dstCryptKeyFile string
+	flag.StringVar(&srcCryptKeyFile, "src-crypt-key", "", "Read the passphrase of an encrypted source from file")
+	flag.StringVar(&dstCryptKeyFile, "dst-crypt-key", "", "Encrypt the target with the passphrase read from file")
+	flag.BoolVar(&config.CryptNames, "crypt-names", false, "Also encrypt file names on encrypted endpoints")
+	flag.StringVar(&config.Compress, "compress", "", "Compress files on the target with gzip or zstd")
+	flag.BoolVar(&config.Decompress, "decompress", false, "Decompress files from a source written with --compress")
+	flag.BoolVar(&config.Progress, "progress", false, "Show progress with throughput and ETA")
+	flag.IntVar(&config.MaxDelete, "max-delete", 0, "Don't delete anything if more than N files would be deleted")
+	flag.StringVar(&config.Output, "output", "text", "Output format: text or json")
+	var verbose, veryVerbose, quiet bool
+	flag.BoolVar(&verbose, "v", false, "Debug output, including why files are copied")
+	flag.BoolVar(&veryVerbose, "vv", false, "Debug output, including files that are up to date")
+	flag.BoolVar(&quiet, "q", false, "Only show warnings and errors (shorthand)")
+	flag.BoolVar(&quiet, "quiet", false, "Only show warnings and errors")
+	flag.StringVar(&config.LogFile, "log-file", "", "Also write the output to FILE")
+	flag.IntVar(&config.LogMaxSize, "log-max-size", 10, "Rotate the log file at this size in MiB (0 never rotates)")
+	flag.IntVar(&config.LogKeep, "log-keep", 5, "Number of rotated log files to keep")
+	flag.StringVar(&config.MetricsAddr, "metrics-addr", "", "Serve Prometheus metrics on ADDR/metrics until the run exits")
+	flag.StringVar(&config.MetricsFile, "metrics-file", "", "Write Prometheus metrics to FILE at the end of the run")
+	flag.Var((*stringList)(&config.PreSyncHooks), "pre-sync", "Command or webhook URL to run before syncing (repeatable)")
+	flag.Var((*stringList)(&config.PostSyncHooks), "post-sync", "Command or webhook URL to run after syncing (repeatable)")
+	flag.Var((*stringList)(&config.FailureHooks), "on-failure", "Command or webhook URL to run when the sync fails (repeatable)")
+	flag.BoolVar(&config.PostSyncIfChanged, "post-sync-if-changed", false, "Only run post-sync hooks if files changed")
+	var bwlimit string
+	flag.StringVar(&bwlimit, "bwlimit", "", "Bandwidth limit, e.g. 10M, or a schedule like \"08:00,512K 18:00,off\"")
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options] <source> <target>\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "One-way file synchronization tool (source -> target)\n\n")
 		fmt.Fprintf(os.Stderr, "Arguments:\n")
-		fmt.Fprintf(os.Stderr, "  <source>  Source directory path or [user@]host:/path\n")
-		fmt.Fprintf(os.Stderr, "  <target>  Target directory path or [user@]host:/path\n\n")
+		fmt.Fprintf(os.Stderr, "  <source>  Source endpoint\n")
+		fmt.Fprintf(os.Stderr, "  <target>  Target endpoint\n\n")
+		fmt.Fprintf(os.Stderr, "Endpoints:\n")
+		fmt.Fprintf(os.Stderr, "  /path, file:///path                            Local directory\n")
+		fmt.Fprintf(os.Stderr, "  /path/name.tar[.gz], .tgz, .zip                Local archive\n")
+		fmt.Fprintf(os.Stderr, "  [user@]host:/path, sftp://[user@]host[:port]/path[?identity=FILE]\n")
+		fmt.Fprintf(os.Stderr, "                                                 SFTP\n")
+		fmt.Fprintf(os.Stderr, "  s3://bucket/prefix[?region=R&endpoint=URL&path-style=BOOL]\n")
+		fmt.Fprintf(os.Stderr, "                                                 S3 or S3-compatible storage\n")
+		fmt.Fprintf(os.Stderr, "  ftp[s]://[user@]host[:port]/path[?tls=implicit|explicit]\n")
+		fmt.Fprintf(os.Stderr, "                                                 FTP or FTPS\n")
+		fmt.Fprintf(os.Stderr, "  webdav[s]://[user@]host[:port]/path            WebDAV over HTTP or HTTPS\n")
+		fmt.Fprintf(os.Stderr, "  IPv6 addresses go in brackets: user@[2001:db8::1]:/path\n\n")
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		fmt.Fprintf(os.Stderr, "  -d, --delete-missing  Delete files in target that don't exist in source\n")
 		fmt.Fprintf(os.Stderr, "  -c, --checksum        Compare files using SHA256 checksum (slower but more accurate)\n")
 		fmt.Fprintf(os.Stderr, "  -i, --identity FILE   Path to SSH private key (default: ~/.ssh/id_ed25519, ~/.ssh/id_rsa)\n")
 		fmt.Fprintf(os.Stderr, "  -p, --port PORT       SSH port (default: 22)\n")
-		fmt.Fprintf(os.Stderr, "      --password PASS   SSH password (prefer key-based auth)\n")
+		fmt.Fprintf(os.Stderr, "      --password-file FILE\n")
+		fmt.Fprintf(os.Stderr, "                        Read SSH password from FILE (or set %s)\n", PasswordEnv)
+		fmt.Fprintf(os.Stderr, "      --password PASS   SSH password (deprecated: visible in the process list)\n")
+		fmt.Fprintf(os.Stderr, "      --src-identity FILE, --src-port PORT, --src-password-file FILE\n")
+		fmt.Fprintf(os.Stderr, "                        SSH settings for the source only (override the above)\n")
+		fmt.Fprintf(os.Stderr, "      --dst-identity FILE, --dst-port PORT, --dst-password-file FILE\n")
+		fmt.Fprintf(os.Stderr, "                        SSH settings for the target only (override the above)\n")
+		fmt.Fprintf(os.Stderr, "      --keepalive DUR   Interval between SSH keepalive requests, 0 disables (default: 30s)\n")
+		fmt.Fprintf(os.Stderr, "      --retries N       Reconnect attempts after an SSH connection drops (default: 3)\n")
+		fmt.Fprintf(os.Stderr, "      --ftp-password-file FILE\n")
+		fmt.Fprintf(os.Stderr, "                        Read the FTP password from FILE (or set %s)\n", FTPPasswordEnv)
+		fmt.Fprintf(os.Stderr, "      --webdav-password-file FILE\n")
+		fmt.Fprintf(os.Stderr, "                        Read the WebDAV password from FILE (or set %s)\n", WebDAVPasswordEnv)
+		fmt.Fprintf(os.Stderr, "      --webdav-allow-http-auth\n")
+		fmt.Fprintf(os.Stderr, "                        Allow sending the WebDAV password over plain http (webdav://)\n")
+		fmt.Fprintf(os.Stderr, "      --dst-crypt-key FILE\n")
+		fmt.Fprintf(os.Stderr, "                        Encrypt files on the target with the passphrase in FILE\n")
+		fmt.Fprintf(os.Stderr, "      --src-crypt-key FILE\n")
+		fmt.Fprintf(os.Stderr, "                        Decrypt files from an encrypted source with the passphrase in FILE\n")
+		fmt.Fprintf(os.Stderr, "      --crypt-names     Also encrypt file and directory names\n")
+		fmt.Fprintf(os.Stderr, "      --compress FORMAT Compress files on the target with gzip or zstd\n")
+		fmt.Fprintf(os.Stderr, "      --decompress      Decompress files from a source written with --compress\n")
+		fmt.Fprintf(os.Stderr, "      --bwlimit RATE    Limit transfers to RATE bytes/s, e.g. 500K or 10M, or follow a\n")
+		fmt.Fprintf(os.Stderr, "                        schedule of HH:MM,RATE entries: \"08:00,512K 18:00,10M 23:00,off\"\n")
+		fmt.Fprintf(os.Stderr, "      --max-delete N    Stop before deleting anything if more than N files would be deleted\n")
+		fmt.Fprintf(os.Stderr, "      --progress        Show files and bytes done, throughput and ETA while syncing\n")
+		fmt.Fprintf(os.Stderr, "      --output FORMAT   Output format: text (default) or json, one event per line\n")
+		fmt.Fprintf(os.Stderr, "  -v, -vv               Debug output: why files are copied; -vv also lists files\n")
+		fmt.Fprintf(os.Stderr, "                        that are up to date\n")
+		fmt.Fprintf(os.Stderr, "  -q, --quiet           Only show warnings and errors\n")
+		fmt.Fprintf(os.Stderr, "      --log-file FILE   Also write the output to FILE\n")
+		fmt.Fprintf(os.Stderr, "      --log-max-size MB Rotate the log file at this size (default: 10, 0 never rotates)\n")
+		fmt.Fprintf(os.Stderr, "      --log-keep N      Number of rotated log files to keep (default: 5)\n")
+		fmt.Fprintf(os.Stderr, "      --metrics-addr ADDR\n")
+		fmt.Fprintf(os.Stderr, "                        Serve Prometheus metrics on ADDR/metrics until the run exits;\n")
+		fmt.Fprintf(os.Stderr, "                        use --metrics-file for scheduled runs\n")
+		fmt.Fprintf(os.Stderr, "      --metrics-file FILE\n")
+		fmt.Fprintf(os.Stderr, "                        Write Prometheus metrics to FILE at the end of the run\n")
+		fmt.Fprintf(os.Stderr, "      --pre-sync HOOK, --post-sync HOOK, --on-failure HOOK\n")
+		fmt.Fprintf(os.Stderr, "                        Run a command or POST to an http(s) URL before, after or when\n")
+		fmt.Fprintf(os.Stderr, "                        the sync fails; may be repeated\n")
+		fmt.Fprintf(os.Stderr, "      --post-sync-if-changed\n")
+		fmt.Fprintf(os.Stderr, "                        Only run post-sync hooks if files were copied, updated or deleted\n")
 		fmt.Fprintf(os.Stderr, "  -h, --help            Show this help message\n\n")
+		fmt.Fprintf(os.Stderr, "Exit codes:\n")
+		fmt.Fprintf(os.Stderr, "  0 success, 1 fatal error (e.g. connection failed), 2 usage error,\n")
+		fmt.Fprintf(os.Stderr, "  3 some files failed, 4 stopped by --max-delete\n\n")
 		fmt.Fprintf(os.Stderr, "Examples:\n")
 		fmt.Fprintf(os.Stderr, "  %s /local/src /local/dst                        Local to local\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s /local/src user@host:/remote/dst             Local to remote\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s user@host:/remote/src /local/dst             Remote to local\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s user@host1:/path user@host2:/path            Remote to remote\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s /local/src s3://bucket/prefix                Local to S3\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s ftps://user@host/outbox /local/dst           FTPS to local\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s webdavs://user@host/dav/docs /local/dst      WebDAV over HTTPS to local\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s ./build release.tar.gz                       Local to reproducible archive\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s --src-port 2222 h1:/path h2:/path             Remote to remote, different ports\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s sftp://h1:2222/path sftp://h2/path            The same with URLs\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s --dst-crypt-key key /data user@host:/backup   Encrypted backup to an untrusted host\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s --compress zstd /var/log /archive/logs        Compressed copy of text-heavy logs\n", os.Args[0])
 	}
 
 	reorderArgs()
@@ -81,11 +392,109 @@ func Parse() *Config {
 	if len(args) < 2 {
 		fmt.Fprintf(os.Stderr, "Error: source and target directories are required\n\n")
 		flag.Usage()
-		os.Exit(1)
+		os.Exit(ExitUsage)
 	}
 
 	config.SourceDir = args[0]
 	config.TargetDir = args[1]
 
+	if config.MaxDelete < 0 {
+		fmt.Fprintf(os.Stderr, "Error: --max-delete must not be negative\n")
+		os.Exit(ExitUsage)
+	}
+
+	if config.Output != "text" && config.Output != "json" {
+		fmt.Fprintf(os.Stderr, "Error: unknown output format %q, expected text or json\n", config.Output)
+		os.Exit(ExitUsage)
+	}
+
+	switch {
+	case quiet && (verbose || veryVerbose):
+		fmt.Fprintf(os.Stderr, "Error: -q cannot be combined with -v\n")
+		os.Exit(ExitUsage)
+	case quiet:
+		config.Verbosity = -1
+	case veryVerbose:
+		config.Verbosity = 2
+	case verbose:
+		config.Verbosity = 1
+	}
+
+	if config.LogMaxSize < 0 || config.LogKeep < 0 {
+		fmt.Fprintf(os.Stderr, "Error: --log-max-size and --log-keep must not be negative\n")
+		os.Exit(ExitUsage)
+	}
+
+	if bwlimit != "" {
+		schedule, err := ratelimit.ParseSchedule(bwlimit)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --bwlimit: %v\n", err)
+			os.Exit(ExitUsage)
+		}
+		config.BWLimit = schedule
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "password", "src-password", "dst-password":
+			fmt.Fprintf(os.Stderr, "Warning: --%s exposes the password in the process list and shell history; use --%s-file or %s instead\n", f.Name, f.Name, PasswordEnv)
+		}
+	})
+
+	global := SSHOptions{Password: config.Password, PasswordFile: config.PasswordFile}
+	if global.Password == "" && global.PasswordFile == "" {
+		global.Password = os.Getenv(PasswordEnv)
+	}
+	for _, opts := range []*SSHOptions{&global, &config.SourceSSH, &config.TargetSSH} {
+		if err := resolvePassword(opts); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(ExitUsage)
+		}
+	}
+	config.Password = global.Password
+
+	for _, p := range []struct {
+		name, file, env string
+		dst             *string
+	}{
+		{"FTP", ftpPasswordFile, FTPPasswordEnv, &config.FTPPassword},
+		{"WebDAV", webdavPasswordFile, WebDAVPasswordEnv, &config.WebDAVPassword},
+	} {
+		*p.dst = os.Getenv(p.env)
+		if p.file == "" {
+			continue
+		}
+		password, err := readPasswordFile(p.file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: cannot read %s password file: %v\n", p.name, err)
+			os.Exit(ExitUsage)
+		}
+		*p.dst = password
+	}
+
+	for _, key := range []struct {
+		file string
+		dst  *string
+	}{{srcCryptKeyFile, &config.SourceCryptKey}, {dstCryptKeyFile, &config.TargetCryptKey}} {
+		if key.file == "" {
+			continue
+		}
+		passphrase, err := readPasswordFile(key.file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: cannot read encryption key file: %v\n", err)
+			os.Exit(ExitUsage)
+		}
+		if passphrase == "" {
+			fmt.Fprintf(os.Stderr, "Error: encryption key file %s is empty\n", key.file)
+			os.Exit(ExitUsage)
+		}
+		*key.dst = passphrase
+	}
+
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		config.PasswordPrompt = PromptPassword
+		config.QuestionPrompt = PromptQuestion
+	}
+
 	return config
 }
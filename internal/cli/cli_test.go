@@ -0,0 +1,99 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSSHOptions_WithDefaults(t *testing.T) {
+	defaults := SSHOptions{IdentityFile: "/keys/global", Port: 22, Password: "global"}
+	tests := []struct {
+		name string
+		opts SSHOptions
+		want SSHOptions
+	}{
+		{"unset", SSHOptions{}, defaults},
+		{
+			"all set",
+			SSHOptions{IdentityFile: "/keys/own", Port: 2222, Password: "own"},
+			SSHOptions{IdentityFile: "/keys/own", Port: 2222, Password: "own"},
+		},
+		{
+			"port only",
+			SSHOptions{Port: 2222},
+			SSHOptions{IdentityFile: "/keys/global", Port: 2222, Password: "global"},
+		},
+		{
+			"identity only",
+			SSHOptions{IdentityFile: "/keys/own"},
+			SSHOptions{IdentityFile: "/keys/own", Port: 22, Password: "global"},
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.opts.withDefaults(defaults); got != tt.want {
+			t.Errorf("%s: withDefaults = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestConfig_EndpointSSHOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   Config
+		src, dst SSHOptions
+	}{
+		{
+			"global only",
+			Config{IdentityFile: "/keys/global", Port: 22, Password: "global"},
+			SSHOptions{IdentityFile: "/keys/global", Port: 22, Password: "global"},
+			SSHOptions{IdentityFile: "/keys/global", Port: 22, Password: "global"},
+		},
+		{
+			"source overrides",
+			Config{
+				IdentityFile: "/keys/global", Port: 22,
+				SourceSSH: SSHOptions{IdentityFile: "/keys/src", Port: 2222, Password: "src"},
+			},
+			SSHOptions{IdentityFile: "/keys/src", Port: 2222, Password: "src"},
+			SSHOptions{IdentityFile: "/keys/global", Port: 22},
+		},
+		{
+			"target overrides",
+			Config{
+				Port: 22, Password: "global",
+				TargetSSH: SSHOptions{Port: 2200},
+			},
+			SSHOptions{Port: 22, Password: "global"},
+			SSHOptions{Port: 2200, Password: "global"},
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.config.SourceSSHOptions(); got != tt.src {
+			t.Errorf("%s: SourceSSHOptions = %+v, want %+v", tt.name, got, tt.src)
+		}
+		if got := tt.config.TargetSSHOptions(); got != tt.dst {
+			t.Errorf("%s: TargetSSHOptions = %+v, want %+v", tt.name, got, tt.dst)
+		}
+	}
+}
+
+func TestResolvePassword(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(path, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := SSHOptions{Password: "flag", PasswordFile: path}
+	if err := resolvePassword(&opts); err != nil {
+		t.Fatalf("resolvePassword failed: %v", err)
+	}
+	if opts.Password != "secret" {
+		t.Errorf("Password = %q, want %q", opts.Password, "secret")
+	}
+
+	opts = SSHOptions{PasswordFile: filepath.Join(t.TempDir(), "missing")}
+	if err := resolvePassword(&opts); err == nil {
+		t.Error("resolvePassword succeeded for a missing file")
+	}
+}
@@ -0,0 +1,687 @@
+package fs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	Register("archive", func(info PathInfo, opts Options) (FileSystem, error) {
+		if info.Host != "" {
+			return nil, fmt.Errorf("file URL names remote host %q", info.Host)
+		}
+		if err := checkQuery(info); err != nil {
+			return nil, err
+		}
+		return NewArchiveFS(info.Archive)
+	})
+}
+
+// ArchiveFormat is the file format of an archive handled by ArchiveFS.
+type ArchiveFormat int
+
+const (
+	ArchiveTar ArchiveFormat = iota + 1
+	ArchiveTarGzip
+	ArchiveZip
+)
+
+// ArchiveFormatOf returns the archive format implied by the extension of
+// name, or 0 if name is not an archive.
+func ArchiveFormatOf(name string) ArchiveFormat {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".tar"):
+		return ArchiveTar
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return ArchiveTarGzip
+	case strings.HasSuffix(lower, ".zip"):
+		return ArchiveZip
+	}
+	return 0
+}
+
+// ArchiveFS is a FileSystem backed by a tar, gzipped tar or zip archive on
+// the local disk. Paths inside the archive are slash-separated and rooted at
+// "/".
+//
+// An existing archive is indexed when opened and its files are read straight
+// from it, so it can be used as a sync source. Changes are kept aside, with
+// new file contents in a temporary directory, and Close writes a complete new
+// archive in place of the old one. Entries are written in lexical order with
+// times truncated to seconds and no owner information, so the same tree
+// always produces the same archive. Nothing is written if nothing changed.
+type ArchiveFS struct {
+	name   string
+	format ArchiveFormat
+
+	mu      sync.Mutex
+	entries map[string]*archiveEntry
+	file    *os.File
+	tmpDir  string
+	dirty   bool
+
+	// untarOnce decompresses a gzipped tar into untarred on first read.
+	untarOnce sync.Once
+	untarred  *os.File
+	untarErr  error
+}
+
+// archiveEntry is a file or directory in the archive. The contents of a file
+// come from tmp if it was written through the ArchiveFS, otherwise from the
+// original archive.
+type archiveEntry struct {
+	mode    os.FileMode
+	modTime time.Time
+	size    int64
+	isDir   bool
+
+	tmp     string
+	zipFile *zip.File
+	// offset is where the contents start in the tar, after decompression
+	// for a gzipped one.
+	offset int64
+}
+
+// NewArchiveFS opens the archive name, whose format is taken from its
+// extension. A missing archive is treated as empty and created on Close.
+func NewArchiveFS(name string) (*ArchiveFS, error) {
+	format := ArchiveFormatOf(name)
+	if format == 0 {
+		return nil, fmt.Errorf("%s: unknown archive format, expected .tar, .tar.gz, .tgz or .zip", name)
+	}
+
+	a := &ArchiveFS{
+		name:    name,
+		format:  format,
+		entries: map[string]*archiveEntry{},
+	}
+
+	file, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		a.entries["/"] = &archiveEntry{mode: os.ModeDir | 0755, modTime: time.Now(), isDir: true}
+		a.dirty = true
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	a.file = file
+	a.entries["/"] = &archiveEntry{mode: os.ModeDir | 0755, modTime: stat.ModTime(), isDir: true}
+
+	if format == ArchiveZip {
+		err = a.indexZip(stat.Size())
+	} else {
+		err = a.indexTar()
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("reading %s: %w", name, err)
+	}
+	return a, nil
+}
+
+// archiveKey converts a name stored in an archive to a path in the
+// ArchiveFS. Cleaning it rooted at "/" also keeps ".." from escaping.
+func archiveKey(name string) string {
+	return path.Clean("/" + name)
+}
+
+// add records an entry read from the archive, with implicit parent
+// directories for archives that don't list them.
+func (a *ArchiveFS) add(key string, e *archiveEntry) {
+	if key == "/" {
+		return
+	}
+	a.entries[key] = e
+	for dir := path.Dir(key); dir != "/"; dir = path.Dir(dir) {
+		if _, ok := a.entries[dir]; ok {
+			break
+		}
+		a.entries[dir] = &archiveEntry{mode: os.ModeDir | 0755, modTime: e.modTime, isDir: true}
+	}
+}
+
+func (a *ArchiveFS) indexZip(size int64) error {
+	r, err := zip.NewReader(a.file, size)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range r.File {
+		modTime := f.Modified
+		mode := f.Mode()
+		switch {
+		case mode.IsDir():
+			a.add(archiveKey(f.Name), &archiveEntry{mode: os.ModeDir | mode.Perm(), modTime: modTime, isDir: true})
+		case mode.IsRegular():
+			a.add(archiveKey(f.Name), &archiveEntry{
+				mode:    mode.Perm(),
+				modTime: modTime,
+				size:    int64(f.UncompressedSize64),
+				zipFile: f,
+			})
+		}
+	}
+	return nil
+}
+
+// countingReader counts the bytes read through it, which gives the offset of
+// each file's contents in a tar.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (a *ArchiveFS) indexTar() error {
+	var r io.Reader = a.file
+	if a.format == ArchiveTarGzip {
+		gz, err := gzip.NewReader(a.file)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	counter := &countingReader{r: r}
+	tr := tar.NewReader(counter)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			a.add(archiveKey(hdr.Name), &archiveEntry{mode: os.ModeDir | mode, modTime: hdr.ModTime, isDir: true})
+		case tar.TypeReg:
+			a.add(archiveKey(hdr.Name), &archiveEntry{
+				mode:    mode,
+				modTime: hdr.ModTime,
+				size:    hdr.Size,
+				offset:  counter.n,
+			})
+		}
+	}
+}
+
+func (a *ArchiveFS) notExist(op, p string) error {
+	return &os.PathError{Op: op, Path: p, Err: os.ErrNotExist}
+}
+
+func (a *ArchiveFS) info(key string, e *archiveEntry) FileInfo {
+	return FileInfo{
+		Name:    path.Base(key),
+		Size:    e.size,
+		Mode:    e.mode,
+		ModTime: e.modTime,
+		IsDir:   e.isDir,
+	}
+}
+
+func (a *ArchiveFS) Stat(p string) (FileInfo, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := archiveKey(p)
+	e, ok := a.entries[key]
+	if !ok {
+		return FileInfo{}, a.notExist("stat", p)
+	}
+	return a.info(key, e), nil
+}
+
+// sortedKeys returns the keys at or below root, each directory directly
+// followed by its contents.
+func (a *ArchiveFS) sortedKeys(root string) []string {
+	var keys []string
+	for key := range a.entries {
+		if key == root || strings.HasPrefix(key, strings.TrimSuffix(root, "/")+"/") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return strings.ReplaceAll(keys[i], "/", "\x00") < strings.ReplaceAll(keys[j], "/", "\x00")
+	})
+	return keys
+}
+
+// Walk walks the tree rooted at root in lexical order.
+func (a *ArchiveFS) Walk(root string, fn WalkFunc) error {
+	a.mu.Lock()
+	rootKey := archiveKey(root)
+	keys := a.sortedKeys(rootKey)
+	infos := make([]FileInfo, len(keys))
+	for i, key := range keys {
+		infos[i] = a.info(key, a.entries[key])
+	}
+	a.mu.Unlock()
+
+	if len(keys) == 0 {
+		return fn(root, FileInfo{}, a.notExist("lstat", root))
+	}
+
+	var skip string
+	for i, key := range keys {
+		if skip != "" && strings.HasPrefix(key, skip) {
+			continue
+		}
+		p := root
+		if rel := strings.TrimPrefix(strings.TrimPrefix(key, rootKey), "/"); rel != "" {
+			p = strings.TrimSuffix(root, "/") + "/" + rel
+		}
+		if err := fn(p, infos[i], nil); err != nil {
+			if infos[i].IsDir && errors.Is(err, filepath.SkipDir) {
+				skip = strings.TrimSuffix(key, "/") + "/"
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *ArchiveFS) Open(p string) (io.ReadCloser, error) {
+	a.mu.Lock()
+	key := archiveKey(p)
+	e, ok := a.entries[key]
+	a.mu.Unlock()
+
+	if !ok || e.isDir {
+		return nil, a.notExist("open", p)
+	}
+	return a.open(key, e)
+}
+
+func (a *ArchiveFS) open(key string, e *archiveEntry) (io.ReadCloser, error) {
+	switch {
+	case e.tmp != "":
+		return os.Open(e.tmp)
+	case e.zipFile != nil:
+		return e.zipFile.Open()
+	case a.format == ArchiveTar:
+		return io.NopCloser(io.NewSectionReader(a.file, e.offset, e.size)), nil
+	default:
+		untarred, err := a.untar()
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(io.NewSectionReader(untarred, e.offset, e.size)), nil
+	}
+}
+
+// untar returns the gzipped tar decompressed into a temporary file, as
+// compressed archives can't be read at an offset. It is only done once, on
+// the first read, so reading every file takes a single pass.
+func (a *ArchiveFS) untar() (*os.File, error) {
+	a.untarOnce.Do(func() {
+		file, err := os.CreateTemp("", "sync-archive-*.tar")
+		if err != nil {
+			a.untarErr = err
+			return
+		}
+		gz, err := gzip.NewReader(io.NewSectionReader(a.file, 0, 1<<63-1))
+		if err == nil {
+			_, err = io.Copy(file, gz)
+		}
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			a.untarErr = fmt.Errorf("reading %s: %w", a.name, err)
+			return
+		}
+		a.untarred = file
+	})
+	return a.untarred, a.untarErr
+}
+
+// Create stores the contents in a temporary file until the archive is
+// written.
+func (a *ArchiveFS) Create(p string) (io.WriteCloser, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := archiveKey(p)
+	if parent, ok := a.entries[path.Dir(key)]; !ok || !parent.isDir {
+		return nil, a.notExist("open", p)
+	}
+	if e, ok := a.entries[key]; ok && e.isDir {
+		return nil, &os.PathError{Op: "open", Path: p, Err: errors.New("is a directory")}
+	}
+
+	if a.tmpDir == "" {
+		dir, err := os.MkdirTemp("", "sync-archive-")
+		if err != nil {
+			return nil, err
+		}
+		a.tmpDir = dir
+	}
+	file, err := os.CreateTemp(a.tmpDir, "file-")
+	if err != nil {
+		return nil, err
+	}
+	return &archiveWriter{fs: a, key: key, file: file}, nil
+}
+
+type archiveWriter struct {
+	fs   *ArchiveFS
+	key  string
+	file *os.File
+}
+
+func (w *archiveWriter) Write(p []byte) (int, error) {
+	return w.file.Write(p)
+}
+
+// Close adds the file to the archive.
+func (w *archiveWriter) Close() error {
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	stat, err := os.Stat(w.file.Name())
+	if err != nil {
+		return err
+	}
+
+	w.fs.mu.Lock()
+	defer w.fs.mu.Unlock()
+
+	if old, ok := w.fs.entries[w.key]; ok && old.tmp != "" {
+		os.Remove(old.tmp)
+	}
+	w.fs.entries[w.key] = &archiveEntry{
+		mode:    0644,
+		modTime: time.Now(),
+		size:    stat.Size(),
+		tmp:     w.file.Name(),
+	}
+	w.fs.dirty = true
+	return nil
+}
+
+// Abort discards the file, leaving any previous version in place.
+func (w *archiveWriter) Abort() error {
+	w.file.Close()
+	return os.Remove(w.file.Name())
+}
+
+func (a *ArchiveFS) Remove(p string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := archiveKey(p)
+	e, ok := a.entries[key]
+	if !ok || key == "/" {
+		return a.notExist("remove", p)
+	}
+	if e.isDir {
+		for other := range a.entries {
+			if strings.HasPrefix(other, key+"/") {
+				return &os.PathError{Op: "remove", Path: p, Err: errors.New("directory not empty")}
+			}
+		}
+	}
+	if e.tmp != "" {
+		os.Remove(e.tmp)
+	}
+	delete(a.entries, key)
+	a.dirty = true
+	return nil
+}
+
+func (a *ArchiveFS) MkdirAll(p string, perm os.FileMode) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := archiveKey(p)
+	for dir := key; ; dir = path.Dir(dir) {
+		if e, ok := a.entries[dir]; ok {
+			if !e.isDir {
+				return &os.PathError{Op: "mkdir", Path: p, Err: errors.New("not a directory")}
+			}
+		} else {
+			// The time is filled in when the archive is written.
+			a.entries[dir] = &archiveEntry{mode: os.ModeDir | perm, isDir: true}
+			a.dirty = true
+		}
+		if dir == "/" {
+			return nil
+		}
+	}
+}
+
+func (a *ArchiveFS) Chmod(p string, mode os.FileMode) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	e, ok := a.entries[archiveKey(p)]
+	if !ok {
+		return a.notExist("chmod", p)
+	}
+	e.mode = e.mode&os.ModeType | mode.Perm()
+	a.dirty = true
+	return nil
+}
+
+func (a *ArchiveFS) Chtimes(p string, atime, mtime time.Time) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	e, ok := a.entries[archiveKey(p)]
+	if !ok {
+		return a.notExist("chtimes", p)
+	}
+	e.modTime = mtime
+	a.dirty = true
+	return nil
+}
+
+// Close writes the archive if anything changed and releases the original.
+func (a *ArchiveFS) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var err error
+	if a.dirty {
+		err = a.write()
+		a.dirty = false
+	}
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+	if a.untarred != nil {
+		a.untarred.Close()
+		os.Remove(a.untarred.Name())
+		a.untarred = nil
+	}
+	if a.tmpDir != "" {
+		os.RemoveAll(a.tmpDir)
+		a.tmpDir = ""
+	}
+	return err
+}
+
+// write writes the whole tree to a temporary file next to the archive and
+// renames it into place, so the old archive stays intact on failure.
+func (a *ArchiveFS) write() error {
+	out, err := os.CreateTemp(filepath.Dir(a.name), "."+filepath.Base(a.name)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	if a.format == ArchiveZip {
+		err = a.writeZip(out)
+	} else {
+		err = a.writeTar(out)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", a.name, err)
+	}
+	if err := os.Chmod(out.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), a.name)
+}
+
+// entryTimes returns the time to store for every entry. Directories created
+// through MkdirAll get the newest time found below them, which keeps the
+// archive reproducible.
+func (a *ArchiveFS) entryTimes(keys []string) map[string]time.Time {
+	times := make(map[string]time.Time, len(keys))
+	for i := len(keys) - 1; i >= 0; i-- {
+		key := keys[i]
+		t := a.entries[key].modTime
+		if t.IsZero() {
+			t = times[key]
+		}
+		if t.IsZero() {
+			t = time.Unix(0, 0)
+		}
+		times[key] = t.UTC().Truncate(time.Second)
+		if parent := path.Dir(key); a.entries[parent].modTime.IsZero() && t.After(times[parent]) {
+			times[parent] = t
+		}
+	}
+	return times
+}
+
+// archiveName returns the name key is stored under, with a trailing slash
+// for directories.
+func archiveName(key string, e *archiveEntry) string {
+	name := strings.TrimPrefix(key, "/")
+	if e.isDir {
+		name += "/"
+	}
+	return name
+}
+
+// copyEntry copies the contents of the file at key to w.
+func (a *ArchiveFS) copyEntry(w io.Writer, key string, e *archiveEntry) error {
+	r, err := a.open(key, e)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return err
+	}
+	if n != e.size {
+		return fmt.Errorf("%s: read %d bytes, expected %d", key, n, e.size)
+	}
+	return nil
+}
+
+func (a *ArchiveFS) writeTar(out io.Writer) error {
+	w := out
+	var gz *gzip.Writer
+	if a.format == ArchiveTarGzip {
+		gz = gzip.NewWriter(out)
+		w = gz
+	}
+
+	tw := tar.NewWriter(w)
+	keys := a.sortedKeys("/")
+	times := a.entryTimes(keys)
+	for _, key := range keys {
+		if key == "/" {
+			continue
+		}
+		e := a.entries[key]
+		hdr := &tar.Header{
+			Name:     archiveName(key, e),
+			Mode:     int64(e.mode.Perm()),
+			ModTime:  times[key],
+			Typeflag: tar.TypeReg,
+			Size:     e.size,
+		}
+		if e.isDir {
+			hdr.Typeflag = tar.TypeDir
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !e.isDir {
+			if err := a.copyEntry(tw, key, e); err != nil {
+				return err
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if gz != nil {
+		return gz.Close()
+	}
+	return nil
+}
+
+func (a *ArchiveFS) writeZip(out io.Writer) error {
+	zw := zip.NewWriter(out)
+	keys := a.sortedKeys("/")
+	times := a.entryTimes(keys)
+	for _, key := range keys {
+		if key == "/" {
+			continue
+		}
+		e := a.entries[key]
+		hdr := &zip.FileHeader{
+			Name:     archiveName(key, e),
+			Method:   zip.Deflate,
+			Modified: times[key],
+		}
+		hdr.SetMode(e.mode)
+		if e.isDir {
+			hdr.Method = zip.Store
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if !e.isDir {
+			if err := a.copyEntry(w, key, e); err != nil {
+				return err
+			}
+		}
+	}
+	return zw.Close()
+}
+
+// Separator returns '/', which archive paths always use.
+func (a *ArchiveFS) Separator() byte {
+	return '/'
+}
@@ -0,0 +1,286 @@
+package fs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func walkArchive(t *testing.T, a *ArchiveFS) string {
+	t.Helper()
+
+	var got []string
+	err := a.Walk("/", func(p string, info FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir && p != "/" {
+			p += "/"
+		}
+		got = append(got, p)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk failed: %v", err)
+	}
+	return strings.Join(got, ",")
+}
+
+func TestArchiveFS_RoundTrip(t *testing.T) {
+	modTime := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	for _, name := range []string{"a.tar", "a.tar.gz", "a.tgz", "a.zip"} {
+		t.Run(name, func(t *testing.T) {
+			archive := filepath.Join(t.TempDir(), name)
+
+			a, err := NewArchiveFS(archive)
+			if err != nil {
+				t.Fatalf("NewArchiveFS failed: %v", err)
+			}
+			if err := a.MkdirAll("/bin/sub", 0755); err != nil {
+				t.Fatalf("MkdirAll failed: %v", err)
+			}
+			writeFileInfo(t, a, "/bin/tool", []byte("#!/bin/sh\n"), FileInfo{Mode: 0755, ModTime: modTime})
+			writeFileInfo(t, a, "/bin/sub/data.txt", []byte("data"), FileInfo{Mode: 0600, ModTime: modTime})
+			writeFileInfo(t, a, "/readme", []byte("hello"), FileInfo{Mode: 0644, ModTime: modTime})
+			if err := a.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			a, err = NewArchiveFS(archive)
+			if err != nil {
+				t.Fatalf("reopening failed: %v", err)
+			}
+			defer a.Close()
+
+			if got, want := walkArchive(t, a), "/,/bin/,/bin/sub/,/bin/sub/data.txt,/bin/tool,/readme"; got != want {
+				t.Errorf("Walk = %s, want %s", got, want)
+			}
+			info, err := a.Stat("/bin/tool")
+			if err != nil {
+				t.Fatalf("Stat failed: %v", err)
+			}
+			if info.Mode != 0755 || info.Size != 10 || !info.ModTime.Equal(modTime) {
+				t.Errorf("Stat = %+v, want mode 0755, 10 bytes, modtime %v", info, modTime)
+			}
+			// Reading files in any order works for every format.
+			if content, err := readFile(a, "/readme"); err != nil || string(content) != "hello" {
+				t.Errorf("readme = %q, %v, want %q", content, err, "hello")
+			}
+			if content, err := readFile(a, "/bin/sub/data.txt"); err != nil || string(content) != "data" {
+				t.Errorf("data.txt = %q, %v, want %q", content, err, "data")
+			}
+			if _, err := a.Open("/missing"); !os.IsNotExist(err) {
+				t.Errorf("Open(missing) = %v, want not-exist error", err)
+			}
+		})
+	}
+}
+
+func TestArchiveFS_Reproducible(t *testing.T) {
+	modTime := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	build := func(t *testing.T, name string, order []string) []byte {
+		archive := filepath.Join(t.TempDir(), name)
+		a, err := NewArchiveFS(archive)
+		if err != nil {
+			t.Fatalf("NewArchiveFS failed: %v", err)
+		}
+		for _, p := range order {
+			if err := a.MkdirAll(filepath.ToSlash(filepath.Dir(p)), 0755); err != nil {
+				t.Fatalf("MkdirAll failed: %v", err)
+			}
+			writeFileInfo(t, a, p, []byte("content of "+p), FileInfo{Mode: 0644, ModTime: modTime})
+		}
+		if err := a.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		data, err := os.ReadFile(archive)
+		if err != nil {
+			t.Fatalf("reading archive failed: %v", err)
+		}
+		return data
+	}
+
+	for _, name := range []string{"a.tar", "a.tar.gz", "a.zip"} {
+		t.Run(name, func(t *testing.T) {
+			first := build(t, name, []string{"/x/1", "/a", "/x/y/2"})
+			time.Sleep(1100 * time.Millisecond)
+			second := build(t, name, []string{"/x/y/2", "/x/1", "/a"})
+			if !bytes.Equal(first, second) {
+				t.Error("archives of the same tree differ")
+			}
+		})
+	}
+}
+
+func TestArchiveFS_TarGzipDecompressedOnce(t *testing.T) {
+	archive := filepath.Join(t.TempDir(), "a.tar.gz")
+	a, err := NewArchiveFS(archive)
+	if err != nil {
+		t.Fatalf("NewArchiveFS failed: %v", err)
+	}
+	for i := range 20 {
+		writeFileInfo(t, a, fmt.Sprintf("/f%02d", i), []byte(strings.Repeat(fmt.Sprint(i), 1000)), FileInfo{Mode: 0644, ModTime: time.Unix(1000, 0)})
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	a, err = NewArchiveFS(archive)
+	if err != nil {
+		t.Fatalf("NewArchiveFS failed: %v", err)
+	}
+	for i := 19; i >= 0; i-- {
+		got, err := readFile(a, fmt.Sprintf("/f%02d", i))
+		if want := strings.Repeat(fmt.Sprint(i), 1000); err != nil || string(got) != want {
+			t.Errorf("f%02d content = %.10q..., %v, want %.10q...", i, got, err, want)
+		}
+	}
+	if a.untarred == nil {
+		t.Fatal("archive wasn't decompressed to a temporary file")
+	}
+	untarred := a.untarred.Name()
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if _, err := os.Stat(untarred); !os.IsNotExist(err) {
+		t.Errorf("decompressed copy left behind: %v", err)
+	}
+}
+
+func TestArchiveFS_Update(t *testing.T) {
+	archive := filepath.Join(t.TempDir(), "a.tar.gz")
+	a, err := NewArchiveFS(archive)
+	if err != nil {
+		t.Fatalf("NewArchiveFS failed: %v", err)
+	}
+	writeFileInfo(t, a, "/keep", []byte("keep"), FileInfo{Mode: 0644, ModTime: time.Unix(1000, 0)})
+	writeFileInfo(t, a, "/change", []byte("old"), FileInfo{Mode: 0644, ModTime: time.Unix(1000, 0)})
+	writeFileInfo(t, a, "/remove", []byte("gone"), FileInfo{Mode: 0644, ModTime: time.Unix(1000, 0)})
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Opening and closing without changes leaves the file alone.
+	before, _ := os.Stat(archive)
+	a, err = NewArchiveFS(archive)
+	if err != nil {
+		t.Fatalf("NewArchiveFS failed: %v", err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if after, _ := os.Stat(archive); !os.SameFile(before, after) {
+		t.Error("unchanged archive was rewritten")
+	}
+
+	a, err = NewArchiveFS(archive)
+	if err != nil {
+		t.Fatalf("NewArchiveFS failed: %v", err)
+	}
+	writeFileInfo(t, a, "/change", []byte("new"), FileInfo{Mode: 0644, ModTime: time.Unix(2000, 0)})
+	if err := a.Remove("/remove"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	w, err := a.Create("/aborted")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	io.WriteString(w, "partial")
+	if err := w.(Aborter).Abort(); err != nil {
+		t.Fatalf("Abort failed: %v", err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	a, err = NewArchiveFS(archive)
+	if err != nil {
+		t.Fatalf("NewArchiveFS failed: %v", err)
+	}
+	defer a.Close()
+	if got, want := walkArchive(t, a), "/,/change,/keep"; got != want {
+		t.Errorf("Walk = %s, want %s", got, want)
+	}
+	if content, err := readFile(a, "/change"); err != nil || string(content) != "new" {
+		t.Errorf("change = %q, %v, want %q", content, err, "new")
+	}
+	if content, err := readFile(a, "/keep"); err != nil || string(content) != "keep" {
+		t.Errorf("keep = %q, %v, want %q", content, err, "keep")
+	}
+}
+
+func TestArchiveFS_ForeignArchives(t *testing.T) {
+	dir := t.TempDir()
+
+	// A tar without directory entries, with "./" prefixes and a name trying
+	// to escape the root.
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	for _, name := range []string{"./docs/a.txt", "../../etc/evil", "link"} {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: 1, Typeflag: tar.TypeReg, ModTime: time.Unix(1000, 0)}
+		if name == "link" {
+			hdr = &tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: "docs"}
+		}
+		tw.WriteHeader(hdr)
+		if hdr.Typeflag == tar.TypeReg {
+			tw.Write([]byte("x"))
+		}
+	}
+	tw.Close()
+	tarFile := filepath.Join(dir, "foreign.tar")
+	os.WriteFile(tarFile, tarBuf.Bytes(), 0644)
+
+	a, err := NewArchiveFS(tarFile)
+	if err != nil {
+		t.Fatalf("NewArchiveFS failed: %v", err)
+	}
+	defer a.Close()
+	if got, want := walkArchive(t, a), "/,/docs/,/docs/a.txt,/etc/,/etc/evil"; got != want {
+		t.Errorf("Walk = %s, want %s", got, want)
+	}
+	if content, err := readFile(a, "/docs/a.txt"); err != nil || string(content) != "x" {
+		t.Errorf("a.txt = %q, %v, want %q", content, err, "x")
+	}
+
+	// A zip without directory entries or modes.
+	var zipBuf bytes.Buffer
+	zw := zip.NewWriter(&zipBuf)
+	f, _ := zw.Create("dir/file.txt")
+	io.WriteString(f, "zipped")
+	zw.Close()
+	zipFile := filepath.Join(dir, "foreign.zip")
+	os.WriteFile(zipFile, zipBuf.Bytes(), 0644)
+
+	z, err := NewArchiveFS(zipFile)
+	if err != nil {
+		t.Fatalf("NewArchiveFS failed: %v", err)
+	}
+	defer z.Close()
+	if got, want := walkArchive(t, z), "/,/dir/,/dir/file.txt"; got != want {
+		t.Errorf("Walk = %s, want %s", got, want)
+	}
+	if content, err := readFile(z, "/dir/file.txt"); err != nil || string(content) != "zipped" {
+		t.Errorf("file.txt = %q, %v, want %q", content, err, "zipped")
+	}
+}
+
+func TestNewArchiveFS_Errors(t *testing.T) {
+	if _, err := NewArchiveFS("archive.rar"); err == nil {
+		t.Error("NewArchiveFS with an unknown extension should fail")
+	}
+
+	corrupt := filepath.Join(t.TempDir(), "corrupt.tar.gz")
+	os.WriteFile(corrupt, []byte("not gzip"), 0644)
+	if _, err := NewArchiveFS(corrupt); err == nil {
+		t.Error("NewArchiveFS with a corrupt archive should fail")
+	}
+}
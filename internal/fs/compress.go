@@ -0,0 +1,615 @@
+package fs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressFormat is the compression applied to files written to a
+// CompressFS.
+type CompressFormat int
+
+const (
+	CompressZstd CompressFormat = iota
+	CompressGzip
+)
+
+// ParseCompressFormat parses "zstd" or "gzip".
+func ParseCompressFormat(s string) (CompressFormat, error) {
+	switch strings.ToLower(s) {
+	case "zstd":
+		return CompressZstd, nil
+	case "gzip", "gz":
+		return CompressGzip, nil
+	}
+	return 0, fmt.Errorf("unknown compression format %q, expected gzip or zstd", s)
+}
+
+// Compressed files start with a header recording what is needed to compare
+// them without decompressing: the original size, modification time and
+// SHA256 checksum.
+//
+//	magic (8) | method (1) | size (8) | mtime (8) | sha256 (32) | data
+//
+// Files that are already compressed are stored as they are, without a
+// header.
+const (
+	compressMagic      = "SYNCCMP\x01"
+	compressHeaderSize = len(compressMagic) + 1 + 8 + 8 + sha256.Size
+
+	compressMethodGzip = 1
+	compressMethodZstd = 2
+
+	// compressSniffSize is how much of a file is looked at to recognize
+	// compressed formats.
+	compressSniffSize = 512
+)
+
+// compressedExtensions are stored as-is without looking at their contents.
+var compressedExtensions = map[string]bool{
+	".gz": true, ".tgz": true, ".zst": true, ".bz2": true, ".xz": true,
+	".lz4": true, ".br": true, ".zip": true, ".7z": true, ".rar": true,
+	".jar": true, ".docx": true, ".xlsx": true, ".pptx": true,
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true,
+	".mp3": true, ".mp4": true, ".mkv": true, ".mov": true, ".avi": true,
+}
+
+// compressedMagics are the leading bytes of common compressed formats.
+var compressedMagics = [][]byte{
+	{0x1f, 0x8b},                       // gzip
+	{0x28, 0xb5, 0x2f, 0xfd},           // zstd
+	[]byte("BZh"),                      // bzip2
+	{0xfd, '7', 'z', 'X', 'Z', 0x00},   // xz
+	{0x04, 0x22, 0x4d, 0x18},           // lz4
+	[]byte("PK\x03\x04"),               // zip
+	{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}, // 7z
+	[]byte("Rar!\x1a\x07"),             // rar
+	{0x89, 'P', 'N', 'G'},              // png
+	{0xff, 0xd8, 0xff},                 // jpeg
+}
+
+type CompressConfig struct {
+	// Format is used for new files. Files are read in whatever format they
+	// were written in.
+	Format CompressFormat
+	// ReadHeaders makes Stat and Walk read the header of every compressed
+	// file to report its original size and modification time. Without it
+	// they open nothing and report the stored file's size and time; the
+	// time is the original one for files written with CreateWithInfo.
+	ReadHeaders bool
+}
+
+// CompressFS is a FileSystem wrapper that compresses files written to the
+// wrapped filesystem and decompresses them on read. Names are unchanged.
+// Checksum returns the checksum recorded in the file's header.
+//
+// Stat and Walk report the stored file's size, see StoredSizer, and its
+// modification time, which CreateWithInfo sets to the original one, so
+// files can be compared by time without opening them. With ReadHeaders
+// they report the original size and time from the header instead. Reading
+// a header opens the file, which costs a round trip per file on remote
+// filesystems, so headers are remembered along with the stored file's size
+// and modification time, and each is read once as long as the file doesn't
+// change.
+//
+// Compressed output is staged in a local temporary file until the file is
+// closed, as the header has to be written first. Files that are already
+// compressed, recognized by extension or leading bytes, are streamed to
+// the wrapped filesystem unchanged.
+type CompressFS struct {
+	inner       FileSystem
+	format      CompressFormat
+	readHeaders bool
+
+	mu      sync.Mutex
+	headers map[string]cachedHeader
+}
+
+// cachedHeader is the header read from a file that had the given size and
+// modification time on the wrapped filesystem.
+type cachedHeader struct {
+	size    int64
+	modTime time.Time
+	header  compressHeader
+	ok      bool
+}
+
+func NewCompressFS(inner FileSystem, cfg CompressConfig) *CompressFS {
+	return &CompressFS{
+		inner:       inner,
+		format:      cfg.Format,
+		readHeaders: cfg.ReadHeaders,
+		headers:     map[string]cachedHeader{},
+	}
+}
+
+// storedByName reports whether files named p are always stored as-is.
+func storedByName(p string) bool {
+	return compressedExtensions[strings.ToLower(filepath.Ext(p))]
+}
+
+func isCompressed(head []byte) bool {
+	for _, magic := range compressedMagics {
+		if bytes.HasPrefix(head, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+type compressHeader struct {
+	method  byte
+	size    int64
+	modTime time.Time
+	sum     []byte
+}
+
+func (h compressHeader) marshal() []byte {
+	buf := make([]byte, 0, compressHeaderSize)
+	buf = append(buf, compressMagic...)
+	buf = append(buf, h.method)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.size))
+	var mtime int64
+	if !h.modTime.IsZero() {
+		mtime = h.modTime.UnixNano()
+	}
+	buf = binary.BigEndian.AppendUint64(buf, uint64(mtime))
+	return append(buf, h.sum...)
+}
+
+// readCompressHeader reads the header of a file. If the file has none, it
+// returns false and the bytes it read, which belong to the file's contents.
+func readCompressHeader(r io.Reader) (compressHeader, bool, []byte, error) {
+	buf := make([]byte, compressHeaderSize)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return compressHeader{}, false, nil, err
+	}
+	buf = buf[:n]
+	if n < compressHeaderSize || !bytes.HasPrefix(buf, []byte(compressMagic)) {
+		return compressHeader{}, false, buf, nil
+	}
+
+	rest := buf[len(compressMagic):]
+	h := compressHeader{
+		method: rest[0],
+		size:   int64(binary.BigEndian.Uint64(rest[1:])),
+		sum:    rest[17:],
+	}
+	if mtime := int64(binary.BigEndian.Uint64(rest[9:])); mtime != 0 {
+		h.modTime = time.Unix(0, mtime)
+	}
+	return h, true, nil, nil
+}
+
+// header returns the header of the file at p, and false for files stored
+// as-is.
+func (c *CompressFS) header(p string) (compressHeader, bool, error) {
+	if storedByName(p) {
+		return compressHeader{}, false, nil
+	}
+	file, err := c.inner.Open(p)
+	if err != nil {
+		return compressHeader{}, false, err
+	}
+	defer file.Close()
+	h, ok, _, err := readCompressHeader(file)
+	return h, ok, err
+}
+
+// cachedHeader returns the header of the file at p, which is described by
+// info on the wrapped filesystem, reading it only if it isn't known yet.
+func (c *CompressFS) cachedHeader(p string, info FileInfo) (compressHeader, bool, error) {
+	c.mu.Lock()
+	cached, found := c.headers[p]
+	c.mu.Unlock()
+	if found && cached.size == info.Size && cached.modTime.Equal(info.ModTime) {
+		return cached.header, cached.ok, nil
+	}
+
+	h, ok, err := c.header(p)
+	if err != nil {
+		return compressHeader{}, false, err
+	}
+	c.mu.Lock()
+	c.headers[p] = cachedHeader{size: info.Size, modTime: info.ModTime, header: h, ok: ok}
+	c.mu.Unlock()
+	return h, ok, nil
+}
+
+// forget drops the cached header of p once the file changes.
+func (c *CompressFS) forget(p string) {
+	c.mu.Lock()
+	delete(c.headers, p)
+	c.mu.Unlock()
+}
+
+// withHeader returns info about a stored file as info about the original,
+// if headers are read.
+func (c *CompressFS) withHeader(p string, info FileInfo) (FileInfo, error) {
+	if info.IsDir || !c.readHeaders {
+		return info, nil
+	}
+	h, ok, err := c.cachedHeader(p, info)
+	if err != nil || !ok {
+		return info, err
+	}
+	info.Size = h.size
+	if !h.modTime.IsZero() {
+		info.ModTime = h.modTime
+	}
+	return info, nil
+}
+
+func (c *CompressFS) Stat(p string) (FileInfo, error) {
+	info, err := c.inner.Stat(p)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return c.withHeader(p, info)
+}
+
+// Walk reads the header of every file it visits if headers are read.
+func (c *CompressFS) Walk(root string, fn WalkFunc) error {
+	return c.inner.Walk(root, func(p string, info FileInfo, err error) error {
+		if err != nil {
+			return fn(p, info, err)
+		}
+		info, err = c.withHeader(p, info)
+		if err != nil {
+			return fn(p, FileInfo{}, err)
+		}
+		return fn(p, info, nil)
+	})
+}
+
+func (c *CompressFS) Open(p string) (io.ReadCloser, error) {
+	file, err := c.inner.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	if storedByName(p) {
+		return file, nil
+	}
+
+	h, ok, head, err := readCompressHeader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !ok {
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(head), file), file}, nil
+	}
+
+	r := &compressReader{path: p, file: file, header: h, hash: sha256.New()}
+	switch h.method {
+	case compressMethodGzip:
+		dec, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, &os.PathError{Op: "decompress", Path: p, Err: err}
+		}
+		r.dec = dec
+	case compressMethodZstd:
+		dec, err := zstd.NewReader(file, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			file.Close()
+			return nil, &os.PathError{Op: "decompress", Path: p, Err: err}
+		}
+		r.dec = dec.IOReadCloser()
+	default:
+		file.Close()
+		return nil, &os.PathError{Op: "decompress", Path: p, Err: fmt.Errorf("unknown compression method %d", h.method)}
+	}
+	return r, nil
+}
+
+// compressReader decompresses a file and checks the result against the
+// size and checksum in its header.
+type compressReader struct {
+	path   string
+	file   io.ReadCloser
+	dec    io.ReadCloser
+	header compressHeader
+	hash   hash.Hash
+	read   int64
+}
+
+func (r *compressReader) Read(p []byte) (int, error) {
+	n, err := r.dec.Read(p)
+	r.hash.Write(p[:n])
+	r.read += int64(n)
+	if r.read > r.header.size {
+		return n, r.corrupt()
+	}
+	if err == io.EOF && (r.read != r.header.size || !bytes.Equal(r.hash.Sum(nil), r.header.sum)) {
+		return n, r.corrupt()
+	}
+	if err != nil && err != io.EOF {
+		return n, &os.PathError{Op: "decompress", Path: r.path, Err: err}
+	}
+	return n, err
+}
+
+func (r *compressReader) corrupt() error {
+	return &os.PathError{Op: "decompress", Path: r.path, Err: errors.New("compressed file is corrupt")}
+}
+
+func (r *compressReader) Close() error {
+	r.dec.Close()
+	return r.file.Close()
+}
+
+func (c *CompressFS) Create(p string) (io.WriteCloser, error) {
+	return c.create(p, nil)
+}
+
+// CreateWithInfo records the modification time in the file's header and
+// passes the metadata on to the wrapped filesystem. Without InfoCreator
+// support there, it is set after the file is written.
+func (c *CompressFS) CreateWithInfo(p string, info FileInfo) (io.WriteCloser, error) {
+	return c.create(p, &info)
+}
+
+func (c *CompressFS) create(p string, info *FileInfo) (io.WriteCloser, error) {
+	w := &compressWriter{fs: c, path: p, info: info}
+	if storedByName(p) {
+		if err := w.createStored(); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// compressWriter buffers the start of a file to decide whether it is
+// already compressed, then either streams it to the wrapped filesystem or
+// compresses it into a temporary file.
+type compressWriter struct {
+	fs   *CompressFS
+	path string
+	info *FileInfo
+
+	head []byte
+	// stored is the file on the wrapped filesystem when the contents are
+	// written as-is.
+	stored io.WriteCloser
+
+	tmp  *os.File
+	enc  io.WriteCloser
+	hash hash.Hash
+	size int64
+}
+
+// createInner creates the file on the wrapped filesystem with the given
+// size.
+func (w *compressWriter) createInner(size int64) (io.WriteCloser, error) {
+	if creator, ok := w.fs.inner.(InfoCreator); ok && w.info != nil {
+		info := *w.info
+		info.Size = size
+		return creator.CreateWithInfo(w.path, info)
+	}
+	return w.fs.inner.Create(w.path)
+}
+
+func (w *compressWriter) createStored() error {
+	size := int64(0)
+	if w.info != nil {
+		size = w.info.Size
+	}
+	file, err := w.createInner(size)
+	if err != nil {
+		return err
+	}
+	w.stored = file
+	return nil
+}
+
+// start decides how the file is stored once its first bytes are known.
+func (w *compressWriter) start() error {
+	if isCompressed(w.head) {
+		if err := w.createStored(); err != nil {
+			return err
+		}
+		_, err := w.stored.Write(w.head)
+		return err
+	}
+
+	tmp, err := os.CreateTemp("", "sync-compress-*")
+	if err != nil {
+		return err
+	}
+	w.tmp = tmp
+	w.hash = sha256.New()
+	switch w.fs.format {
+	case CompressGzip:
+		w.enc = gzip.NewWriter(tmp)
+	default:
+		enc, err := zstd.NewWriter(tmp, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		w.enc = enc
+	}
+	_, err = w.writeCompressed(w.head)
+	return err
+}
+
+func (w *compressWriter) writeCompressed(p []byte) (int, error) {
+	n, err := w.enc.Write(p)
+	w.hash.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	switch {
+	case w.stored != nil:
+		return w.stored.Write(p)
+	case w.enc != nil:
+		return w.writeCompressed(p)
+	}
+
+	n := min(len(p), compressSniffSize-len(w.head))
+	w.head = append(w.head, p[:n]...)
+	if len(w.head) < compressSniffSize {
+		return n, nil
+	}
+	if err := w.start(); err != nil {
+		return 0, err
+	}
+	m, err := w.Write(p[n:])
+	return n + m, err
+}
+
+func (w *compressWriter) Close() error {
+	defer w.fs.forget(w.path)
+	if w.stored == nil && w.enc == nil {
+		if err := w.start(); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	if w.stored != nil {
+		if err := w.stored.Close(); err != nil {
+			return err
+		}
+		return w.setInfo()
+	}
+
+	defer w.removeTmp()
+	if err := w.enc.Close(); err != nil {
+		return err
+	}
+	compressed, err := w.tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := w.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	h := compressHeader{method: compressMethodZstd, size: w.size, sum: w.hash.Sum(nil)}
+	if w.fs.format == CompressGzip {
+		h.method = compressMethodGzip
+	}
+	if w.info != nil {
+		h.modTime = w.info.ModTime
+	}
+
+	file, err := w.createInner(int64(compressHeaderSize) + compressed)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(h.marshal()); err != nil {
+		abortFile(file)
+		return err
+	}
+	if _, err := io.Copy(file, w.tmp); err != nil {
+		abortFile(file)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return w.setInfo()
+}
+
+// setInfo applies the metadata when the wrapped filesystem couldn't take it
+// at creation.
+func (w *compressWriter) setInfo() error {
+	if w.info == nil {
+		return nil
+	}
+	if _, ok := w.fs.inner.(InfoCreator); ok {
+		return nil
+	}
+	if err := w.fs.inner.Chmod(w.path, w.info.Mode); err != nil {
+		return err
+	}
+	return w.fs.inner.Chtimes(w.path, w.info.ModTime, w.info.ModTime)
+}
+
+func (w *compressWriter) removeTmp() {
+	w.tmp.Close()
+	os.Remove(w.tmp.Name())
+}
+
+// Abort discards the file. Nothing reaches the wrapped filesystem for
+// compressed files until Close.
+func (w *compressWriter) Abort() error {
+	if w.stored != nil {
+		return abortFile(w.stored)
+	}
+	if w.tmp != nil {
+		w.removeTmp()
+	}
+	return nil
+}
+
+// Checksum returns the checksum recorded in a compressed file's header. For
+// files stored as-is it defers to the wrapped filesystem, or returns
+// errors.ErrUnsupported.
+func (c *CompressFS) Checksum(p string) (string, error) {
+	h, ok, err := c.header(p)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return hex.EncodeToString(h.sum), nil
+	}
+	if checksummer, ok := c.inner.(Checksummer); ok {
+		return checksummer.Checksum(p)
+	}
+	return "", errors.ErrUnsupported
+}
+
+func (c *CompressFS) Remove(p string) error {
+	c.forget(p)
+	return c.inner.Remove(p)
+}
+
+func (c *CompressFS) MkdirAll(p string, perm os.FileMode) error {
+	return c.inner.MkdirAll(p, perm)
+}
+
+func (c *CompressFS) Chmod(p string, mode os.FileMode) error {
+	return c.inner.Chmod(p, mode)
+}
+
+// Chtimes changes the time of the stored file. With ReadHeaders, Stat keeps
+// reporting the time recorded in the header of compressed files.
+func (c *CompressFS) Chtimes(p string, atime, mtime time.Time) error {
+	return c.inner.Chtimes(p, atime, mtime)
+}
+
+// StoredSizes reports whether Stat and Walk report stored sizes, which is
+// when headers aren't read.
+func (c *CompressFS) StoredSizes() bool {
+	return !c.readHeaders
+}
+
+func (c *CompressFS) Close() error {
+	return c.inner.Close()
+}
+
+// Separator returns the separator of the wrapped filesystem.
+func (c *CompressFS) Separator() byte {
+	return PathSeparator(c.inner)
+}
@@ -0,0 +1,223 @@
+package fs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func logLines(n int) []byte {
+	var buf bytes.Buffer
+	for i := range n {
+		fmt.Fprintf(&buf, "2024-05-01T12:00:%02d INFO request handled path=/api/items/%d status=200\n", i%60, i)
+	}
+	return buf.Bytes()
+}
+
+func TestCompressFS_RoundTrip(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, format := range []string{"gzip", "zstd"} {
+		t.Run(format, func(t *testing.T) {
+			f, err := ParseCompressFormat(format)
+			if err != nil {
+				t.Fatalf("ParseCompressFormat failed: %v", err)
+			}
+			m := NewMemFS()
+			c := NewCompressFS(m, CompressConfig{Format: f, ReadHeaders: true})
+
+			for _, data := range [][]byte{nil, []byte("short"), logLines(5000)} {
+				writeFileInfo(t, c, "/app.log", data, FileInfo{Mode: 0640, ModTime: modTime})
+
+				got, err := readFile(c, "/app.log")
+				if err != nil {
+					t.Fatalf("reading failed: %v", err)
+				}
+				if !bytes.Equal(got, data) {
+					t.Errorf("%d bytes: content differs after round trip", len(data))
+				}
+
+				stat, err := c.Stat("/app.log")
+				if err != nil {
+					t.Fatalf("Stat failed: %v", err)
+				}
+				if stat.Size != int64(len(data)) || !stat.ModTime.Equal(modTime) || stat.Mode != 0640 {
+					t.Errorf("%d bytes: Stat = %+v", len(data), stat)
+				}
+
+				sum := sha256.Sum256(data)
+				if got, err := c.Checksum("/app.log"); err != nil || got != hex.EncodeToString(sum[:]) {
+					t.Errorf("%d bytes: Checksum = %s, %v", len(data), got, err)
+				}
+			}
+
+			raw, _ := m.ReadFile("/app.log")
+			if len(raw) > len(logLines(5000))/5 {
+				t.Errorf("log compressed to %d bytes, expected far less", len(raw))
+			}
+
+			var walked FileInfo
+			c.Walk("/", func(p string, info FileInfo, err error) error {
+				if p == "/app.log" {
+					walked = info
+				}
+				return err
+			})
+			if walked.Size != int64(len(logLines(5000))) {
+				t.Errorf("Walk size = %d, want %d", walked.Size, len(logLines(5000)))
+			}
+		})
+	}
+}
+
+func TestCompressFS_StoredAsIs(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(logLines(100))
+	zw.Close()
+
+	tests := []struct {
+		name string
+		path string
+		data []byte
+	}{
+		{"by extension", "/photo.JPG", []byte("not really a jpeg, but named like one")},
+		{"by magic", "/rotated-log", gz.Bytes()},
+		{"short", "/tiny", []byte{0x1f, 0x8b}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMemFS()
+			c := NewCompressFS(m, CompressConfig{})
+			writeFile(t, c, tt.path, tt.data)
+
+			if raw, _ := m.ReadFile(tt.path); !bytes.Equal(raw, tt.data) {
+				t.Errorf("stored %d bytes, want the original %d", len(raw), len(tt.data))
+			}
+			if got, err := readFile(c, tt.path); err != nil || !bytes.Equal(got, tt.data) {
+				t.Errorf("reading = %d bytes, %v", len(got), err)
+			}
+			if info, err := c.Stat(tt.path); err != nil || info.Size != int64(len(tt.data)) {
+				t.Errorf("Stat = %+v, %v", info, err)
+			}
+		})
+	}
+}
+
+func TestCompressFS_PlainFiles(t *testing.T) {
+	m := NewMemFS()
+	m.WriteFile("/plain.txt", []byte("written without compression"), 0644, time.Now())
+	// Contents that look like a header are compressed, so they read back.
+	lookalike := []byte(compressMagic + strings.Repeat("x", 100))
+
+	c := NewCompressFS(m, CompressConfig{})
+	writeFile(t, c, "/lookalike", lookalike)
+
+	if got, err := readFile(c, "/plain.txt"); err != nil || string(got) != "written without compression" {
+		t.Errorf("reading a plain file = %q, %v", got, err)
+	}
+	if got, err := readFile(c, "/lookalike"); err != nil || !bytes.Equal(got, lookalike) {
+		t.Errorf("reading a header lookalike = %q, %v", got, err)
+	}
+}
+
+func TestCompressFS_Corrupt(t *testing.T) {
+	m := NewMemFS()
+	c := NewCompressFS(m, CompressConfig{Format: CompressGzip})
+	writeFile(t, c, "/app.log", logLines(1000))
+
+	raw, _ := m.ReadFile("/app.log")
+	raw[compressHeaderSize+len(raw[compressHeaderSize:])/2] ^= 0xff
+	m.WriteFile("/app.log", raw, 0644, time.Now())
+
+	if _, err := readFile(c, "/app.log"); err == nil {
+		t.Error("reading a corrupt file succeeded")
+	}
+}
+
+func TestCompressFS_Abort(t *testing.T) {
+	m := NewMemFS()
+	c := NewCompressFS(m, CompressConfig{})
+
+	w, err := c.Create("/app.log")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	w.Write(logLines(100))
+	if err := w.(Aborter).Abort(); err != nil {
+		t.Fatalf("Abort failed: %v", err)
+	}
+	if _, err := m.Stat("/app.log"); !os.IsNotExist(err) {
+		t.Errorf("aborted file exists: %v", err)
+	}
+}
+
+func TestCompressFS_HeaderCached(t *testing.T) {
+	m := NewMemFS()
+	m.MkdirAll("/data", 0755)
+	// The header is expected to be read once before and once after the
+	// rewrite below; a third read fails.
+	f := NewFaultFS(m, FaultRule{Op: "Open", Nth: 3, Err: ErrInjected})
+	c := NewCompressFS(f, CompressConfig{ReadHeaders: true})
+	modTime := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	writeFileInfo(t, c, "/data/a.txt", bytes.Repeat([]byte("a"), 1000), FileInfo{Mode: 0644, ModTime: modTime})
+
+	for range 2 {
+		if info, err := c.Stat("/data/a.txt"); err != nil || info.Size != 1000 {
+			t.Fatalf("Stat = %+v, %v, want size 1000", info, err)
+		}
+	}
+	err := c.Walk("/data", func(p string, info FileInfo, err error) error {
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Walk read the header again: %v", err)
+	}
+
+	// Rewriting the file drops what was remembered.
+	writeFileInfo(t, c, "/data/a.txt", bytes.Repeat([]byte("b"), 2000), FileInfo{Mode: 0644, ModTime: modTime})
+	for range 2 {
+		if info, err := c.Stat("/data/a.txt"); err != nil || info.Size != 2000 {
+			t.Errorf("Stat after rewrite = %+v, %v, want size 2000", info, err)
+		}
+	}
+}
+
+func TestCompressFS_StatWithoutHeaders(t *testing.T) {
+	m := NewMemFS()
+	m.MkdirAll("/data", 0755)
+	f := NewFaultFS(m, FaultRule{Op: "Open", Err: ErrInjected})
+	c := NewCompressFS(f, CompressConfig{})
+	modTime := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	writeFileInfo(t, c, "/data/a.txt", bytes.Repeat([]byte("a"), 1000), FileInfo{Mode: 0644, ModTime: modTime})
+
+	if !c.StoredSizes() {
+		t.Error("StoredSizes = false without ReadHeaders")
+	}
+	info, err := c.Stat("/data/a.txt")
+	if err != nil {
+		t.Fatalf("Stat opened the file: %v", err)
+	}
+	if !info.ModTime.Equal(modTime) {
+		t.Errorf("Stat ModTime = %v, want %v", info.ModTime, modTime)
+	}
+	err = c.Walk("/data", func(p string, info FileInfo, err error) error {
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Walk opened a file: %v", err)
+	}
+}
+
+func TestParseCompressFormat(t *testing.T) {
+	if _, err := ParseCompressFormat("lzma"); err == nil {
+		t.Error("ParseCompressFormat accepted an unknown format")
+	}
+}
@@ -0,0 +1,758 @@
+package fs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted files consist of a header with a random salt, from which the
+// file's key is derived, the contents in AES-256-GCM sealed chunks, and a
+// sealed trailer holding the SHA256 checksum of the plaintext:
+//
+//	magic (8) | salt (32) | chunk... | trailer (48)
+//
+// Each chunk holds up to cryptChunkSize bytes plus a 16 byte tag. The nonce
+// is the chunk's index and a flag marking the last chunk and the trailer,
+// so chunks can't be reordered, dropped or truncated without detection.
+const (
+	cryptMagic       = "SYNCENC\x01"
+	cryptSaltSize    = 32
+	cryptHeaderSize  = len(cryptMagic) + cryptSaltSize
+	cryptChunkSize   = 64 << 10
+	cryptTagSize     = 16
+	cryptSealedSize  = cryptChunkSize + cryptTagSize
+	cryptTrailerSize = sha256.Size + cryptTagSize
+
+	cryptFlagData    = 0
+	cryptFlagLast    = 1
+	cryptFlagTrailer = 2
+)
+
+// The keys are derived from the passphrase and a random salt kept in a key
+// file at the root, so the same passphrase gives different keys, and
+// different encrypted names, on every target. The key file also holds a
+// check value derived from the keys, so a wrong passphrase is rejected
+// before anything is written with it:
+//
+//	magic (8) | salt (32) | check (32)
+const (
+	cryptKeyFile  = ".sync-crypt"
+	cryptKeyMagic = "SYNCKEY\x01"
+	cryptKeySize  = len(cryptKeyMagic) + cryptSaltSize + sha256.Size
+)
+
+var (
+	// ErrNotEncrypted is returned for files and names under a CryptFS root
+	// that were not encrypted with its passphrase.
+	ErrNotEncrypted = errors.New("not encrypted with this key")
+	// ErrWrongPassphrase is returned by NewCryptFS when the tree at root
+	// was encrypted with a different passphrase.
+	ErrWrongPassphrase = errors.New("wrong encryption passphrase")
+
+	cryptNames = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+type CryptConfig struct {
+	Passphrase string
+	// EncryptNames also encrypts file and directory names below the root.
+	// Names are encrypted deterministically so files can still be looked
+	// up, which reveals when two names in a directory are the same.
+	EncryptNames bool
+}
+
+// CryptFS is a FileSystem wrapper that encrypts the contents, and
+// optionally the names, of files below root on the wrapped filesystem.
+// Sizes reported by Stat and Walk are those of the plaintext, and
+// modification times and modes are passed through, so files can be
+// compared by metadata without reading them. Checksum returns the plaintext
+// checksum stored in the encrypted trailer.
+type CryptFS struct {
+	inner FileSystem
+	// keyFile is the path of the key file, and keyData its contents when it
+	// still has to be written.
+	keyFile string
+	keyData []byte
+	// prefix is the root with a trailing separator, or empty for a root of
+	// ".", which holds every relative path.
+	prefix string
+	sep    byte
+	names  bool
+
+	contentKey []byte
+	nameAEAD   cipher.AEAD
+	nameMAC    []byte
+}
+
+// NewCryptFS returns a CryptFS encrypting the tree below root on inner.
+// Paths outside root, such as its parent directories, are passed through.
+// The key file is read from root, or created with the first file written
+// there. It returns an error wrapping ErrWrongPassphrase if the key file
+// doesn't match the passphrase.
+func NewCryptFS(inner FileSystem, root string, cfg CryptConfig) (*CryptFS, error) {
+	if cfg.Passphrase == "" {
+		return nil, errors.New("encryption passphrase is empty")
+	}
+
+	sep := PathSeparator(inner)
+	if sep == os.PathSeparator {
+		root = filepath.Clean(root)
+	} else {
+		root = strings.ReplaceAll(path.Clean(strings.ReplaceAll(root, string(sep), "/")), "/", string(sep))
+	}
+	switch {
+	case root == ".":
+		root = ""
+	case !strings.HasSuffix(root, string(sep)):
+		root += string(sep)
+	}
+
+	keyFile := root + cryptKeyFile
+	salt, check, err := readCryptKey(inner, keyFile)
+	pending := errors.Is(err, os.ErrNotExist)
+	if pending {
+		salt = make([]byte, cryptSaltSize)
+		_, err = rand.Read(salt)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	master, err := scrypt.Key([]byte(cfg.Passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	contentKey, err := hkdf.Key(sha256.New, master, nil, "content", 32)
+	if err != nil {
+		return nil, err
+	}
+	nameKey, err := hkdf.Key(sha256.New, master, nil, "names", 32)
+	if err != nil {
+		return nil, err
+	}
+	nameMAC, err := hkdf.Key(sha256.New, master, nil, "name nonces", 32)
+	if err != nil {
+		return nil, err
+	}
+	nameAEAD, err := newGCM(nameKey)
+	if err != nil {
+		return nil, err
+	}
+	keyCheck, err := hkdf.Key(sha256.New, master, nil, "key check", sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	if !pending && !hmac.Equal(check, keyCheck) {
+		return nil, fmt.Errorf("%s: %w", keyFile, ErrWrongPassphrase)
+	}
+
+	c := &CryptFS{
+		inner:      inner,
+		keyFile:    keyFile,
+		prefix:     root,
+		sep:        sep,
+		names:      cfg.EncryptNames,
+		contentKey: contentKey,
+		nameAEAD:   nameAEAD,
+		nameMAC:    nameMAC,
+	}
+	if pending {
+		c.keyData = slices.Concat([]byte(cryptKeyMagic), salt, keyCheck)
+	}
+	return c, nil
+}
+
+// readCryptKey returns the salt and check value stored in the key file at p.
+func readCryptKey(inner FileSystem, p string) (salt, check []byte, err error) {
+	file, err := inner.Open(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, int64(cryptKeySize+1)))
+	if err != nil {
+		return nil, nil, err
+	}
+	rest, ok := bytes.CutPrefix(data, []byte(cryptKeyMagic))
+	if !ok || len(data) != cryptKeySize {
+		return nil, nil, fmt.Errorf("%s is not a valid key file", p)
+	}
+	return rest[:cryptSaltSize], rest[cryptSaltSize:], nil
+}
+
+// writeKey writes the key file if it doesn't exist yet. It is called before
+// anything is written below the root, so the tree can always be read back.
+func (c *CryptFS) writeKey() error {
+	if c.keyData == nil {
+		return nil
+	}
+	file, err := c.inner.Create(c.keyFile)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(c.keyData); err != nil {
+		abortFile(file)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	c.keyData = nil
+	return nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// fileAEAD returns the cipher for the file with the given salt.
+func (c *CryptFS) fileAEAD(salt []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, c.contentKey, salt, "file", 32)
+	if err != nil {
+		return nil, err
+	}
+	return newGCM(key)
+}
+
+func cryptNonce(index uint64, flag uint32) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, index)
+	binary.BigEndian.PutUint32(nonce[8:], flag)
+	return nonce
+}
+
+// encryptedSize returns the size of the encrypted form of size bytes.
+func encryptedSize(size int64) int64 {
+	chunks := max((size+cryptChunkSize-1)/cryptChunkSize, 1)
+	return int64(cryptHeaderSize) + size + chunks*cryptTagSize + cryptTrailerSize
+}
+
+// plaintextSize returns the size of the plaintext of an encrypted file of
+// size bytes, and false if no encrypted file has that size.
+func plaintextSize(size int64) (int64, bool) {
+	data := size - int64(cryptHeaderSize) - cryptTrailerSize
+	if data < cryptTagSize {
+		return 0, false
+	}
+	chunks := (data + cryptSealedSize - 1) / cryptSealedSize
+	plain := data - chunks*cryptTagSize
+	return plain, encryptedSize(plain) == size
+}
+
+// underRoot returns p relative to the root, split into components, and
+// whether p is below the root at all.
+func (c *CryptFS) underRoot(p string) ([]string, bool) {
+	rest, ok := strings.CutPrefix(p, c.prefix)
+	if !ok || rest == "" || rest == "." {
+		return nil, false
+	}
+	parts := strings.Split(rest, string(c.sep))
+	if c.prefix == "" && (parts[0] == "" || parts[0] == ".." || c.sep == os.PathSeparator && filepath.IsAbs(rest)) {
+		return nil, false
+	}
+	return parts, true
+}
+
+// encPath returns the path on the wrapped filesystem for p.
+func (c *CryptFS) encPath(p string) (string, error) {
+	if p == c.keyFile {
+		return "", &os.PathError{Op: "encrypt", Path: p, Err: errors.New("name is reserved for the key file")}
+	}
+	if !c.names {
+		return p, nil
+	}
+	parts, ok := c.underRoot(p)
+	if !ok {
+		return p, nil
+	}
+	for i, name := range parts {
+		enc, err := c.encryptName(name)
+		if err != nil {
+			return "", &os.PathError{Op: "encrypt", Path: p, Err: err}
+		}
+		parts[i] = enc
+	}
+	return c.prefix + strings.Join(parts, string(c.sep)), nil
+}
+
+// decPath returns the plaintext path for a path on the wrapped filesystem.
+func (c *CryptFS) decPath(p string) (string, error) {
+	if !c.names {
+		return p, nil
+	}
+	parts, ok := c.underRoot(p)
+	if !ok {
+		return p, nil
+	}
+	for i, name := range parts {
+		dec, err := c.decryptName(name)
+		if err != nil {
+			return "", &os.PathError{Op: "decrypt", Path: p, Err: err}
+		}
+		parts[i] = dec
+	}
+	return c.prefix + strings.Join(parts, string(c.sep)), nil
+}
+
+// encryptName seals name with a nonce derived from the name itself, so the
+// same name always encrypts to the same string.
+func (c *CryptFS) encryptName(name string) (string, error) {
+	if name == "" || name == "." || name == ".." {
+		return name, nil
+	}
+	mac := hmac.New(sha256.New, c.nameMAC)
+	mac.Write([]byte(name))
+	nonce := mac.Sum(nil)[:c.nameAEAD.NonceSize()]
+
+	sealed := c.nameAEAD.Seal(nonce, nonce, []byte(name), nil)
+	enc := strings.ToLower(cryptNames.EncodeToString(sealed))
+	if len(enc) > 255 {
+		return "", fmt.Errorf("name %q is too long to encrypt", name)
+	}
+	return enc, nil
+}
+
+func (c *CryptFS) decryptName(enc string) (string, error) {
+	if enc == "" || enc == "." || enc == ".." {
+		return enc, nil
+	}
+	sealed, err := cryptNames.DecodeString(strings.ToUpper(enc))
+	if err != nil || len(sealed) < c.nameAEAD.NonceSize() {
+		return "", ErrNotEncrypted
+	}
+	nonce, sealed := sealed[:c.nameAEAD.NonceSize()], sealed[c.nameAEAD.NonceSize():]
+	name, err := c.nameAEAD.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return "", ErrNotEncrypted
+	}
+	return string(name), nil
+}
+
+// decInfo converts info about an encrypted file to info about its
+// plaintext.
+func (c *CryptFS) decInfo(p string, info FileInfo) (FileInfo, error) {
+	if c.names {
+		if _, ok := c.underRoot(p); ok {
+			name, err := c.decryptName(info.Name)
+			if err != nil {
+				return FileInfo{}, &os.PathError{Op: "decrypt", Path: p, Err: err}
+			}
+			info.Name = name
+		}
+	}
+	if !info.IsDir {
+		size, ok := plaintextSize(info.Size)
+		if !ok {
+			return FileInfo{}, &os.PathError{Op: "decrypt", Path: p, Err: ErrNotEncrypted}
+		}
+		info.Size = size
+	}
+	return info, nil
+}
+
+func (c *CryptFS) Stat(p string) (FileInfo, error) {
+	enc, err := c.encPath(p)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info, err := c.inner.Stat(enc)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return c.decInfo(enc, info)
+}
+
+func (c *CryptFS) Walk(root string, fn WalkFunc) error {
+	encRoot, err := c.encPath(root)
+	if err != nil {
+		return fn(root, FileInfo{}, err)
+	}
+	return c.inner.Walk(encRoot, func(p string, info FileInfo, err error) error {
+		if p == c.keyFile {
+			return nil
+		}
+		dec, decErr := c.decPath(p)
+		if decErr != nil {
+			return fn(p, FileInfo{}, decErr)
+		}
+		if err != nil {
+			return fn(dec, info, err)
+		}
+		info, err = c.decInfo(p, info)
+		if err != nil {
+			return fn(dec, FileInfo{}, err)
+		}
+		return fn(dec, info, nil)
+	})
+}
+
+func (c *CryptFS) Open(p string) (io.ReadCloser, error) {
+	enc, err := c.encPath(p)
+	if err != nil {
+		return nil, err
+	}
+	file, err := c.inner.Open(enc)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, cryptHeaderSize)
+	if _, err := io.ReadFull(file, header); err != nil || string(header[:len(cryptMagic)]) != cryptMagic {
+		file.Close()
+		return nil, &os.PathError{Op: "decrypt", Path: p, Err: ErrNotEncrypted}
+	}
+	aead, err := c.fileAEAD(header[len(cryptMagic):])
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &cryptReader{
+		path:   p,
+		file:   file,
+		in:     bufio.NewReaderSize(file, cryptSealedSize+cryptTrailerSize+1),
+		aead:   aead,
+		hash:   sha256.New(),
+		sealed: make([]byte, cryptSealedSize),
+	}, nil
+}
+
+// cryptReader decrypts a file chunk by chunk, looking ahead far enough to
+// tell the last chunk and the trailer apart.
+type cryptReader struct {
+	path   string
+	file   io.ReadCloser
+	in     *bufio.Reader
+	aead   cipher.AEAD
+	hash   hash.Hash
+	sealed []byte
+	plain  []byte
+	index  uint64
+	done   bool
+}
+
+func (r *cryptReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+func (r *cryptReader) corrupt() error {
+	return &os.PathError{Op: "decrypt", Path: r.path, Err: errors.New("encrypted file is corrupt or was tampered with")}
+}
+
+func (r *cryptReader) next() error {
+	ahead, err := r.in.Peek(cryptSealedSize + cryptTrailerSize + 1)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return err
+	}
+
+	flag := uint32(cryptFlagData)
+	size := cryptSealedSize
+	if len(ahead) <= cryptSealedSize+cryptTrailerSize {
+		// The rest of the file is the last chunk and the trailer.
+		flag = cryptFlagLast
+		size = len(ahead) - cryptTrailerSize
+		if size < cryptTagSize {
+			return r.corrupt()
+		}
+	}
+
+	sealed := r.sealed[:size]
+	if _, err := io.ReadFull(r.in, sealed); err != nil {
+		return err
+	}
+	plain, err := r.aead.Open(sealed[:0], cryptNonce(r.index, flag), sealed, nil)
+	if err != nil {
+		return r.corrupt()
+	}
+	r.index++
+	r.hash.Write(plain)
+	r.plain = plain
+
+	if flag == cryptFlagLast {
+		trailer := make([]byte, cryptTrailerSize)
+		if _, err := io.ReadFull(r.in, trailer); err != nil {
+			return err
+		}
+		sum, err := r.aead.Open(nil, cryptNonce(r.index, cryptFlagTrailer), trailer, nil)
+		if err != nil || !bytes.Equal(sum, r.hash.Sum(nil)) {
+			return r.corrupt()
+		}
+		r.done = true
+	}
+	return nil
+}
+
+func (r *cryptReader) Close() error {
+	return r.file.Close()
+}
+
+func (c *CryptFS) Create(p string) (io.WriteCloser, error) {
+	return c.create(p, func(enc string) (io.WriteCloser, error) {
+		return c.inner.Create(enc)
+	})
+}
+
+// CreateWithInfo passes the metadata on to the wrapped filesystem, with the
+// size of the encrypted file. Without InfoCreator support there, it is set
+// after the file is written.
+func (c *CryptFS) CreateWithInfo(p string, info FileInfo) (io.WriteCloser, error) {
+	if creator, ok := c.inner.(InfoCreator); ok {
+		return c.create(p, func(enc string) (io.WriteCloser, error) {
+			encInfo := info
+			encInfo.Size = encryptedSize(info.Size)
+			return creator.CreateWithInfo(enc, encInfo)
+		})
+	}
+
+	w, err := c.Create(p)
+	if err != nil {
+		return nil, err
+	}
+	w.(*cryptWriter).info = &info
+	return w, nil
+}
+
+func (c *CryptFS) create(p string, create func(enc string) (io.WriteCloser, error)) (io.WriteCloser, error) {
+	enc, err := c.encPath(p)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := c.underRoot(p); ok {
+		if err := c.writeKey(); err != nil {
+			return nil, err
+		}
+	}
+
+	salt := make([]byte, cryptSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := c.fileAEAD(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := create(enc)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Write(append([]byte(cryptMagic), salt...)); err != nil {
+		abortFile(file)
+		return nil, err
+	}
+	return &cryptWriter{
+		fs:   c,
+		path: enc,
+		file: file,
+		aead: aead,
+		hash: sha256.New(),
+		buf:  make([]byte, 0, cryptChunkSize),
+	}, nil
+}
+
+// abortFile discards a partly written file if it supports that.
+func abortFile(file io.WriteCloser) error {
+	if aborter, ok := file.(Aborter); ok {
+		return aborter.Abort()
+	}
+	return file.Close()
+}
+
+type cryptWriter struct {
+	fs    *CryptFS
+	path  string
+	file  io.WriteCloser
+	aead  cipher.AEAD
+	hash  hash.Hash
+	buf   []byte
+	index uint64
+	// info is applied after closing when the wrapped filesystem can't take
+	// it at creation.
+	info *FileInfo
+}
+
+func (w *cryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data follows, as the last
+		// chunk is sealed differently.
+		if len(w.buf) == cryptChunkSize {
+			if err := w.seal(cryptFlagData); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):cryptChunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		w.hash.Write(p[:n])
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *cryptWriter) seal(flag uint32) error {
+	sealed := w.aead.Seal(nil, cryptNonce(w.index, flag), w.buf, nil)
+	w.index++
+	w.buf = w.buf[:0]
+	_, err := w.file.Write(sealed)
+	return err
+}
+
+func (w *cryptWriter) Close() error {
+	if err := w.seal(cryptFlagLast); err != nil {
+		abortFile(w.file)
+		return err
+	}
+	trailer := w.aead.Seal(nil, cryptNonce(w.index, cryptFlagTrailer), w.hash.Sum(nil), nil)
+	if _, err := w.file.Write(trailer); err != nil {
+		abortFile(w.file)
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+
+	if w.info != nil {
+		if err := w.fs.inner.Chmod(w.path, w.info.Mode); err != nil {
+			return err
+		}
+		return w.fs.inner.Chtimes(w.path, w.info.ModTime, w.info.ModTime)
+	}
+	return nil
+}
+
+// Abort discards the file on the wrapped filesystem if it supports that.
+func (w *cryptWriter) Abort() error {
+	return abortFile(w.file)
+}
+
+// Checksum returns the checksum of the plaintext from the file's trailer.
+// Only the header and the trailer are read when the wrapped filesystem's
+// files can seek; otherwise it returns errors.ErrUnsupported and the file
+// is decrypted and hashed instead.
+func (c *CryptFS) Checksum(p string) (string, error) {
+	enc, err := c.encPath(p)
+	if err != nil {
+		return "", err
+	}
+	file, err := c.inner.Open(enc)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	seeker, ok := file.(io.Seeker)
+	if !ok {
+		return "", errors.ErrUnsupported
+	}
+
+	header := make([]byte, cryptHeaderSize)
+	if _, err := io.ReadFull(file, header); err != nil || string(header[:len(cryptMagic)]) != cryptMagic {
+		return "", &os.PathError{Op: "decrypt", Path: p, Err: ErrNotEncrypted}
+	}
+	size, err := seeker.Seek(-cryptTrailerSize, io.SeekEnd)
+	if err != nil {
+		return "", err
+	}
+	plain, ok := plaintextSize(size + cryptTrailerSize)
+	if !ok {
+		return "", &os.PathError{Op: "decrypt", Path: p, Err: ErrNotEncrypted}
+	}
+	trailer := make([]byte, cryptTrailerSize)
+	if _, err := io.ReadFull(file, trailer); err != nil {
+		return "", err
+	}
+
+	aead, err := c.fileAEAD(header[len(cryptMagic):])
+	if err != nil {
+		return "", err
+	}
+	chunks := uint64(max((plain+cryptChunkSize-1)/cryptChunkSize, 1))
+	sum, err := aead.Open(nil, cryptNonce(chunks, cryptFlagTrailer), trailer, nil)
+	if err != nil {
+		return "", &os.PathError{Op: "decrypt", Path: p, Err: errors.New("encrypted file is corrupt or was tampered with")}
+	}
+	return hex.EncodeToString(sum), nil
+}
+
+func (c *CryptFS) Remove(p string) error {
+	enc, err := c.encPath(p)
+	if err != nil {
+		return err
+	}
+	return c.inner.Remove(enc)
+}
+
+func (c *CryptFS) MkdirAll(p string, perm os.FileMode) error {
+	enc, err := c.encPath(p)
+	if err != nil {
+		return err
+	}
+	if err := c.inner.MkdirAll(enc, perm); err != nil {
+		return err
+	}
+	if _, ok := c.underRoot(p); ok {
+		return c.writeKey()
+	}
+	return nil
+}
+
+func (c *CryptFS) Chmod(p string, mode os.FileMode) error {
+	enc, err := c.encPath(p)
+	if err != nil {
+		return err
+	}
+	return c.inner.Chmod(enc, mode)
+}
+
+func (c *CryptFS) Chtimes(p string, atime, mtime time.Time) error {
+	enc, err := c.encPath(p)
+	if err != nil {
+		return err
+	}
+	return c.inner.Chtimes(enc, atime, mtime)
+}
+
+func (c *CryptFS) Close() error {
+	return c.inner.Close()
+}
+
+// Separator returns the separator of the wrapped filesystem.
+func (c *CryptFS) Separator() byte {
+	return c.sep
+}
@@ -0,0 +1,374 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCryptFS(t *testing.T, inner FileSystem, root, passphrase string, names bool) *CryptFS {
+	t.Helper()
+
+	c, err := NewCryptFS(inner, root, CryptConfig{Passphrase: passphrase, EncryptNames: names})
+	if err != nil {
+		t.Fatalf("NewCryptFS failed: %v", err)
+	}
+	return c
+}
+
+func TestCryptFS_RoundTrip(t *testing.T) {
+	m := NewMemFS()
+	m.MkdirAll("/backup", 0755)
+	c := newTestCryptFS(t, m, "/backup", "secret", false)
+
+	for _, size := range []int{0, 1, cryptChunkSize - 1, cryptChunkSize, cryptChunkSize + 1, 3*cryptChunkSize + 100} {
+		data := bytes.Repeat([]byte("0123456789abcdef"), size/16+1)[:size]
+		p := "/backup/file"
+		writeFile(t, c, p, data)
+
+		got, err := readFile(c, p)
+		if err != nil {
+			t.Fatalf("size %d: reading failed: %v", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("size %d: content differs after round trip", size)
+		}
+
+		info, err := c.Stat(p)
+		if err != nil {
+			t.Fatalf("size %d: Stat failed: %v", size, err)
+		}
+		if info.Size != int64(size) {
+			t.Errorf("size %d: Stat size = %d", size, info.Size)
+		}
+
+		raw, _ := m.ReadFile(p)
+		if int64(len(raw)) != encryptedSize(int64(size)) {
+			t.Errorf("size %d: encrypted size = %d, want %d", size, len(raw), encryptedSize(int64(size)))
+		}
+		// Shorter plaintexts turn up in random ciphertext by chance.
+		if size >= 16 && bytes.Contains(raw, data[:min(size, 64)]) {
+			t.Errorf("size %d: plaintext stored unencrypted", size)
+		}
+	}
+}
+
+func TestCryptFS_Sizes(t *testing.T) {
+	for size := int64(0); size < 3*cryptChunkSize; size += 997 {
+		for _, s := range []int64{size, size + 1, cryptChunkSize*(size/cryptChunkSize+1) - 1} {
+			got, ok := plaintextSize(encryptedSize(s))
+			if !ok || got != s {
+				t.Fatalf("plaintextSize(encryptedSize(%d)) = %d, %v", s, got, ok)
+			}
+		}
+	}
+
+	for _, size := range []int64{0, 40, int64(cryptHeaderSize + cryptTrailerSize + cryptTagSize - 1), encryptedSize(cryptChunkSize) + 1} {
+		if _, ok := plaintextSize(size); ok {
+			t.Errorf("plaintextSize(%d) accepted an impossible size", size)
+		}
+	}
+}
+
+func TestCryptFS_Names(t *testing.T) {
+	m := NewMemFS()
+	m.MkdirAll("/backup", 0755)
+	c := newTestCryptFS(t, m, "/backup", "secret", true)
+
+	if err := c.MkdirAll("/backup/photos/2024", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	writeFile(t, c, "/backup/photos/2024/beach.jpg", []byte("jpeg"))
+
+	var inner []string
+	m.Walk("/backup", func(p string, info FileInfo, err error) error {
+		inner = append(inner, p)
+		return err
+	})
+	for _, p := range inner {
+		if strings.Contains(p, "photos") || strings.Contains(p, "beach") {
+			t.Errorf("name stored unencrypted: %s", p)
+		}
+	}
+
+	var walked []string
+	err := c.Walk("/backup", func(p string, info FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		walked = append(walked, p)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk failed: %v", err)
+	}
+	want := "/backup,/backup/photos,/backup/photos/2024,/backup/photos/2024/beach.jpg"
+	if got := strings.Join(walked, ","); got != want {
+		t.Errorf("Walk = %s, want %s", got, want)
+	}
+
+	info, err := c.Stat("/backup/photos/2024/beach.jpg")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Name != "beach.jpg" || info.Size != 4 {
+		t.Errorf("Stat = %+v", info)
+	}
+
+	// Names encrypt the same way every time, so files can be looked up.
+	other := newTestCryptFS(t, m, "/backup/", "secret", true)
+	if data, err := readFile(other, "/backup/photos/2024/beach.jpg"); err != nil || string(data) != "jpeg" {
+		t.Errorf("reading with a second CryptFS = %q, %v", data, err)
+	}
+
+	// Names that weren't encrypted with this key are reported, should the
+	// key file get lost.
+	m.Remove("/backup/" + cryptKeyFile)
+	wrong := newTestCryptFS(t, m, "/backup", "wrong", true)
+	err = wrong.Walk("/backup", func(p string, info FileInfo, err error) error {
+		return err
+	})
+	if !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("Walk with the wrong passphrase = %v, want ErrNotEncrypted", err)
+	}
+}
+
+func TestCryptFS_KeyFile(t *testing.T) {
+	m := NewMemFS()
+	m.MkdirAll("/a", 0755)
+	m.MkdirAll("/b", 0755)
+	first := newTestCryptFS(t, m, "/a", "secret", true)
+	second := newTestCryptFS(t, m, "/b", "secret", true)
+
+	// Nothing is written until the first file.
+	if _, err := m.Stat("/a/" + cryptKeyFile); err == nil {
+		t.Error("key file written before anything else")
+	}
+	writeFile(t, first, "/a/notes.txt", []byte("notes"))
+	writeFile(t, second, "/b/notes.txt", []byte("notes"))
+
+	names := func(root string) []string {
+		var names []string
+		m.Walk(root, func(p string, info FileInfo, err error) error {
+			if p != root {
+				names = append(names, info.Name)
+			}
+			return err
+		})
+		return names
+	}
+	a, b := names("/a"), names("/b")
+	if len(a) != 2 || len(b) != 2 {
+		t.Fatalf("stored names = %v and %v, want a key file and a file each", a, b)
+	}
+	for _, name := range a {
+		if name != cryptKeyFile && slices.Contains(b, name) {
+			t.Errorf("%s encrypts the same on both targets", name)
+		}
+	}
+
+	// The key file is hidden from Walk and can't be overwritten.
+	var walked []string
+	first.Walk("/a", func(p string, info FileInfo, err error) error {
+		walked = append(walked, p)
+		return err
+	})
+	if got := strings.Join(walked, ","); got != "/a,/a/notes.txt" {
+		t.Errorf("Walk = %s, want /a,/a/notes.txt", got)
+	}
+	plain := newTestCryptFS(t, m, "/a", "secret", false)
+	if _, err := plain.Create("/a/" + cryptKeyFile); err == nil {
+		t.Error("Create overwrote the key file")
+	}
+
+	reopened := newTestCryptFS(t, m, "/a", "secret", true)
+	if data, err := readFile(reopened, "/a/notes.txt"); err != nil || string(data) != "notes" {
+		t.Errorf("reading with the stored key = %q, %v", data, err)
+	}
+}
+
+func TestCryptFS_NamesRelativeRoot(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	c := newTestCryptFS(t, NewLocalFS(), ".", "secret", true)
+
+	if err := c.MkdirAll("photos", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	writeFile(t, c, filepath.Join("photos", "beach.jpg"), []byte("jpeg"))
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	for _, entry := range entries {
+		if entry.Name() == "photos" {
+			t.Error("name stored unencrypted below a root of \".\"")
+		}
+	}
+
+	var walked []string
+	err = c.Walk(".", func(p string, info FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		walked = append(walked, p)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk failed: %v", err)
+	}
+	want := strings.Join([]string{".", "photos", filepath.Join("photos", "beach.jpg")}, ",")
+	if got := strings.Join(walked, ","); got != want {
+		t.Errorf("Walk = %s, want %s", got, want)
+	}
+
+	for _, p := range []string{".", filepath.Join("..", "other"), filepath.Join(dir, "photos")} {
+		if enc, err := c.encPath(p); err != nil || enc != p {
+			t.Errorf("encPath(%s) = %s, %v, want it passed through", p, enc, err)
+		}
+	}
+}
+
+func TestCryptFS_Tampering(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 2*cryptChunkSize+10)
+
+	tests := []struct {
+		name   string
+		modify func(raw []byte) []byte
+	}{
+		{"flipped bit", func(raw []byte) []byte {
+			raw[cryptHeaderSize+100] ^= 1
+			return raw
+		}},
+		{"truncated chunk", func(raw []byte) []byte {
+			return append(raw[:cryptHeaderSize+cryptSealedSize], raw[len(raw)-cryptTrailerSize:]...)
+		}},
+		{"swapped chunks", func(raw []byte) []byte {
+			first := bytes.Clone(raw[cryptHeaderSize : cryptHeaderSize+cryptSealedSize])
+			copy(raw[cryptHeaderSize:], raw[cryptHeaderSize+cryptSealedSize:cryptHeaderSize+2*cryptSealedSize])
+			copy(raw[cryptHeaderSize+cryptSealedSize:], first)
+			return raw
+		}},
+		{"missing trailer", func(raw []byte) []byte {
+			return raw[:len(raw)-cryptTrailerSize]
+		}},
+		{"changed salt", func(raw []byte) []byte {
+			raw[len(cryptMagic)] ^= 1
+			return raw
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMemFS()
+			m.MkdirAll("/backup", 0755)
+			c := newTestCryptFS(t, m, "/backup", "secret", false)
+			writeFile(t, c, "/backup/file", data)
+
+			raw, _ := m.ReadFile("/backup/file")
+			m.WriteFile("/backup/file", tt.modify(raw), 0644, time.Now())
+
+			if got, err := readFile(c, "/backup/file"); err == nil {
+				t.Errorf("reading a tampered file succeeded with %d bytes", len(got))
+			}
+		})
+	}
+
+	t.Run("wrong passphrase", func(t *testing.T) {
+		m := NewMemFS()
+		m.MkdirAll("/backup", 0755)
+		writeFile(t, newTestCryptFS(t, m, "/backup", "secret", false), "/backup/file", data)
+
+		// Without the key check, a wrong passphrase would still see the
+		// plaintext sizes and times and write new files under another key.
+		if _, err := NewCryptFS(m, "/backup", CryptConfig{Passphrase: "wrong"}); !errors.Is(err, ErrWrongPassphrase) {
+			t.Errorf("NewCryptFS = %v, want ErrWrongPassphrase", err)
+		}
+
+		// Files that don't match the key file's keys still fail to decrypt.
+		m.Remove("/backup/" + cryptKeyFile)
+		if _, err := readFile(newTestCryptFS(t, m, "/backup", "wrong", false), "/backup/file"); err == nil {
+			t.Error("reading with the wrong passphrase succeeded")
+		}
+	})
+
+	t.Run("not encrypted", func(t *testing.T) {
+		m := NewMemFS()
+		m.MkdirAll("/backup", 0755)
+		m.WriteFile("/backup/plain", []byte("plain text"), 0644, time.Now())
+
+		c := newTestCryptFS(t, m, "/backup", "secret", false)
+		if _, err := readFile(c, "/backup/plain"); !errors.Is(err, ErrNotEncrypted) {
+			t.Errorf("Open = %v, want ErrNotEncrypted", err)
+		}
+		if _, err := c.Stat("/backup/plain"); !errors.Is(err, ErrNotEncrypted) {
+			t.Errorf("Stat = %v, want ErrNotEncrypted", err)
+		}
+	})
+}
+
+func TestCryptFS_Checksum(t *testing.T) {
+	dir := t.TempDir()
+	c := newTestCryptFS(t, NewLocalFS(), dir, "secret", true)
+
+	data := bytes.Repeat([]byte("checksum"), cryptChunkSize/4)
+	p := filepath.Join(dir, "file")
+	writeFile(t, c, p, data)
+
+	sum := sha256.Sum256(data)
+	got, err := c.Checksum(p)
+	if err != nil {
+		t.Fatalf("Checksum failed: %v", err)
+	}
+	if want := hex.EncodeToString(sum[:]); got != want {
+		t.Errorf("Checksum = %s, want %s", got, want)
+	}
+
+	// Without seeking the file would have to be read in full.
+	m := NewMemFS()
+	m.MkdirAll("/backup", 0755)
+	mc := newTestCryptFS(t, m, "/backup", "secret", false)
+	writeFile(t, mc, "/backup/file", data)
+	if _, err := mc.Checksum("/backup/file"); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Checksum on MemFS = %v, want ErrUnsupported", err)
+	}
+}
+
+func TestCryptFS_CreateWithInfo(t *testing.T) {
+	m := NewMemFS()
+	m.MkdirAll("/backup", 0755)
+	c := newTestCryptFS(t, m, "/backup", "secret", false)
+
+	modTime := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	w, err := c.CreateWithInfo("/backup/file", FileInfo{Size: 4, Mode: 0600, ModTime: modTime})
+	if err != nil {
+		t.Fatalf("CreateWithInfo failed: %v", err)
+	}
+	io.WriteString(w, "data")
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	info, err := c.Stat("/backup/file")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Mode != 0600 || !info.ModTime.Equal(modTime) || info.Size != 4 {
+		t.Errorf("Stat = %+v", info)
+	}
+}
+
+func TestNewCryptFS_EmptyPassphrase(t *testing.T) {
+	if _, err := NewCryptFS(NewMemFS(), "/", CryptConfig{}); err == nil {
+		t.Error("NewCryptFS accepted an empty passphrase")
+	}
+}
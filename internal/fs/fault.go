@@ -0,0 +1,363 @@
+package fs
+
+import (
+	"errors"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInjected is returned by FaultFS for stream faults that don't set their
+// own error.
+var ErrInjected = errors.New("injected fault")
+
+// FaultRule describes a fault FaultFS injects into matching calls.
+type FaultRule struct {
+	// Op is the FileSystem method to affect, e.g. "Create". Empty matches any.
+	Op string
+	// Path is a path.Match pattern, matched against the slash-separated path,
+	// or against the base name when it contains no slash. Empty matches any.
+	// For Walk it is matched against every visited entry.
+	Path string
+	// Nth fires the rule only on the nth matching call, counting from 1.
+	// Zero fires it on every matching call.
+	Nth int
+	// Probability fires the rule on a random share of matching calls.
+	// Zero means always.
+	Probability float64
+
+	// Latency delays the call.
+	Latency time.Duration
+	// Err is returned by the call. For stream faults it is the error the
+	// stream fails with, ErrInjected if unset.
+	Err error
+	// ShortWrite makes files returned from Create accept only this many
+	// bytes; later writes are cut short with io.ErrShortWrite.
+	ShortWrite int64
+	// DisconnectAfter makes streams returned from Open and Create fail
+	// after this many bytes, like a connection dropping mid-transfer.
+	DisconnectAfter int64
+}
+
+func (r FaultRule) streamErr() error {
+	if r.Err != nil {
+		return r.Err
+	}
+	return ErrInjected
+}
+
+// FaultFS wraps a FileSystem and injects errors, latency, short writes and
+// mid-stream disconnects according to its rules, to test how callers cope
+// with an unreliable filesystem. Random decisions use a fixed seed so runs
+// are reproducible; see Seed.
+//
+// Copy, Checksum and CreateWithInfo are forwarded to the wrapped
+// filesystem, or report errors.ErrUnsupported, or fall back to Create, when
+// it lacks them. Copy rules match the destination path, and CreateWithInfo
+// is subject to the rules for Create.
+type FaultFS struct {
+	inner FileSystem
+
+	mu     sync.Mutex
+	rules  []FaultRule
+	counts []int
+	rand   *rand.Rand
+}
+
+// NewFaultFS returns inner wrapped with the given rules.
+func NewFaultFS(inner FileSystem, rules ...FaultRule) *FaultFS {
+	f := &FaultFS{
+		inner: inner,
+		rand:  rand.New(rand.NewPCG(1, 1)),
+	}
+	for _, rule := range rules {
+		f.AddRule(rule)
+	}
+	return f
+}
+
+// AddRule adds a rule. Rules are checked in the order they were added.
+func (f *FaultFS) AddRule(rule FaultRule) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.rules = append(f.rules, rule)
+	f.counts = append(f.counts, 0)
+}
+
+// Seed reseeds the random source used for Probability.
+func (f *FaultFS) Seed(seed uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.rand = rand.New(rand.NewPCG(seed, seed))
+}
+
+func (f *FaultFS) match(pattern, p string) bool {
+	if pattern == "" {
+		return true
+	}
+	if sep := PathSeparator(f.inner); sep != '/' {
+		p = strings.ReplaceAll(p, string(sep), "/")
+	}
+	if !strings.Contains(pattern, "/") {
+		p = path.Base(p)
+	}
+	ok, _ := path.Match(pattern, p)
+	return ok
+}
+
+// fire returns the rules that fire for this call of op on p, after sleeping
+// for their latency.
+func (f *FaultFS) fire(op, p string) []FaultRule {
+	f.mu.Lock()
+	var fired []FaultRule
+	var latency time.Duration
+	for i, rule := range f.rules {
+		if rule.Op != "" && rule.Op != op || !f.match(rule.Path, p) {
+			continue
+		}
+		f.counts[i]++
+		if rule.Nth != 0 && f.counts[i] != rule.Nth {
+			continue
+		}
+		if rule.Probability != 0 && f.rand.Float64() >= rule.Probability {
+			continue
+		}
+		fired = append(fired, rule)
+		latency += rule.Latency
+	}
+	f.mu.Unlock()
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	return fired
+}
+
+// callErr returns the error a call of op on p fails with, if any.
+func (f *FaultFS) callErr(op, p string) error {
+	for _, rule := range f.fire(op, p) {
+		if rule.Err != nil && rule.ShortWrite == 0 && rule.DisconnectAfter == 0 {
+			return rule.Err
+		}
+	}
+	return nil
+}
+
+func (f *FaultFS) Stat(p string) (FileInfo, error) {
+	if err := f.callErr("Stat", p); err != nil {
+		return FileInfo{}, err
+	}
+	return f.inner.Stat(p)
+}
+
+func (f *FaultFS) Walk(root string, fn WalkFunc) error {
+	return f.inner.Walk(root, func(p string, info FileInfo, err error) error {
+		if err == nil {
+			if injected := f.callErr("Walk", p); injected != nil {
+				// A directory that failed to list has no entries to visit.
+				if err := fn(p, FileInfo{}, injected); err != nil || !info.IsDir {
+					return err
+				}
+				return filepath.SkipDir
+			}
+		}
+		return fn(p, info, err)
+	})
+}
+
+func (f *FaultFS) Open(p string) (io.ReadCloser, error) {
+	fired := f.fire("Open", p)
+	for _, rule := range fired {
+		if rule.Err != nil && rule.DisconnectAfter == 0 {
+			return nil, rule.Err
+		}
+	}
+
+	r, err := f.inner.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range fired {
+		if rule.DisconnectAfter != 0 {
+			r = &faultReader{ReadCloser: r, remaining: rule.DisconnectAfter, err: rule.streamErr()}
+		}
+	}
+	return r, nil
+}
+
+func (f *FaultFS) Create(p string) (io.WriteCloser, error) {
+	return f.create(p, func() (io.WriteCloser, error) {
+		return f.inner.Create(p)
+	})
+}
+
+func (f *FaultFS) CreateWithInfo(p string, info FileInfo) (io.WriteCloser, error) {
+	return f.create(p, func() (io.WriteCloser, error) {
+		if creator, ok := f.inner.(InfoCreator); ok {
+			return creator.CreateWithInfo(p, info)
+		}
+		w, err := f.inner.Create(p)
+		if err != nil {
+			return nil, err
+		}
+		return &infoWriter{WriteCloser: w, fs: f, path: p, info: info}, nil
+	})
+}
+
+func (f *FaultFS) create(p string, create func() (io.WriteCloser, error)) (io.WriteCloser, error) {
+	fired := f.fire("Create", p)
+	for _, rule := range fired {
+		if rule.Err != nil && rule.ShortWrite == 0 && rule.DisconnectAfter == 0 {
+			return nil, rule.Err
+		}
+	}
+
+	w, err := create()
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range fired {
+		switch {
+		case rule.DisconnectAfter != 0:
+			w = &faultWriter{WriteCloser: w, remaining: rule.DisconnectAfter, err: rule.streamErr()}
+		case rule.ShortWrite != 0:
+			w = &faultWriter{WriteCloser: w, remaining: rule.ShortWrite, err: io.ErrShortWrite}
+		}
+	}
+	return w, nil
+}
+
+func (f *FaultFS) Copy(src, dst string) error {
+	if err := f.callErr("Copy", dst); err != nil {
+		return err
+	}
+	if copier, ok := f.inner.(Copier); ok {
+		return copier.Copy(src, dst)
+	}
+	return errors.ErrUnsupported
+}
+
+func (f *FaultFS) Checksum(p string) (string, error) {
+	if err := f.callErr("Checksum", p); err != nil {
+		return "", err
+	}
+	if checksummer, ok := f.inner.(Checksummer); ok {
+		return checksummer.Checksum(p)
+	}
+	return "", errors.ErrUnsupported
+}
+
+func (f *FaultFS) Remove(p string) error {
+	if err := f.callErr("Remove", p); err != nil {
+		return err
+	}
+	return f.inner.Remove(p)
+}
+
+func (f *FaultFS) MkdirAll(p string, perm os.FileMode) error {
+	if err := f.callErr("MkdirAll", p); err != nil {
+		return err
+	}
+	return f.inner.MkdirAll(p, perm)
+}
+
+func (f *FaultFS) Chmod(p string, mode os.FileMode) error {
+	if err := f.callErr("Chmod", p); err != nil {
+		return err
+	}
+	return f.inner.Chmod(p, mode)
+}
+
+func (f *FaultFS) Chtimes(p string, atime, mtime time.Time) error {
+	if err := f.callErr("Chtimes", p); err != nil {
+		return err
+	}
+	return f.inner.Chtimes(p, atime, mtime)
+}
+
+func (f *FaultFS) Close() error {
+	return f.inner.Close()
+}
+
+// Separator returns the separator of the wrapped filesystem.
+func (f *FaultFS) Separator() byte {
+	return PathSeparator(f.inner)
+}
+
+// faultReader fails with err once remaining bytes have been read.
+type faultReader struct {
+	io.ReadCloser
+	remaining int64
+	err       error
+}
+
+func (r *faultReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, r.err
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.remaining -= int64(n)
+	return n, err
+}
+
+// faultWriter writes what fits into remaining bytes and then fails with err.
+type faultWriter struct {
+	io.WriteCloser
+	remaining int64
+	err       error
+}
+
+func (w *faultWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) <= w.remaining {
+		n, err := w.WriteCloser.Write(p)
+		w.remaining -= int64(n)
+		return n, err
+	}
+
+	n, err := w.WriteCloser.Write(p[:w.remaining])
+	w.remaining -= int64(n)
+	if err != nil {
+		return n, err
+	}
+	return n, w.err
+}
+
+// Abort discards the file if the wrapped file supports that.
+func (w *faultWriter) Abort() error {
+	return abortFile(w.WriteCloser)
+}
+
+// infoWriter sets the mode and modification time of a file created through
+// CreateWithInfo once it is closed, for wrapped filesystems that can't take
+// them at creation.
+type infoWriter struct {
+	io.WriteCloser
+	fs   FileSystem
+	path string
+	info FileInfo
+}
+
+func (w *infoWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	if err := w.fs.Chmod(w.path, w.info.Mode); err != nil {
+		return err
+	}
+	return w.fs.Chtimes(w.path, w.info.ModTime, w.info.ModTime)
+}
+
+// Abort discards the file if the wrapped file supports that.
+func (w *infoWriter) Abort() error {
+	return abortFile(w.WriteCloser)
+}
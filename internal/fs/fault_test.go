@@ -0,0 +1,273 @@
+package fs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newFaultTestFS(t *testing.T) *MemFS {
+	t.Helper()
+
+	m := NewMemFS()
+	for _, p := range []string{"/data/a.txt", "/data/b.txt", "/data/sub/c.log"} {
+		if err := m.WriteFile(p, []byte("0123456789"), 0644, time.Now()); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+	return m
+}
+
+func TestFaultFS_Nth(t *testing.T) {
+	boom := errors.New("boom")
+	f := NewFaultFS(newFaultTestFS(t), FaultRule{Op: "Stat", Nth: 2, Err: boom})
+
+	for i, want := range []error{nil, boom, nil} {
+		if _, err := f.Stat("/data/a.txt"); !errors.Is(err, want) {
+			t.Errorf("call %d: err = %v, want %v", i+1, err, want)
+		}
+	}
+}
+
+func TestFaultFS_PathPattern(t *testing.T) {
+	boom := errors.New("boom")
+	f := NewFaultFS(newFaultTestFS(t),
+		FaultRule{Op: "Open", Path: "*.log", Err: boom},
+		FaultRule{Op: "Remove", Path: "/data/b.*", Err: boom},
+	)
+
+	if _, err := f.Open("/data/sub/c.log"); !errors.Is(err, boom) {
+		t.Errorf("Open(c.log) err = %v, want %v", err, boom)
+	}
+	if r, err := f.Open("/data/a.txt"); err != nil {
+		t.Errorf("Open(a.txt) failed: %v", err)
+	} else {
+		r.Close()
+	}
+	if err := f.Remove("/data/b.txt"); !errors.Is(err, boom) {
+		t.Errorf("Remove(b.txt) err = %v, want %v", err, boom)
+	}
+	if err := f.Remove("/data/a.txt"); err != nil {
+		t.Errorf("Remove(a.txt) failed: %v", err)
+	}
+}
+
+func TestFaultFS_ProbabilityIsReproducible(t *testing.T) {
+	failures := func(seed uint64) []int {
+		f := NewFaultFS(newFaultTestFS(t), FaultRule{Op: "Stat", Probability: 0.3, Err: ErrInjected})
+		f.Seed(seed)
+		var failed []int
+		for i := range 200 {
+			if _, err := f.Stat("/data/a.txt"); err != nil {
+				failed = append(failed, i)
+			}
+		}
+		return failed
+	}
+
+	first, second := failures(7), failures(7)
+	if len(first) < 30 || len(first) > 90 {
+		t.Errorf("%d of 200 calls failed, want about 60", len(first))
+	}
+	if len(first) != len(second) {
+		t.Fatalf("same seed gave %d and %d failures", len(first), len(second))
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("same seed failed different calls: %v vs %v", first, second)
+		}
+	}
+}
+
+func TestFaultFS_Walk(t *testing.T) {
+	f := NewFaultFS(newFaultTestFS(t), FaultRule{Op: "Walk", Path: "b.txt", Err: ErrInjected})
+
+	var failed []string
+	err := f.Walk("/data", func(p string, info FileInfo, err error) error {
+		if err != nil {
+			failed = append(failed, p)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk failed: %v", err)
+	}
+	if len(failed) != 1 || failed[0] != "/data/b.txt" {
+		t.Errorf("failed entries = %v, want [/data/b.txt]", failed)
+	}
+}
+
+func TestFaultFS_WalkSkipsFailedDir(t *testing.T) {
+	f := NewFaultFS(newFaultTestFS(t), FaultRule{Op: "Walk", Path: "/data/sub", Err: ErrInjected})
+
+	var visited, failed []string
+	err := f.Walk("/data", func(p string, info FileInfo, err error) error {
+		if err != nil {
+			failed = append(failed, p)
+			return nil
+		}
+		visited = append(visited, p)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk failed: %v", err)
+	}
+	if len(failed) != 1 || failed[0] != "/data/sub" {
+		t.Errorf("failed entries = %v, want [/data/sub]", failed)
+	}
+	for _, p := range visited {
+		if p == "/data/sub/c.log" {
+			t.Errorf("Walk visited %s inside a failed directory", p)
+		}
+	}
+}
+
+func TestFaultFS_DisconnectAfter(t *testing.T) {
+	m := newFaultTestFS(t)
+	f := NewFaultFS(m,
+		FaultRule{Op: "Open", DisconnectAfter: 4},
+		FaultRule{Op: "Create", DisconnectAfter: 3, Err: io.ErrUnexpectedEOF},
+	)
+
+	r, err := f.Open("/data/a.txt")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if !errors.Is(err, ErrInjected) || string(data) != "0123" {
+		t.Errorf("ReadAll = %q, %v; want %q, %v", data, err, "0123", ErrInjected)
+	}
+
+	w, err := f.Create("/data/new.txt")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	n, err := io.WriteString(w, "abcdef")
+	w.Close()
+	if !errors.Is(err, io.ErrUnexpectedEOF) || n != 3 {
+		t.Errorf("Write = %d, %v; want 3, %v", n, err, io.ErrUnexpectedEOF)
+	}
+	if got, _ := m.ReadFile("/data/new.txt"); string(got) != "abc" {
+		t.Errorf("written = %q, want %q", got, "abc")
+	}
+}
+
+func TestFaultFS_ShortWrite(t *testing.T) {
+	f := NewFaultFS(NewMemFS(), FaultRule{Op: "Create", ShortWrite: 5})
+
+	w, err := f.Create("/out.txt")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	defer w.Close()
+	if n, err := w.Write([]byte("abc")); n != 3 || err != nil {
+		t.Errorf("first Write = %d, %v; want 3, nil", n, err)
+	}
+	if n, err := w.Write([]byte("defg")); n != 2 || !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("second Write = %d, %v; want 2, %v", n, err, io.ErrShortWrite)
+	}
+}
+
+func TestFaultFS_Latency(t *testing.T) {
+	f := NewFaultFS(newFaultTestFS(t), FaultRule{Op: "Stat", Latency: 20 * time.Millisecond})
+
+	start := time.Now()
+	if _, err := f.Stat("/data/a.txt"); err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("Stat took %v, want at least 20ms", elapsed)
+	}
+}
+
+func TestFaultFS_Separator(t *testing.T) {
+	m := NewMemFSWithSeparator('\\')
+	if err := m.WriteFile(`\data\a.txt`, []byte("x"), 0644, time.Now()); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	f := NewFaultFS(m, FaultRule{Path: "/data/*.txt", Err: ErrInjected})
+
+	if got := PathSeparator(f); got != '\\' {
+		t.Errorf("PathSeparator = %q, want '\\\\'", got)
+	}
+	if _, err := f.Stat(`\data\a.txt`); !errors.Is(err, ErrInjected) {
+		t.Errorf("Stat err = %v, want %v", err, ErrInjected)
+	}
+}
+
+func TestFaultFS_OptionalInterfaces(t *testing.T) {
+	boom := errors.New("boom")
+	dir := t.TempDir()
+	c, err := NewCryptFS(NewLocalFS(), dir, CryptConfig{Passphrase: "secret"})
+	if err != nil {
+		t.Fatalf("NewCryptFS failed: %v", err)
+	}
+	encrypted := filepath.Join(dir, "a.txt")
+	writeFile(t, c, encrypted, []byte("0123456789"))
+
+	f := NewFaultFS(c, FaultRule{Op: "Checksum", Nth: 1, Err: boom})
+	if _, err := f.Checksum(encrypted); !errors.Is(err, boom) {
+		t.Errorf("first Checksum = %v, want %v", err, boom)
+	}
+	if sum, err := f.Checksum(encrypted); err != nil || len(sum) != 64 {
+		t.Errorf("second Checksum = %q, %v, want the inner checksum", sum, err)
+	}
+
+	m := newFaultTestFS(t)
+
+	// Without support underneath, Copy and Checksum fall back to streaming
+	// and CreateWithInfo sets the metadata after closing.
+	f = NewFaultFS(m, FaultRule{Op: "Copy", Path: "b.txt", Err: boom})
+	if err := f.Copy("/data/a.txt", "/data/b.txt"); !errors.Is(err, boom) {
+		t.Errorf("Copy = %v, want %v", err, boom)
+	}
+	if err := f.Copy("/data/a.txt", "/data/d.txt"); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Copy = %v, want ErrUnsupported", err)
+	}
+	if _, err := f.Checksum("/data/a.txt"); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Checksum = %v, want ErrUnsupported", err)
+	}
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	w, err := f.CreateWithInfo("/data/e.txt", FileInfo{Mode: 0600, ModTime: modTime})
+	if err != nil {
+		t.Fatalf("CreateWithInfo failed: %v", err)
+	}
+	io.WriteString(w, "data")
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if info, err := m.Stat("/data/e.txt"); err != nil || info.Mode != 0600 || !info.ModTime.Equal(modTime) {
+		t.Errorf("Stat after CreateWithInfo = %+v, %v", info, err)
+	}
+}
+
+func TestFaultFS_Abort(t *testing.T) {
+	a, err := NewArchiveFS(filepath.Join(t.TempDir(), "a.tar"))
+	if err != nil {
+		t.Fatalf("NewArchiveFS failed: %v", err)
+	}
+	defer a.Close()
+	f := NewFaultFS(a, FaultRule{Op: "Create", ShortWrite: 2})
+
+	w, err := f.Create("/partial.txt")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := io.WriteString(w, "data"); !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("Write = %v, want io.ErrShortWrite", err)
+	}
+	aborter, ok := w.(Aborter)
+	if !ok {
+		t.Fatal("file from Create doesn't support Abort")
+	}
+	if err := aborter.Abort(); err != nil {
+		t.Errorf("Abort failed: %v", err)
+	}
+	if _, err := a.Stat("/partial.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("aborted file exists: %v", err)
+	}
+}
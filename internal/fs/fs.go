@@ -27,3 +27,53 @@ type FileSystem interface {
 	Chtimes(path string, atime, mtime time.Time) error
 	Close() error
 }
+
+// Copier is implemented by filesystems that can copy a file to another path
+// on the same filesystem without streaming its contents through the client.
+// Copy returns errors.ErrUnsupported when the copy has to be streamed after all.
+type Copier interface {
+	Copy(src, dst string) error
+}
+
+// Checksummer is implemented by filesystems that can compute the SHA256
+// checksum of a file without transferring its contents. Checksum returns the
+// hex-encoded digest, or errors.ErrUnsupported when the file has to be read
+// and hashed locally after all.
+type Checksummer interface {
+	Checksum(path string) (string, error)
+}
+
+// InfoCreator is implemented by filesystems that need a file's mode and
+// modification time when it is created, because changing them afterwards is
+// expensive or impossible. The returned file carries both once closed.
+type InfoCreator interface {
+	CreateWithInfo(path string, info FileInfo) (io.WriteCloser, error)
+}
+
+// StoredSizer is implemented by filesystems whose Stat and Walk may report
+// the size a file is stored at rather than the size it was written with,
+// such as CompressFS. StoredSizes reports whether they currently do, in
+// which case sizes can't be compared with another filesystem's.
+type StoredSizer interface {
+	StoredSizes() bool
+}
+
+// Aborter is implemented by files returned from Create that can discard what
+// was written instead of committing it, e.g. to cancel an upload.
+type Aborter interface {
+	Abort() error
+}
+
+// Separator is implemented by filesystems whose paths don't use the local
+// operating system's separator.
+type Separator interface {
+	Separator() byte
+}
+
+// PathSeparator returns the path separator used by filesystem.
+func PathSeparator(filesystem FileSystem) byte {
+	if s, ok := filesystem.(Separator); ok {
+		return s.Separator()
+	}
+	return os.PathSeparator
+}
@@ -0,0 +1,71 @@
+package fs
+
+import (
+	"io"
+	"testing"
+)
+
+// writeFile creates p on filesystem with data, written in small pieces so
+// that wrappers buffering the start of a file see it split.
+func writeFile(t *testing.T, filesystem FileSystem, p string, data []byte) {
+	t.Helper()
+
+	w, err := filesystem.Create(p)
+	if err != nil {
+		t.Fatalf("Create(%s) failed: %v", p, err)
+	}
+	writeAndClose(t, w, p, data)
+}
+
+// writeFileInfo is writeFile with the mode and modification time of info,
+// passed to CreateWithInfo where the filesystem takes them and set after
+// the file is written otherwise.
+func writeFileInfo(t *testing.T, filesystem FileSystem, p string, data []byte, info FileInfo) {
+	t.Helper()
+
+	creator, ok := filesystem.(InfoCreator)
+	if !ok {
+		writeFile(t, filesystem, p, data)
+		if err := filesystem.Chmod(p, info.Mode); err != nil {
+			t.Fatalf("Chmod(%s) failed: %v", p, err)
+		}
+		if err := filesystem.Chtimes(p, info.ModTime, info.ModTime); err != nil {
+			t.Fatalf("Chtimes(%s) failed: %v", p, err)
+		}
+		return
+	}
+	info.Size = int64(len(data))
+	w, err := creator.CreateWithInfo(p, info)
+	if err != nil {
+		t.Fatalf("CreateWithInfo(%s) failed: %v", p, err)
+	}
+	writeAndClose(t, w, p, data)
+}
+
+func writeAndClose(t *testing.T, w io.WriteCloser, p string, data []byte) {
+	t.Helper()
+
+	for len(data) > 0 {
+		n := min(len(data), 100)
+		if _, err := w.Write(data[:n]); err != nil {
+			t.Fatalf("Write(%s) failed: %v", p, err)
+		}
+		data = data[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close(%s) failed: %v", p, err)
+	}
+}
+
+// readFile returns the contents of p on filesystem.
+func readFile(filesystem FileSystem, p string) ([]byte, error) {
+	r, err := filesystem.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(r)
+	if closeErr := r.Close(); err == nil {
+		err = closeErr
+	}
+	return data, err
+}
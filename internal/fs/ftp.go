@@ -0,0 +1,1090 @@
+package fs
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robertgontarski/sync/internal/logger"
+)
+
+// FTPTLS selects how an FTP connection is secured.
+type FTPTLS int
+
+const (
+	FTPPlain FTPTLS = iota
+	// FTPExplicitTLS connects in plain text and upgrades with AUTH TLS
+	// (RFC 4217).
+	FTPExplicitTLS
+	// FTPImplicitTLS speaks TLS from the first byte, usually on port 990.
+	FTPImplicitTLS
+)
+
+type FTPConfig struct {
+	Host string
+	// Port defaults to 21, or 990 with implicit TLS.
+	Port int
+	// User defaults to anonymous, which always logs in with the placeholder
+	// password "anonymous@".
+	User     string
+	Password string
+	// PasswordPrompt is called for the password when Password is empty and
+	// the server asks for one.
+	PasswordPrompt func(user, host string) (string, error)
+	TLS            FTPTLS
+	// TLSConfig overrides the TLS settings, e.g. to trust a private CA.
+	TLSConfig *tls.Config
+	// Timeout limits connecting and waiting for the server. Defaults to 30s.
+	Timeout time.Duration
+	Logger  *logger.Logger
+}
+
+// FTPFS accesses files on an FTP or FTPS server in passive mode. Paths are
+// slash-separated and absolute from the login directory. Directories are
+// listed with MLSD when the server supports it and with LIST otherwise;
+// modification times are read with MDTM and set with MFMT where available.
+// Without MLST, Stat asks for a file's SIZE and MDTM, which don't include its
+// mode, so such files are reported as 0644; it lists the parent directory
+// only for directories and on servers lacking those commands. LIST times
+// carry no timezone and are read as UTC, and Walk reports them as they are.
+// Modes are set with SITE CHMOD, which servers may ignore.
+//
+// FTP runs one transfer at a time per control connection, so FTPFS keeps a
+// small pool and opens another connection when all are busy.
+type FTPFS struct {
+	cfg       FTPConfig
+	addr      string
+	tlsConfig *tls.Config
+	password  func() (string, error)
+	features  map[string]string
+
+	mu          sync.Mutex
+	idle        []*ftpConn
+	noEPSV      bool
+	noChmod     bool
+	warnedMtime bool
+}
+
+type ftpConn struct {
+	conn net.Conn
+	text *textproto.Conn
+}
+
+func init() {
+	open := func(info PathInfo, opts Options) (FileSystem, error) {
+		cfg, err := ftpConfigFor(info, opts)
+		if err != nil {
+			return nil, err
+		}
+		return NewFTPFS(cfg)
+	}
+	Register("ftp", open)
+	Register("ftps", open)
+}
+
+// ftpConfigFor returns the settings for an ftp:// or ftps:// endpoint. ftps
+// uses implicit TLS on port 990, the default, and explicit TLS on any other
+// port, unless the tls URL option says "implicit" or "explicit".
+func ftpConfigFor(info PathInfo, opts Options) (FTPConfig, error) {
+	allowed := []string{}
+	if info.Scheme == "ftps" {
+		allowed = append(allowed, "tls")
+	}
+	if err := checkQuery(info, allowed...); err != nil {
+		return FTPConfig{}, err
+	}
+
+	cfg := FTPConfig{
+		Host:           info.Host,
+		Port:           info.Port,
+		User:           info.User,
+		Password:       opts.FTPPassword,
+		PasswordPrompt: opts.PasswordPrompt,
+		Logger:         opts.Logger,
+	}
+	if info.Scheme == "ftps" {
+		cfg.TLS = FTPImplicitTLS
+		if cfg.Port != 0 && cfg.Port != 990 {
+			cfg.TLS = FTPExplicitTLS
+		}
+		switch mode := info.Query.Get("tls"); mode {
+		case "":
+		case "implicit":
+			cfg.TLS = FTPImplicitTLS
+		case "explicit":
+			cfg.TLS = FTPExplicitTLS
+		default:
+			return FTPConfig{}, fmt.Errorf("invalid ftps option tls=%q, expected implicit or explicit", mode)
+		}
+	}
+	return cfg, nil
+}
+
+func NewFTPFS(cfg FTPConfig) (*FTPFS, error) {
+	if cfg.Host == "" {
+		return nil, fmt.Errorf("FTP host is required")
+	}
+	if cfg.Port == 0 {
+		cfg.Port = 21
+		if cfg.TLS == FTPImplicitTLS {
+			cfg.Port = 990
+		}
+	}
+	if cfg.User == "" {
+		cfg.User = "anonymous"
+		cfg.Password = "anonymous@"
+		cfg.PasswordPrompt = nil
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 30 * time.Second
+	}
+
+	tlsConfig := &tls.Config{}
+	if cfg.TLSConfig != nil {
+		tlsConfig = cfg.TLSConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = cfg.Host
+	}
+	// Many servers require data connections to resume the control
+	// connection's TLS session.
+	if tlsConfig.ClientSessionCache == nil {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+
+	f := &FTPFS{
+		cfg:       cfg,
+		addr:      net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)),
+		tlsConfig: tlsConfig,
+		password:  passwordSource(cfg.User, cfg.Host, cfg.Password, cfg.PasswordPrompt),
+	}
+
+	c, err := f.dial()
+	if err != nil {
+		return nil, err
+	}
+	f.features = c.features()
+	f.put(c)
+	return f, nil
+}
+
+func (f *FTPFS) dial() (*ftpConn, error) {
+	dialer := &net.Dialer{Timeout: f.cfg.Timeout}
+
+	var conn net.Conn
+	var err error
+	if f.cfg.TLS == FTPImplicitTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", f.addr, f.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", f.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("FTP connection failed: %w", err)
+	}
+
+	c := &ftpConn{conn: conn, text: textproto.NewConn(conn)}
+	if err := f.handshake(c); err != nil {
+		c.text.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (f *FTPFS) handshake(c *ftpConn) error {
+	c.conn.SetDeadline(time.Now().Add(f.cfg.Timeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	if _, _, err := c.text.ReadResponse(220); err != nil {
+		return fmt.Errorf("FTP greeting: %w", err)
+	}
+
+	if f.cfg.TLS == FTPExplicitTLS {
+		if _, _, err := c.cmd(234, "AUTH TLS"); err != nil {
+			return fmt.Errorf("FTP AUTH TLS: %w", err)
+		}
+		tlsConn := tls.Client(c.conn, f.tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return fmt.Errorf("FTP TLS handshake: %w", err)
+		}
+		c.conn = tlsConn
+		c.text = textproto.NewConn(tlsConn)
+	}
+
+	code, msg, err := c.cmd(0, "USER %s", f.cfg.User)
+	if err == nil && code == 331 {
+		var password string
+		password, err = f.password()
+		if err != nil {
+			return err
+		}
+		code, msg, err = c.cmd(0, "PASS %s", password)
+	}
+	if err == nil && code/100 != 2 {
+		err = &textproto.Error{Code: code, Msg: msg}
+	}
+	if err != nil {
+		return fmt.Errorf("FTP login failed: %w", err)
+	}
+
+	if f.cfg.TLS != FTPPlain {
+		if _, _, err := c.cmd(200, "PBSZ 0"); err != nil {
+			return fmt.Errorf("FTP PBSZ: %w", err)
+		}
+		if _, _, err := c.cmd(200, "PROT P"); err != nil {
+			return fmt.Errorf("FTP PROT: %w", err)
+		}
+	}
+	if _, _, err := c.cmd(200, "TYPE I"); err != nil {
+		return fmt.Errorf("FTP TYPE: %w", err)
+	}
+	return nil
+}
+
+// cmd sends a command and reads its reply. expect is a reply code or its
+// leading digits as for textproto.Reader.ReadResponse; 0 accepts any code.
+func (c *ftpConn) cmd(expect int, format string, args ...any) (int, string, error) {
+	for _, arg := range args {
+		if s, ok := arg.(string); ok && strings.ContainsAny(s, "\r\n") {
+			return 0, "", fmt.Errorf("FTP: invalid name %q", s)
+		}
+	}
+	id, err := c.text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	c.text.StartResponse(id)
+	defer c.text.EndResponse(id)
+	return c.text.ReadResponse(expect)
+}
+
+// features returns the server's FEAT extensions by upper-case name, with
+// their parameters as value.
+func (c *ftpConn) features() map[string]string {
+	features := make(map[string]string)
+	_, msg, err := c.cmd(211, "FEAT")
+	if err != nil {
+		return features
+	}
+	for _, line := range strings.Split(msg, "\n") {
+		if !strings.HasPrefix(line, " ") {
+			continue
+		}
+		name, params, _ := strings.Cut(strings.TrimSpace(line), " ")
+		features[strings.ToUpper(name)] = params
+	}
+	return features
+}
+
+func (f *FTPFS) supports(feature string) bool {
+	_, ok := f.features[feature]
+	return ok
+}
+
+func (f *FTPFS) get() (*ftpConn, bool, error) {
+	f.mu.Lock()
+	if n := len(f.idle); n > 0 {
+		c := f.idle[n-1]
+		f.idle = f.idle[:n-1]
+		f.mu.Unlock()
+		return c, true, nil
+	}
+	f.mu.Unlock()
+
+	c, err := f.dial()
+	return c, false, err
+}
+
+func (f *FTPFS) put(c *ftpConn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.idle = append(f.idle, c)
+}
+
+// isFTPConnectionError reports whether err means the control connection is
+// unusable.
+func isFTPConnectionError(err error) bool {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code == 421
+	}
+	return isConnectionError(err) || errors.As(err, new(textproto.ProtocolError))
+}
+
+// do runs op on a pooled connection. A pooled connection the server has
+// closed in the meantime is replaced once.
+func (f *FTPFS) do(op func(c *ftpConn) error) error {
+	c, reused, err := f.get()
+	if err != nil {
+		return err
+	}
+	err = op(c)
+	if reused && isFTPConnectionError(err) {
+		c.text.Close()
+		if c, err = f.dial(); err != nil {
+			return err
+		}
+		err = op(c)
+	}
+	if isFTPConnectionError(err) {
+		c.text.Close()
+	} else {
+		f.put(c)
+	}
+	return err
+}
+
+// ftpError converts a failed reply into an error. 550 replies are reported
+// as os.ErrNotExist, which is what servers use for missing paths.
+func ftpError(op, p string, err error) error {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) && protoErr.Code == 550 {
+		return &os.PathError{Op: op, Path: p, Err: os.ErrNotExist}
+	}
+	return &os.PathError{Op: op, Path: p, Err: err}
+}
+
+func ftpCode(err error) int {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code
+	}
+	return 0
+}
+
+func ftpPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// dataConn opens a passive data connection, preferring EPSV.
+func (f *FTPFS) dataConn(c *ftpConn) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(c.conn.RemoteAddr().String())
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	tryEPSV := !f.noEPSV
+	f.mu.Unlock()
+
+	port := 0
+	if tryEPSV {
+		_, msg, err := c.cmd(229, "EPSV")
+		if err == nil {
+			port, err = parseEPSV(msg)
+		}
+		if err != nil {
+			if isFTPConnectionError(err) {
+				return nil, err
+			}
+			f.mu.Lock()
+			f.noEPSV = true
+			f.mu.Unlock()
+		}
+	}
+	if port == 0 {
+		_, msg, err := c.cmd(227, "PASV")
+		if err != nil {
+			return nil, err
+		}
+		// The address in the reply is ignored: servers behind NAT often
+		// report an internal one.
+		if port, err = parsePASV(msg); err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), f.cfg.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("FTP data connection failed: %w", err)
+	}
+	if f.cfg.TLS != FTPPlain {
+		conn = tls.Client(conn, f.tlsConfig)
+	}
+	return conn, nil
+}
+
+// parseEPSV extracts the port from "Entering Extended Passive Mode (|||port|)".
+func parseEPSV(msg string) (int, error) {
+	start := strings.Index(msg, "(")
+	end := strings.LastIndex(msg, ")")
+	if start < 0 || end < start+2 {
+		return 0, fmt.Errorf("FTP: malformed EPSV reply %q", msg)
+	}
+	inner := msg[start+1 : end]
+	parts := strings.Split(inner, inner[:1])
+	if len(parts) != 5 {
+		return 0, fmt.Errorf("FTP: malformed EPSV reply %q", msg)
+	}
+	port, err := strconv.Atoi(parts[3])
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("FTP: malformed EPSV reply %q", msg)
+	}
+	return port, nil
+}
+
+// parsePASV extracts the port from "Entering Passive Mode (h1,h2,h3,h4,p1,p2)".
+func parsePASV(msg string) (int, error) {
+	start := strings.Index(msg, "(")
+	end := strings.LastIndex(msg, ")")
+	if start < 0 || end < start {
+		// Some servers leave out the parentheses.
+		start = strings.LastIndex(msg, " ")
+		end = len(msg)
+	}
+	parts := strings.Split(msg[start+1:end], ",")
+	if len(parts) != 6 {
+		return 0, fmt.Errorf("FTP: malformed PASV reply %q", msg)
+	}
+	hi, err1 := strconv.Atoi(strings.TrimSpace(parts[4]))
+	lo, err2 := strconv.Atoi(strings.TrimSpace(parts[5]))
+	if err1 != nil || err2 != nil || hi < 0 || hi > 255 || lo < 0 || lo > 255 {
+		return 0, fmt.Errorf("FTP: malformed PASV reply %q", msg)
+	}
+	return hi<<8 | lo, nil
+}
+
+// transfer starts a data transfer for cmd and returns the data connection.
+// The caller must close it and then read the final reply with finish.
+func (f *FTPFS) transfer(c *ftpConn, format string, args ...any) (net.Conn, error) {
+	data, err := f.dataConn(c)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := c.cmd(1, format, args...); err != nil {
+		data.Close()
+		return nil, err
+	}
+	if tlsConn, ok := data.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			data.Close()
+			c.text.ReadResponse(0)
+			return nil, fmt.Errorf("FTP data TLS handshake: %w", err)
+		}
+	}
+	return data, nil
+}
+
+// finish reads the reply that ends a transfer.
+func (c *ftpConn) finish() error {
+	c.conn.SetReadDeadline(time.Now().Add(time.Minute))
+	defer c.conn.SetReadDeadline(time.Time{})
+
+	_, _, err := c.text.ReadResponse(2)
+	return err
+}
+
+// readLines runs a listing command and returns its non-empty lines.
+func (f *FTPFS) readLines(c *ftpConn, format string, args ...any) ([]string, error) {
+	data, err := f.transfer(c, format, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(data)
+	for scanner.Scan() {
+		if line := strings.TrimRight(scanner.Text(), "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	data.Close()
+	if err := c.finish(); err != nil {
+		return nil, err
+	}
+	return lines, scanner.Err()
+}
+
+// list returns the entries of dir, without "." and "..". LIST times are
+// left as the server gave them, in minutes at best and only days for older
+// files; stat looks up the precise time of the one file it needs.
+func (f *FTPFS) list(c *ftpConn, dir string) ([]FileInfo, error) {
+	if f.supports("MLST") {
+		lines, err := f.readLines(c, "MLSD %s", dir)
+		if err != nil {
+			return nil, err
+		}
+		var infos []FileInfo
+		for _, line := range lines {
+			if info, ok := parseMLSxEntry(line); ok {
+				infos = append(infos, info)
+			}
+		}
+		return infos, nil
+	}
+
+	lines, err := f.readLines(c, "LIST %s", dir)
+	if err != nil {
+		return nil, err
+	}
+	var infos []FileInfo
+	for _, line := range lines {
+		info, ok := parseListLine(line, time.Now())
+		if !ok || info.Name == "." || info.Name == ".." {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (f *FTPFS) mdtm(c *ftpConn, p string) (time.Time, error) {
+	_, msg, err := c.cmd(213, "MDTM %s", p)
+	if err != nil {
+		return time.Time{}, err
+	}
+	modTime, ok := parseFTPTime(strings.TrimSpace(msg))
+	if !ok {
+		return time.Time{}, fmt.Errorf("FTP: malformed MDTM reply %q", msg)
+	}
+	return modTime, nil
+}
+
+// parseFTPTime parses the YYYYMMDDHHMMSS[.sss] UTC timestamps of MDTM and
+// MLSx.
+func parseFTPTime(v string) (time.Time, bool) {
+	t, err := time.Parse("20060102150405", v)
+	if err != nil {
+		if t, err = time.Parse("20060102150405.999999999", v); err != nil {
+			return time.Time{}, false
+		}
+	}
+	return t, true
+}
+
+func formatFTPTime(t time.Time) string {
+	return t.UTC().Format("20060102150405")
+}
+
+// parseMLSxEntry parses an MLSD or MLST line "fact=value;...; name". Only
+// files and directories are returned.
+func parseMLSxEntry(line string) (FileInfo, bool) {
+	facts, name, ok := strings.Cut(strings.TrimPrefix(line, " "), " ")
+	if !ok || name == "" {
+		return FileInfo{}, false
+	}
+
+	info := FileInfo{Name: path.Base(name)}
+	var perm os.FileMode
+	hasPerm := false
+	for _, fact := range strings.Split(facts, ";") {
+		key, value, _ := strings.Cut(fact, "=")
+		switch strings.ToLower(key) {
+		case "type":
+			switch strings.ToLower(value) {
+			case "file":
+			case "dir":
+				info.IsDir = true
+			default:
+				return FileInfo{}, false
+			}
+		case "size":
+			info.Size, _ = strconv.ParseInt(value, 10, 64)
+		case "modify":
+			info.ModTime, _ = parseFTPTime(value)
+		case "unix.mode":
+			if m, err := strconv.ParseUint(value, 8, 32); err == nil {
+				perm, hasPerm = os.FileMode(m).Perm(), true
+			}
+		}
+	}
+
+	if !hasPerm {
+		perm = 0644
+		if info.IsDir {
+			perm = 0755
+		}
+	}
+	info.Mode = perm
+	if info.IsDir {
+		info.Mode |= os.ModeDir
+		info.Size = 0
+	}
+	return info, true
+}
+
+// parseListLine parses a LIST line in Unix ls or DOS format. Symlinks and
+// unknown formats are skipped. now resolves the year of recent Unix entries.
+// LIST gives no timezone, so times are parsed as UTC.
+func parseListLine(line string, now time.Time) (FileInfo, bool) {
+	if info, ok := parseUnixListLine(line, now); ok {
+		return info, true
+	}
+	return parseDOSListLine(line)
+}
+
+// splitFields splits the first n whitespace-separated fields off line and
+// returns them with the rest of the line, which may contain spaces.
+func splitFields(line string, n int) ([]string, string, bool) {
+	fields := make([]string, 0, n)
+	rest := line
+	for range n {
+		rest = strings.TrimLeft(rest, " ")
+		i := strings.IndexByte(rest, ' ')
+		if i < 0 {
+			return nil, "", false
+		}
+		fields = append(fields, rest[:i])
+		rest = rest[i:]
+	}
+	if len(rest) < 2 {
+		return nil, "", false
+	}
+	return fields, rest[1:], true
+}
+
+// parseUnixListLine parses "drwxr-xr-x 2 owner group 4096 Jan  2 15:04 name".
+func parseUnixListLine(line string, now time.Time) (FileInfo, bool) {
+	fields, name, ok := splitFields(line, 8)
+	if !ok || len(fields[0]) != 10 {
+		return FileInfo{}, false
+	}
+	// The time column is followed by a single space before the name.
+	name = strings.TrimLeft(name, " ")
+
+	info := FileInfo{Name: name}
+	switch fields[0][0] {
+	case 'd':
+		info.IsDir = true
+	case '-':
+	default:
+		return FileInfo{}, false
+	}
+
+	for i, c := range fields[0][1:] {
+		// S and T are setuid, setgid and sticky without execute permission.
+		if c != '-' && c != 'S' && c != 'T' {
+			info.Mode |= 1 << (8 - i)
+		}
+	}
+	if info.IsDir {
+		info.Mode |= os.ModeDir
+	} else {
+		size, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return FileInfo{}, false
+		}
+		info.Size = size
+	}
+
+	stamp := fields[5] + " " + fields[6] + " " + fields[7]
+	if strings.Contains(fields[7], ":") {
+		t, err := time.Parse("Jan 2 15:04 2006", stamp+" "+strconv.Itoa(now.Year()))
+		if err != nil {
+			return FileInfo{}, false
+		}
+		// Entries without a year are from the last six months.
+		if t.After(now.Add(24 * time.Hour)) {
+			t = t.AddDate(-1, 0, 0)
+		}
+		info.ModTime = t
+	} else {
+		t, err := time.Parse("Jan 2 2006", stamp)
+		if err != nil {
+			return FileInfo{}, false
+		}
+		info.ModTime = t
+	}
+	return info, true
+}
+
+// parseDOSListLine parses "01-02-06  03:04PM  <DIR>  name" and
+// "01-02-2006  15:04  1234  name".
+func parseDOSListLine(line string) (FileInfo, bool) {
+	fields, name, ok := splitFields(line, 3)
+	if !ok {
+		return FileInfo{}, false
+	}
+	name = strings.TrimLeft(name, " ")
+
+	var modTime time.Time
+	var err error
+	stamp := fields[0] + " " + fields[1]
+	for _, layout := range []string{"01-02-06 03:04PM", "01-02-2006 03:04PM", "01-02-06 15:04", "01-02-2006 15:04"} {
+		if modTime, err = time.Parse(layout, stamp); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return FileInfo{}, false
+	}
+
+	info := FileInfo{Name: name, ModTime: modTime}
+	if fields[2] == "<DIR>" {
+		info.IsDir = true
+		info.Mode = os.ModeDir | 0755
+		return info, true
+	}
+	size, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return FileInfo{}, false
+	}
+	info.Size = size
+	info.Mode = 0644
+	return info, true
+}
+
+func (f *FTPFS) stat(c *ftpConn, p string) (FileInfo, error) {
+	if f.supports("MLST") {
+		_, msg, err := c.cmd(250, "MLST %s", p)
+		if err != nil {
+			return FileInfo{}, err
+		}
+		for _, line := range strings.Split(msg, "\n") {
+			if !strings.Contains(line, "=") {
+				continue
+			}
+			if info, ok := parseMLSxEntry(strings.TrimLeft(line, " ")); ok {
+				info.Name = path.Base(p)
+				return info, nil
+			}
+		}
+		return FileInfo{}, &textproto.Error{Code: 550, Msg: "no such file"}
+	}
+
+	if p == "/" {
+		return FileInfo{Name: "/", Mode: os.ModeDir | 0755, IsDir: true}, nil
+	}
+	if f.supports("SIZE") && f.supports("MDTM") {
+		info, err := f.statFile(c, p)
+		if err == nil || isFTPConnectionError(err) {
+			return info, err
+		}
+	}
+
+	// SIZE fails for directories and missing paths, so look for p in its
+	// parent's listing.
+	infos, err := f.list(c, path.Dir(p))
+	if err != nil {
+		return FileInfo{}, err
+	}
+	for _, info := range infos {
+		if info.Name != path.Base(p) {
+			continue
+		}
+		if !info.IsDir && f.supports("MDTM") {
+			if modTime, err := f.mdtm(c, p); err == nil {
+				info.ModTime = modTime
+			} else if isFTPConnectionError(err) {
+				return FileInfo{}, err
+			}
+		}
+		return info, nil
+	}
+	return FileInfo{}, &textproto.Error{Code: 550, Msg: "no such file"}
+}
+
+// statFile stats a file with SIZE and MDTM, which is two round trips however
+// large its directory is.
+func (f *FTPFS) statFile(c *ftpConn, p string) (FileInfo, error) {
+	_, msg, err := c.cmd(213, "SIZE %s", p)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+	if err != nil || size < 0 {
+		return FileInfo{}, fmt.Errorf("FTP: malformed SIZE reply %q", msg)
+	}
+	modTime, err := f.mdtm(c, p)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Name: path.Base(p), Size: size, Mode: 0644, ModTime: modTime}, nil
+}
+
+func (f *FTPFS) Stat(p string) (FileInfo, error) {
+	p = ftpPath(p)
+	var info FileInfo
+	err := f.do(func(c *ftpConn) (err error) {
+		info, err = f.stat(c, p)
+		return err
+	})
+	if err != nil {
+		return FileInfo{}, ftpError("stat", p, err)
+	}
+	return info, nil
+}
+
+// Walk walks the tree rooted at root in lexical order.
+func (f *FTPFS) Walk(root string, fn WalkFunc) error {
+	info, err := f.Stat(root)
+	if err != nil {
+		return fn(root, FileInfo{}, err)
+	}
+	return f.walk(root, info, fn)
+}
+
+func (f *FTPFS) walk(p string, info FileInfo, fn WalkFunc) error {
+	if err := fn(p, info, nil); err != nil {
+		if info.IsDir && errors.Is(err, filepath.SkipDir) {
+			return nil
+		}
+		return err
+	}
+	if !info.IsDir {
+		return nil
+	}
+
+	var entries []FileInfo
+	err := f.do(func(c *ftpConn) (err error) {
+		entries, err = f.list(c, ftpPath(p))
+		return err
+	})
+	if err != nil {
+		return fn(p, info, ftpError("readdir", p, err))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	for _, entry := range entries {
+		if err := f.walk(path.Join(p, entry.Name), entry, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *FTPFS) Open(p string) (io.ReadCloser, error) {
+	p = ftpPath(p)
+	c, data, err := f.startTransfer("RETR %s", p)
+	if err != nil {
+		return nil, ftpError("open", p, err)
+	}
+	return &ftpReader{fs: f, c: c, data: data}, nil
+}
+
+func (f *FTPFS) Create(p string) (io.WriteCloser, error) {
+	p = ftpPath(p)
+	c, data, err := f.startTransfer("STOR %s", p)
+	if err != nil {
+		return nil, ftpError("create", p, err)
+	}
+	return &ftpWriter{fs: f, c: c, data: data, path: p}, nil
+}
+
+// startTransfer takes a connection from the pool for the length of a file
+// transfer.
+func (f *FTPFS) startTransfer(format string, p string) (*ftpConn, net.Conn, error) {
+	c, reused, err := f.get()
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := f.transfer(c, format, p)
+	if reused && isFTPConnectionError(err) {
+		c.text.Close()
+		if c, err = f.dial(); err != nil {
+			return nil, nil, err
+		}
+		data, err = f.transfer(c, format, p)
+	}
+	if err != nil {
+		if isFTPConnectionError(err) {
+			c.text.Close()
+		} else {
+			f.put(c)
+		}
+		return nil, nil, err
+	}
+	return c, data, nil
+}
+
+// release returns c to the pool, or closes it if the transfer left it in an
+// unknown state.
+func (f *FTPFS) release(c *ftpConn, err error) {
+	if err != nil {
+		c.text.Close()
+		return
+	}
+	f.put(c)
+}
+
+type ftpReader struct {
+	fs   *FTPFS
+	c    *ftpConn
+	data net.Conn
+	eof  bool
+	once sync.Once
+	err  error
+}
+
+func (r *ftpReader) Read(p []byte) (int, error) {
+	n, err := r.data.Read(p)
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+func (r *ftpReader) Close() error {
+	r.once.Do(func() {
+		r.data.Close()
+		err := r.c.finish()
+		r.fs.release(r.c, err)
+		// Closing early makes servers report an aborted transfer, which
+		// isn't an error for the reader.
+		if r.eof {
+			r.err = err
+		}
+	})
+	return r.err
+}
+
+type ftpWriter struct {
+	fs   *FTPFS
+	c    *ftpConn
+	data net.Conn
+	path string
+	once sync.Once
+	err  error
+}
+
+func (w *ftpWriter) Write(p []byte) (int, error) {
+	return w.data.Write(p)
+}
+
+func (w *ftpWriter) Close() error {
+	w.once.Do(func() {
+		w.data.Close()
+		w.err = w.c.finish()
+		w.fs.release(w.c, w.err)
+	})
+	return w.err
+}
+
+// Abort ends the upload and removes the partial file.
+func (w *ftpWriter) Abort() error {
+	w.Close()
+	return w.fs.Remove(w.path)
+}
+
+// Remove deletes a file, or an empty directory.
+func (f *FTPFS) Remove(p string) error {
+	p = ftpPath(p)
+	err := f.do(func(c *ftpConn) error {
+		_, _, err := c.cmd(250, "DELE %s", p)
+		if ftpCode(err) == 550 {
+			if _, _, rmdErr := c.cmd(250, "RMD %s", p); rmdErr == nil {
+				return nil
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return ftpError("remove", p, err)
+	}
+	return nil
+}
+
+func (f *FTPFS) MkdirAll(p string, perm os.FileMode) error {
+	p = ftpPath(p)
+	err := f.do(func(c *ftpConn) error {
+		if info, err := f.stat(c, p); err == nil {
+			if !info.IsDir {
+				return fmt.Errorf("not a directory")
+			}
+			return nil
+		} else if isFTPConnectionError(err) {
+			return err
+		}
+
+		dir := ""
+		for _, name := range strings.Split(strings.Trim(p, "/"), "/") {
+			dir += "/" + name
+			if _, _, err := c.cmd(257, "MKD %s", dir); err != nil {
+				if isFTPConnectionError(err) {
+					return err
+				}
+				// It may exist already.
+				info, statErr := f.stat(c, dir)
+				if statErr != nil || !info.IsDir {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return ftpError("mkdir", p, err)
+	}
+	return nil
+}
+
+// Chmod sets the mode with SITE CHMOD. Servers that don't implement it are
+// left alone.
+func (f *FTPFS) Chmod(p string, mode os.FileMode) error {
+	f.mu.Lock()
+	skip := f.noChmod
+	f.mu.Unlock()
+	if skip {
+		return nil
+	}
+
+	p = ftpPath(p)
+	err := f.do(func(c *ftpConn) error {
+		_, _, err := c.cmd(200, "SITE CHMOD %04o %s", uint32(mode.Perm()), p)
+		return err
+	})
+	switch code := ftpCode(err); {
+	case code == 500 || code == 502 || code == 504:
+		f.mu.Lock()
+		f.noChmod = true
+		f.mu.Unlock()
+		return nil
+	case err != nil:
+		return ftpError("chmod", p, err)
+	}
+	return nil
+}
+
+// Chtimes sets the modification time with MFMT. Without it the upload time
+// stays, so metadata comparison will see the file as changed next time.
+func (f *FTPFS) Chtimes(p string, atime, mtime time.Time) error {
+	if !f.supports("MFMT") {
+		f.mu.Lock()
+		warn := !f.warnedMtime
+		f.warnedMtime = true
+		f.mu.Unlock()
+		if warn && f.cfg.Logger != nil {
+			f.cfg.Logger.Warn("%s cannot set modification times (no MFMT); consider --checksum", f.cfg.Host)
+		}
+		return nil
+	}
+
+	p = ftpPath(p)
+	err := f.do(func(c *ftpConn) error {
+		_, _, err := c.cmd(213, "MFMT %s %s", formatFTPTime(mtime), p)
+		return err
+	})
+	if err != nil {
+		return ftpError("chtimes", p, err)
+	}
+	return nil
+}
+
+func (f *FTPFS) Close() error {
+	f.mu.Lock()
+	idle := f.idle
+	f.idle = nil
+	f.mu.Unlock()
+
+	for _, c := range idle {
+		c.cmd(221, "QUIT")
+		c.text.Close()
+	}
+	return nil
+}
+
+// Separator returns '/', which FTP paths always use.
+func (f *FTPFS) Separator() byte {
+	return '/'
+}
@@ -0,0 +1,883 @@
+package fs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/textproto"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeFTP is an in-process FTP server serving a MemFS. The zero value
+// supports MLSD, EPSV, SIZE, MDTM, MFMT and SITE CHMOD; the no* fields turn
+// them off to exercise fallbacks.
+type fakeFTP struct {
+	fs       *MemFS
+	user     string
+	password string
+
+	tls      *tls.Config
+	implicit bool
+
+	noMLSD  bool
+	noEPSV  bool
+	noSIZE  bool
+	noMFMT  bool
+	noChmod bool
+	dosList bool
+
+	listener net.Listener
+	mu       sync.Mutex
+	logins   int
+	commands []string
+}
+
+func (s *fakeFTP) start(t *testing.T) {
+	t.Helper()
+
+	if s.fs == nil {
+		s.fs = NewMemFS()
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	s.listener = listener
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+}
+
+func (s *fakeFTP) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeFTP) loginCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.logins
+}
+
+func (s *fakeFTP) saw(prefix string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, cmd := range s.commands {
+		if strings.HasPrefix(cmd, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *fakeFTP) serve(conn net.Conn) {
+	defer conn.Close()
+
+	if s.implicit {
+		conn = tls.Server(conn, s.tls)
+	}
+	text := textproto.NewConn(conn)
+	reply := func(code int, format string, args ...any) {
+		text.PrintfLine("%d %s", code, fmt.Sprintf(format, args...))
+	}
+
+	var (
+		pasv      net.Listener
+		user      string
+		loggedIn  bool
+		protected = s.implicit
+	)
+	defer func() {
+		if pasv != nil {
+			pasv.Close()
+		}
+	}()
+
+	// accept takes the data connection of a transfer.
+	accept := func() (net.Conn, bool) {
+		if pasv == nil {
+			reply(425, "use PASV or EPSV first")
+			return nil, false
+		}
+		if s.tls != nil && !protected {
+			reply(521, "data connections must be protected")
+			return nil, false
+		}
+		reply(150, "opening data connection")
+		data, err := pasv.Accept()
+		pasv.Close()
+		pasv = nil
+		if err != nil {
+			reply(425, "cannot open data connection")
+			return nil, false
+		}
+		if protected {
+			data = tls.Server(data, s.tls)
+		}
+		return data, true
+	}
+
+	reply(220, "fake FTP ready")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(line, " ")
+		cmd = strings.ToUpper(cmd)
+
+		s.mu.Lock()
+		s.commands = append(s.commands, line)
+		s.mu.Unlock()
+
+		if !loggedIn && cmd != "USER" && cmd != "PASS" && cmd != "AUTH" && cmd != "QUIT" && cmd != "FEAT" {
+			reply(530, "not logged in")
+			continue
+		}
+
+		switch cmd {
+		case "AUTH":
+			if s.tls == nil || s.implicit {
+				reply(502, "TLS not available")
+				continue
+			}
+			reply(234, "proceed with TLS")
+			conn = tls.Server(conn, s.tls)
+			text = textproto.NewConn(conn)
+		case "USER":
+			user = arg
+			reply(331, "password required")
+		case "PASS":
+			if user != s.user || arg != s.password {
+				reply(530, "login incorrect")
+				continue
+			}
+			loggedIn = true
+			s.mu.Lock()
+			s.logins++
+			s.mu.Unlock()
+			reply(230, "logged in")
+		case "PBSZ":
+			reply(200, "PBSZ=0")
+		case "PROT":
+			protected = arg == "P"
+			reply(200, "protection set")
+		case "TYPE":
+			reply(200, "type set")
+		case "FEAT":
+			lines := []string{"211-Features:", " MDTM", " UTF8"}
+			if !s.noSIZE {
+				lines = append(lines, " SIZE")
+			}
+			if !s.noMLSD {
+				lines = append(lines, " MLST type*;size*;modify*;unix.mode*;")
+			}
+			if !s.noMFMT {
+				lines = append(lines, " MFMT")
+			}
+			for _, l := range lines {
+				text.PrintfLine("%s", l)
+			}
+			reply(211, "End")
+		case "EPSV", "PASV":
+			if cmd == "EPSV" && s.noEPSV {
+				reply(502, "EPSV not implemented")
+				continue
+			}
+			if pasv != nil {
+				pasv.Close()
+			}
+			if pasv, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				reply(425, "cannot listen")
+				continue
+			}
+			port := pasv.Addr().(*net.TCPAddr).Port
+			if cmd == "EPSV" {
+				reply(229, "Entering Extended Passive Mode (|||%d|)", port)
+			} else {
+				// Report a bogus address, as servers behind NAT do.
+				reply(227, "Entering Passive Mode (10,0,0,1,%d,%d)", port>>8, port&0xff)
+			}
+		case "MLST":
+			if s.noMLSD {
+				reply(500, "unknown command")
+				continue
+			}
+			info, err := s.fs.Stat(arg)
+			if err != nil {
+				reply(550, "no such file")
+				continue
+			}
+			text.PrintfLine("250-Listing %s", arg)
+			text.PrintfLine(" %s %s", mlsxFacts(info), arg)
+			reply(250, "End")
+		case "MLSD", "LIST":
+			if cmd == "MLSD" && s.noMLSD {
+				reply(500, "unknown command")
+				continue
+			}
+			entries, err := s.children(arg)
+			if err != nil {
+				reply(550, "no such directory")
+				continue
+			}
+			data, ok := accept()
+			if !ok {
+				continue
+			}
+			for _, info := range entries {
+				switch {
+				case cmd == "MLSD":
+					fmt.Fprintf(data, "%s %s\r\n", mlsxFacts(info), info.Name)
+				case s.dosList:
+					fmt.Fprintf(data, "%s\r\n", dosListLine(info))
+				default:
+					fmt.Fprintf(data, "%s\r\n", unixListLine(info))
+				}
+			}
+			data.Close()
+			reply(226, "transfer complete")
+		case "SIZE":
+			if s.noSIZE {
+				reply(500, "unknown command")
+				continue
+			}
+			info, err := s.fs.Stat(arg)
+			if err != nil || info.IsDir {
+				reply(550, "not a plain file")
+				continue
+			}
+			reply(213, "%d", info.Size)
+		case "MDTM":
+			info, err := s.fs.Stat(arg)
+			if err != nil || info.IsDir {
+				reply(550, "no such file")
+				continue
+			}
+			reply(213, "%s", info.ModTime.UTC().Format("20060102150405"))
+		case "MFMT":
+			stamp, p, _ := strings.Cut(arg, " ")
+			modTime, err := time.Parse("20060102150405", stamp)
+			if s.noMFMT || err != nil {
+				reply(500, "unknown command")
+				continue
+			}
+			if err := s.fs.Chtimes(p, modTime, modTime); err != nil {
+				reply(550, "no such file")
+				continue
+			}
+			reply(213, "Modify=%s; %s", stamp, p)
+		case "SITE":
+			fields := strings.SplitN(arg, " ", 3)
+			if s.noChmod || len(fields) != 3 || strings.ToUpper(fields[0]) != "CHMOD" {
+				reply(500, "unknown SITE command")
+				continue
+			}
+			mode, err := strconv.ParseUint(fields[1], 8, 32)
+			if err != nil {
+				reply(501, "bad mode")
+				continue
+			}
+			if err := s.fs.Chmod(fields[2], os.FileMode(mode)); err != nil {
+				reply(550, "no such file")
+				continue
+			}
+			reply(200, "mode changed")
+		case "RETR":
+			content, err := s.fs.ReadFile(arg)
+			if err != nil {
+				reply(550, "no such file")
+				continue
+			}
+			data, ok := accept()
+			if !ok {
+				continue
+			}
+			data.Write(content)
+			data.Close()
+			reply(226, "transfer complete")
+		case "STOR":
+			if info, err := s.fs.Stat(path.Dir(arg)); err != nil || !info.IsDir {
+				reply(550, "no such directory")
+				continue
+			}
+			data, ok := accept()
+			if !ok {
+				continue
+			}
+			content, err := io.ReadAll(data)
+			data.Close()
+			if err != nil {
+				reply(426, "transfer aborted")
+				continue
+			}
+			s.fs.WriteFile(arg, content, 0644, time.Now())
+			reply(226, "transfer complete")
+		case "DELE":
+			if info, err := s.fs.Stat(arg); err != nil || info.IsDir {
+				reply(550, "not a file")
+				continue
+			}
+			s.fs.Remove(arg)
+			reply(250, "deleted")
+		case "RMD":
+			if info, err := s.fs.Stat(arg); err != nil || !info.IsDir {
+				reply(550, "not a directory")
+				continue
+			}
+			if err := s.fs.Remove(arg); err != nil {
+				reply(550, "directory not empty")
+				continue
+			}
+			reply(250, "removed")
+		case "MKD":
+			if _, err := s.fs.Stat(arg); err == nil {
+				reply(550, "exists")
+				continue
+			}
+			if info, err := s.fs.Stat(path.Dir(arg)); err != nil || !info.IsDir {
+				reply(550, "no such directory")
+				continue
+			}
+			s.fs.MkdirAll(arg, 0755)
+			reply(257, "%q created", arg)
+		case "QUIT":
+			reply(221, "bye")
+			return
+		default:
+			reply(502, "not implemented")
+		}
+	}
+}
+
+func (s *fakeFTP) children(dir string) ([]FileInfo, error) {
+	dir = path.Clean("/" + dir)
+	var entries []FileInfo
+	err := s.fs.Walk(dir, func(p string, info FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == dir {
+			return nil
+		}
+		entries = append(entries, info)
+		if info.IsDir {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func mlsxFacts(info FileInfo) string {
+	kind := "file"
+	if info.IsDir {
+		kind = "dir"
+	}
+	return fmt.Sprintf("type=%s;size=%d;modify=%s;unix.mode=%04o;",
+		kind, info.Size, info.ModTime.UTC().Format("20060102150405"), uint32(info.Mode.Perm()))
+}
+
+func unixListLine(info FileInfo) string {
+	return fmt.Sprintf("%s 1 owner group %8d %s %s", info.Mode.String(), info.Size, info.ModTime.UTC().Format("Jan _2  2006"), info.Name)
+}
+
+func dosListLine(info FileInfo) string {
+	size := "<DIR>"
+	if !info.IsDir {
+		size = strconv.FormatInt(info.Size, 10)
+	}
+	return fmt.Sprintf("%s  %14s %s", info.ModTime.UTC().Format("01-02-06  03:04PM"), size, info.Name)
+}
+
+// newTestTLS returns a server config with a self-signed certificate for
+// 127.0.0.1 and a client config trusting it.
+func newTestTLS(t *testing.T) (server, client *tls.Config) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parsing certificate: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	client = &tls.Config{RootCAs: pool}
+	return server, client
+}
+
+func newTestFTPFS(t *testing.T, server *fakeFTP, cfg FTPConfig) *FTPFS {
+	t.Helper()
+
+	if server.user == "" {
+		server.user, server.password = "user", "secret"
+	}
+	server.start(t)
+
+	cfg.Host = "127.0.0.1"
+	cfg.Port = server.port()
+	if cfg.User == "" {
+		cfg.User, cfg.Password = server.user, server.password
+	}
+	cfg.Timeout = 5 * time.Second
+	f, err := NewFTPFS(cfg)
+	if err != nil {
+		t.Fatalf("NewFTPFS failed: %v", err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func walkFTP(t *testing.T, f *FTPFS, root string) []string {
+	t.Helper()
+
+	var got []string
+	err := f.Walk(root, func(p string, info FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		entry := p
+		if info.IsDir {
+			entry += "/"
+		} else {
+			entry += fmt.Sprintf(" %d", info.Size)
+		}
+		got = append(got, entry)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk failed: %v", err)
+	}
+	return got
+}
+
+func testFTPRoundTrip(t *testing.T, server *fakeFTP, cfg FTPConfig) {
+	f := newTestFTPFS(t, server, cfg)
+
+	if err := f.MkdirAll("/data/sub dir", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	writeFile(t, f, "/data/a.txt", []byte("alpha"))
+	writeFile(t, f, "/data/sub dir/b.txt", []byte("bravo!"))
+
+	modTime := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	if err := f.Chtimes("/data/a.txt", modTime, modTime); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+	if err := f.Chmod("/data/a.txt", 0600); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+
+	info, err := f.Stat("/data/a.txt")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Name != "a.txt" || info.Size != 5 || !info.ModTime.Equal(modTime) || info.Mode.Perm() != 0600 || info.IsDir {
+		t.Errorf("Stat = %+v, want a.txt, 5 bytes, %v, 0600", info, modTime)
+	}
+	if info, err := f.Stat("/data/sub dir"); err != nil || !info.IsDir {
+		t.Errorf("Stat(dir) = %+v, %v; want directory", info, err)
+	}
+	if _, err := f.Stat("/data/missing"); !os.IsNotExist(err) {
+		t.Errorf("Stat(missing) = %v, want not-exist error", err)
+	}
+
+	got := walkFTP(t, f, "/data")
+	want := []string{"/data/", "/data/a.txt 5", "/data/sub dir/", "/data/sub dir/b.txt 6"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Walk = %v, want %v", got, want)
+	}
+
+	if content, err := readFile(f, "/data/sub dir/b.txt"); err != nil || string(content) != "bravo!" {
+		t.Errorf("content = %q, %v, want %q", content, err, "bravo!")
+	}
+
+	if err := f.Remove("/data/sub dir/b.txt"); err != nil {
+		t.Fatalf("Remove(file) failed: %v", err)
+	}
+	if err := f.Remove("/data/sub dir"); err != nil {
+		t.Fatalf("Remove(dir) failed: %v", err)
+	}
+	if _, err := server.fs.Stat("/data/sub dir"); !os.IsNotExist(err) {
+		t.Errorf("directory still exists: %v", err)
+	}
+}
+
+func TestFTPFS_RoundTrip(t *testing.T) {
+	testFTPRoundTrip(t, &fakeFTP{}, FTPConfig{})
+}
+
+func TestFTPFS_ListFallback(t *testing.T) {
+	server := &fakeFTP{noMLSD: true, noEPSV: true, noSIZE: true}
+	testFTPRoundTrip(t, server, FTPConfig{})
+
+	if !server.saw("LIST") || !server.saw("PASV") || server.saw("MLSD") {
+		t.Error("expected LIST over PASV without MLSD")
+	}
+}
+
+func TestFTPFS_StatWithSizeAndMDTM(t *testing.T) {
+	server := &fakeFTP{noMLSD: true}
+	f := newTestFTPFS(t, server, FTPConfig{})
+
+	modTime := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	for i := range 10 {
+		server.fs.WriteFile(fmt.Sprintf("/dir/%d.txt", i), []byte("12345"), 0600, modTime)
+	}
+
+	info, err := f.Stat("/dir/3.txt")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Name != "3.txt" || info.Size != 5 || !info.ModTime.Equal(modTime) || info.Mode != 0644 {
+		t.Errorf("Stat = %+v, want 3.txt, 5 bytes, %v, 0644", info, modTime)
+	}
+	if !server.saw("SIZE /dir/3.txt") || !server.saw("MDTM /dir/3.txt") || server.saw("LIST") {
+		t.Error("expected SIZE and MDTM without listing the directory")
+	}
+
+	if got := walkFTP(t, f, "/dir"); len(got) != 11 {
+		t.Errorf("Walk = %v, want the directory and 10 files", got)
+	}
+	if server.saw("MDTM /dir/0.txt") {
+		t.Error("Walk looked up the time of every file")
+	}
+
+	if info, err := f.Stat("/dir"); err != nil || !info.IsDir {
+		t.Errorf("Stat(dir) = %+v, %v; want directory", info, err)
+	}
+	if _, err := f.Stat("/dir/missing"); !os.IsNotExist(err) {
+		t.Errorf("Stat(missing) = %v, want not-exist error", err)
+	}
+}
+
+func TestFTPFS_DOSListing(t *testing.T) {
+	server := &fakeFTP{noMLSD: true, dosList: true}
+	f := newTestFTPFS(t, server, FTPConfig{})
+
+	modTime := time.Date(2023, 5, 6, 7, 8, 9, 0, time.UTC)
+	server.fs.WriteFile("/dir/file.txt", []byte("12345"), 0644, modTime)
+
+	got := walkFTP(t, f, "/dir")
+	if want := []string{"/dir/", "/dir/file.txt 5"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Walk = %v, want %v", got, want)
+	}
+	if info, err := f.Stat("/dir/file.txt"); err != nil || !info.ModTime.Equal(modTime) {
+		t.Errorf("Stat = %+v, %v; want modTime %v from MDTM", info, err, modTime)
+	}
+}
+
+func TestFTPFS_WithoutMFMTAndChmod(t *testing.T) {
+	server := &fakeFTP{noMFMT: true, noChmod: true}
+	f := newTestFTPFS(t, server, FTPConfig{})
+	writeFile(t, f, "/file.txt", []byte("x"))
+
+	if err := f.Chtimes("/file.txt", time.Unix(0, 0), time.Unix(0, 0)); err != nil {
+		t.Errorf("Chtimes without MFMT = %v, want nil", err)
+	}
+	if err := f.Chmod("/file.txt", 0600); err != nil {
+		t.Errorf("Chmod without SITE CHMOD = %v, want nil", err)
+	}
+	if err := f.Chmod("/file.txt", 0600); err != nil {
+		t.Errorf("second Chmod = %v, want nil", err)
+	}
+	if server.saw("MFMT") {
+		t.Error("MFMT sent although the server doesn't advertise it")
+	}
+}
+
+func TestFTPFS_ExplicitTLS(t *testing.T) {
+	serverTLS, clientTLS := newTestTLS(t)
+	server := &fakeFTP{tls: serverTLS}
+	testFTPRoundTrip(t, server, FTPConfig{TLS: FTPExplicitTLS, TLSConfig: clientTLS})
+
+	if !server.saw("AUTH TLS") || !server.saw("PROT P") {
+		t.Error("expected AUTH TLS and PROT P")
+	}
+}
+
+func TestFTPFS_ImplicitTLS(t *testing.T) {
+	serverTLS, clientTLS := newTestTLS(t)
+	testFTPRoundTrip(t, &fakeFTP{tls: serverTLS, implicit: true}, FTPConfig{TLS: FTPImplicitTLS, TLSConfig: clientTLS})
+}
+
+func TestFTPFS_UntrustedCertificate(t *testing.T) {
+	serverTLS, _ := newTestTLS(t)
+	server := &fakeFTP{tls: serverTLS, user: "user", password: "secret"}
+	server.start(t)
+
+	_, err := NewFTPFS(FTPConfig{Host: "127.0.0.1", Port: server.port(), User: "user", Password: "secret", TLS: FTPExplicitTLS})
+	if err == nil {
+		t.Error("NewFTPFS should reject an untrusted certificate")
+	}
+}
+
+func TestFTPFS_LoginFailure(t *testing.T) {
+	server := &fakeFTP{user: "user", password: "secret"}
+	server.start(t)
+
+	_, err := NewFTPFS(FTPConfig{Host: "127.0.0.1", Port: server.port(), User: "user", Password: "wrong"})
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) || protoErr.Code != 530 {
+		t.Errorf("NewFTPFS = %v, want 530 reply", err)
+	}
+}
+
+func TestFTPFS_AnonymousIgnoresPassword(t *testing.T) {
+	server := &fakeFTP{user: "anonymous", password: "anonymous@"}
+	server.start(t)
+
+	f, err := NewFTPFS(FTPConfig{
+		Host:     "127.0.0.1",
+		Port:     server.port(),
+		Password: "ssh-secret",
+		PasswordPrompt: func(user, host string) (string, error) {
+			t.Error("prompted for an anonymous login")
+			return "", nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewFTPFS failed: %v", err)
+	}
+	f.Close()
+	if server.saw("PASS ssh-secret") {
+		t.Error("the configured password was sent for an anonymous login")
+	}
+}
+
+func TestFTPConfigFor_Password(t *testing.T) {
+	opts := Options{Password: "ssh", FTPPassword: "ftp"}
+	cfg, err := ftpConfigFor(mustParsePath(t, "ftp://user@host/path"), opts)
+	if err != nil {
+		t.Fatalf("ftpConfigFor failed: %v", err)
+	}
+	if cfg.Password != "ftp" {
+		t.Errorf("Password = %q, want the FTP password", cfg.Password)
+	}
+}
+
+func TestFTPFS_PromptsForPassword(t *testing.T) {
+	prompts := 0
+	newTestFTPFS(t, &fakeFTP{}, FTPConfig{
+		User: "user",
+		PasswordPrompt: func(user, host string) (string, error) {
+			prompts++
+			return "secret", nil
+		},
+	})
+	if prompts != 1 {
+		t.Errorf("prompted %d times, want 1", prompts)
+	}
+}
+
+func TestFTPFS_ConcurrentTransfers(t *testing.T) {
+	server := &fakeFTP{}
+	f := newTestFTPFS(t, server, FTPConfig{})
+	writeFile(t, f, "/a.txt", []byte("alpha"))
+
+	r, err := f.Open("/a.txt")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	// A second transfer while the first is open needs its own connection.
+	writeFile(t, f, "/b.txt", []byte("bravo"))
+	data, _ := io.ReadAll(r)
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if string(data) != "alpha" {
+		t.Errorf("content = %q, want %q", data, "alpha")
+	}
+	if n := server.loginCount(); n != 2 {
+		t.Errorf("logins = %d, want 2", n)
+	}
+
+	// Both connections are reused afterwards.
+	for _, p := range []string{"/b.txt", "/a.txt"} {
+		if _, err := readFile(f, p); err != nil {
+			t.Fatalf("reading %s failed: %v", p, err)
+		}
+	}
+	if n := server.loginCount(); n != 2 {
+		t.Errorf("logins = %d after reuse, want 2", n)
+	}
+}
+
+func TestFTPFS_Abort(t *testing.T) {
+	server := &fakeFTP{}
+	f := newTestFTPFS(t, server, FTPConfig{})
+
+	w, err := f.Create("/partial.txt")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	io.WriteString(w, "half")
+	if err := w.(Aborter).Abort(); err != nil {
+		t.Fatalf("Abort failed: %v", err)
+	}
+	if _, err := server.fs.Stat("/partial.txt"); !os.IsNotExist(err) {
+		t.Errorf("partial file still exists: %v", err)
+	}
+}
+
+func TestParseListLine(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		line string
+		want FileInfo
+		ok   bool
+	}{
+		{
+			line: "-rw-r--r--   1 owner group      1234 Mar  9 08:15 file.txt",
+			want: FileInfo{Name: "file.txt", Size: 1234, Mode: 0644, ModTime: time.Date(2024, 3, 9, 8, 15, 0, 0, time.UTC)},
+			ok:   true,
+		},
+		{
+			line: "-rwxr-x---   1 owner group        10 Dec 24 18:00 last year.sh",
+			want: FileInfo{Name: "last year.sh", Size: 10, Mode: 0750, ModTime: time.Date(2023, 12, 24, 18, 0, 0, 0, time.UTC)},
+			ok:   true,
+		},
+		{
+			line: "drwxr-xr-x   2 owner group      4096 Jan  2  2006 old dir",
+			want: FileInfo{Name: "old dir", Mode: os.ModeDir | 0755, ModTime: time.Date(2006, 1, 2, 0, 0, 0, 0, time.UTC), IsDir: true},
+			ok:   true,
+		},
+		{
+			line: "lrwxrwxrwx   1 owner group        11 Jan  2  2006 link -> target",
+		},
+		{
+			line: "01-02-06  03:04PM       <DIR>          Windows Dir",
+			want: FileInfo{Name: "Windows Dir", Mode: os.ModeDir | 0755, ModTime: time.Date(2006, 1, 2, 15, 4, 0, 0, time.UTC), IsDir: true},
+			ok:   true,
+		},
+		{
+			line: "01-02-2006  09:30           5678 report.doc",
+			want: FileInfo{Name: "report.doc", Size: 5678, Mode: 0644, ModTime: time.Date(2006, 1, 2, 9, 30, 0, 0, time.UTC)},
+			ok:   true,
+		},
+		{line: "total 12"},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseListLine(tt.line, now)
+		if ok != tt.ok {
+			t.Errorf("parseListLine(%q) ok = %v, want %v", tt.line, ok, tt.ok)
+			continue
+		}
+		if ok && (got.Name != tt.want.Name || got.Size != tt.want.Size || got.Mode != tt.want.Mode ||
+			!got.ModTime.Equal(tt.want.ModTime) || got.IsDir != tt.want.IsDir) {
+			t.Errorf("parseListLine(%q) = %+v, want %+v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseMLSxEntry(t *testing.T) {
+	info, ok := parseMLSxEntry("type=file;size=42;modify=20240102150405.123;UNIX.mode=0640; name with space.txt")
+	if !ok {
+		t.Fatal("parseMLSxEntry rejected a file entry")
+	}
+	want := time.Date(2024, 1, 2, 15, 4, 5, 123e6, time.UTC)
+	if info.Name != "name with space.txt" || info.Size != 42 || info.Mode != 0640 || !info.ModTime.Equal(want) {
+		t.Errorf("parseMLSxEntry = %+v", info)
+	}
+
+	for _, line := range []string{"type=cdir;modify=20240102150405; .", "type=pdir; ..", "type=OS.unix=slink:/x; link", "garbage"} {
+		if _, ok := parseMLSxEntry(line); ok {
+			t.Errorf("parseMLSxEntry(%q) should be skipped", line)
+		}
+	}
+}
+
+func TestParsePassiveReplies(t *testing.T) {
+	if port, err := parseEPSV("Entering Extended Passive Mode (|||6446|)"); err != nil || port != 6446 {
+		t.Errorf("parseEPSV = %d, %v; want 6446", port, err)
+	}
+	if port, err := parsePASV("Entering Passive Mode (192,168,1,2,19,137)"); err != nil || port != 19<<8|137 {
+		t.Errorf("parsePASV = %d, %v; want %d", port, err, 19<<8|137)
+	}
+	if port, err := parsePASV("Entering Passive Mode 192,168,1,2,0,21"); err != nil || port != 21 {
+		t.Errorf("parsePASV without parentheses = %d, %v; want 21", port, err)
+	}
+	for _, msg := range []string{"(|||0|)", "nonsense", "(1,2,3)"} {
+		if _, err := parseEPSV(msg); err == nil {
+			t.Errorf("parseEPSV(%q) should fail", msg)
+		}
+	}
+	if _, err := parsePASV("(1,2,3,4,999,1)"); err == nil {
+		t.Error("parsePASV should reject out-of-range port bytes")
+	}
+}
+
+func TestFTPConfigFor_TLS(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want FTPTLS
+	}{
+		{raw: "ftp://host/path", want: FTPPlain},
+		{raw: "ftp://host:2121/path", want: FTPPlain},
+		{raw: "ftps://host/path", want: FTPImplicitTLS},
+		{raw: "ftps://host:990/path", want: FTPImplicitTLS},
+		{raw: "ftps://host:21/path", want: FTPExplicitTLS},
+		{raw: "ftps://host/path?tls=explicit", want: FTPExplicitTLS},
+		{raw: "ftps://host:2121/path?tls=implicit", want: FTPImplicitTLS},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ftpConfigFor(mustParsePath(t, tt.raw), Options{})
+		if err != nil {
+			t.Errorf("ftpConfigFor(%s) failed: %v", tt.raw, err)
+			continue
+		}
+		if cfg.TLS != tt.want {
+			t.Errorf("ftpConfigFor(%s).TLS = %v, want %v", tt.raw, cfg.TLS, tt.want)
+		}
+	}
+
+	for _, raw := range []string{"ftps://host/path?tls=maybe", "ftp://host/path?tls=explicit"} {
+		if _, err := ftpConfigFor(mustParsePath(t, raw), Options{}); err == nil {
+			t.Errorf("ftpConfigFor(%s) should fail", raw)
+		}
+	}
+}
@@ -1,12 +1,25 @@
 package fs
 
 import (
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"time"
 )
 
+func init() {
+	Register("file", func(info PathInfo, opts Options) (FileSystem, error) {
+		if info.Host != "" {
+			return nil, fmt.Errorf("file URL names remote host %q", info.Host)
+		}
+		if err := checkQuery(info); err != nil {
+			return nil, err
+		}
+		return NewLocalFS(), nil
+	})
+}
+
 type LocalFS struct{}
 
 func NewLocalFS() *LocalFS {
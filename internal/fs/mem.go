@@ -0,0 +1,338 @@
+package fs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemFS is a FileSystem that keeps files, modes and modification times in
+// memory. It is meant for tests and for library users that sync into or out
+// of generated content. Paths use a configurable separator, so code that has
+// to handle foreign path conventions can be tested on any OS, and failures
+// can be injected per operation and path.
+type MemFS struct {
+	sep byte
+
+	mu       sync.Mutex
+	files    map[string]*memFile
+	failures []memFailure
+}
+
+type memFile struct {
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+	isDir   bool
+}
+
+type memFailure struct {
+	op   string
+	path string
+	err  error
+}
+
+// NewMemFS returns an empty MemFS using forward slashes.
+func NewMemFS() *MemFS {
+	return NewMemFSWithSeparator('/')
+}
+
+// NewMemFSWithSeparator returns an empty MemFS whose paths use sep.
+func NewMemFSWithSeparator(sep byte) *MemFS {
+	return &MemFS{
+		sep: sep,
+		files: map[string]*memFile{
+			"/": {mode: os.ModeDir | 0755, modTime: time.Now(), isDir: true},
+		},
+	}
+}
+
+// key converts p to the slash-separated, cleaned form used as map key.
+func (m *MemFS) key(p string) string {
+	if m.sep != '/' {
+		p = strings.ReplaceAll(p, string(m.sep), "/")
+	}
+	return path.Clean("/" + p)
+}
+
+// Fail makes every later call of op on p return err. op is a FileSystem
+// method name such as "Create"; an empty op or p matches any.
+func (m *MemFS) Fail(op, p string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if p != "" {
+		p = m.key(p)
+	}
+	m.failures = append(m.failures, memFailure{op: op, path: p, err: err})
+}
+
+func (m *MemFS) failure(op, key string) error {
+	for _, f := range m.failures {
+		if (f.op == "" || f.op == op) && (f.path == "" || f.path == key) {
+			return f.err
+		}
+	}
+	return nil
+}
+
+func (m *MemFS) notExist(op, p string) error {
+	return &os.PathError{Op: op, Path: p, Err: os.ErrNotExist}
+}
+
+// WriteFile creates or replaces the file at p, creating parent directories.
+func (m *MemFS) WriteFile(p string, data []byte, mode os.FileMode, modTime time.Time) error {
+	if err := m.MkdirAll(m.dir(p), 0755); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.files[m.key(p)] = &memFile{
+		data:    bytes.Clone(data),
+		mode:    mode,
+		modTime: modTime,
+	}
+	return nil
+}
+
+// ReadFile returns the contents of the file at p.
+func (m *MemFS) ReadFile(p string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, ok := m.files[m.key(p)]
+	if !ok || f.isDir {
+		return nil, m.notExist("open", p)
+	}
+	return bytes.Clone(f.data), nil
+}
+
+func (m *MemFS) dir(p string) string {
+	i := strings.LastIndexByte(p, m.sep)
+	if i <= 0 {
+		return string(m.sep)
+	}
+	return p[:i]
+}
+
+func (m *MemFS) info(key string, f *memFile) FileInfo {
+	return FileInfo{
+		Name:    path.Base(key),
+		Size:    int64(len(f.data)),
+		Mode:    f.mode,
+		ModTime: f.modTime,
+		IsDir:   f.isDir,
+	}
+}
+
+func (m *MemFS) Stat(p string) (FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := m.key(p)
+	if err := m.failure("Stat", key); err != nil {
+		return FileInfo{}, err
+	}
+	f, ok := m.files[key]
+	if !ok {
+		return FileInfo{}, m.notExist("stat", p)
+	}
+	return m.info(key, f), nil
+}
+
+// Walk walks the tree rooted at root in lexical order. Paths passed to fn are
+// root joined with the entry names using the filesystem's separator.
+func (m *MemFS) Walk(root string, fn WalkFunc) error {
+	m.mu.Lock()
+	rootKey := m.key(root)
+	if err := m.failure("Walk", rootKey); err != nil {
+		m.mu.Unlock()
+		return fn(root, FileInfo{}, err)
+	}
+	var keys []string
+	for key := range m.files {
+		if key == rootKey || strings.HasPrefix(key, strings.TrimSuffix(rootKey, "/")+"/") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		// Compare component-wise so a directory's contents follow it directly.
+		return strings.ReplaceAll(keys[i], "/", "\x00") < strings.ReplaceAll(keys[j], "/", "\x00")
+	})
+	infos := make([]FileInfo, len(keys))
+	for i, key := range keys {
+		infos[i] = m.info(key, m.files[key])
+	}
+	m.mu.Unlock()
+
+	if len(keys) == 0 {
+		return fn(root, FileInfo{}, m.notExist("lstat", root))
+	}
+
+	var skip string
+	for i, key := range keys {
+		if skip != "" && strings.HasPrefix(key, skip) {
+			continue
+		}
+		p := root
+		if rel := strings.TrimPrefix(strings.TrimPrefix(key, rootKey), "/"); rel != "" {
+			p = strings.TrimSuffix(root, string(m.sep)) + string(m.sep) + strings.ReplaceAll(rel, "/", string(m.sep))
+		}
+		if err := fn(p, infos[i], nil); err != nil {
+			if infos[i].IsDir && errors.Is(err, filepath.SkipDir) {
+				skip = strings.TrimSuffix(key, "/") + "/"
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemFS) Open(p string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := m.key(p)
+	if err := m.failure("Open", key); err != nil {
+		return nil, err
+	}
+	f, ok := m.files[key]
+	if !ok || f.isDir {
+		return nil, m.notExist("open", p)
+	}
+	return io.NopCloser(bytes.NewReader(bytes.Clone(f.data))), nil
+}
+
+func (m *MemFS) Create(p string) (io.WriteCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := m.key(p)
+	if err := m.failure("Create", key); err != nil {
+		return nil, err
+	}
+	if parent, ok := m.files[path.Dir(key)]; !ok || !parent.isDir {
+		return nil, m.notExist("open", p)
+	}
+	if f, ok := m.files[key]; ok && f.isDir {
+		return nil, &os.PathError{Op: "open", Path: p, Err: errors.New("is a directory")}
+	}
+
+	f := &memFile{mode: 0644, modTime: time.Now()}
+	m.files[key] = f
+	return &memWriter{fs: m, file: f}, nil
+}
+
+type memWriter struct {
+	fs   *MemFS
+	file *memFile
+}
+
+func (w *memWriter) Write(p []byte) (int, error) {
+	w.fs.mu.Lock()
+	defer w.fs.mu.Unlock()
+
+	w.file.data = append(w.file.data, p...)
+	w.file.modTime = time.Now()
+	return len(p), nil
+}
+
+func (w *memWriter) Close() error {
+	return nil
+}
+
+func (m *MemFS) Remove(p string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := m.key(p)
+	if err := m.failure("Remove", key); err != nil {
+		return err
+	}
+	f, ok := m.files[key]
+	if !ok {
+		return m.notExist("remove", p)
+	}
+	if f.isDir {
+		for other := range m.files {
+			if strings.HasPrefix(other, key+"/") {
+				return &os.PathError{Op: "remove", Path: p, Err: errors.New("directory not empty")}
+			}
+		}
+	}
+	delete(m.files, key)
+	return nil
+}
+
+func (m *MemFS) MkdirAll(p string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := m.key(p)
+	if err := m.failure("MkdirAll", key); err != nil {
+		return err
+	}
+	for dir := key; ; dir = path.Dir(dir) {
+		if f, ok := m.files[dir]; ok {
+			if !f.isDir {
+				return &os.PathError{Op: "mkdir", Path: p, Err: errors.New("not a directory")}
+			}
+		} else {
+			m.files[dir] = &memFile{mode: os.ModeDir | perm, modTime: time.Now(), isDir: true}
+		}
+		if dir == "/" {
+			return nil
+		}
+	}
+}
+
+func (m *MemFS) Chmod(p string, mode os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := m.key(p)
+	if err := m.failure("Chmod", key); err != nil {
+		return err
+	}
+	f, ok := m.files[key]
+	if !ok {
+		return m.notExist("chmod", p)
+	}
+	f.mode = f.mode&os.ModeType | mode.Perm()
+	return nil
+}
+
+func (m *MemFS) Chtimes(p string, atime, mtime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := m.key(p)
+	if err := m.failure("Chtimes", key); err != nil {
+		return err
+	}
+	f, ok := m.files[key]
+	if !ok {
+		return m.notExist("chtimes", p)
+	}
+	f.modTime = mtime
+	return nil
+}
+
+func (m *MemFS) Close() error {
+	return nil
+}
+
+// Separator returns the separator MemFS paths use.
+func (m *MemFS) Separator() byte {
+	return m.sep
+}
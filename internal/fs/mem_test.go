@@ -0,0 +1,153 @@
+package fs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemFS_CreateAndRead(t *testing.T) {
+	m := NewMemFS()
+
+	if err := m.MkdirAll("/dir", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	w, err := m.Create("/dir/file.txt")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	io.WriteString(w, "content")
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	r, err := m.Open("/dir/file.txt")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer r.Close()
+	data, _ := io.ReadAll(r)
+	if string(data) != "content" {
+		t.Errorf("content = %q, want %q", data, "content")
+	}
+}
+
+func TestMemFS_CreateRequiresParent(t *testing.T) {
+	m := NewMemFS()
+
+	if _, err := m.Create("/missing/file.txt"); !os.IsNotExist(err) {
+		t.Errorf("Create without parent = %v, want not-exist error", err)
+	}
+}
+
+func TestMemFS_Metadata(t *testing.T) {
+	m := NewMemFS()
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	if err := m.WriteFile("/file.txt", []byte("abc"), 0644, time.Now()); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := m.Chmod("/file.txt", 0600); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+	if err := m.Chtimes("/file.txt", modTime, modTime); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+
+	info, err := m.Stat("/file.txt")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Name != "file.txt" || info.Size != 3 || info.Mode != 0600 || !info.ModTime.Equal(modTime) || info.IsDir {
+		t.Errorf("Stat = %+v", info)
+	}
+}
+
+func TestMemFS_WalkWithSeparator(t *testing.T) {
+	m := NewMemFSWithSeparator('\\')
+	for _, p := range []string{`\root\b.txt`, `\root\a\c.txt`, `\root\a.txt`, `\other\x.txt`} {
+		if err := m.WriteFile(p, []byte(p), 0644, time.Now()); err != nil {
+			t.Fatalf("WriteFile(%s) failed: %v", p, err)
+		}
+	}
+
+	var got []string
+	err := m.Walk(`\root`, func(p string, info FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		got = append(got, p)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk failed: %v", err)
+	}
+
+	want := []string{`\root`, `\root\a`, `\root\a\c.txt`, `\root\a.txt`, `\root\b.txt`}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Walk visited %v, want %v", got, want)
+	}
+}
+
+func TestMemFS_WalkSkipDir(t *testing.T) {
+	m := NewMemFS()
+	for _, p := range []string{"/skip/a.txt", "/keep/b.txt"} {
+		if err := m.WriteFile(p, nil, 0644, time.Now()); err != nil {
+			t.Fatalf("WriteFile(%s) failed: %v", p, err)
+		}
+	}
+
+	var got []string
+	err := m.Walk("/", func(p string, info FileInfo, err error) error {
+		if p == "/skip" {
+			return filepath.SkipDir
+		}
+		got = append(got, p)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk failed: %v", err)
+	}
+
+	want := []string{"/", "/keep", "/keep/b.txt"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Walk visited %v, want %v", got, want)
+	}
+}
+
+func TestMemFS_Fail(t *testing.T) {
+	m := NewMemFS()
+	errInjected := errors.New("injected")
+	m.Fail("Create", "/bad.txt", errInjected)
+
+	if _, err := m.Create("/bad.txt"); !errors.Is(err, errInjected) {
+		t.Errorf("Create(/bad.txt) = %v, want injected error", err)
+	}
+	if _, err := m.Create("/good.txt"); err != nil {
+		t.Errorf("Create(/good.txt) failed: %v", err)
+	}
+	if _, err := m.Stat("/good.txt"); err != nil {
+		t.Errorf("Stat should not be affected by a Create failure: %v", err)
+	}
+}
+
+func TestMemFS_RemoveNonEmptyDir(t *testing.T) {
+	m := NewMemFS()
+	if err := m.WriteFile("/dir/file.txt", nil, 0644, time.Now()); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	if err := m.Remove("/dir"); err == nil {
+		t.Error("Remove of non-empty directory should fail")
+	}
+	if err := m.Remove("/dir/file.txt"); err != nil {
+		t.Errorf("Remove of file failed: %v", err)
+	}
+	if err := m.Remove("/dir"); err != nil {
+		t.Errorf("Remove of empty directory failed: %v", err)
+	}
+}
@@ -1,45 +1,275 @@
 package fs
 
-import "strings"
+import (
+	"fmt"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
 
 type PathInfo struct {
+	// Scheme selects the backend registered for it: "file" for local paths,
+	// "sftp" for [user@]host:/path, "archive" for local archives, or the
+	// scheme of a URL such as "s3".
+	Scheme   string
 	IsRemote bool
 	User     string
-	Host     string
-	Path     string
+	// Host is the host name or IP address, without brackets for IPv6.
+	Host string
+	// Port is set when a URL-style path names one.
+	Port int
+	// Query holds the options given in a URL's query string, e.g.
+	// s3://bucket/prefix?region=eu-west-1. It is nil when there are none.
+	Query url.Values
+	// Archive is the local archive file for Scheme "archive". Path is then
+	// the directory inside it.
+	Archive string
+	Path    string
 }
 
-// ParsePath parses a path string in the format [user@]host:/path or a local path.
-func ParsePath(raw string) PathInfo {
+// ParsePath parses an endpoint: a scheme://[user@]host[:port]/path?options
+// URL for any registered scheme, e.g. sftp://, s3://, ftp[s]:// or
+// webdav[s]://, a file:// URL, [user@]host:/path for SFTP, or a local path.
+// IPv6 addresses are written in brackets, e.g. user@[2001:db8::1]:/data.
+// A local .tar, .tar.gz, .tgz or .zip file refers to the root of that
+// archive.
+//
+// Inputs that could mean different things, such as host:2222:/data, are
+// rejected with an error instead of guessing, and so is a URL with an
+// unregistered scheme rather than being read as an SFTP host.
+func ParsePath(raw string) (PathInfo, error) {
+	// A single letter before :// could be a Windows drive letter (C://data).
+	if scheme, _, ok := strings.Cut(raw, "://"); ok && len(scheme) > 1 && validScheme(scheme) {
+		switch scheme = strings.ToLower(scheme); {
+		case scheme == "file":
+			return parseFileURL(raw)
+		case scheme != "archive":
+			if _, ok := lookup(scheme); ok {
+				return parseURL(raw)
+			}
+		}
+		return PathInfo{}, fmt.Errorf("%q: unsupported scheme %q, expected one of %s", raw, scheme, strings.Join(urlSchemes(), ", "))
+	}
+
+	// Like scp, the last @ before the host's colon separates the user, so
+	// user names may contain @ themselves.
+	userPart, hostPart := "", raw
+	if at := strings.LastIndex(raw[:hostEnd(raw)], "@"); at >= 0 {
+		userPart, hostPart = raw[:at], raw[at+1:]
+	}
+
+	if strings.HasPrefix(hostPart, "[") {
+		end := strings.Index(hostPart, "]")
+		if end > 0 && strings.HasPrefix(hostPart[end+1:], ":") && !strings.ContainsAny(hostPart[:end], `/\`) {
+			return parseBracketed(raw, userPart, hostPart[1:end], hostPart[end+2:])
+		}
+		if userPart != "" || end < 0 && strings.Contains(hostPart, ":") {
+			return PathInfo{}, fmt.Errorf("%q: expected [host]:path", raw)
+		}
+	}
+
 	// Look for the colon separator that indicates a remote path.
 	// We need host:/path pattern — the colon must not be part of a Windows drive letter (e.g., C:\).
-	colonIdx := strings.Index(raw, ":")
+	colonIdx := strings.Index(hostPart, ":")
 	if colonIdx < 0 {
-		return PathInfo{Path: raw}
+		return localPath(raw), nil
 	}
 
 	// A single letter before colon could be a Windows drive letter (C:\path).
-	// Remote hosts are always longer than one character.
-	hostPart := raw[:colonIdx]
-	if len(hostPart) <= 1 {
-		return PathInfo{Path: raw}
+	// Remote hosts are always longer than one character, and a colon after
+	// a path separator is part of a local file name.
+	host := hostPart[:colonIdx]
+	if userPart == "" && (len(host) <= 1 || strings.ContainsAny(host, `/\`)) {
+		return localPath(raw), nil
+	}
+	if host == "" || strings.ContainsAny(host, `/\`) {
+		return PathInfo{}, fmt.Errorf("%q: missing host before ':'", raw)
+	}
+
+	remotePath := hostPart[colonIdx+1:]
+	if err := checkAmbiguous(raw, host, remotePath); err != nil {
+		return PathInfo{}, err
 	}
 
-	remotePath := raw[colonIdx+1:]
+	return PathInfo{
+		Scheme:   "sftp",
+		IsRemote: true,
+		User:     userPart,
+		Host:     host,
+		Path:     remotePath,
+	}, nil
+}
+
+// hostEnd returns the index of the colon ending the [user@]host part of raw,
+// skipping colons in brackets, or the index of the first path separator if
+// that comes first.
+func hostEnd(raw string) int {
+	inBrackets := false
+	for i := 0; i < len(raw); i++ {
+		switch raw[i] {
+		case '[':
+			inBrackets = true
+		case ']':
+			inBrackets = false
+		case ':':
+			if !inBrackets {
+				return i
+			}
+		case '/', '\\':
+			return i
+		}
+	}
+	return len(raw)
+}
 
-	// Check for user@host
-	if atIdx := strings.Index(hostPart, "@"); atIdx >= 0 {
-		return PathInfo{
-			IsRemote: true,
-			User:     hostPart[:atIdx],
-			Host:     hostPart[atIdx+1:],
-			Path:     remotePath,
+// parseBracketed parses [host]:path, where host is usually an IPv6 address.
+func parseBracketed(raw, userPart, host, remotePath string) (PathInfo, error) {
+	if host == "" {
+		return PathInfo{}, fmt.Errorf("%q: empty host in brackets", raw)
+	}
+	if strings.Contains(host, ":") {
+		if _, err := netip.ParseAddr(host); err != nil {
+			return PathInfo{}, fmt.Errorf("%q: invalid IPv6 address %q", raw, host)
 		}
 	}
+	if port, _, ok := strings.Cut(remotePath, ":"); ok && isDigits(port) {
+		return PathInfo{}, fmt.Errorf("%q: ports can't be given in [host]:path form, use sftp://[%s]:%s/...", raw, host, port)
+	}
 
 	return PathInfo{
+		Scheme:   "sftp",
 		IsRemote: true,
-		Host:     hostPart,
+		User:     userPart,
+		Host:     host,
 		Path:     remotePath,
+	}, nil
+}
+
+// checkAmbiguous rejects host:path inputs that look like a port or an
+// unbracketed IPv6 address rather than a path.
+func checkAmbiguous(raw, host, remotePath string) error {
+	first, _, ok := strings.Cut(remotePath, ":")
+	if !ok || strings.ContainsAny(first, `/\`) {
+		return nil
+	}
+	// Digits are taken as a port even after a hex host like "cafe", which is
+	// more likely a host name than the first group of an IPv6 address.
+	if isDigits(first) {
+		return fmt.Errorf("%q is ambiguous: to use port %s write sftp://%s:%s/...", raw, first, host, first)
+	}
+	if isHex(host) && (first == "" || isHex(first)) {
+		return fmt.Errorf("%q looks like an IPv6 address, which must be written in brackets, e.g. [2001:db8::1]:/path", raw)
+	}
+	return nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// isHex reports whether s could be one group of an IPv6 address.
+func isHex(s string) bool {
+	if len(s) > 4 {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// validScheme reports whether s is a URL scheme as defined by RFC 3986.
+// urlSchemes returns the registered schemes that can be written as a URL.
+func urlSchemes() []string {
+	return slices.DeleteFunc(Schemes(), func(s string) bool { return s == "archive" })
+}
+
+func validScheme(s string) bool {
+	for i, c := range s {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		case i > 0 && ('0' <= c && c <= '9' || c == '+' || c == '-' || c == '.'):
+		default:
+			return false
+		}
+	}
+	return s != ""
+}
+
+// localPath treats a path with an archive extension as an archive, unless it
+// is an existing directory or other non-regular file.
+func localPath(raw string) PathInfo {
+	if ArchiveFormatOf(raw) != 0 && !isNonRegular(raw) {
+		return PathInfo{Scheme: "archive", Archive: raw, Path: "/"}
+	}
+	return PathInfo{Scheme: "file", Path: raw}
+}
+
+func isNonRegular(name string) bool {
+	info, err := os.Stat(name)
+	return err == nil && !info.Mode().IsRegular()
+}
+
+// parseFileURL parses a file:///path URL. On Windows file:///C:/dir names
+// the drive path C:/dir. A host other than localhost is kept in Host for
+// the file backend to reject.
+func parseFileURL(raw string) (PathInfo, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return PathInfo{}, err
+	}
+
+	p := u.Path
+	if len(p) >= 3 && p[0] == '/' && p[2] == ':' {
+		p = p[1:]
+	}
+	info := localPath(p)
+	if u.Host != "" && !strings.EqualFold(u.Host, "localhost") {
+		info.Host = u.Host
+	}
+	if u.RawQuery != "" {
+		info.Query = u.Query()
+	}
+	return info, nil
+}
+
+// parseURL parses a scheme://[user@]host[:port]/path URL. A password in the
+// URL is ignored; it would end up in shell history and process listings.
+func parseURL(raw string) (PathInfo, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return PathInfo{}, err
+	}
+	if u.Hostname() == "" {
+		return PathInfo{}, fmt.Errorf("%q: missing host", raw)
+	}
+
+	info := PathInfo{
+		Scheme:   strings.ToLower(u.Scheme),
+		IsRemote: true,
+		User:     u.User.Username(),
+		Host:     u.Hostname(),
+		Path:     path.Clean("/" + u.Path),
+	}
+	if port := u.Port(); port != "" {
+		info.Port, err = strconv.Atoi(port)
+		if err != nil || info.Port < 1 || info.Port > 65535 {
+			return PathInfo{}, fmt.Errorf("%q: invalid port %q", raw, port)
+		}
+	}
+	if u.RawQuery != "" {
+		info.Query = u.Query()
 	}
+	return info, nil
 }
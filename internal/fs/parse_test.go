@@ -1,6 +1,16 @@
 package fs
 
-import "testing"
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
 
 func TestParsePath(t *testing.T) {
 	tests := []struct {
@@ -11,17 +21,18 @@ func TestParsePath(t *testing.T) {
 		{
 			name:     "local absolute path",
 			input:    "/home/user/data",
-			expected: PathInfo{Path: "/home/user/data"},
+			expected: PathInfo{Scheme: "file", Path: "/home/user/data"},
 		},
 		{
 			name:     "local relative path",
 			input:    "relative/path",
-			expected: PathInfo{Path: "relative/path"},
+			expected: PathInfo{Scheme: "file", Path: "relative/path"},
 		},
 		{
 			name:  "remote with user",
 			input: "user@host:/remote/path",
 			expected: PathInfo{
+				Scheme:   "sftp",
 				IsRemote: true,
 				User:     "user",
 				Host:     "host",
@@ -32,6 +43,7 @@ func TestParsePath(t *testing.T) {
 			name:  "remote without user",
 			input: "host:/remote/path",
 			expected: PathInfo{
+				Scheme:   "sftp",
 				IsRemote: true,
 				Host:     "host",
 				Path:     "/remote/path",
@@ -41,6 +53,7 @@ func TestParsePath(t *testing.T) {
 			name:  "remote with domain host",
 			input: "user@example.com:/data",
 			expected: PathInfo{
+				Scheme:   "sftp",
 				IsRemote: true,
 				User:     "user",
 				Host:     "example.com",
@@ -51,6 +64,7 @@ func TestParsePath(t *testing.T) {
 			name:  "remote with IP",
 			input: "root@192.168.1.1:/var/data",
 			expected: PathInfo{
+				Scheme:   "sftp",
 				IsRemote: true,
 				User:     "root",
 				Host:     "192.168.1.1",
@@ -60,26 +74,380 @@ func TestParsePath(t *testing.T) {
 		{
 			name:     "windows drive letter",
 			input:    "C:\\Users\\data",
-			expected: PathInfo{Path: "C:\\Users\\data"},
+			expected: PathInfo{Scheme: "file", Path: "C:\\Users\\data"},
 		},
 		{
 			name:  "remote relative path",
 			input: "user@host:relative/path",
 			expected: PathInfo{
+				Scheme:   "sftp",
 				IsRemote: true,
 				User:     "user",
 				Host:     "host",
 				Path:     "relative/path",
 			},
 		},
+		{
+			name:  "s3 bucket with prefix",
+			input: "s3://bucket/backups/daily/",
+			expected: PathInfo{
+				Scheme:   "s3",
+				IsRemote: true,
+				Host:     "bucket",
+				Path:     "/backups/daily",
+			},
+		},
+		{
+			name:  "s3 bucket root",
+			input: "s3://bucket",
+			expected: PathInfo{
+				Scheme:   "s3",
+				IsRemote: true,
+				Host:     "bucket",
+				Path:     "/",
+			},
+		},
+		{
+			name:  "ftp with user and port",
+			input: "ftp://user@ftp.example.com:2121/drop/box/",
+			expected: PathInfo{
+				Scheme:   "ftp",
+				IsRemote: true,
+				User:     "user",
+				Host:     "ftp.example.com",
+				Port:     2121,
+				Path:     "/drop/box",
+			},
+		},
+		{
+			name:  "webdavs nextcloud",
+			input: "webdavs://alice@cloud.example.com/remote.php/dav/files/alice/Documents",
+			expected: PathInfo{
+				Scheme:   "webdavs",
+				IsRemote: true,
+				User:     "alice",
+				Host:     "cloud.example.com",
+				Path:     "/remote.php/dav/files/alice/Documents",
+			},
+		},
+		{
+			name:     "local archive",
+			input:    "build/release.tar.gz",
+			expected: PathInfo{Scheme: "archive", Archive: "build/release.tar.gz", Path: "/"},
+		},
+		{
+			name:     "windows archive",
+			input:    "C:\\out\\site.ZIP",
+			expected: PathInfo{Scheme: "archive", Archive: "C:\\out\\site.ZIP", Path: "/"},
+		},
+		{
+			name:  "remote archive name is a directory",
+			input: "host:/backups/site.tar",
+			expected: PathInfo{
+				Scheme:   "sftp",
+				IsRemote: true,
+				Host:     "host",
+				Path:     "/backups/site.tar",
+			},
+		},
+		{
+			name:  "sftp URL with port",
+			input: "sftp://user@host:2222/data/dir",
+			expected: PathInfo{
+				Scheme:   "sftp",
+				IsRemote: true,
+				User:     "user",
+				Host:     "host",
+				Port:     2222,
+				Path:     "/data/dir",
+			},
+		},
+		{
+			name:  "sftp URL with options",
+			input: "SFTP://host/data?identity=%2Fkeys%2Fid_ed25519",
+			expected: PathInfo{
+				Scheme:   "sftp",
+				IsRemote: true,
+				Host:     "host",
+				Query:    url.Values{"identity": {"/keys/id_ed25519"}},
+				Path:     "/data",
+			},
+		},
+		{
+			name:  "s3 URL with options",
+			input: "s3://bucket/prefix?region=eu-west-1&path-style=true",
+			expected: PathInfo{
+				Scheme:   "s3",
+				IsRemote: true,
+				Host:     "bucket",
+				Query:    url.Values{"region": {"eu-west-1"}, "path-style": {"true"}},
+				Path:     "/prefix",
+			},
+		},
+		{
+			name:     "file URL",
+			input:    "file:///home/user/my%20data",
+			expected: PathInfo{Scheme: "file", Path: "/home/user/my data"},
+		},
+		{
+			name:     "file URL with localhost",
+			input:    "file://localhost/srv",
+			expected: PathInfo{Scheme: "file", Path: "/srv"},
+		},
+		{
+			name:     "file URL with windows drive",
+			input:    "file:///C:/Users/data",
+			expected: PathInfo{Scheme: "file", Path: "C:/Users/data"},
+		},
+		{
+			name:     "file URL to archive",
+			input:    "file:///tmp/release.zip",
+			expected: PathInfo{Scheme: "archive", Archive: "/tmp/release.zip", Path: "/"},
+		},
+		{
+			name:     "file URL with remote host",
+			input:    "file://server/share",
+			expected: PathInfo{Scheme: "file", Host: "server", Path: "/share"},
+		},
+		{
+			name:  "bracketed IPv6",
+			input: "user@[2001:db8::1]:/data",
+			expected: PathInfo{
+				Scheme:   "sftp",
+				IsRemote: true,
+				User:     "user",
+				Host:     "2001:db8::1",
+				Path:     "/data",
+			},
+		},
+		{
+			name:  "bracketed IPv6 without user",
+			input: "[::1]:backups",
+			expected: PathInfo{
+				Scheme:   "sftp",
+				IsRemote: true,
+				Host:     "::1",
+				Path:     "backups",
+			},
+		},
+		{
+			name:  "sftp URL with IPv6 and port",
+			input: "sftp://user@[fe80::1%25eth0]:2222/data",
+			expected: PathInfo{
+				Scheme:   "sftp",
+				IsRemote: true,
+				User:     "user",
+				Host:     "fe80::1%eth0",
+				Port:     2222,
+				Path:     "/data",
+			},
+		},
+		{
+			name:  "user name with @",
+			input: "me@corp.example@host:/home/me",
+			expected: PathInfo{
+				Scheme:   "sftp",
+				IsRemote: true,
+				User:     "me@corp.example",
+				Host:     "host",
+				Path:     "/home/me",
+			},
+		},
+		{
+			name:  "@ and colons in remote path",
+			input: "user@host:/data/a@b:c",
+			expected: PathInfo{
+				Scheme:   "sftp",
+				IsRemote: true,
+				User:     "user",
+				Host:     "host",
+				Path:     "/data/a@b:c",
+			},
+		},
+		{
+			name:     "local path with colon after separator",
+			input:    "./notes:2024",
+			expected: PathInfo{Scheme: "file", Path: "./notes:2024"},
+		},
+		{
+			name:     "local path with @",
+			input:    "/srv/user@example/data",
+			expected: PathInfo{Scheme: "file", Path: "/srv/user@example/data"},
+		},
+		{
+			name:     "local path starting with bracket",
+			input:    "[draft]/notes",
+			expected: PathInfo{Scheme: "file", Path: "[draft]/notes"},
+		},
+		{
+			name:  "ftps anonymous",
+			input: "ftps://ftp.example.com",
+			expected: PathInfo{
+				Scheme:   "ftps",
+				IsRemote: true,
+				Host:     "ftp.example.com",
+				Path:     "/",
+			},
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := ParsePath(tt.input)
-			if result != tt.expected {
+			result, err := ParsePath(tt.input)
+			if err != nil {
+				t.Fatalf("ParsePath(%q) failed: %v", tt.input, err)
+			}
+			if !reflect.DeepEqual(result, tt.expected) {
 				t.Errorf("ParsePath(%q) = %+v, want %+v", tt.input, result, tt.expected)
 			}
 		})
 	}
 }
+
+func TestParsePath_DirectoryWithArchiveExtension(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "site.tar")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	info, err := ParsePath(dir)
+	if err != nil {
+		t.Fatalf("ParsePath failed: %v", err)
+	}
+	if want := (PathInfo{Scheme: "file", Path: dir}); !reflect.DeepEqual(info, want) {
+		t.Errorf("ParsePath(%s) = %+v, want %+v", dir, info, want)
+	}
+
+	file := filepath.Join(t.TempDir(), "site.tar")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	if info, err := ParsePath(file); err != nil || info.Scheme != "archive" {
+		t.Errorf("ParsePath(%s) = %+v, %v, want an archive", file, info, err)
+	}
+}
+
+func TestParsePath_Errors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{name: "port in host:path", input: "host:2222:/data", want: "sftp://host:2222/"},
+		{name: "port with user", input: "user@host:2222:/data", want: "ambiguous"},
+		{name: "port after hex host", input: "cafe:22:/data", want: "sftp://cafe:22/"},
+		{name: "unbracketed IPv6", input: "user@2001:db8::1:/data", want: "brackets"},
+		{name: "unbracketed IPv6 loopback", input: "fe80::1:/data", want: "brackets"},
+		{name: "port after brackets", input: "[::1]:22:/data", want: "sftp://[::1]:22/"},
+		{name: "invalid IPv6", input: "user@[2001:db8::zz]:/data", want: "invalid IPv6"},
+		{name: "unclosed bracket", input: "user@[2001:db8::1:/data", want: "[host]:path"},
+		{name: "missing colon after bracket", input: "user@[::1]/data", want: "[host]:path"},
+		{name: "missing host", input: "user@:/data", want: "missing host"},
+		{name: "URL without host", input: "sftp:///data", want: "missing host"},
+		{name: "URL with bad port", input: "sftp://host:99999/data", want: "invalid port"},
+		{name: "URL with non-numeric port", input: "ftp://host:ftp/data", want: "port"},
+		{name: "URL with bad IPv6", input: "sftp://[::g]/data", want: "invalid host"},
+		{name: "unregistered scheme", input: "backup://data", want: `unsupported scheme "backup"`},
+		{name: "archive URL", input: "archive:///tmp/site.tar", want: "unsupported scheme"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := ParsePath(tt.input)
+			if err == nil {
+				t.Fatalf("ParsePath(%q) = %+v, want error", tt.input, info)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("ParsePath(%q) error = %v, want it to mention %q", tt.input, err, tt.want)
+			}
+		})
+	}
+}
+
+// mustParsePath parses raw and fails the test on error.
+func mustParsePath(t testing.TB, raw string) PathInfo {
+	t.Helper()
+
+	info, err := ParsePath(raw)
+	if err != nil {
+		t.Fatalf("ParsePath(%q) failed: %v", raw, err)
+	}
+	return info
+}
+
+func FuzzParsePath(f *testing.F) {
+	for _, seed := range []string{
+		"/home/user/data", "C:\\Users\\data", "user@host:/path", "host:relative",
+		"user@[2001:db8::1]:/data", "[::1]:x", "host:2222:/data", "2001:db8::1:/x",
+		"sftp://user@host:2222/path?identity=k", "s3://bucket/prefix?region=r",
+		"ftps://[::1]:990/", "file:///C:/x", "release.tar.gz", "a@b@c:d:e", "[x]:",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, raw string) {
+		info, err := ParsePath(raw)
+		if err != nil {
+			return
+		}
+		if info.Scheme == "" {
+			t.Fatalf("ParsePath(%q) = %+v without a scheme", raw, info)
+		}
+		if info.Port < 0 || info.Port > 65535 {
+			t.Fatalf("ParsePath(%q) port %d out of range", raw, info.Port)
+		}
+		if !info.IsRemote {
+			return
+		}
+		if info.Host == "" {
+			t.Fatalf("ParsePath(%q) = %+v, remote without host", raw, info)
+		}
+		if info.Scheme == "sftp" && info.Port == 0 && info.Query == nil {
+			// host:path form: the host never swallows the path, and a host
+			// with colons must be a bracketed IPv6 address.
+			if strings.ContainsAny(info.Host, "@/\\") {
+				t.Fatalf("ParsePath(%q) host %q contains a separator", raw, info.Host)
+			}
+			if strings.Contains(info.Host, ":") && !strings.Contains(raw, "["+info.Host+"]:") {
+				t.Fatalf("ParsePath(%q) host %q has colons but wasn't bracketed", raw, info.Host)
+			}
+			if strings.Contains(info.Host, ":") {
+				if _, err := netip.ParseAddr(info.Host); err != nil {
+					t.Fatalf("ParsePath(%q) host %q is not an IPv6 address", raw, info.Host)
+				}
+			}
+		}
+	})
+}
+
+func FuzzParsePath_IPv6(f *testing.F) {
+	f.Add([]byte(net.ParseIP("2001:db8::1")), uint16(2222), "/data")
+	f.Add([]byte(net.ParseIP("::1")), uint16(22), "backups")
+
+	f.Fuzz(func(t *testing.T, ip []byte, port uint16, p string) {
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok || !addr.Is6() || addr.Is4In6() || strings.ContainsAny(p, ":?#%") {
+			return
+		}
+		host := addr.String()
+
+		info, err := ParsePath("user@[" + host + "]:" + p)
+		if err != nil {
+			t.Fatalf("ParsePath of [%s]:%s failed: %v", host, p, err)
+		}
+		if info.Host != host || info.User != "user" || info.Path != p {
+			t.Fatalf("ParsePath of [%s]:%s = %+v", host, p, info)
+		}
+
+		if port == 0 {
+			return
+		}
+		raw := fmt.Sprintf("sftp://user@[%s]:%d/%s", host, port, url.PathEscape(strings.TrimPrefix(p, "/")))
+		info, err = ParsePath(raw)
+		if err != nil {
+			t.Fatalf("ParsePath(%q) failed: %v", raw, err)
+		}
+		if info.Host != host || info.Port != int(port) {
+			t.Fatalf("ParsePath(%q) = %+v, want host %s port %d", raw, info, host, port)
+		}
+	})
+}
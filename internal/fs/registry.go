@@ -0,0 +1,107 @@
+package fs
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robertgontarski/sync/internal/logger"
+)
+
+// Options are the settings from the command line that apply to an endpoint.
+// Settings in the endpoint itself, such as a port in its URL, take
+// precedence over them.
+type Options struct {
+	Port         int
+	IdentityFile string
+	// Password is the SSH password. Other protocols have their own, so it
+	// isn't sent to servers it wasn't meant for.
+	Password string
+	// FTPPassword is the password for FTP endpoints with a user name.
+	FTPPassword string
+	// WebDAVPassword is the password for WebDAV endpoints with a user name.
+	// WebDAVAllowHTTPAuth lets it be sent over plain http.
+	WebDAVPassword      string
+	WebDAVAllowHTTPAuth bool
+	// PasswordPrompt asks for a password interactively. It is nil when no
+	// terminal is attached.
+	PasswordPrompt func(user, host string) (string, error)
+	// QuestionPrompt asks SSH keyboard-interactive questions other than the
+	// password. It is nil when no terminal is attached.
+	QuestionPrompt func(question string, echo bool) (string, error)
+	KeepAlive      time.Duration
+	Retries        int
+	Logger         *logger.Logger
+	// OnReconnect is called after a dropped connection was re-established.
+	OnReconnect func()
+}
+
+// Constructor opens the filesystem of a parsed endpoint.
+type Constructor func(info PathInfo, opts Options) (FileSystem, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Constructor)
+)
+
+// Register makes a backend available for endpoints with the given scheme,
+// both as scheme://... URLs and for paths ParsePath maps to it. It panics
+// if the scheme is registered twice.
+func Register(scheme string, c Constructor) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	scheme = strings.ToLower(scheme)
+	if _, ok := registry[scheme]; ok {
+		panic("fs: Register called twice for scheme " + scheme)
+	}
+	registry[scheme] = c
+}
+
+func lookup(scheme string) (Constructor, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	c, ok := registry[strings.ToLower(scheme)]
+	return c, ok
+}
+
+// Schemes returns the registered schemes in sorted order.
+func Schemes() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	schemes := make([]string, 0, len(registry))
+	for scheme := range registry {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Open opens the filesystem of info with the backend registered for its
+// scheme.
+func Open(info PathInfo, opts Options) (FileSystem, error) {
+	c, ok := lookup(info.Scheme)
+	if !ok {
+		return nil, fmt.Errorf("unsupported scheme %q, expected one of %s", info.Scheme, strings.Join(Schemes(), ", "))
+	}
+	return c(info, opts)
+}
+
+// checkQuery returns an error if the URL query of info has options other
+// than allowed, so misspelled options don't go unnoticed.
+func checkQuery(info PathInfo, allowed ...string) error {
+	for key := range info.Query {
+		if !slices.Contains(allowed, key) {
+			if len(allowed) == 0 {
+				return fmt.Errorf("%s URLs take no options, got %q", info.Scheme, key)
+			}
+			return fmt.Errorf("unknown %s option %q, expected one of %s", info.Scheme, key, strings.Join(allowed, ", "))
+		}
+	}
+	return nil
+}
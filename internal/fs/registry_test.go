@@ -0,0 +1,72 @@
+package fs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRegister_CustomScheme(t *testing.T) {
+	mem := NewMemFS()
+	var got PathInfo
+	Register("test-registry", func(info PathInfo, opts Options) (FileSystem, error) {
+		if err := checkQuery(info, "bucket"); err != nil {
+			return nil, err
+		}
+		got = info
+		return mem, nil
+	})
+	defer func() {
+		registryMu.Lock()
+		delete(registry, "test-registry")
+		registryMu.Unlock()
+	}()
+
+	info := mustParsePath(t, "test-registry://user@store:9000/data?bucket=b1")
+	filesystem, err := Open(info, Options{})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if filesystem != mem {
+		t.Error("Open did not return the registered backend's filesystem")
+	}
+	if got.User != "user" || got.Host != "store" || got.Port != 9000 || got.Path != "/data" || got.Query.Get("bucket") != "b1" {
+		t.Errorf("constructor got %+v", got)
+	}
+
+	if _, err := Open(mustParsePath(t, "test-registry://store/data?bukcet=b1"), Options{}); err == nil || !strings.Contains(err.Error(), "bukcet") {
+		t.Errorf("Open with a misspelled option = %v, want error naming it", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a scheme twice should panic")
+		}
+	}()
+	Register("test-registry", func(PathInfo, Options) (FileSystem, error) { return nil, errors.ErrUnsupported })
+}
+
+func TestOpen_Builtin(t *testing.T) {
+	for _, scheme := range []string{"archive", "file", "ftp", "ftps", "s3", "sftp", "webdav", "webdavs"} {
+		if _, ok := lookup(scheme); !ok {
+			t.Errorf("scheme %s is not registered", scheme)
+		}
+	}
+
+	filesystem, err := Open(mustParsePath(t, "file://"+t.TempDir()), Options{})
+	if err != nil {
+		t.Fatalf("Open(file://) failed: %v", err)
+	}
+	if _, ok := filesystem.(*LocalFS); !ok {
+		t.Errorf("Open(file://) = %T, want *LocalFS", filesystem)
+	}
+
+	for _, raw := range []string{"file://server/share", "file:///data?x=1", "webdav://host/dav?depth=1"} {
+		if _, err := Open(mustParsePath(t, raw), Options{}); err == nil {
+			t.Errorf("Open(%s) should fail", raw)
+		}
+	}
+	if _, err := Open(PathInfo{Scheme: "nope"}, Options{}); err == nil || !strings.Contains(err.Error(), "sftp") {
+		t.Errorf("Open with an unknown scheme = %v, want error listing the known ones", err)
+	}
+}
@@ -0,0 +1,703 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// s3PartSize is the size of each part of a multipart upload. Files
+	// smaller than this are uploaded with a single PUT.
+	s3PartSize = 8 << 20
+
+	s3MetaMtime = "X-Amz-Meta-Mtime"
+	s3MetaMode  = "X-Amz-Meta-Mode"
+)
+
+type S3Config struct {
+	Bucket string
+	// Endpoint is the base URL of an S3-compatible service, e.g.
+	// http://localhost:9000 for MinIO. Empty means AWS.
+	Endpoint string
+	Region   string
+	// PathStyle addresses buckets as endpoint/bucket instead of
+	// bucket.endpoint. It is required by most S3-compatible services.
+	PathStyle    bool
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+// S3FS stores files as objects in an S3 bucket. Paths are slash-separated
+// and rooted at the bucket, so "/backups/a.txt" is the key "backups/a.txt".
+// Directories don't exist as such: MkdirAll is a no-op and a directory is
+// any prefix that has objects under it. Mode and modification time are kept
+// in object metadata.
+type S3FS struct {
+	cfg      S3Config
+	client   *http.Client
+	pageSize int
+}
+
+func init() {
+	Register("s3", func(info PathInfo, opts Options) (FileSystem, error) {
+		cfg, err := s3ConfigFor(info)
+		if err != nil {
+			return nil, err
+		}
+		return NewS3FS(cfg)
+	})
+}
+
+// s3ConfigFor returns the settings for an s3://bucket/prefix endpoint. They
+// are read from the standard AWS environment variables, and the region,
+// endpoint and path-style URL options override them.
+func s3ConfigFor(info PathInfo) (S3Config, error) {
+	if err := checkQuery(info, "region", "endpoint", "path-style"); err != nil {
+		return S3Config{}, err
+	}
+
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_S3")
+	if endpoint == "" {
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	if v := info.Query.Get("region"); v != "" {
+		region = v
+	}
+	if v := info.Query.Get("endpoint"); v != "" {
+		endpoint = v
+	}
+
+	cfg := S3Config{
+		Bucket:       info.Host,
+		Endpoint:     endpoint,
+		Region:       region,
+		PathStyle:    endpoint != "",
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if v := info.Query.Get("path-style"); v != "" {
+		pathStyle, err := strconv.ParseBool(v)
+		if err != nil {
+			return S3Config{}, fmt.Errorf("invalid s3 option path-style=%q: %w", v, err)
+		}
+		cfg.PathStyle = pathStyle
+	}
+	return cfg, nil
+}
+
+func NewS3FS(cfg S3Config) (*S3FS, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("S3 bucket name is required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", cfg.Region)
+	}
+	if _, err := url.Parse(cfg.Endpoint); err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint: %w", err)
+	}
+	cfg.Endpoint = strings.TrimSuffix(cfg.Endpoint, "/")
+
+	return &S3FS{
+		cfg:      cfg,
+		client:   &http.Client{},
+		pageSize: 1000,
+	}, nil
+}
+
+func s3Key(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// objectURL returns the URL of key, or of the bucket itself when key is empty.
+func (s *S3FS) objectURL(key string, query url.Values) string {
+	u, _ := url.Parse(s.cfg.Endpoint)
+	if s.cfg.PathStyle {
+		u.Path += "/" + s.cfg.Bucket + "/" + key
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+		u.Path += "/" + key
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = s3CanonicalQuery(query)
+	return u.String()
+}
+
+// do sends a signed request and returns the response if it succeeded.
+func (s *S3FS) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.objectURL(key, query), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.ContentLength = int64(len(body))
+	s.sign(req, body, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		return nil, s3ResponseError(method, key, resp)
+	}
+	return resp, nil
+}
+
+// s3ResponseError converts a failed response into an error. Missing objects
+// are reported as os.ErrNotExist.
+func s3ResponseError(method, key string, resp *http.Response) error {
+	var body struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	xml.Unmarshal(data, &body)
+
+	if resp.StatusCode == http.StatusNotFound && body.Code != "NoSuchBucket" {
+		return &os.PathError{Op: strings.ToLower(method), Path: "/" + key, Err: os.ErrNotExist}
+	}
+	if body.Code != "" {
+		return fmt.Errorf("S3 %s /%s: %s: %s", method, key, body.Code, body.Message)
+	}
+	return fmt.Errorf("S3 %s /%s: %s", method, key, resp.Status)
+}
+
+func (s *S3FS) head(key string) (FileInfo, http.Header, error) {
+	resp, err := s.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return FileInfo{}, nil, err
+	}
+	resp.Body.Close()
+	return objectInfo(key, resp.ContentLength, resp.Header), resp.Header, nil
+}
+
+// objectInfo builds a FileInfo from an object's size and response headers.
+func objectInfo(key string, size int64, header http.Header) FileInfo {
+	info := FileInfo{
+		Name: path.Base(key),
+		Size: size,
+		Mode: 0644,
+	}
+	if t, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+		info.ModTime = t
+	}
+	if t, ok := parseS3Mtime(header.Get(s3MetaMtime)); ok {
+		info.ModTime = t
+	}
+	if mode, err := strconv.ParseUint(header.Get(s3MetaMode), 8, 32); err == nil {
+		info.Mode = os.FileMode(mode)
+	}
+	return info
+}
+
+// formatS3Mtime encodes t as fractional Unix seconds, the format rclone uses.
+func formatS3Mtime(t time.Time) string {
+	return fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond())
+}
+
+func parseS3Mtime(v string) (time.Time, bool) {
+	if v == "" {
+		return time.Time{}, false
+	}
+	secs, frac, _ := strings.Cut(v, ".")
+	sec, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	var nsec int64
+	if frac != "" {
+		frac = (frac + "000000000")[:9]
+		if nsec, err = strconv.ParseInt(frac, 10, 64); err != nil {
+			return time.Time{}, false
+		}
+	}
+	return time.Unix(sec, nsec), true
+}
+
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	Size         int64     `xml:"Size"`
+}
+
+type s3ListResult struct {
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+	Contents              []s3Object `xml:"Contents"`
+}
+
+// list calls fn for each page of objects under prefix.
+func (s *S3FS) list(prefix string, maxKeys int, fn func(objects []s3Object) error) error {
+	token := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+			"max-keys":  {strconv.Itoa(maxKeys)},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("S3 list %s: %w", prefix, err)
+		}
+
+		if err := fn(result.Contents); err != nil {
+			return err
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// errStopList ends a listing early without reporting an error.
+var errStopList = errors.New("stop listing")
+
+func (s *S3FS) isDir(key string) (bool, error) {
+	if key == "" {
+		return true, nil
+	}
+	found := false
+	err := s.list(key+"/", 1, func(objects []s3Object) error {
+		found = len(objects) > 0
+		return errStopList
+	})
+	if err != nil && !errors.Is(err, errStopList) {
+		return false, err
+	}
+	return found, nil
+}
+
+func (s *S3FS) Stat(p string) (FileInfo, error) {
+	key := s3Key(p)
+	if key != "" {
+		info, _, err := s.head(key)
+		if err == nil {
+			return info, nil
+		}
+		if !os.IsNotExist(err) {
+			return FileInfo{}, err
+		}
+	}
+
+	dir, err := s.isDir(key)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if !dir {
+		return FileInfo{}, &os.PathError{Op: "stat", Path: p, Err: os.ErrNotExist}
+	}
+	return FileInfo{Name: path.Base("/" + key), Mode: os.ModeDir | 0755, IsDir: true}, nil
+}
+
+// Walk lists every object under root with paginated ListObjectsV2 calls and
+// reports the directories implied by their keys before their contents.
+// Listings don't include object metadata, so ModTime is the upload time;
+// use Stat for the preserved modification time.
+func (s *S3FS) Walk(root string, fn WalkFunc) error {
+	rootKey := s3Key(root)
+	prefix := ""
+	if rootKey != "" {
+		prefix = rootKey + "/"
+	}
+
+	info, err := s.Stat(root)
+	if err != nil {
+		return fn(root, FileInfo{}, err)
+	}
+	if err := fn(root, info, nil); err != nil || !info.IsDir {
+		if errors.Is(err, filepath.SkipDir) {
+			return nil
+		}
+		return err
+	}
+
+	seen := map[string]bool{}
+	var skipped []string
+	err = s.list(prefix, s.pageSize, func(objects []s3Object) error {
+	objects:
+		for _, obj := range objects {
+			for _, skip := range skipped {
+				if strings.HasPrefix(obj.Key, skip) {
+					continue objects
+				}
+			}
+
+			// Report each directory between the root and the object once.
+			rel := strings.TrimPrefix(obj.Key, prefix)
+			parts := strings.Split(rel, "/")
+			dir := rootKey
+			for _, part := range parts[:len(parts)-1] {
+				dir = strings.TrimPrefix(dir+"/"+part, "/")
+				if seen[dir] {
+					continue
+				}
+				seen[dir] = true
+				err := fn("/"+dir, FileInfo{Name: part, Mode: os.ModeDir | 0755, IsDir: true}, nil)
+				if errors.Is(err, filepath.SkipDir) {
+					skipped = append(skipped, dir+"/")
+					continue objects
+				}
+				if err != nil {
+					return err
+				}
+			}
+
+			// Keys ending in a slash are directory markers.
+			name := parts[len(parts)-1]
+			if name == "" {
+				continue
+			}
+			err := fn("/"+obj.Key, FileInfo{
+				Name:    name,
+				Size:    obj.Size,
+				Mode:    0644,
+				ModTime: obj.LastModified,
+			}, nil)
+			if err != nil && !errors.Is(err, filepath.SkipDir) {
+				return err
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+func (s *S3FS) Open(p string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, s3Key(p), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3FS) Create(p string) (io.WriteCloser, error) {
+	return s.CreateWithInfo(p, FileInfo{Mode: 0644, ModTime: time.Now()})
+}
+
+// CreateWithInfo uploads the file with its mode and modification time stored
+// in object metadata, so no second request is needed to set them.
+func (s *S3FS) CreateWithInfo(p string, info FileInfo) (io.WriteCloser, error) {
+	header := http.Header{}
+	header.Set(s3MetaMtime, formatS3Mtime(info.ModTime))
+	header.Set(s3MetaMode, strconv.FormatUint(uint64(info.Mode.Perm()), 8))
+	return &s3Writer{fs: s, key: s3Key(p), header: header}, nil
+}
+
+func (s *S3FS) Remove(p string) error {
+	resp, err := s.do(http.MethodDelete, s3Key(p), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// MkdirAll does nothing: S3 has no directories.
+func (s *S3FS) MkdirAll(p string, perm os.FileMode) error {
+	return nil
+}
+
+func (s *S3FS) Chmod(p string, mode os.FileMode) error {
+	return s.updateMetadata(s3Key(p), s3MetaMode, strconv.FormatUint(uint64(mode.Perm()), 8))
+}
+
+func (s *S3FS) Chtimes(p string, atime, mtime time.Time) error {
+	return s.updateMetadata(s3Key(p), s3MetaMtime, formatS3Mtime(mtime))
+}
+
+// updateMetadata sets one metadata header by copying the object onto itself,
+// the only way S3 allows changing metadata.
+func (s *S3FS) updateMetadata(key, name, value string) error {
+	_, current, err := s.head(key)
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	for k, v := range current {
+		if strings.HasPrefix(k, "X-Amz-Meta-") || k == "Content-Type" {
+			header[k] = v
+		}
+	}
+	header.Set(name, value)
+	header.Set("X-Amz-Copy-Source", s3EscapePath("/"+s.cfg.Bucket+"/"+key))
+	header.Set("X-Amz-Metadata-Directive", "REPLACE")
+
+	resp, err := s.do(http.MethodPut, key, nil, header, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *S3FS) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// Separator reports that S3 keys always use forward slashes.
+func (s *S3FS) Separator() byte {
+	return '/'
+}
+
+// s3Writer buffers writes and uploads them as a single object, switching to
+// a multipart upload once more than one part has been written.
+type s3Writer struct {
+	fs       *S3FS
+	key      string
+	header   http.Header
+	buf      []byte
+	uploadID string
+	parts    []s3Part
+	err      error
+	closed   bool
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf = append(w.buf, p...)
+	for len(w.buf) >= s3PartSize {
+		if err := w.uploadPart(w.buf[:s3PartSize]); err != nil {
+			w.err = err
+			return 0, err
+		}
+		w.buf = append(w.buf[:0], w.buf[s3PartSize:]...)
+	}
+	return len(p), nil
+}
+
+func (w *s3Writer) uploadPart(data []byte) error {
+	if w.uploadID == "" {
+		resp, err := w.fs.do(http.MethodPost, w.key, url.Values{"uploads": {""}}, w.header, nil)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("S3 create multipart upload: %w", err)
+		}
+		w.uploadID = result.UploadID
+	}
+
+	number := len(w.parts) + 1
+	query := url.Values{
+		"partNumber": {strconv.Itoa(number)},
+		"uploadId":   {w.uploadID},
+	}
+	resp, err := w.fs.do(http.MethodPut, w.key, query, nil, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	w.parts = append(w.parts, s3Part{PartNumber: number, ETag: resp.Header.Get("ETag")})
+	return nil
+}
+
+func (w *s3Writer) Close() error {
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+	if w.err != nil {
+		w.abort()
+		return w.err
+	}
+
+	if w.uploadID == "" {
+		resp, err := w.fs.do(http.MethodPut, w.key, nil, w.header, w.buf)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	if len(w.buf) > 0 {
+		if err := w.uploadPart(w.buf); err != nil {
+			w.abort()
+			return err
+		}
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: w.parts})
+	if err != nil {
+		return err
+	}
+	resp, err := w.fs.do(http.MethodPost, w.key, url.Values{"uploadId": {w.uploadID}}, nil, body)
+	if err != nil {
+		w.abort()
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Abort discards the upload without creating the object.
+func (w *s3Writer) Abort() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.abort()
+}
+
+func (w *s3Writer) abort() error {
+	if w.uploadID == "" {
+		return nil
+	}
+	resp, err := w.fs.do(http.MethodDelete, w.key, url.Values{"uploadId": {w.uploadID}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req. Requests
+// are sent unsigned when no credentials are configured.
+func (s *S3FS) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256Hex(body)
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.cfg.SessionToken)
+	}
+	if s.cfg.AccessKey == "" {
+		return
+	}
+
+	// Sign the host and every header S3 requires or we set ourselves.
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" || lower == "content-md5" || lower == "range" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	date := amzDate[:8]
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), date)
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything except unreserved characters, as SigV4
+// requires.
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3EscapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	var pairs []string
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, s3Escape(name)+"="+s3Escape(value))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
@@ -0,0 +1,595 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/robertgontarski/sync/internal/sftptest"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestPasswordSource_UsesConfiguredPassword(t *testing.T) {
+	prompted := false
+	password := passwordSource("", "", "secret", func(user, host string) (string, error) {
+		prompted = true
+		return "", nil
+	})
+
+	got, err := password()
+	if err != nil {
+		t.Fatalf("password failed: %v", err)
+	}
+	if got != "secret" {
+		t.Errorf("password = %q, want %q", got, "secret")
+	}
+	if prompted {
+		t.Error("prompt should not be used when a password is configured")
+	}
+}
+
+func TestPasswordSource_PromptsOnce(t *testing.T) {
+	calls := 0
+	password := passwordSource("user", "host", "", func(user, host string) (string, error) {
+		calls++
+		if user != "user" || host != "host" {
+			t.Errorf("prompt called with %s@%s, want user@host", user, host)
+		}
+		return "typed", nil
+	})
+
+	for i := 0; i < 2; i++ {
+		got, err := password()
+		if err != nil {
+			t.Fatalf("password failed: %v", err)
+		}
+		if got != "typed" {
+			t.Errorf("password = %q, want %q", got, "typed")
+		}
+	}
+	if calls != 1 {
+		t.Errorf("prompt called %d times, want 1", calls)
+	}
+}
+
+func TestSFTPConfigFor(t *testing.T) {
+	opts := Options{Port: 22, IdentityFile: "/keys/global", Retries: 3}
+
+	cfg, err := sftpConfigFor(mustParsePath(t, "alice@host:/data"), opts)
+	if err != nil {
+		t.Fatalf("sftpConfigFor failed: %v", err)
+	}
+	if cfg.User != "alice" || cfg.Host != "host" || cfg.Port != 22 || cfg.IdentityFile != "/keys/global" || cfg.Retries != 3 {
+		t.Errorf("sftpConfigFor = %+v, want the command line settings", cfg)
+	}
+
+	cfg, err = sftpConfigFor(mustParsePath(t, "sftp://alice@host:2222/data?identity=/keys/deploy"), opts)
+	if err != nil {
+		t.Fatalf("sftpConfigFor failed: %v", err)
+	}
+	if cfg.Port != 2222 || cfg.IdentityFile != "/keys/deploy" {
+		t.Errorf("sftpConfigFor = %+v, want port and identity from the URL", cfg)
+	}
+
+	if _, err := sftpConfigFor(mustParsePath(t, "sftp://host/data?compress=yes"), opts); err == nil {
+		t.Error("sftpConfigFor with an unknown option should fail")
+	}
+}
+
+func TestBuildAuthMethods_NoPasswordWithoutSource(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	t.Setenv("HOME", t.TempDir())
+
+	if methods := buildAuthMethods(SFTPConfig{}); len(methods) != 0 {
+		t.Errorf("got %d auth methods, want 0", len(methods))
+	}
+	if methods := buildAuthMethods(SFTPConfig{Password: "secret"}); len(methods) != 2 {
+		t.Errorf("got %d auth methods, want 2 (password and keyboard-interactive)", len(methods))
+	}
+}
+
+// pipeTransport connects an SFTP client and server in memory.
+type pipeTransport struct {
+	clientRead, serverRead   *io.PipeReader
+	clientWrite, serverWrite *io.PipeWriter
+}
+
+func (p *pipeTransport) Close() error {
+	p.clientRead.Close()
+	p.serverRead.Close()
+	p.clientWrite.Close()
+	p.serverWrite.Close()
+	return nil
+}
+
+// pipeDialer starts an in-process SFTP server per dial.
+type pipeDialer struct {
+	dials      int
+	transports []*pipeTransport
+}
+
+func (d *pipeDialer) dial() (*sftpConn, error) {
+	d.dials++
+
+	t := &pipeTransport{}
+	t.clientRead, t.serverWrite = io.Pipe()
+	t.serverRead, t.clientWrite = io.Pipe()
+	d.transports = append(d.transports, t)
+
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{t.serverRead, t.serverWrite})
+	if err != nil {
+		return nil, err
+	}
+	go server.Serve()
+
+	client, err := sftp.NewClientPipe(t.clientRead, t.clientWrite)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpConn{client: client, transport: t, done: make(chan struct{})}, nil
+}
+
+// drop simulates the network dropping the most recent connection.
+func (d *pipeDialer) drop() {
+	d.transports[len(d.transports)-1].Close()
+}
+
+func newTestSFTPFS(t *testing.T, retries int) (*SFTPFS, *pipeDialer) {
+	t.Helper()
+	dialer := &pipeDialer{}
+	sfs, err := newSFTPFS(SFTPConfig{Host: "test", Retries: retries}, dialer.dial)
+	if err != nil {
+		t.Fatalf("newSFTPFS failed: %v", err)
+	}
+	sfs.retryDelay = 0
+	t.Cleanup(func() { sfs.Close() })
+	return sfs, dialer
+}
+
+func TestSFTPFS_ReconnectsAfterDrop(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "file.txt")
+	if err := os.WriteFile(filePath, []byte("content"), 0644); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	sfs, dialer := newTestSFTPFS(t, 3)
+	reconnects := 0
+	sfs.cfg.OnReconnect = func() { reconnects++ }
+	dialer.drop()
+
+	info, err := sfs.Stat(filePath)
+	if err != nil {
+		t.Fatalf("Stat after drop failed: %v", err)
+	}
+	if info.Size != int64(len("content")) {
+		t.Errorf("size = %d, want %d", info.Size, len("content"))
+	}
+	if dialer.dials != 2 {
+		t.Errorf("dials = %d, want 2", dialer.dials)
+	}
+	if reconnects != 1 {
+		t.Errorf("OnReconnect called %d times, want 1", reconnects)
+	}
+}
+
+func TestSFTPFS_NoRetriesFailsAfterDrop(t *testing.T) {
+	sfs, dialer := newTestSFTPFS(t, 0)
+	dialer.drop()
+
+	if _, err := sfs.Stat(t.TempDir()); !isConnectionError(err) {
+		t.Errorf("Stat after drop = %v, want connection error", err)
+	}
+	if dialer.dials != 1 {
+		t.Errorf("dials = %d, want 1", dialer.dials)
+	}
+}
+
+func TestSFTPFS_DoesNotRetryOperationErrors(t *testing.T) {
+	sfs, dialer := newTestSFTPFS(t, 3)
+
+	if _, err := sfs.Stat(filepath.Join(t.TempDir(), "missing")); !os.IsNotExist(err) {
+		t.Errorf("Stat of missing file = %v, want not-exist error", err)
+	}
+	if dialer.dials != 1 {
+		t.Errorf("dials = %d, want 1", dialer.dials)
+	}
+}
+
+func TestSFTPFS_RemoveAfterDrop(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "file.txt")
+	if err := os.WriteFile(filePath, []byte("content"), 0644); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	sfs, dialer := newTestSFTPFS(t, 3)
+	if err := sfs.Remove(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("Remove of missing file = %v, want not-exist error", err)
+	}
+
+	// The lost request may have removed the file before the connection
+	// dropped; the retry then finds it gone.
+	dialer.drop()
+	if err := os.Remove(filePath); err != nil {
+		t.Fatalf("failed to remove file: %v", err)
+	}
+	if err := sfs.Remove(filePath); err != nil {
+		t.Errorf("Remove after drop = %v, want nil", err)
+	}
+	if dialer.dials != 2 {
+		t.Errorf("dials = %d, want 2", dialer.dials)
+	}
+}
+
+func TestSFTPFS_WalkAfterDrop(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"b.txt", "a.txt", "sub/c.txt"} {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(p, []byte(name), 0644); err != nil {
+			t.Fatalf("failed to create file: %v", err)
+		}
+	}
+
+	sfs, dialer := newTestSFTPFS(t, 3)
+	dialer.drop()
+
+	var got []string
+	err := sfs.Walk(dir, func(p string, info FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		got = append(got, strings.TrimPrefix(p, dir))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk failed: %v", err)
+	}
+
+	want := []string{"", "/a.txt", "/b.txt", "/sub", "/sub/c.txt"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Walk visited %v, want %v", got, want)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := map[string]string{
+		"/plain/path":       "'/plain/path'",
+		"/with space":       "'/with space'",
+		"/it's":             `'/it'\''s'`,
+		"/$(rm -rf ~)":      "'/$(rm -rf ~)'",
+		"-starts-with-dash": "'-starts-with-dash'",
+	}
+	for input, want := range tests {
+		if got := shellQuote(input); got != want {
+			t.Errorf("shellQuote(%q) = %s, want %s", input, got, want)
+		}
+	}
+}
+
+func TestSFTPFS_CopyWithoutExec(t *testing.T) {
+	sfs, _ := newTestSFTPFS(t, 0)
+
+	if err := sfs.Copy("/a", "/b"); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Copy without exec = %v, want ErrUnsupported", err)
+	}
+}
+
+func TestParseChecksum(t *testing.T) {
+	const sum = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+	tests := []struct {
+		name    string
+		output  string
+		want    string
+		wantErr bool
+	}{
+		{name: "sha256sum", output: sum + "  /data/test.txt\n", want: sum},
+		{name: "uppercase", output: strings.ToUpper(sum) + "  file\n", want: sum},
+		{name: "escaped name", output: `\` + sum + `  /data/back\\slash\nnewline` + "\n", want: sum},
+		{name: "empty", output: "", wantErr: true},
+		{name: "not hex", output: strings.Repeat("z", 64) + "  file\n", wantErr: true},
+		{name: "wrong length", output: "abcd  file\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseChecksum([]byte(tt.output))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseChecksum error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseChecksum = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSFTPFS_ChecksumWithoutExec(t *testing.T) {
+	sfs, _ := newTestSFTPFS(t, 0)
+
+	if _, err := sfs.Checksum("/a"); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Checksum without exec = %v, want ErrUnsupported", err)
+	}
+}
+
+// newServerSFTPFS connects to an embedded test server as its user, with HOME
+// trusting the server and no agent.
+func newServerSFTPFS(t *testing.T, server *sftptest.Server, cfg SFTPConfig) (*SFTPFS, error) {
+	t.Helper()
+
+	cfg.User = server.User
+	cfg.Host = server.Host
+	cfg.Port = server.Port
+	sfs, err := NewSFTPFS(cfg)
+	if err == nil {
+		t.Cleanup(func() { sfs.Close() })
+	}
+	return sfs, err
+}
+
+func setupServer(t *testing.T, cfg sftptest.Config) *sftptest.Server {
+	t.Helper()
+
+	server := sftptest.NewServer(t, cfg)
+	server.SetupHome(t)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	return server
+}
+
+func TestSFTPFS_IdentityFileAuth(t *testing.T) {
+	server := setupServer(t, sftptest.Config{})
+
+	sfs, err := newServerSFTPFS(t, server, SFTPConfig{IdentityFile: server.KeyFile})
+	if err != nil {
+		t.Fatalf("NewSFTPFS failed: %v", err)
+	}
+
+	dir := t.TempDir()
+	filePath := path.Join(filepath.ToSlash(dir), "sub", "file.txt")
+	if err := sfs.MkdirAll(path.Dir(filePath), 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	w, err := sfs.Create(filePath)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	io.WriteString(w, "content")
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := sfs.Chtimes(filePath, modTime, modTime); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+	if err := sfs.Chmod(filePath, 0600); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+	info, err := sfs.Stat(filePath)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Size != 7 || !info.ModTime.Equal(modTime) || info.Mode.Perm() != 0600 {
+		t.Errorf("Stat = %+v, want size 7, modTime %v, mode 0600", info, modTime)
+	}
+
+	r, err := sfs.Open(filePath)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "content" {
+		t.Errorf("content = %q, want %q", data, "content")
+	}
+
+	if err := sfs.Remove(filePath); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.FromSlash(filePath)); !os.IsNotExist(err) {
+		t.Errorf("file still exists after Remove: %v", err)
+	}
+
+	if auths := server.Auths(); len(auths) != 1 || auths[0] != "publickey" {
+		t.Errorf("auths = %v, want [publickey]", auths)
+	}
+}
+
+func TestSFTPFS_DefaultKeyAuth(t *testing.T) {
+	server := setupServer(t, sftptest.Config{})
+
+	key, err := os.ReadFile(server.KeyFile)
+	if err != nil {
+		t.Fatalf("reading key: %v", err)
+	}
+	home, _ := os.UserHomeDir()
+	if err := os.WriteFile(filepath.Join(home, ".ssh", "id_ed25519"), key, 0600); err != nil {
+		t.Fatalf("writing key: %v", err)
+	}
+
+	if _, err := newServerSFTPFS(t, server, SFTPConfig{}); err != nil {
+		t.Fatalf("NewSFTPFS with default key failed: %v", err)
+	}
+}
+
+func TestSFTPFS_AgentAuth(t *testing.T) {
+	server := setupServer(t, sftptest.Config{})
+	server.StartAgent(t)
+
+	if _, err := newServerSFTPFS(t, server, SFTPConfig{}); err != nil {
+		t.Fatalf("NewSFTPFS with agent failed: %v", err)
+	}
+	if auths := server.Auths(); len(auths) != 1 || auths[0] != "publickey" {
+		t.Errorf("auths = %v, want [publickey]", auths)
+	}
+}
+
+func TestKeyboardInteractive(t *testing.T) {
+	password := func() (string, error) { return "secret", nil }
+	var asked []string
+	prompt := func(question string, echo bool) (string, error) {
+		asked = append(asked, fmt.Sprintf("%s echo=%v", question, echo))
+		return "123456", nil
+	}
+
+	challenge := keyboardInteractive(password, prompt)
+	answers, err := challenge("", "", []string{"Password: ", "Verification code: ", "Username: "}, []bool{false, false, true})
+	if err != nil {
+		t.Fatalf("challenge failed: %v", err)
+	}
+	if want := []string{"secret", "123456", "123456"}; !slices.Equal(answers, want) {
+		t.Errorf("answers = %q, want %q", answers, want)
+	}
+	if want := []string{"Verification code:  echo=false", "Username:  echo=true"}; !slices.Equal(asked, want) {
+		t.Errorf("prompted for %q, want %q", asked, want)
+	}
+
+	// Without a terminal, only the password is answered.
+	challenge = keyboardInteractive(password, nil)
+	if answers, err := challenge("", "", []string{"user@host's password: "}, []bool{false}); err != nil || answers[0] != "secret" {
+		t.Errorf("password question = %q, %v", answers, err)
+	}
+	for _, tt := range []struct {
+		question string
+		echo     bool
+	}{{"Verification code: ", false}, {"Password: ", true}} {
+		if answers, err := challenge("", "", []string{tt.question}, []bool{tt.echo}); err == nil {
+			t.Errorf("%q with echo=%v answered with %q, want error", tt.question, tt.echo, answers)
+		}
+	}
+}
+
+func TestSFTPFS_PasswordAuth(t *testing.T) {
+	for _, interactive := range []bool{false, true} {
+		name := "password"
+		if interactive {
+			name = "keyboard-interactive"
+		}
+		t.Run(name, func(t *testing.T) {
+			server := setupServer(t, sftptest.Config{Password: "secret", KeyboardInteractive: interactive})
+
+			if _, err := newServerSFTPFS(t, server, SFTPConfig{Password: "wrong"}); err == nil {
+				t.Error("NewSFTPFS with wrong password should fail")
+			}
+
+			prompts := 0
+			_, err := newServerSFTPFS(t, server, SFTPConfig{
+				PasswordPrompt: func(user, host string) (string, error) {
+					prompts++
+					return "secret", nil
+				},
+			})
+			if err != nil {
+				t.Fatalf("NewSFTPFS with prompted password failed: %v", err)
+			}
+			if prompts != 1 {
+				t.Errorf("prompted %d times, want 1", prompts)
+			}
+			if auths := server.Auths(); len(auths) != 1 || auths[0] != name {
+				t.Errorf("auths = %v, want [%s]", auths, name)
+			}
+		})
+	}
+}
+
+func TestSFTPFS_NoAuthMethod(t *testing.T) {
+	server := setupServer(t, sftptest.Config{})
+
+	if _, err := newServerSFTPFS(t, server, SFTPConfig{}); err == nil {
+		t.Error("NewSFTPFS without credentials should fail")
+	}
+}
+
+func TestSFTPFS_KnownHostsMismatch(t *testing.T) {
+	server := setupServer(t, sftptest.Config{})
+	impostor := sftptest.NewServer(t, sftptest.Config{})
+
+	// Trust the impostor's key for the server's address.
+	home, _ := os.UserHomeDir()
+	line := knownhosts.Line([]string{server.Addr()}, impostor.HostKey)
+	if err := os.WriteFile(filepath.Join(home, ".ssh", "known_hosts"), []byte(line+"\n"), 0600); err != nil {
+		t.Fatalf("writing known_hosts: %v", err)
+	}
+
+	_, err := newServerSFTPFS(t, server, SFTPConfig{IdentityFile: server.KeyFile})
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		t.Errorf("NewSFTPFS = %v, want host key mismatch", err)
+	}
+}
+
+func TestSFTPFS_ServerSideCopyAndChecksum(t *testing.T) {
+	server := setupServer(t, sftptest.Config{Exec: true})
+
+	sfs, err := newServerSFTPFS(t, server, SFTPConfig{IdentityFile: server.KeyFile})
+	if err != nil {
+		t.Fatalf("NewSFTPFS failed: %v", err)
+	}
+
+	dir := filepath.ToSlash(t.TempDir())
+	if err := os.WriteFile(filepath.FromSlash(dir+"/src.txt"), []byte("test"), 0644); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	if err := sfs.Copy(dir+"/src.txt", dir+"/it's a copy.txt"); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.FromSlash(dir + "/it's a copy.txt")); err != nil || string(data) != "test" {
+		t.Errorf("copy = %q, %v; want %q", data, err, "test")
+	}
+
+	sum, err := sfs.Checksum(dir + "/src.txt")
+	if err != nil {
+		t.Fatalf("Checksum failed: %v", err)
+	}
+	if want := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"; sum != want {
+		t.Errorf("Checksum = %s, want %s", sum, want)
+	}
+}
+
+func TestSFTPFS_ServerWithoutExec(t *testing.T) {
+	server := setupServer(t, sftptest.Config{})
+
+	sfs, err := newServerSFTPFS(t, server, SFTPConfig{IdentityFile: server.KeyFile})
+	if err != nil {
+		t.Fatalf("NewSFTPFS failed: %v", err)
+	}
+	if err := sfs.Copy("/a", "/b"); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Copy = %v, want ErrUnsupported", err)
+	}
+}
+
+func TestSFTPFS_ReconnectsToServer(t *testing.T) {
+	server := setupServer(t, sftptest.Config{})
+
+	sfs, err := newServerSFTPFS(t, server, SFTPConfig{IdentityFile: server.KeyFile, Retries: 3})
+	if err != nil {
+		t.Fatalf("NewSFTPFS failed: %v", err)
+	}
+	sfs.retryDelay = time.Millisecond
+
+	dir := t.TempDir()
+	server.DropConnections()
+
+	if _, err := sfs.Stat(filepath.ToSlash(dir)); err != nil {
+		t.Fatalf("Stat after drop failed: %v", err)
+	}
+	if auths := server.Auths(); len(auths) != 2 {
+		t.Errorf("logged in %d times, want 2", len(auths))
+	}
+}
@@ -0,0 +1,501 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robertgontarski/sync/internal/logger"
+)
+
+// davNamespace holds the dead properties WebDAVFS stores on the server.
+const davNamespace = "https://github.com/robertgontarski/sync/"
+
+const davPropfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:" xmlns:s="` + davNamespace + `"><d:prop>` +
+	`<d:resourcetype/><d:getcontentlength/><d:getlastmodified/><d:getetag/><s:mtime/>` +
+	`</d:prop></d:propfind>`
+
+type WebDAVConfig struct {
+	// URL is the server's scheme and host, e.g. https://cloud.example.com.
+	// Its path is ignored; paths passed to WebDAVFS are full URL paths.
+	URL      string
+	User     string
+	Password string
+	// PasswordPrompt is called for the password when User is set and
+	// Password is empty.
+	PasswordPrompt func(user, host string) (string, error)
+	// AllowHTTPAuth allows basic auth over an http URL, which sends the
+	// password in the clear. Without it such a config is rejected.
+	AllowHTTPAuth bool
+	// Client sends the requests. Defaults to a client without timeout, as
+	// uploads can take arbitrarily long.
+	Client *http.Client
+	Logger *logger.Logger
+}
+
+// WebDAVFS accesses files on a WebDAV server. Paths are slash-separated URL
+// paths on the server, e.g. "/remote.php/dav/files/alice/Documents" for
+// Nextcloud. Directories are listed one level at a time with PROPFIND, as
+// many servers refuse infinite depth.
+//
+// WebDAV has no modes, so Chmod is a no-op. Modification times can't be set
+// through the standard properties; Chtimes stores them in a dead property
+// together with the file's ETag, and they are only used while the ETag
+// still matches, so later changes made by others are not masked.
+type WebDAVFS struct {
+	cfg    WebDAVConfig
+	base   *url.URL
+	client *http.Client
+
+	mu          sync.Mutex
+	warnedMtime bool
+}
+
+func init() {
+	open := func(info PathInfo, opts Options) (FileSystem, error) {
+		if err := checkQuery(info); err != nil {
+			return nil, err
+		}
+		return NewWebDAVFS(webdavConfigFor(info, opts))
+	}
+	Register("webdav", open)
+	Register("webdavs", open)
+}
+
+// webdavConfigFor returns the settings for a webdav:// (HTTP) or webdavs://
+// (HTTPS) endpoint.
+func webdavConfigFor(info PathInfo, opts Options) WebDAVConfig {
+	u := url.URL{Scheme: "http", Host: info.Host}
+	if info.Scheme == "webdavs" {
+		u.Scheme = "https"
+	}
+	if strings.Contains(u.Host, ":") {
+		u.Host = "[" + u.Host + "]"
+	}
+	if info.Port != 0 {
+		u.Host = net.JoinHostPort(info.Host, strconv.Itoa(info.Port))
+	}
+
+	return WebDAVConfig{
+		URL:            u.String(),
+		User:           info.User,
+		Password:       opts.WebDAVPassword,
+		PasswordPrompt: opts.PasswordPrompt,
+		AllowHTTPAuth:  opts.WebDAVAllowHTTPAuth,
+		Logger:         opts.Logger,
+	}
+}
+
+func NewWebDAVFS(cfg WebDAVConfig) (*WebDAVFS, error) {
+	base, err := url.Parse(cfg.URL)
+	if err != nil || base.Host == "" || (base.Scheme != "http" && base.Scheme != "https") {
+		return nil, fmt.Errorf("invalid WebDAV URL %q", cfg.URL)
+	}
+	if cfg.User != "" && base.Scheme == "http" && !cfg.AllowHTTPAuth {
+		return nil, fmt.Errorf("WebDAV over http would send the password for %s in the clear; use webdavs:// or allow it explicitly", cfg.User)
+	}
+
+	if cfg.User != "" && cfg.Password == "" && cfg.PasswordPrompt != nil {
+		password, err := cfg.PasswordPrompt(cfg.User, base.Hostname())
+		if err != nil {
+			return nil, err
+		}
+		cfg.Password = password
+	}
+
+	client := cfg.Client
+	if client == nil {
+		client = &http.Client{}
+	}
+	return &WebDAVFS{cfg: cfg, base: base, client: client}, nil
+}
+
+func (w *WebDAVFS) url(p string, dir bool) string {
+	u := *w.base
+	u.Path = path.Clean("/" + p)
+	if dir && u.Path != "/" {
+		u.Path += "/"
+	}
+	u.RawPath = ""
+	return u.String()
+}
+
+// do sends a request and returns the response if its status is one of ok.
+func (w *WebDAVFS) do(method, p string, dir bool, header http.Header, body io.Reader, ok ...int) (*http.Response, error) {
+	req, err := http.NewRequest(method, w.url(p, dir), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if w.cfg.User != "" {
+		req.SetBasicAuth(w.cfg.User, w.cfg.Password)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range ok {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+	resp.Body.Close()
+	return nil, davError(method, p, resp)
+}
+
+// davError converts a failed response into an error. Missing resources are
+// reported as os.ErrNotExist.
+func davError(method, p string, resp *http.Response) error {
+	err := &davStatusError{Method: method, Status: resp.Status, Code: resp.StatusCode}
+	if resp.StatusCode == http.StatusNotFound {
+		return &os.PathError{Op: strings.ToLower(method), Path: p, Err: os.ErrNotExist}
+	}
+	return &os.PathError{Op: strings.ToLower(method), Path: p, Err: err}
+}
+
+type davStatusError struct {
+	Method string
+	Status string
+	Code   int
+}
+
+func (e *davStatusError) Error() string {
+	return fmt.Sprintf("WebDAV %s: %s", e.Method, e.Status)
+}
+
+func davStatusCode(err error) int {
+	var statusErr *davStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code
+	}
+	return 0
+}
+
+type davMultistatus struct {
+	Responses []davResponse `xml:"DAV: response"`
+}
+
+type davResponse struct {
+	Href      string        `xml:"DAV: href"`
+	Propstats []davPropstat `xml:"DAV: propstat"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"DAV: prop"`
+	Status string  `xml:"DAV: status"`
+}
+
+type davProp struct {
+	ResourceType struct {
+		Collection *struct{} `xml:"DAV: collection"`
+	} `xml:"DAV: resourcetype"`
+	ContentLength string `xml:"DAV: getcontentlength"`
+	LastModified  string `xml:"DAV: getlastmodified"`
+	ETag          string `xml:"DAV: getetag"`
+	Mtime         string `xml:"https://github.com/robertgontarski/sync/ mtime"`
+}
+
+// davEntry is one resource of a PROPFIND response.
+type davEntry struct {
+	path string
+	info FileInfo
+	// guard identifies the content version the stored mtime belongs to.
+	guard string
+}
+
+// propfind returns p itself for depth 0, and p followed by its children for
+// depth 1.
+func (w *WebDAVFS) propfind(p string, depth int) ([]davEntry, error) {
+	header := http.Header{
+		"Depth":        {strconv.Itoa(depth)},
+		"Content-Type": {"application/xml; charset=utf-8"},
+	}
+	resp, err := w.do("PROPFIND", p, depth > 0, header, strings.NewReader(davPropfindBody), http.StatusMultiStatus)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var ms davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("WebDAV PROPFIND %s: %w", p, err)
+	}
+
+	entries := make([]davEntry, 0, len(ms.Responses))
+	for _, r := range ms.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, davEntryFrom(path.Clean("/"+href.Path), r.Propstats))
+	}
+	return entries, nil
+}
+
+func davEntryFrom(p string, propstats []davPropstat) davEntry {
+	var prop davProp
+	for _, ps := range propstats {
+		if strings.Contains(ps.Status, " 200 ") {
+			prop = ps.Prop
+			break
+		}
+	}
+
+	entry := davEntry{
+		path:  p,
+		info:  FileInfo{Name: path.Base(p), Mode: 0644},
+		guard: prop.ETag,
+	}
+	if entry.guard == "" {
+		entry.guard = prop.LastModified
+	}
+	if prop.ResourceType.Collection != nil {
+		entry.info.IsDir = true
+		entry.info.Mode = os.ModeDir | 0755
+	} else {
+		entry.info.Size, _ = strconv.ParseInt(prop.ContentLength, 10, 64)
+	}
+	if t, err := http.ParseTime(prop.LastModified); err == nil {
+		entry.info.ModTime = t
+	}
+	if nanos, guard, ok := strings.Cut(prop.Mtime, " "); ok && guard == entry.guard && guard != "" {
+		if n, err := strconv.ParseInt(nanos, 10, 64); err == nil {
+			entry.info.ModTime = time.Unix(0, n)
+		}
+	}
+	return entry
+}
+
+func (w *WebDAVFS) Stat(p string) (FileInfo, error) {
+	entries, err := w.propfind(p, 0)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if len(entries) == 0 {
+		return FileInfo{}, &os.PathError{Op: "stat", Path: p, Err: os.ErrNotExist}
+	}
+	info := entries[0].info
+	info.Name = path.Base(path.Clean("/" + p))
+	return info, nil
+}
+
+// Walk walks the tree rooted at root in lexical order.
+func (w *WebDAVFS) Walk(root string, fn WalkFunc) error {
+	info, err := w.Stat(root)
+	if err != nil {
+		return fn(root, FileInfo{}, err)
+	}
+	return w.walk(root, info, fn)
+}
+
+func (w *WebDAVFS) walk(p string, info FileInfo, fn WalkFunc) error {
+	if err := fn(p, info, nil); err != nil {
+		if info.IsDir && errors.Is(err, filepath.SkipDir) {
+			return nil
+		}
+		return err
+	}
+	if !info.IsDir {
+		return nil
+	}
+
+	entries, err := w.propfind(p, 1)
+	if err != nil {
+		return fn(p, info, err)
+	}
+	self := path.Clean("/" + p)
+	children := entries[:0]
+	for _, entry := range entries {
+		if entry.path != self {
+			children = append(children, entry)
+		}
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].info.Name < children[j].info.Name })
+
+	for _, entry := range children {
+		if err := w.walk(path.Join(p, entry.info.Name), entry.info, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *WebDAVFS) Open(p string) (io.ReadCloser, error) {
+	resp, err := w.do(http.MethodGet, p, false, nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Create uploads the file with a single streaming PUT.
+func (w *WebDAVFS) Create(p string) (io.WriteCloser, error) {
+	pr, pw := io.Pipe()
+	writer := &davWriter{pw: pw, done: make(chan error, 1)}
+	go func() {
+		resp, err := w.do(http.MethodPut, p, false, nil, pr, http.StatusOK, http.StatusCreated, http.StatusNoContent)
+		if err == nil {
+			resp.Body.Close()
+		}
+		pr.CloseWithError(err)
+		writer.done <- err
+	}()
+	return writer, nil
+}
+
+type davWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+	once sync.Once
+	err  error
+}
+
+func (d *davWriter) Write(p []byte) (int, error) {
+	return d.pw.Write(p)
+}
+
+func (d *davWriter) Close() error {
+	return d.finish(nil)
+}
+
+// Abort cancels the upload.
+func (d *davWriter) Abort() error {
+	d.finish(errors.New("upload aborted"))
+	return nil
+}
+
+func (d *davWriter) finish(abort error) error {
+	d.once.Do(func() {
+		d.pw.CloseWithError(abort)
+		d.err = <-d.done
+	})
+	return d.err
+}
+
+func (w *WebDAVFS) Remove(p string) error {
+	info, err := w.Stat(p)
+	if err != nil {
+		return err
+	}
+	resp, err := w.do(http.MethodDelete, p, info.IsDir, nil, nil, http.StatusOK, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// MkdirAll creates p and its missing parents with MKCOL.
+func (w *WebDAVFS) MkdirAll(p string, perm os.FileMode) error {
+	if info, err := w.Stat(p); err == nil {
+		if !info.IsDir {
+			return &os.PathError{Op: "mkdir", Path: p, Err: errors.New("not a directory")}
+		}
+		return nil
+	}
+
+	dir := ""
+	for _, name := range strings.Split(strings.Trim(path.Clean("/"+p), "/"), "/") {
+		dir += "/" + name
+		resp, err := w.do("MKCOL", dir, true, nil, nil, http.StatusCreated)
+		if err == nil {
+			resp.Body.Close()
+			continue
+		}
+		// 405 means the collection exists already.
+		if davStatusCode(err) != http.StatusMethodNotAllowed {
+			return err
+		}
+	}
+	return nil
+}
+
+// Chmod does nothing; WebDAV has no file modes.
+func (w *WebDAVFS) Chmod(p string, mode os.FileMode) error {
+	return nil
+}
+
+// Chtimes stores mtime in a dead property, tied to the file's current ETag.
+// Servers that don't keep dead properties are left alone.
+func (w *WebDAVFS) Chtimes(p string, atime, mtime time.Time) error {
+	entries, err := w.propfind(p, 0)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 || entries[0].guard == "" {
+		w.warnMtime()
+		return nil
+	}
+
+	var value bytes.Buffer
+	xml.EscapeText(&value, []byte(strconv.FormatInt(mtime.UnixNano(), 10)+" "+entries[0].guard))
+	body := `<?xml version="1.0" encoding="utf-8"?>
+<d:propertyupdate xmlns:d="DAV:" xmlns:s="` + davNamespace + `"><d:set><d:prop><s:mtime>` +
+		value.String() + `</s:mtime></d:prop></d:set></d:propertyupdate>`
+
+	header := http.Header{"Content-Type": {"application/xml; charset=utf-8"}}
+	resp, err := w.do("PROPPATCH", p, false, header, strings.NewReader(body), http.StatusMultiStatus, http.StatusOK)
+	if err != nil {
+		switch davStatusCode(err) {
+		case http.StatusForbidden, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+			w.warnMtime()
+			return nil
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusMultiStatus {
+		var ms davMultistatus
+		if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+			return fmt.Errorf("WebDAV PROPPATCH %s: %w", p, err)
+		}
+		for _, r := range ms.Responses {
+			for _, ps := range r.Propstats {
+				if !strings.Contains(ps.Status, " 200 ") {
+					w.warnMtime()
+					return nil
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (w *WebDAVFS) warnMtime() {
+	w.mu.Lock()
+	warn := !w.warnedMtime
+	w.warnedMtime = true
+	w.mu.Unlock()
+
+	if warn && w.cfg.Logger != nil {
+		w.cfg.Logger.Warn("%s cannot store modification times; consider --checksum", w.base.Host)
+	}
+}
+
+func (w *WebDAVFS) Close() error {
+	w.client.CloseIdleConnections()
+	return nil
+}
+
+// Separator returns '/', which WebDAV paths always use.
+func (w *WebDAVFS) Separator() byte {
+	return '/'
+}
@@ -0,0 +1,284 @@
+package fs
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// davServer is a WebDAV server backed by golang.org/x/net/webdav's in-memory
+// filesystem, requiring basic auth and counting requests by method.
+type davServer struct {
+	fs       webdav.FileSystem
+	url      string
+	rejectFn func(r *http.Request) bool
+
+	mu      sync.Mutex
+	methods map[string]int
+}
+
+func newDAVServer(t *testing.T) *davServer {
+	t.Helper()
+
+	s := &davServer{fs: webdav.NewMemFS(), methods: make(map[string]int)}
+	handler := &webdav.Handler{FileSystem: s.fs, LockSystem: webdav.NewMemLS()}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "user" || password != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		s.mu.Lock()
+		s.methods[r.Method]++
+		s.mu.Unlock()
+		if s.rejectFn != nil && s.rejectFn(r) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	s.url = server.URL
+	return s
+}
+
+func (s *davServer) count(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.methods[method]
+}
+
+// write stores a file directly on the server, like another client would.
+func (s *davServer) write(t *testing.T, p, content string) {
+	t.Helper()
+
+	f, err := s.fs.OpenFile(context.Background(), p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile(%s) failed: %v", p, err)
+	}
+	if _, err := io.WriteString(f, content); err != nil {
+		t.Fatalf("Write(%s) failed: %v", p, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close(%s) failed: %v", p, err)
+	}
+}
+
+func newTestWebDAVFS(t *testing.T, server *davServer) *WebDAVFS {
+	t.Helper()
+
+	w, err := NewWebDAVFS(WebDAVConfig{URL: server.url, User: "user", Password: "secret", AllowHTTPAuth: true})
+	if err != nil {
+		t.Fatalf("NewWebDAVFS failed: %v", err)
+	}
+	t.Cleanup(func() { w.Close() })
+	return w
+}
+
+func TestWebDAVFS_RoundTrip(t *testing.T) {
+	server := newDAVServer(t)
+	w := newTestWebDAVFS(t, server)
+
+	if err := w.MkdirAll("/docs/sub dir/ünï", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	if err := w.MkdirAll("/docs/sub dir", 0755); err != nil {
+		t.Fatalf("MkdirAll of existing directory failed: %v", err)
+	}
+	writeFile(t, w, "/docs/a.txt", []byte("alpha"))
+	writeFile(t, w, "/docs/sub dir/ünï/b #1.txt", []byte("bravo!"))
+
+	info, err := w.Stat("/docs/a.txt")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Name != "a.txt" || info.Size != 5 || info.IsDir {
+		t.Errorf("Stat = %+v, want a.txt with 5 bytes", info)
+	}
+	if _, err := w.Stat("/docs/missing"); !os.IsNotExist(err) {
+		t.Errorf("Stat(missing) = %v, want not-exist error", err)
+	}
+
+	var got []string
+	err = w.Walk("/docs", func(p string, info FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir {
+			p += "/"
+		}
+		got = append(got, p)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk failed: %v", err)
+	}
+	want := []string{"/docs/", "/docs/a.txt", "/docs/sub dir/", "/docs/sub dir/ünï/", "/docs/sub dir/ünï/b #1.txt"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Walk = %v, want %v", got, want)
+	}
+
+	if data, err := readFile(w, "/docs/sub dir/ünï/b #1.txt"); err != nil || string(data) != "bravo!" {
+		t.Errorf("content = %q, %v, want %q", data, err, "bravo!")
+	}
+	if _, err := w.Open("/docs/missing"); !os.IsNotExist(err) {
+		t.Errorf("Open(missing) = %v, want not-exist error", err)
+	}
+
+	if err := w.Remove("/docs/a.txt"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if _, err := w.Stat("/docs/a.txt"); !os.IsNotExist(err) {
+		t.Errorf("Stat after Remove = %v, want not-exist error", err)
+	}
+}
+
+func TestWebDAVFS_Chtimes(t *testing.T) {
+	server := newDAVServer(t)
+	w := newTestWebDAVFS(t, server)
+	writeFile(t, w, "/file.txt", []byte("content"))
+
+	modTime := time.Date(2020, 5, 6, 7, 8, 9, 0, time.UTC)
+	if err := w.Chtimes("/file.txt", modTime, modTime); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+	if server.count("PROPPATCH") != 1 {
+		t.Errorf("PROPPATCH sent %d times, want 1", server.count("PROPPATCH"))
+	}
+
+	info, err := w.Stat("/file.txt")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if !info.ModTime.Equal(modTime) {
+		t.Errorf("ModTime = %v, want %v", info.ModTime, modTime)
+	}
+
+	// Another client changing the file invalidates the stored time.
+	time.Sleep(10 * time.Millisecond)
+	server.write(t, "/file.txt", "changed")
+	info, err = w.Stat("/file.txt")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.ModTime.Equal(modTime) {
+		t.Error("stored modification time should not survive an outside change")
+	}
+}
+
+func TestWebDAVFS_ChtimesUnsupported(t *testing.T) {
+	server := newDAVServer(t)
+	server.rejectFn = func(r *http.Request) bool { return r.Method == "PROPPATCH" }
+	w := newTestWebDAVFS(t, server)
+	writeFile(t, w, "/file.txt", []byte("content"))
+
+	if err := w.Chtimes("/file.txt", time.Unix(0, 0), time.Unix(0, 0)); err != nil {
+		t.Errorf("Chtimes on a server refusing PROPPATCH = %v, want nil", err)
+	}
+}
+
+func TestWebDAVFS_AuthFailure(t *testing.T) {
+	server := newDAVServer(t)
+	w, err := NewWebDAVFS(WebDAVConfig{URL: server.url, User: "user", Password: "wrong", AllowHTTPAuth: true})
+	if err != nil {
+		t.Fatalf("NewWebDAVFS failed: %v", err)
+	}
+
+	_, err = w.Stat("/")
+	if davStatusCode(err) != http.StatusUnauthorized {
+		t.Errorf("Stat = %v, want 401", err)
+	}
+}
+
+func TestWebDAVFS_PromptsForPassword(t *testing.T) {
+	server := newDAVServer(t)
+	w, err := NewWebDAVFS(WebDAVConfig{
+		URL:  server.url,
+		User: "user",
+		PasswordPrompt: func(user, host string) (string, error) {
+			return "secret", nil
+		},
+		AllowHTTPAuth: true,
+	})
+	if err != nil {
+		t.Fatalf("NewWebDAVFS failed: %v", err)
+	}
+	if _, err := w.Stat("/"); err != nil {
+		t.Errorf("Stat with prompted password failed: %v", err)
+	}
+}
+
+func TestWebDAVFS_AbortAndCreateErrors(t *testing.T) {
+	server := newDAVServer(t)
+	w := newTestWebDAVFS(t, server)
+
+	f, err := w.Create("/missing-dir/file.txt")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	io.WriteString(f, "data")
+	if err := f.Close(); err == nil {
+		t.Error("upload into a missing directory should fail on Close")
+	}
+
+	f, err = w.Create("/aborted.txt")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	io.WriteString(f, "partial")
+	if err := f.(Aborter).Abort(); err != nil {
+		t.Errorf("Abort failed: %v", err)
+	}
+}
+
+func TestNewWebDAVFS_InvalidURL(t *testing.T) {
+	for _, raw := range []string{"", "ftp://host", "://bad", "http://"} {
+		if _, err := NewWebDAVFS(WebDAVConfig{URL: raw}); err == nil {
+			t.Errorf("NewWebDAVFS(%q) should fail", raw)
+		}
+	}
+}
+
+func TestNewWebDAVFS_HTTPAuth(t *testing.T) {
+	if _, err := NewWebDAVFS(WebDAVConfig{URL: "http://host", User: "user", Password: "secret"}); err == nil {
+		t.Error("NewWebDAVFS should refuse basic auth over http")
+	}
+	if _, err := NewWebDAVFS(WebDAVConfig{URL: "https://host", User: "user", Password: "secret"}); err != nil {
+		t.Errorf("NewWebDAVFS over https failed: %v", err)
+	}
+	if _, err := NewWebDAVFS(WebDAVConfig{URL: "http://host"}); err != nil {
+		t.Errorf("NewWebDAVFS over http without a user failed: %v", err)
+	}
+}
+
+func TestWebDAVConfigFor_Password(t *testing.T) {
+	opts := Options{Password: "ssh", WebDAVPassword: "dav"}
+	if got := webdavConfigFor(mustParsePath(t, "webdavs://user@host/dav"), opts).Password; got != "dav" {
+		t.Errorf("Password = %q, want the WebDAV password", got)
+	}
+}
+
+func TestWebDAVConfigFor_URL(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{raw: "webdav://host/dav", want: "http://host"},
+		{raw: "webdavs://user@host/dav", want: "https://host"},
+		{raw: "webdavs://host:8443/dav", want: "https://host:8443"},
+	}
+
+	for _, tt := range tests {
+		if got := webdavConfigFor(mustParsePath(t, tt.raw), Options{}).URL; got != tt.want {
+			t.Errorf("webdavConfigFor(%s).URL = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Package hooks runs user-configured commands and webhooks before and
+// after a sync.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robertgontarski/sync/internal/cli"
+	"github.com/robertgontarski/sync/internal/logger"
+	"github.com/robertgontarski/sync/internal/syncer"
+)
+
+// Event is the point in a run a hook fires at.
+type Event string
+
+const (
+	PreSync   Event = "pre-sync"
+	PostSync  Event = "post-sync"
+	OnFailure Event = "on-failure"
+)
+
+// Timeout limits how long a single hook may run.
+const Timeout = 5 * time.Minute
+
+// waitDelay is how long a command that timed out may take to exit, and to
+// close its output, once it has been killed.
+const waitDelay = 5 * time.Second
+
+// Run describes the sync a hook fires for. Webhooks receive it as their
+// JSON body.
+type Run struct {
+	Event  Event  `json:"event"`
+	Source string `json:"source"`
+	Target string `json:"target"`
+	// Changed reports whether any file was copied, updated or deleted.
+	Changed bool `json:"changed"`
+	// Summary is nil for pre-sync hooks.
+	Summary *syncer.Summary `json:"summary,omitempty"`
+}
+
+// Runner fires the hooks of a configuration.
+type Runner struct {
+	config  *cli.Config
+	logger  *logger.Logger
+	client  *http.Client
+	timeout time.Duration
+}
+
+func New(config *cli.Config, log *logger.Logger) *Runner {
+	return &Runner{
+		config:  config,
+		logger:  log,
+		client:  &http.Client{Timeout: Timeout},
+		timeout: Timeout,
+	}
+}
+
+// Before fires the pre-sync hooks. An error means the sync shouldn't run.
+func (r *Runner) Before() error {
+	return r.fire(r.config.PreSyncHooks, Run{Event: PreSync})
+}
+
+// After fires the hooks for a finished run: post-sync hooks if it got
+// through, even with failed files, and on-failure hooks if it returned an
+// error. Errors from these hooks are logged; the run's result stands.
+func (r *Runner) After(result syncer.Result, err error) {
+	summary := syncer.NewSummary(result, err)
+	changed := result.Copied+result.Updated+result.Deleted > 0
+
+	code := syncer.ExitCode(err)
+	completed := code == cli.ExitOK || code == cli.ExitPartial
+	if completed && (changed || !r.config.PostSyncIfChanged) {
+		r.logError(r.fire(r.config.PostSyncHooks, Run{Event: PostSync, Changed: changed, Summary: &summary}))
+	}
+	if err != nil {
+		r.logError(r.fire(r.config.FailureHooks, Run{Event: OnFailure, Changed: changed, Summary: &summary}))
+	}
+}
+
+func (r *Runner) logError(err error) {
+	if err != nil {
+		r.logger.Error("%v", err)
+	}
+}
+
+// fire runs hooks in order, stopping at the first that fails.
+func (r *Runner) fire(hooks []string, run Run) error {
+	run.Source, run.Target = r.config.SourceDir, r.config.TargetDir
+	for _, hook := range hooks {
+		r.logger.Debug("running %s hook %s", run.Event, hook)
+		var err error
+		if isURL(hook) {
+			err = r.post(hook, run)
+		} else {
+			err = r.command(hook, run)
+		}
+		if err != nil {
+			return fmt.Errorf("%s hook %s failed: %w", run.Event, hook, err)
+		}
+	}
+	return nil
+}
+
+func isURL(hook string) bool {
+	return strings.HasPrefix(hook, "http://") || strings.HasPrefix(hook, "https://")
+}
+
+// post sends run as JSON to a webhook.
+func (r *Runner) post(url string, run Run) error {
+	body, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	resp, err := r.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("server returned %s", resp.Status)
+	}
+	return nil
+}
+
+// command runs a shell command with the run in its environment. Its
+// output is captured, so it doesn't mix with the sync's own output, and
+// included in the error if it fails. On timeout the processes it started
+// are killed along with the shell.
+func (r *Runner) command(command string, run Run) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	cmd.Env = append(os.Environ(), environ(run)...)
+	cmd.WaitDelay = waitDelay
+	killGroupOnCancel(cmd)
+
+	output, err := cmd.CombinedOutput()
+	if out := strings.TrimSpace(string(output)); out != "" {
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, out)
+		}
+		r.logger.Debug("%s hook output: %s", run.Event, out)
+	}
+	return err
+}
+
+// environ returns the environment variables describing run to a command.
+func environ(run Run) []string {
+	env := []string{
+		"SYNC_EVENT=" + string(run.Event),
+		"SYNC_SOURCE=" + run.Source,
+		"SYNC_TARGET=" + run.Target,
+	}
+	if s := run.Summary; s != nil {
+		env = append(env,
+			"SYNC_CHANGED="+strconv.FormatBool(run.Changed),
+			"SYNC_SCANNED="+strconv.Itoa(s.Scanned),
+			"SYNC_COPIED="+strconv.Itoa(s.Copied),
+			"SYNC_UPDATED="+strconv.Itoa(s.Updated),
+			"SYNC_SKIPPED="+strconv.Itoa(s.Skipped),
+			"SYNC_DELETED="+strconv.Itoa(s.Deleted),
+			"SYNC_FAILED="+strconv.Itoa(s.Failed),
+			"SYNC_BYTES_SENT="+strconv.FormatInt(s.BytesSent, 10),
+			"SYNC_DURATION="+strconv.FormatFloat(s.Duration, 'f', 3, 64),
+			"SYNC_EXIT_CODE="+strconv.Itoa(s.ExitCode),
+			"SYNC_ERROR="+s.Error,
+		)
+	}
+	return env
+}
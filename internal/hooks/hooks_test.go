@@ -0,0 +1,157 @@
+package hooks
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/robertgontarski/sync/internal/cli"
+	"github.com/robertgontarski/sync/internal/logger"
+	"github.com/robertgontarski/sync/internal/syncer"
+)
+
+func TestRunner_Command(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	out := filepath.Join(t.TempDir(), "env")
+	config := &cli.Config{
+		SourceDir:     "/data",
+		TargetDir:     "host:/backup",
+		PostSyncHooks: []string{`echo "$SYNC_EVENT $SYNC_SOURCE $SYNC_TARGET $SYNC_CHANGED $SYNC_COPIED $SYNC_EXIT_CODE" > ` + out},
+	}
+	New(config, logger.NewWithWriter(&bytes.Buffer{})).After(syncer.Result{Scanned: 3, Copied: 2}, nil)
+
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("hook didn't run: %v", err)
+	}
+	if want := "post-sync /data host:/backup true 2 0\n"; string(got) != want {
+		t.Errorf("hook saw %q, want %q", got, want)
+	}
+}
+
+func TestRunner_PreSyncFailure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	config := &cli.Config{PreSyncHooks: []string{"echo mount missing; exit 3"}}
+	err := New(config, logger.NewWithWriter(&bytes.Buffer{})).Before()
+	if err == nil || !strings.Contains(err.Error(), "pre-sync hook") || !strings.Contains(err.Error(), "mount missing") {
+		t.Errorf("Before = %v, want the failing hook and its output", err)
+	}
+}
+
+func TestRunner_CommandTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	config := &cli.Config{PreSyncHooks: []string{"sleep 30 & echo $! > " + pidFile + "; wait"}}
+	runner := New(config, logger.NewWithWriter(&bytes.Buffer{}))
+	runner.timeout = 200 * time.Millisecond
+
+	start := time.Now()
+	if err := runner.Before(); err == nil {
+		t.Fatal("Before succeeded although the hook timed out")
+	}
+	if elapsed := time.Since(start); elapsed > waitDelay {
+		t.Errorf("Before took %v", elapsed)
+	}
+
+	// The background sleep was killed along with the shell.
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatalf("failed to read pid: %v", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatalf("bad pid %q: %v", data, err)
+	}
+	process, _ := os.FindProcess(pid)
+	for deadline := time.Now().Add(5 * time.Second); process.Signal(syscall.Signal(0)) == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			process.Kill()
+			t.Fatal("background process outlived the timed out hook")
+		}
+	}
+}
+
+func TestRunner_Webhook(t *testing.T) {
+	var received []Run
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var run Run
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %s with Content-Type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&run); err != nil {
+			t.Errorf("body is not JSON: %v", err)
+		}
+		received = append(received, run)
+	}))
+	defer server.Close()
+
+	config := &cli.Config{
+		PostSyncHooks: []string{server.URL + "/post"},
+		FailureHooks:  []string{server.URL + "/failure"},
+	}
+	failed := &syncer.SyncError{Failures: []syncer.Failure{{Path: "a.txt", Op: "copy", Err: errors.New("disk full")}}}
+	New(config, logger.NewWithWriter(&bytes.Buffer{})).After(syncer.Result{Copied: 1, Failed: 1}, failed)
+
+	// A run with failed files completed, so both hooks fire.
+	if len(received) != 2 || received[0].Event != PostSync || received[1].Event != OnFailure {
+		t.Fatalf("received %+v, want post-sync and on-failure", received)
+	}
+	s := received[1].Summary
+	if s == nil || s.Failed != 1 || s.ExitCode != cli.ExitPartial || !strings.Contains(s.Error, "copy a.txt: disk full") {
+		t.Errorf("summary = %+v", s)
+	}
+}
+
+func TestRunner_PostSyncIfChanged(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer server.Close()
+
+	config := &cli.Config{PostSyncHooks: []string{server.URL}, PostSyncIfChanged: true}
+	runner := New(config, logger.NewWithWriter(&bytes.Buffer{}))
+	runner.After(syncer.Result{Scanned: 5, Skipped: 5}, nil)
+	if calls != 0 {
+		t.Errorf("post-sync hook fired for a run that changed nothing")
+	}
+	runner.After(syncer.Result{Scanned: 5, Skipped: 4, Deleted: 1}, nil)
+	if calls != 1 {
+		t.Errorf("post-sync hook fired %d times after a change, want 1", calls)
+	}
+
+	// Fatal errors skip post-sync hooks.
+	runner.After(syncer.Result{Copied: 1}, errors.New("connection refused"))
+	if calls != 1 {
+		t.Errorf("post-sync hook fired after a fatal error")
+	}
+}
+
+func TestRunner_WebhookError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	log := &bytes.Buffer{}
+	New(&cli.Config{FailureHooks: []string{server.URL}}, logger.NewWithWriter(log)).After(syncer.Result{}, errors.New("boom"))
+	if !strings.Contains(log.String(), "on-failure hook") || !strings.Contains(log.String(), "502") {
+		t.Errorf("log = %q, want the failed webhook", log.String())
+	}
+}
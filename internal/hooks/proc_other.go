@@ -0,0 +1,10 @@
+//go:build !unix
+
+package hooks
+
+import "os/exec"
+
+// killGroupOnCancel leaves cmd as it is: only the shell is killed when cmd
+// is cancelled, and WaitDelay keeps a hook from waiting on the output of
+// processes it left behind.
+func killGroupOnCancel(cmd *exec.Cmd) {}
@@ -1,45 +1,202 @@
 package logger
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
+	"sync"
 	"time"
 )
 
 type Level string
 
 const (
+	DEBUG Level = "DEBUG"
 	INFO  Level = "INFO"
+	WARN  Level = "WARN"
 	ERROR Level = "ERROR"
 )
 
+// rank orders the levels by severity.
+func (l Level) rank() int {
+	switch l {
+	case DEBUG:
+		return 0
+	case WARN:
+		return 2
+	case ERROR:
+		return 3
+	}
+	return 1
+}
+
+// slogLevel returns the slog level matching l.
+func (l Level) slogLevel() slog.Level {
+	switch l {
+	case DEBUG:
+		return slog.LevelDebug
+	case WARN:
+		return slog.LevelWarn
+	case ERROR:
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
+
 type Logger struct {
+	mu  sync.Mutex
 	out io.Writer
+	// errOut receives WARN and ERROR lines instead of out.
+	errOut io.Writer
+	// file receives a copy of every line; nil if there is none.
+	file io.Writer
+	// level is the least severe level that is written.
+	level Level
+	// json writes every line as a JSON object instead of text.
+	json bool
+	// slog, if set, receives every message instead of the writers.
+	slog *slog.Logger
 }
 
+// New returns a Logger writing to stdout, with warnings and errors on
+// stderr.
 func New() *Logger {
 	return &Logger{
-		out: os.Stdout,
+		out:    os.Stdout,
+		errOut: os.Stderr,
+		level:  INFO,
 	}
 }
 
+// NewWithWriter returns a Logger writing all lines to w.
 func NewWithWriter(w io.Writer) *Logger {
 	return &Logger{
-		out: w,
+		out:    w,
+		errOut: w,
+		level:  INFO,
+	}
+}
+
+// NewJSON returns a Logger writing one JSON object per line to w, for
+// output that is read by other programs.
+func NewJSON(w io.Writer) *Logger {
+	return &Logger{
+		out:    w,
+		errOut: w,
+		level:  INFO,
+		json:   true,
+	}
+}
+
+// NewSlog returns a Logger passing its messages on to l, whose handler
+// decides which levels are kept.
+func NewSlog(l *slog.Logger) *Logger {
+	return &Logger{
+		level: DEBUG,
+		slog:  l,
+	}
+}
+
+// SetLevel makes the logger drop lines less severe than level.
+func (l *Logger) SetLevel(level Level) {
+	l.level = level
+}
+
+// SetErrorWriter sends WARN and ERROR lines to w.
+func (l *Logger) SetErrorWriter(w io.Writer) {
+	l.errOut = w
+}
+
+// SetFile copies every line written to w, e.g. a RotatingFile.
+func (l *Logger) SetFile(w io.Writer) {
+	l.file = w
+}
+
+// Enabled reports whether lines at level are written.
+func (l *Logger) Enabled(level Level) bool {
+	if l.slog != nil {
+		return l.slog.Enabled(context.Background(), level.slogLevel())
 	}
+	return level.rank() >= l.level.rank()
+}
+
+// JSON reports whether the logger writes JSON.
+func (l *Logger) JSON() bool {
+	return l.json
+}
+
+// line is a log message in JSON output.
+type line struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Level   Level     `json:"level"`
+	Message string    `json:"message"`
 }
 
 func (l *Logger) log(level Level, format string, args ...any) {
-	timestamp := time.Now().Format("2006-01-02 15:04:05")
+	if !l.Enabled(level) {
+		return
+	}
 	message := fmt.Sprintf(format, args...)
-	fmt.Fprintf(l.out, "[%s] %s: %s\n", level, timestamp, message)
+	if l.slog != nil {
+		l.slog.Log(context.Background(), level.slogLevel(), message)
+		return
+	}
+	out := l.out
+	if level.rank() >= WARN.rank() {
+		out = l.errOut
+	}
+	if l.json {
+		l.write(out, l.marshal(line{Type: "log", Time: time.Now(), Level: level, Message: message}))
+		return
+	}
+	timestamp := time.Now().Format("2006-01-02 15:04:05")
+	l.write(out, fmt.Appendf(nil, "[%s] %s: %s\n", level, timestamp, message))
+}
+
+func (l *Logger) Debug(format string, args ...any) {
+	l.log(DEBUG, format, args...)
 }
 
 func (l *Logger) Info(format string, args ...any) {
 	l.log(INFO, format, args...)
 }
 
+func (l *Logger) Warn(format string, args ...any) {
+	l.log(WARN, format, args...)
+}
+
 func (l *Logger) Error(format string, args ...any) {
 	l.log(ERROR, format, args...)
 }
+
+// Event writes v as a line of JSON. Text output has no events, so it
+// writes nothing there.
+func (l *Logger) Event(v any) {
+	if !l.json {
+		return
+	}
+	l.write(l.out, l.marshal(v))
+}
+
+func (l *Logger) marshal(v any) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(line{Type: "log", Time: time.Now(), Level: ERROR, Message: err.Error()})
+	}
+	return append(data, '\n')
+}
+
+// write writes a whole line to out and the log file, so lines from
+// concurrent callers don't interleave.
+func (l *Logger) write(out io.Writer, data []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out.Write(data)
+	if l.file != nil {
+		l.file.Write(data)
+	}
+}
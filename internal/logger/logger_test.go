@@ -0,0 +1,132 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogger_Levels(t *testing.T) {
+	out, errOut, file := &bytes.Buffer{}, &bytes.Buffer{}, &bytes.Buffer{}
+	l := NewWithWriter(out)
+	l.SetErrorWriter(errOut)
+	l.SetFile(file)
+
+	l.Debug("hidden")
+	l.Info("copying a.txt")
+	l.Warn("slow server")
+	l.Error("failed")
+
+	if strings.Contains(out.String(), "hidden") || !strings.Contains(out.String(), "[INFO]") {
+		t.Errorf("stdout = %q", out.String())
+	}
+	if strings.Contains(out.String(), "WARN") || strings.Count(errOut.String(), "\n") != 2 {
+		t.Errorf("warnings and errors should go to the error writer only, got %q and %q", out.String(), errOut.String())
+	}
+	if strings.Count(file.String(), "\n") != 3 {
+		t.Errorf("log file = %q, want all three lines", file.String())
+	}
+
+	out.Reset()
+	l.SetLevel(DEBUG)
+	l.Debug("a.txt: size differs")
+	if !strings.HasPrefix(out.String(), "[DEBUG] ") {
+		t.Errorf("debug line = %q", out.String())
+	}
+
+	out.Reset()
+	errOut.Reset()
+	l.SetLevel(WARN)
+	l.Info("copying a.txt")
+	l.Warn("slow server")
+	if out.Len() != 0 || errOut.Len() == 0 {
+		t.Errorf("WARN level wrote %q and %q", out.String(), errOut.String())
+	}
+}
+
+func TestLogger_JSON(t *testing.T) {
+	out := &bytes.Buffer{}
+	l := NewJSON(out)
+	l.Error("connection to %s lost", "host")
+
+	var got line
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("not JSON: %q", out.String())
+	}
+	if got.Type != "log" || got.Level != ERROR || got.Message != "connection to host lost" {
+		t.Errorf("line = %+v", got)
+	}
+
+	text := &bytes.Buffer{}
+	NewWithWriter(text).Event(got)
+	if text.Len() != 0 {
+		t.Errorf("text output wrote an event: %q", text.String())
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "sync.log")
+	os.WriteFile(p, []byte("from an earlier run\n"), 0644)
+
+	f, err := OpenRotatingFile(p, 30, 2)
+	if err != nil {
+		t.Fatalf("OpenRotatingFile failed: %v", err)
+	}
+	// Each line is 20 bytes, so every write after the first rotates.
+	for _, s := range []string{"first line of three\n", "second line of thre\n", "third line of three\n"} {
+		if _, err := f.Write([]byte(s)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	f.Close()
+
+	for name, want := range map[string]string{
+		"sync.log":   "third line of three\n",
+		"sync.log.1": "second line of thre\n",
+		"sync.log.2": "first line of three\n",
+	} {
+		got, err := os.ReadFile(filepath.Join(filepath.Dir(p), name))
+		if err != nil || string(got) != want {
+			t.Errorf("%s = %q, %v, want %q", name, got, err, want)
+		}
+	}
+	if _, err := os.Stat(p + ".3"); !os.IsNotExist(err) {
+		t.Errorf("kept more than 2 old files: %v", err)
+	}
+
+	// Without rotation the file is appended to.
+	f, _ = OpenRotatingFile(p, 0, 2)
+	f.Write([]byte("more\n"))
+	f.Close()
+	if got, _ := os.ReadFile(p); string(got) != "third line of three\nmore\n" {
+		t.Errorf("sync.log = %q after appending", got)
+	}
+}
+
+func TestRotatingFile_RotationFails(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "sync.log")
+	// A non-empty directory in the way of sync.log.1 makes the rename fail.
+	if err := os.MkdirAll(filepath.Join(p+".1", "sub"), 0755); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+
+	f, err := OpenRotatingFile(p, 30, 1)
+	if err != nil {
+		t.Fatalf("OpenRotatingFile failed: %v", err)
+	}
+	f.Write([]byte("first line of three\n"))
+	if _, err := f.Write([]byte("second line of thre\n")); err == nil {
+		t.Error("Write didn't report the failed rotation")
+	}
+	f.Write([]byte("third line of three\n"))
+	f.Close()
+
+	// Lines keep going to the current file.
+	want := "first line of three\nsecond line of thre\nthird line of three\n"
+	if got, _ := os.ReadFile(p); string(got) != want {
+		t.Errorf("sync.log = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,99 @@
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// RotatingFile is a log file that is rotated once it would grow past a
+// maximum size: FILE is renamed to FILE.1, FILE.1 to FILE.2 and so on,
+// and the oldest is removed.
+type RotatingFile struct {
+	path    string
+	maxSize int64
+	keep    int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// OpenRotatingFile opens path for appending. It is rotated when it would
+// exceed maxSize bytes, keeping keep old files; a maxSize of 0 never
+// rotates.
+func OpenRotatingFile(path string, maxSize int64, keep int) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, maxSize: maxSize, keep: keep}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var rotateErr error
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if rotateErr = f.rotate(); f.file == nil {
+			return 0, rotateErr
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// rotate moves the current file and its predecessors one place along and
+// starts a new file. If that fails, the current file is reopened so
+// logging carries on; f.file is only nil if that failed as well.
+func (f *RotatingFile) rotate() error {
+	err := f.file.Close()
+	if err == nil {
+		err = f.shift()
+	}
+	if openErr := f.open(); openErr != nil {
+		f.file = nil
+		return errors.Join(err, openErr)
+	}
+	return err
+}
+
+func (f *RotatingFile) shift() error {
+	if f.keep == 0 {
+		return os.Remove(f.path)
+	}
+	os.Remove(fmt.Sprintf("%s.%d", f.path, f.keep))
+	for i := f.keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	return os.Rename(f.path, f.path+".1")
+}
+
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
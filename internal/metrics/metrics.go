@@ -0,0 +1,247 @@
+// Package metrics collects counters and histograms about sync runs and
+// exposes them in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Buckets of the duration histograms, in seconds.
+var (
+	runBuckets  = []float64{1, 5, 15, 30, 60, 300, 900, 1800, 3600, 7200, 21600}
+	fileBuckets = []float64{0.01, 0.1, 0.5, 1, 5, 15, 60, 300}
+)
+
+// lastSuccessName is the metric carried over between runs by Restore.
+const lastSuccessName = "sync_last_success_timestamp_seconds"
+
+// Metrics holds the metrics of this process. The methods recording into
+// a nil *Metrics do nothing, so callers don't need to check whether
+// metrics are enabled.
+type Metrics struct {
+	mu           sync.Mutex
+	files        map[string]float64
+	bytes        float64
+	errors       map[string]float64
+	reconnects   float64
+	runs         map[string]float64
+	runDuration  *histogram
+	fileDuration *histogram
+	// lastSuccess is the end of the last successful run in Unix seconds,
+	// or 0 if there was none.
+	lastSuccess float64
+}
+
+// New returns empty metrics.
+func New() *Metrics {
+	return &Metrics{
+		files:        map[string]float64{},
+		errors:       map[string]float64{},
+		runs:         map[string]float64{},
+		runDuration:  newHistogram(runBuckets),
+		fileDuration: newHistogram(fileBuckets),
+	}
+}
+
+// File records an action on a file, e.g. "copy", that transferred bytes
+// and took d.
+func (m *Metrics) File(action string, bytes int64, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[action]++
+	m.bytes += float64(bytes)
+	if bytes > 0 {
+		m.fileDuration.observe(d.Seconds())
+	}
+}
+
+// Error records a failed operation on a file, e.g. "copy".
+func (m *Metrics) Error(op string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errors[op]++
+}
+
+// Reconnect records that a lost SSH connection was re-established.
+func (m *Metrics) Reconnect() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reconnects++
+}
+
+// Run records a finished run, with result "success", "partial" or
+// "failed", that took d.
+func (m *Metrics) Run(result string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.runs[result]++
+	m.runDuration.observe(d.Seconds())
+	if result == "success" {
+		m.lastSuccess = float64(time.Now().Unix())
+	}
+}
+
+// Restore takes over the last success time from a file written by
+// WriteFile in an earlier run, so it survives failed runs. A missing file
+// is not an error.
+func (m *Metrics) Restore(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), " ")
+		if !ok || name != lastSuccessName {
+			continue
+		}
+		if v, err := strconv.ParseFloat(value, 64); err == nil {
+			m.mu.Lock()
+			m.lastSuccess = max(m.lastSuccess, v)
+			m.mu.Unlock()
+		}
+	}
+	return scanner.Err()
+}
+
+// WriteTo writes the metrics in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+	writeLabeled(&b, "sync_files_total", "counter", "Files handled, by action.", "action", m.files)
+	writeMetric(&b, "sync_bytes_total", "counter", "Bytes transferred to the target.", m.bytes)
+	writeLabeled(&b, "sync_errors_total", "counter", "Failed file operations, by operation.", "op", m.errors)
+	writeMetric(&b, "sync_ssh_reconnects_total", "counter", "SSH connections re-established after a drop.", m.reconnects)
+	writeLabeled(&b, "sync_runs_total", "counter", "Finished runs, by result.", "result", m.runs)
+	m.runDuration.write(&b, "sync_run_duration_seconds", "Duration of sync runs.")
+	m.fileDuration.write(&b, "sync_file_transfer_duration_seconds", "Duration of file copies and updates.")
+	if m.lastSuccess > 0 {
+		writeMetric(&b, lastSuccessName, "gauge", "End of the last run without errors, in Unix time.", m.lastSuccess)
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// Handler serves the metrics, e.g. on /metrics.
+func (m *Metrics) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.WriteTo(w)
+	})
+}
+
+// WriteFile writes the metrics to path for the node_exporter textfile
+// collector. The file is replaced atomically, so the collector never
+// reads half of it.
+func (m *Metrics) WriteFile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".sync-metrics-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := m.WriteTo(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func writeHeader(b *strings.Builder, name, kind, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeMetric(b *strings.Builder, name, kind, help string, value float64) {
+	writeHeader(b, name, kind, help)
+	fmt.Fprintf(b, "%s %s\n", name, formatValue(value))
+}
+
+func writeLabeled(b *strings.Builder, name, kind, help, label string, values map[string]float64) {
+	writeHeader(b, name, kind, help)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(b, "%s{%s=%s} %s\n", name, label, quoteLabel(k), formatValue(values[k]))
+	}
+}
+
+// quoteLabel quotes a label value, escaping as the text format requires.
+func quoteLabel(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+	return `"` + s + `"`
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// histogram counts observations in cumulative buckets.
+type histogram struct {
+	bounds []float64
+	counts []float64
+	count  float64
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]float64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) write(b *strings.Builder, name, help string) {
+	writeHeader(b, name, "histogram", help)
+	for i, bound := range h.bounds {
+		fmt.Fprintf(b, "%s_bucket{le=%s} %s\n", name, quoteLabel(formatValue(bound)), formatValue(h.counts[i]))
+	}
+	fmt.Fprintf(b, "%s_bucket{le=\"+Inf\"} %s\n", name, formatValue(h.count))
+	fmt.Fprintf(b, "%s_sum %s\n%s_count %s\n", name, formatValue(h.sum), name, formatValue(h.count))
+}
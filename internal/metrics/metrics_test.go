@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics_Exposition(t *testing.T) {
+	m := New()
+	m.File("copy", 2048, 300*time.Millisecond)
+	m.File("skip", 0, 0)
+	m.File("skip", 0, 0)
+	m.Error("copy")
+	m.Error(`say "hi"`)
+	m.Reconnect()
+	m.Run("partial", 20*time.Second)
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	out := rec.Body.String()
+
+	for _, want := range []string{
+		"# TYPE sync_files_total counter\n",
+		`sync_files_total{action="copy"} 1` + "\n",
+		`sync_files_total{action="skip"} 2` + "\n",
+		"sync_bytes_total 2048\n",
+		`sync_errors_total{op="say \"hi\""} 1` + "\n",
+		"sync_ssh_reconnects_total 1\n",
+		`sync_runs_total{result="partial"} 1` + "\n",
+		`sync_run_duration_seconds_bucket{le="15"} 0` + "\n",
+		`sync_run_duration_seconds_bucket{le="30"} 1` + "\n",
+		`sync_run_duration_seconds_bucket{le="+Inf"} 1` + "\n",
+		"sync_run_duration_seconds_sum 20\n",
+		`sync_file_transfer_duration_seconds_bucket{le="0.5"} 1` + "\n",
+		"sync_file_transfer_duration_seconds_count 1\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics lack %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, lastSuccessName) {
+		t.Error("last success reported without a successful run")
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+}
+
+func TestMetrics_LastSuccessSurvivesFailedRuns(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "sync.prom")
+
+	first := New()
+	first.Run("success", time.Second)
+	if err := first.WriteFile(p); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	data, _ := os.ReadFile(p)
+	if !strings.Contains(string(data), lastSuccessName+" ") {
+		t.Fatalf("metrics file lacks the last success:\n%s", data)
+	}
+
+	second := New()
+	if err := second.Restore(p); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	second.Run("failed", time.Second)
+	if second.lastSuccess != first.lastSuccess {
+		t.Errorf("last success = %v, want %v from the earlier run", second.lastSuccess, first.lastSuccess)
+	}
+
+	if err := New().Restore(filepath.Join(t.TempDir(), "missing.prom")); err != nil {
+		t.Errorf("Restore of a missing file = %v", err)
+	}
+}
+
+func TestMetrics_Nil(t *testing.T) {
+	var m *Metrics
+	m.File("copy", 1, time.Second)
+	m.Error("copy")
+	m.Reconnect()
+	m.Run("success", time.Second)
+}
@@ -0,0 +1,290 @@
+// Package progress shows how far a sync has got: files and bytes done out
+// of the totals, throughput and an estimated time to completion.
+package progress
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ttyInterval is how often the bar is redrawn on a terminal.
+	ttyInterval = 200 * time.Millisecond
+	// lineInterval is how often a progress line is written otherwise.
+	lineInterval = 10 * time.Second
+)
+
+// Progress tracks a sync and reports on it periodically between Start and
+// Stop. On a terminal it redraws a status line in place; otherwise it
+// writes a line every few seconds. A nil *Progress reports nothing.
+type Progress struct {
+	out   io.Writer
+	tty   bool
+	width int
+
+	mu          sync.Mutex
+	totalFiles  int
+	totalBytes  int64
+	doneFiles   int
+	doneBytes   int64
+	transferred int64
+	file        *fileState
+	drawn       bool
+
+	start time.Time
+	// rate is a moving average of the throughput in bytes per second.
+	rate     float64
+	lastTick time.Time
+	lastSent int64
+
+	stop chan struct{}
+	done chan struct{}
+	now  func() time.Time
+}
+
+type fileState struct {
+	name  string
+	size  int64
+	read  int64
+	start time.Time
+}
+
+// New returns a Progress writing to out. tty selects the redrawing status
+// line, width is the terminal's width, or 0 if unknown.
+func New(out io.Writer, tty bool, width int) *Progress {
+	if width <= 0 {
+		width = 80
+	}
+	return &Progress{out: out, tty: tty, width: width, now: time.Now}
+}
+
+// SetTotal sets the number of files and bytes the sync goes through.
+func (p *Progress) SetTotal(files int, bytes int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.totalFiles, p.totalBytes = files, bytes
+}
+
+// StartFile marks the file being worked on.
+func (p *Progress) StartFile(name string, size int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.file = &fileState{name: name, size: size, start: p.now()}
+}
+
+// EndFile counts the current file as done, whether it was copied, skipped
+// or failed.
+func (p *Progress) EndFile() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.file != nil {
+		p.doneFiles++
+		p.doneBytes += p.file.size
+		p.file = nil
+	}
+}
+
+// Reader returns r counting the bytes read from it as transferred for the
+// current file.
+func (p *Progress) Reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return &reader{r: r, p: p}
+}
+
+type reader struct {
+	r io.Reader
+	p *Progress
+}
+
+func (r *reader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.p.mu.Lock()
+	r.p.transferred += int64(n)
+	if r.p.file != nil {
+		r.p.file.read += int64(n)
+	}
+	r.p.mu.Unlock()
+	return n, err
+}
+
+// Start begins reporting.
+func (p *Progress) Start() {
+	if p == nil {
+		return
+	}
+	p.start = p.now()
+	p.lastTick = p.start
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+
+	interval := lineInterval
+	if p.tty {
+		interval = ttyInterval
+	}
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.tick()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends reporting, removing the status line on a terminal and writing
+// a last line otherwise.
+func (p *Progress) Stop() {
+	if p == nil || p.stop == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tty {
+		p.clear()
+		return
+	}
+	// The last line shows the average over the whole run.
+	if elapsed := p.now().Sub(p.start).Seconds(); elapsed > 0 {
+		p.rate = float64(p.transferred) / elapsed
+	}
+	fmt.Fprintln(p.out, p.status())
+}
+
+// tick updates the throughput and redraws the status.
+func (p *Progress) tick() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	if elapsed := now.Sub(p.lastTick).Seconds(); elapsed > 0 {
+		current := float64(p.transferred-p.lastSent) / elapsed
+		if p.rate == 0 {
+			p.rate = current
+		} else {
+			p.rate = 0.3*current + 0.7*p.rate
+		}
+	}
+	p.lastTick, p.lastSent = now, p.transferred
+
+	if p.tty {
+		p.draw()
+	} else {
+		fmt.Fprintln(p.out, p.status())
+	}
+}
+
+// status formats the current state as one line.
+func (p *Progress) status() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d/%d files, %s/%s", p.doneFiles, p.totalFiles, FormatBytes(p.bytesDone()), FormatBytes(p.totalBytes))
+	if p.totalBytes > 0 {
+		fmt.Fprintf(&b, " (%d%%)", min(p.bytesDone()*100/p.totalBytes, 100))
+	}
+	fmt.Fprintf(&b, ", %s/s", FormatBytes(int64(p.rate)))
+	if remaining := p.totalBytes - p.bytesDone(); remaining > 0 && p.rate > 0 {
+		eta := time.Duration(float64(remaining) / p.rate * float64(time.Second))
+		fmt.Fprintf(&b, ", ETA %s", eta.Round(time.Second))
+	}
+	if f := p.file; f != nil && f.read > 0 {
+		fmt.Fprintf(&b, ", %s", f.name)
+		if f.size > 0 {
+			fmt.Fprintf(&b, " %d%%", min(f.read*100/f.size, 100))
+		}
+		if elapsed := p.now().Sub(f.start).Seconds(); elapsed > 0 {
+			fmt.Fprintf(&b, " at %s/s", FormatBytes(int64(float64(f.read)/elapsed)))
+		}
+	}
+	return b.String()
+}
+
+// bytesDone returns the bytes done, counting the current file as far as it
+// got.
+func (p *Progress) bytesDone() int64 {
+	done := p.doneBytes
+	if p.file != nil {
+		done += min(p.file.read, p.file.size)
+	}
+	return done
+}
+
+func (p *Progress) draw() {
+	line := []rune(p.status())
+	if len(line) >= p.width {
+		line = line[:p.width-1]
+	}
+	fmt.Fprintf(p.out, "\r\x1b[K%s", string(line))
+	p.drawn = true
+}
+
+func (p *Progress) clear() {
+	if p.drawn {
+		fmt.Fprint(p.out, "\r\x1b[K")
+		p.drawn = false
+	}
+}
+
+// Writer returns w for output that goes to the same terminal as the status
+// line, e.g. log messages. The status line is cleared before each write
+// and redrawn after it, so the two don't run into each other.
+func (p *Progress) Writer(w io.Writer) io.Writer {
+	if p == nil || !p.tty {
+		return w
+	}
+	return &writer{w: w, p: p}
+}
+
+type writer struct {
+	w io.Writer
+	p *Progress
+}
+
+func (w *writer) Write(b []byte) (int, error) {
+	w.p.mu.Lock()
+	defer w.p.mu.Unlock()
+
+	redraw := w.p.drawn
+	w.p.clear()
+	n, err := w.w.Write(b)
+	if redraw {
+		w.p.draw()
+	}
+	return n, err
+}
+
+// FormatBytes formats n bytes with binary units, e.g. 1.5 MiB.
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value := float64(n)
+	for _, suffix := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		value /= unit
+		if value < unit || suffix == "TiB" {
+			return fmt.Sprintf("%.1f %s", value, suffix)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,103 @@
+package progress
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestProgress returns a Progress with a clock that only moves when
+// advanced.
+func newTestProgress(out io.Writer, tty bool) (*Progress, *time.Time) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	p := New(out, tty, 0)
+	p.now = func() time.Time { return now }
+	return p, &now
+}
+
+func TestProgress_Status(t *testing.T) {
+	out := &bytes.Buffer{}
+	p, now := newTestProgress(out, false)
+	p.SetTotal(3, 30<<20)
+	p.lastTick = *now
+
+	p.StartFile("a.txt", 10<<20)
+	p.EndFile()
+
+	p.StartFile("big.iso", 20<<20)
+	io.CopyN(io.Discard, p.Reader(bytes.NewReader(make([]byte, 20<<20))), 5<<20)
+	*now = now.Add(time.Second)
+	p.tick()
+
+	want := "1/3 files, 15.0 MiB/30.0 MiB (50%), 5.0 MiB/s, ETA 3s, big.iso 25% at 5.0 MiB/s\n"
+	if got := out.String(); got != want {
+		t.Errorf("status = %q, want %q", got, want)
+	}
+}
+
+func TestProgress_TTY(t *testing.T) {
+	out := &bytes.Buffer{}
+	p, _ := newTestProgress(out, true)
+	p.SetTotal(1, 100)
+	p.tick()
+	if !strings.HasPrefix(out.String(), "\r\x1b[K0/1 files") {
+		t.Errorf("status line = %q", out.String())
+	}
+
+	// Log output clears the line first and redraws it after.
+	out.Reset()
+	log := &bytes.Buffer{}
+	io.WriteString(p.Writer(log), "copying a.txt\n")
+	if log.String() != "copying a.txt\n" {
+		t.Errorf("log = %q", log.String())
+	}
+	if !strings.HasPrefix(out.String(), "\r\x1b[K\r\x1b[K0/1 files") {
+		t.Errorf("output around log line = %q", out.String())
+	}
+}
+
+func TestProgress_Truncates(t *testing.T) {
+	out := &bytes.Buffer{}
+	p, _ := newTestProgress(out, true)
+	p.width = 40
+	p.StartFile(strings.Repeat("ü", 100), 10)
+	p.Reader(strings.NewReader("12345")).Read(make([]byte, 5))
+	p.draw()
+
+	line := strings.TrimPrefix(out.String(), "\r\x1b[K")
+	if n := len([]rune(line)); n != 39 {
+		t.Errorf("status line has %d characters, want 39", n)
+	}
+}
+
+func TestProgress_Nil(t *testing.T) {
+	var p *Progress
+	p.SetTotal(1, 1)
+	p.StartFile("a", 1)
+	p.EndFile()
+	p.Start()
+	p.Stop()
+	r := strings.NewReader("")
+	if p.Reader(r) != r {
+		t.Error("nil Progress wrapped the reader")
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := map[int64]string{
+		0:          "0 B",
+		1023:       "1023 B",
+		1024:       "1.0 KiB",
+		1536:       "1.5 KiB",
+		5 << 20:    "5.0 MiB",
+		3 << 30:    "3.0 GiB",
+		2048 << 40: "2048.0 TiB",
+	}
+	for n, want := range tests {
+		if got := FormatBytes(n); got != want {
+			t.Errorf("FormatBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
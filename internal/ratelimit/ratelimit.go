@@ -0,0 +1,194 @@
+// Package ratelimit throttles the bytes read during a sync to a bandwidth
+// limit, optionally one that changes with the time of day.
+package ratelimit
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Slot is one entry of a Schedule: from Start, measured from midnight in
+// local time, the limit is Rate bytes per second. A Rate of 0 means
+// unlimited.
+type Slot struct {
+	Start time.Duration
+	Rate  int64
+}
+
+// Schedule is a bandwidth limit by time of day, sorted by start time. The
+// last slot of the day also applies before the first one. An empty
+// Schedule means unlimited.
+type Schedule []Slot
+
+// ParseRate parses a rate in bytes per second such as 500K, 10M or 1.5G,
+// with binary multiples. "off" and "0" mean unlimited.
+func ParseRate(s string) (int64, error) {
+	if strings.EqualFold(s, "off") {
+		return 0, nil
+	}
+
+	number := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "B"), "I")
+	multiplier := 1.0
+	if number != "" {
+		switch number[len(number)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		}
+		if multiplier != 1 {
+			number = number[:len(number)-1]
+		}
+	}
+
+	value, err := strconv.ParseFloat(number, 64)
+	// ParseFloat accepts "inf" and "nan", and anything past MaxInt64 would
+	// overflow the conversion below.
+	if err != nil || !(value >= 0 && value*multiplier < math.MaxInt64) {
+		return 0, fmt.Errorf("invalid rate %q, expected e.g. 500K or 10M", s)
+	}
+	return int64(value * multiplier), nil
+}
+
+// ParseSchedule parses a single rate, which applies all day, or a
+// space-separated list of HH:MM,RATE entries, e.g.
+// "08:00,512K 18:00,10M 23:00,off".
+func ParseSchedule(s string) (Schedule, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 1 && !strings.Contains(fields[0], ",") {
+		rate, err := ParseRate(fields[0])
+		if err != nil || rate == 0 {
+			return nil, err
+		}
+		return Schedule{{Rate: rate}}, nil
+	}
+
+	var schedule Schedule
+	for _, field := range fields {
+		at, rateText, ok := strings.Cut(field, ",")
+		if !ok {
+			return nil, fmt.Errorf("invalid schedule entry %q, expected HH:MM,RATE", field)
+		}
+		start, err := time.Parse("15:04", at)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time %q in schedule entry %q", at, field)
+		}
+		rate, err := ParseRate(rateText)
+		if err != nil {
+			return nil, err
+		}
+		offset := time.Duration(start.Hour())*time.Hour + time.Duration(start.Minute())*time.Minute
+		for _, slot := range schedule {
+			if slot.Start == offset {
+				return nil, fmt.Errorf("time %s appears twice in the schedule", at)
+			}
+		}
+		schedule = append(schedule, Slot{Start: offset, Rate: rate})
+	}
+	sort.Slice(schedule, func(i, j int) bool { return schedule[i].Start < schedule[j].Start })
+	return schedule, nil
+}
+
+// RateAt returns the limit in bytes per second at t, or 0 for unlimited.
+func (s Schedule) RateAt(t time.Time) int64 {
+	if len(s) == 0 {
+		return 0
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+
+	rate := s[len(s)-1].Rate
+	for _, slot := range s {
+		if slot.Start > offset {
+			break
+		}
+		rate = slot.Rate
+	}
+	return rate
+}
+
+// maxRead caps single reads, so a throttled stream moves in small steps
+// instead of long pauses.
+const maxRead = 32 << 10
+
+// Limiter is a token bucket shared by all streams it wraps, so concurrent
+// transfers together stay under the limit. A nil *Limiter doesn't limit.
+type Limiter struct {
+	schedule Schedule
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// New returns a Limiter following schedule, or nil if schedule is empty.
+func New(schedule Schedule) *Limiter {
+	if len(schedule) == 0 {
+		return nil
+	}
+	return &Limiter{schedule: schedule, now: time.Now, sleep: time.Sleep}
+}
+
+// Wait blocks until n more bytes may pass.
+func (l *Limiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := l.now()
+	rate := float64(l.schedule.RateAt(now))
+	if rate == 0 {
+		l.tokens = 0
+		l.last = now
+		l.mu.Unlock()
+		return
+	}
+	// Allow bursts of up to a tenth of a second at the current rate.
+	burst := max(rate/10, maxRead)
+	if !l.last.IsZero() {
+		l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*rate, burst)
+	}
+	l.last = now
+	// The bucket may go into debt; later callers then wait for it too.
+	l.tokens -= float64(n)
+	wait := time.Duration(-l.tokens / rate * float64(time.Second))
+	l.mu.Unlock()
+
+	if wait > 0 {
+		l.sleep(wait)
+	}
+}
+
+// Reader returns r throttled by the limiter.
+func (l *Limiter) Reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &reader{r: r, limiter: l}
+}
+
+type reader struct {
+	r       io.Reader
+	limiter *Limiter
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(p) > maxRead {
+		p = p[:maxRead]
+	}
+	n, err := r.r.Read(p)
+	r.limiter.Wait(n)
+	return n, err
+}
@@ -0,0 +1,161 @@
+package ratelimit
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"500", 500},
+		{"500K", 500 << 10},
+		{"10M", 10 << 20},
+		{"10m", 10 << 20},
+		{"10MB", 10 << 20},
+		{"10MiB", 10 << 20},
+		{"1.5G", 3 << 29},
+		{"off", 0},
+		{"0", 0},
+	}
+	for _, tt := range tests {
+		got, err := ParseRate(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseRate(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "M", "fast", "-1K", "10X", "inf", "+Inf", "NaN", "infK", "1e30"} {
+		if _, err := ParseRate(in); err == nil {
+			t.Errorf("ParseRate(%q) succeeded", in)
+		}
+	}
+}
+
+func TestParseSchedule(t *testing.T) {
+	got, err := ParseSchedule("18:00,10M 08:00,512K 23:30,off")
+	if err != nil {
+		t.Fatalf("ParseSchedule failed: %v", err)
+	}
+	want := Schedule{
+		{Start: 8 * time.Hour, Rate: 512 << 10},
+		{Start: 18 * time.Hour, Rate: 10 << 20},
+		{Start: 23*time.Hour + 30*time.Minute, Rate: 0},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseSchedule = %v, want %v", got, want)
+	}
+
+	day := func(h, m int) time.Time { return time.Date(2024, 5, 1, h, m, 0, 0, time.Local) }
+	for _, tt := range []struct {
+		at   time.Time
+		want int64
+	}{
+		{day(7, 59), 0}, // the last slot carries over midnight
+		{day(8, 0), 512 << 10},
+		{day(12, 0), 512 << 10},
+		{day(18, 0), 10 << 20},
+		{day(23, 45), 0},
+	} {
+		if rate := got.RateAt(tt.at); rate != tt.want {
+			t.Errorf("RateAt(%s) = %d, want %d", tt.at.Format("15:04"), rate, tt.want)
+		}
+	}
+
+	if s, err := ParseSchedule("10M"); err != nil || !reflect.DeepEqual(s, Schedule{{Rate: 10 << 20}}) {
+		t.Errorf("ParseSchedule(10M) = %v, %v", s, err)
+	}
+	if s, err := ParseSchedule("off"); err != nil || s != nil {
+		t.Errorf("ParseSchedule(off) = %v, %v", s, err)
+	}
+	for _, in := range []string{"8:00", "25:00,1M", "08:00,fast", "08:00,1M 08:00,2M"} {
+		if _, err := ParseSchedule(in); err == nil {
+			t.Errorf("ParseSchedule(%q) succeeded", in)
+		}
+	}
+}
+
+// fakeClock advances only when the limiter sleeps.
+type fakeClock struct {
+	now   time.Time
+	slept time.Duration
+}
+
+func (c *fakeClock) install(l *Limiter) {
+	l.now = func() time.Time { return c.now }
+	l.sleep = func(d time.Duration) {
+		c.now = c.now.Add(d)
+		c.slept += d
+	}
+}
+
+func TestLimiter_Rate(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 5, 1, 12, 0, 0, 0, time.Local)}
+	l := New(Schedule{{Rate: 1 << 20}})
+	clock.install(l)
+
+	n, err := io.Copy(io.Discard, l.Reader(bytes.NewReader(make([]byte, 10<<20))))
+	if err != nil || n != 10<<20 {
+		t.Fatalf("copy = %d, %v", n, err)
+	}
+	// 10 MiB at 1 MiB/s, less the initial burst.
+	if clock.slept < 9*time.Second || clock.slept > 10*time.Second {
+		t.Errorf("copy took %v, want about 10s", clock.slept)
+	}
+}
+
+func TestLimiter_Shared(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 5, 1, 12, 0, 0, 0, time.Local)}
+	l := New(Schedule{{Rate: 1 << 20}})
+	clock.install(l)
+
+	// Two streams read in turns share one limit.
+	a := l.Reader(bytes.NewReader(make([]byte, 4<<20)))
+	b := l.Reader(bytes.NewReader(make([]byte, 4<<20)))
+	buf := make([]byte, 64<<10)
+	for {
+		_, errA := a.Read(buf)
+		_, errB := b.Read(buf)
+		if errA == io.EOF && errB == io.EOF {
+			break
+		}
+	}
+	if clock.slept < 7*time.Second {
+		t.Errorf("8 MiB over a 1 MiB/s limit took %v", clock.slept)
+	}
+}
+
+func TestLimiter_Schedule(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 5, 1, 7, 0, 0, 0, time.Local)}
+	l := New(Schedule{{Start: 8 * time.Hour, Rate: 1 << 10}, {Start: 18 * time.Hour, Rate: 0}})
+	clock.install(l)
+
+	// Unlimited before 08:00, as the 18:00 slot carries over midnight.
+	io.Copy(io.Discard, l.Reader(bytes.NewReader(make([]byte, 1<<20))))
+	if clock.slept != 0 {
+		t.Errorf("unlimited copy slept %v", clock.slept)
+	}
+
+	clock.now = time.Date(2024, 5, 1, 9, 0, 0, 0, time.Local)
+	io.Copy(io.Discard, l.Reader(bytes.NewReader(make([]byte, 64<<10))))
+	if clock.slept < 30*time.Second {
+		t.Errorf("64 KiB at 1 KiB/s took %v", clock.slept)
+	}
+}
+
+func TestLimiter_Nil(t *testing.T) {
+	if New(nil) != nil {
+		t.Fatal("New(nil) returned a limiter")
+	}
+	var l *Limiter
+	r := bytes.NewReader([]byte("data"))
+	if l.Reader(r) != r {
+		t.Error("nil limiter wrapped the reader")
+	}
+	l.Wait(100)
+}
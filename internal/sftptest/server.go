@@ -0,0 +1,369 @@
+// Package sftptest runs an in-process SSH server with the SFTP subsystem for
+// end-to-end tests of SFTP code. The server listens on a random localhost
+// port, uses generated host and user keys, and serves the local filesystem,
+// so remote paths are ordinary local paths such as t.TempDir().
+package sftptest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Config controls which clients the server accepts.
+type Config struct {
+	// User is the only user name accepted. Defaults to "test".
+	User string
+	// Password enables password authentication when set.
+	Password string
+	// KeyboardInteractive offers Password through keyboard-interactive
+	// authentication instead of password authentication.
+	KeyboardInteractive bool
+	// Exec allows clients to run commands, which are executed with sh -c on
+	// the local machine. Without it exec requests are refused, like on
+	// SFTP-only servers.
+	Exec bool
+}
+
+// Server is a running test server. It is closed when the test ends.
+type Server struct {
+	Host string
+	Port int
+	User string
+	// HostKey is the key the server identifies itself with.
+	HostKey ssh.PublicKey
+	// UserKey is the private key accepted for public key authentication.
+	UserKey ssh.Signer
+	// KeyFile is UserKey written to disk in OpenSSH format.
+	KeyFile string
+
+	cfg      Config
+	hostKey  ssh.Signer
+	userKey  ed25519.PrivateKey
+	listener net.Listener
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	auths []string
+	wg    sync.WaitGroup
+}
+
+// NewServer starts a server and registers its shutdown with t.Cleanup.
+func NewServer(t testing.TB, cfg Config) *Server {
+	t.Helper()
+
+	if cfg.User == "" {
+		cfg.User = "test"
+	}
+
+	hostKey, _, err := generateKey()
+	if err != nil {
+		t.Fatalf("generating host key: %v", err)
+	}
+	userKey, userPriv, err := generateKey()
+	if err != nil {
+		t.Fatalf("generating user key: %v", err)
+	}
+
+	block, err := ssh.MarshalPrivateKey(userPriv, "sftptest")
+	if err != nil {
+		t.Fatalf("encoding user key: %v", err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("writing user key: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+
+	s := &Server{
+		Host:     "127.0.0.1",
+		Port:     listener.Addr().(*net.TCPAddr).Port,
+		User:     cfg.User,
+		HostKey:  hostKey.PublicKey(),
+		UserKey:  userKey,
+		KeyFile:  keyFile,
+		cfg:      cfg,
+		hostKey:  hostKey,
+		userKey:  userPriv,
+		listener: listener,
+		conns:    make(map[net.Conn]struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func generateKey() (ssh.Signer, ed25519.PrivateKey, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	return signer, priv, nil
+}
+
+// Addr returns the host:port the server listens on.
+func (s *Server) Addr() string {
+	return net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+}
+
+// KnownHostsLine returns the known_hosts entry for the server.
+func (s *Server) KnownHostsLine() string {
+	return knownhosts.Line([]string{s.Addr()}, s.HostKey)
+}
+
+// SetupHome points HOME at a fresh directory whose ~/.ssh/known_hosts trusts
+// the server, and returns the directory. No default identity files exist in
+// it, so only explicitly configured authentication is used.
+func (s *Server) SetupHome(t testing.TB) string {
+	t.Helper()
+
+	home := t.TempDir()
+	sshDir := filepath.Join(home, ".ssh")
+	if err := os.MkdirAll(sshDir, 0700); err != nil {
+		t.Fatalf("creating %s: %v", sshDir, err)
+	}
+	if err := os.WriteFile(filepath.Join(sshDir, "known_hosts"), []byte(s.KnownHostsLine()+"\n"), 0600); err != nil {
+		t.Fatalf("writing known_hosts: %v", err)
+	}
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	return home
+}
+
+// StartAgent runs an SSH agent holding UserKey and points SSH_AUTH_SOCK at
+// it for the rest of the test.
+func (s *Server) StartAgent(t testing.TB) {
+	t.Helper()
+
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: s.userKey}); err != nil {
+		t.Fatalf("adding key to agent: %v", err)
+	}
+
+	// Unix socket paths are limited to about 100 bytes, which t.TempDir can
+	// exceed.
+	dir, err := os.MkdirTemp("", "sftptest")
+	if err != nil {
+		t.Fatalf("creating agent directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	sock := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("listening on %s: %v", sock, err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	t.Setenv("SSH_AUTH_SOCK", sock)
+}
+
+// Auths returns the authentication methods of successful logins, in order.
+func (s *Server) Auths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.auths...)
+}
+
+// DropConnections closes all client connections without a clean shutdown,
+// as if the network failed.
+func (s *Server) DropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// Close stops the server and closes all connections.
+func (s *Server) Close() {
+	s.listener.Close()
+	s.DropConnections()
+	s.wg.Wait()
+}
+
+func (s *Server) serverConfig() *ssh.ServerConfig {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if meta.User() == s.User && string(key.Marshal()) == string(s.UserKey.PublicKey().Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown public key")
+		},
+		AuthLogCallback: func(meta ssh.ConnMetadata, method string, err error) {
+			if err == nil {
+				s.mu.Lock()
+				s.auths = append(s.auths, method)
+				s.mu.Unlock()
+			}
+		},
+	}
+
+	if s.cfg.Password != "" && s.cfg.KeyboardInteractive {
+		config.KeyboardInteractiveCallback = func(meta ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := challenge(meta.User(), "", []string{"Password: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+			if meta.User() == s.User && len(answers) == 1 && answers[0] == s.cfg.Password {
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		}
+	} else if s.cfg.Password != "" {
+		config.PasswordCallback = func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if meta.User() == s.User && string(password) == s.cfg.Password {
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		}
+	}
+
+	config.AddHostKey(s.hostKey)
+	return config
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	config := s.serverConfig()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+				conn.Close()
+			}()
+			s.handleConn(conn, config)
+		}()
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn, config *ssh.ServerConfig) {
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	defer sshConn.Close()
+
+	go ssh.DiscardRequests(reqs)
+
+	var wg sync.WaitGroup
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handleSession(channel, requests)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *Server) handleSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	for req := range requests {
+		switch req.Type {
+		case "subsystem":
+			var payload struct{ Name string }
+			if ssh.Unmarshal(req.Payload, &payload) != nil || payload.Name != "sftp" {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+
+			server, err := sftp.NewServer(channel)
+			if err != nil {
+				return
+			}
+			server.Serve()
+			server.Close()
+			return
+
+		case "exec":
+			var payload struct{ Command string }
+			if !s.cfg.Exec || ssh.Unmarshal(req.Payload, &payload) != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+
+			cmd := exec.Command("sh", "-c", payload.Command)
+			cmd.Stdout = channel
+			cmd.Stderr = channel.Stderr()
+			status := 0
+			if err := cmd.Run(); err != nil {
+				status = 127
+				var exitErr *exec.ExitError
+				if errors.As(err, &exitErr) {
+					status = exitErr.ExitCode()
+				}
+			}
+			channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+			return
+
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package syncer
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/robertgontarski/sync/internal/cli"
+)
+
+// ErrSafetyLimit is returned when a run is stopped by a safety limit such as
+// MaxDelete before it changes anything it shouldn't.
+var ErrSafetyLimit = errors.New("safety limit reached")
+
+// ConfigError reports an invalid endpoint or option. Nothing was done.
+type ConfigError struct {
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// Failure is a file that couldn't be synchronized.
+type Failure struct {
+	// Path is relative to the source or target root, except for a path a
+	// walk returned from outside the root, which is given as it is.
+	Path string
+	// Op is what failed, e.g. "copy" or "delete".
+	Op  string
+	Err error
+}
+
+func (f Failure) Error() string {
+	return fmt.Sprintf("%s %s: %v", f.Op, f.Path, f.Err)
+}
+
+func (f Failure) Unwrap() error {
+	return f.Err
+}
+
+// maxListed is how many failures a SyncError's message lists.
+const maxListed = 10
+
+// SyncError is returned by a run that finished but failed for some files.
+type SyncError struct {
+	Failures []Failure
+}
+
+func (e *SyncError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d files failed: ", len(e.Failures))
+	for i, f := range e.Failures {
+		if i == maxListed {
+			fmt.Fprintf(&b, "; and %d more", len(e.Failures)-maxListed)
+			break
+		}
+		if i > 0 {
+			b.WriteString("; ")
+		}
+		b.WriteString(f.Error())
+	}
+	return b.String()
+}
+
+func (e *SyncError) Unwrap() []error {
+	errs := make([]error, len(e.Failures))
+	for i, f := range e.Failures {
+		errs[i] = f
+	}
+	return errs
+}
+
+// runResult classifies a run for metrics as "success", "partial" or
+// "failed".
+func runResult(err error) string {
+	switch ExitCode(err) {
+	case cli.ExitOK:
+		return "success"
+	case cli.ExitPartial:
+		return "partial"
+	}
+	return "failed"
+}
+
+// ExitCode returns the exit code of the sync command for an error returned
+// by Sync. Of errors joined together, a fatal one decides, and failed files
+// only when nothing else went wrong.
+func ExitCode(err error) int {
+	var configErr *ConfigError
+	var syncErr *SyncError
+	// A SyncError unwraps to its failures, which aren't joined errors.
+	if _, ok := err.(*SyncError); !ok {
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			code := cli.ExitOK
+			for _, e := range joined.Unwrap() {
+				switch c := ExitCode(e); {
+				case code == cli.ExitOK, code == cli.ExitPartial && c != cli.ExitOK, c == cli.ExitFatal:
+					code = c
+				}
+			}
+			return code
+		}
+	}
+	switch {
+	case err == nil:
+		return cli.ExitOK
+	case errors.As(err, &configErr):
+		return cli.ExitUsage
+	case errors.Is(err, ErrSafetyLimit):
+		return cli.ExitSafetyLimit
+	case errors.As(err, &syncErr):
+		return cli.ExitPartial
+	}
+	return cli.ExitFatal
+}
@@ -0,0 +1,149 @@
+package syncer
+
+import (
+	"fmt"
+	"time"
+)
+
+// Actions reported in events.
+const (
+	ActionCopy   = "copy"
+	ActionUpdate = "update"
+	ActionSkip   = "skip"
+	ActionDelete = "delete"
+	ActionFail   = "fail"
+)
+
+// Reasons reported in events. Failures have "failed to " and the operation,
+// e.g. "failed to copy".
+const (
+	ReasonMissingInTarget = "missing in target"
+	ReasonMissingInSource = "missing in source"
+	ReasonUpToDate        = "up to date"
+	ReasonSize            = "size differs"
+	ReasonModTime         = "modification time differs"
+	ReasonChecksum        = "checksum differs"
+)
+
+// difference is why a file is acted on: one of the reasons above and, when
+// the files were compared, the differing values in source and target.
+type difference struct {
+	reason         string
+	source, target string
+}
+
+// String describes the difference for debug output.
+func (d difference) String() string {
+	switch d.reason {
+	case ReasonSize:
+		return fmt.Sprintf("%s: %s bytes in source, %s in target", d.reason, d.source, d.target)
+	case ReasonModTime:
+		return fmt.Sprintf("%s: %s in source, %s in target", d.reason, d.source, d.target)
+	case ReasonChecksum:
+		return fmt.Sprintf("%s: %.12s in source, %.12s in target", d.reason, d.source, d.target)
+	}
+	return d.reason
+}
+
+// Event reports what was done with one file. With JSON output each event is
+// written as a line once the action is done.
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// Path is relative to the source or target root, like Failure.Path.
+	Path   string `json:"path"`
+	Action string `json:"action"`
+	// Reason says why the action was taken, e.g. "size differs".
+	Reason string `json:"reason,omitempty"`
+	// Source and Target are the values that differ for the reasons
+	// comparing files: sizes in bytes, RFC 3339 modification times or
+	// SHA256 checksums.
+	Source string `json:"source,omitempty"`
+	Target string `json:"target,omitempty"`
+	// Bytes is the size of the file copied.
+	Bytes int64 `json:"bytes"`
+	// Duration is how long the action took, in seconds.
+	Duration float64 `json:"duration"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// Summary is the last line of JSON output, reporting on the whole run.
+type Summary struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Scanned   int       `json:"scanned"`
+	Copied    int       `json:"copied"`
+	Updated   int       `json:"updated"`
+	Skipped   int       `json:"skipped"`
+	Deleted   int       `json:"deleted"`
+	Failed    int       `json:"failed"`
+	BytesSent int64     `json:"bytes_sent"`
+	// Duration is the length of the run in seconds.
+	Duration float64 `json:"duration"`
+	Error    string  `json:"error,omitempty"`
+	ExitCode int     `json:"exit_code"`
+}
+
+// NewSummary returns the summary of a run that returned result and err.
+func NewSummary(result Result, err error) Summary {
+	summary := Summary{
+		Type:      "summary",
+		Time:      time.Now(),
+		Scanned:   result.Scanned,
+		Copied:    result.Copied,
+		Updated:   result.Updated,
+		Skipped:   result.Skipped,
+		Deleted:   result.Deleted,
+		Failed:    result.Failed,
+		BytesSent: result.BytesSent,
+		Duration:  result.Duration.Seconds(),
+		ExitCode:  ExitCode(err),
+	}
+	if err != nil {
+		summary.Error = err.Error()
+	}
+	return summary
+}
+
+// event reports an action on path, taken because of why, that started at
+// start. It is where actions are recorded, in metrics as well as JSON output.
+func (s *Syncer) event(action, path string, why difference, bytes int64, start time.Time, err error) {
+	// Failures are counted by fail.
+	if s.metrics != nil && err == nil {
+		s.metrics.File(action, bytes, time.Since(start))
+	}
+	if !s.logger.JSON() {
+		return
+	}
+	ev := Event{
+		Type:     "file",
+		Time:     time.Now(),
+		Path:     path,
+		Action:   action,
+		Reason:   why.reason,
+		Source:   why.source,
+		Target:   why.target,
+		Bytes:    bytes,
+		Duration: time.Since(start).Seconds(),
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	s.logger.Event(ev)
+}
+
+// explain logs at debug level why path is acted on, to diagnose unexpected
+// copies. JSON events carry the reason instead.
+func (s *Syncer) explain(path string, why difference) {
+	if !s.logger.JSON() {
+		s.logger.Debug("%s: %s", path, why)
+	}
+}
+
+// announce logs an action before it starts. JSON output reports it with an
+// event once it's done instead.
+func (s *Syncer) announce(format string, args ...any) {
+	if !s.logger.JSON() {
+		s.logger.Info(format, args...)
+	}
+}
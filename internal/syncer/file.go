@@ -3,85 +3,181 @@ package syncer
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"io"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/robertgontarski/sync/internal/fs"
 )
 
+// readWrapper wraps the streams read while copying and hashing files, e.g.
+// to throttle them. A nil readWrapper leaves them as they are.
+type readWrapper func(io.Reader) io.Reader
+
+func (wrap readWrapper) reader(r io.Reader) io.Reader {
+	if wrap == nil {
+		return r
+	}
+	return wrap(r)
+}
+
 func CopyFile(srcFS fs.FileSystem, srcPath string, dstFS fs.FileSystem, dstPath string) error {
+	return copyFile(srcFS, srcPath, dstFS, dstPath, nil)
+}
+
+func copyFile(srcFS fs.FileSystem, srcPath string, dstFS fs.FileSystem, dstPath string, wrap readWrapper) error {
 	srcInfo, err := srcFS.Stat(srcPath)
 	if err != nil {
 		return err
 	}
 
+	// Copy within one filesystem on the server when it supports it.
+	if copier, ok := dstFS.(fs.Copier); ok && srcFS == dstFS {
+		err := copier.Copy(srcPath, dstPath)
+		if err == nil {
+			return setMetadata(dstFS, dstPath, srcInfo)
+		}
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return err
+		}
+	}
+
+	// Filesystems that take the metadata at creation time get it there.
+	if creator, ok := dstFS.(fs.InfoCreator); ok {
+		return streamFile(srcFS, srcPath, func() (io.WriteCloser, error) {
+			return creator.CreateWithInfo(dstPath, srcInfo)
+		}, wrap)
+	}
+
+	err = streamFile(srcFS, srcPath, func() (io.WriteCloser, error) {
+		return dstFS.Create(dstPath)
+	}, wrap)
+	if err != nil {
+		return err
+	}
+
+	return setMetadata(dstFS, dstPath, srcInfo)
+}
+
+func streamFile(srcFS fs.FileSystem, srcPath string, create func() (io.WriteCloser, error), wrap readWrapper) error {
 	srcFile, err := srcFS.Open(srcPath)
 	if err != nil {
 		return err
 	}
 	defer srcFile.Close()
 
-	dstFile, err := dstFS.Create(dstPath)
+	dstFile, err := create()
 	if err != nil {
 		return err
 	}
-	defer dstFile.Close()
 
-	if _, err := io.Copy(dstFile, srcFile); err != nil {
+	if _, err := io.Copy(dstFile, wrap.reader(srcFile)); err != nil {
+		if aborter, ok := dstFile.(fs.Aborter); ok {
+			aborter.Abort()
+		} else {
+			dstFile.Close()
+		}
 		return err
 	}
 
-	if err := dstFS.Chmod(dstPath, srcInfo.Mode); err != nil {
+	return dstFile.Close()
+}
+
+func setMetadata(filesystem fs.FileSystem, path string, info fs.FileInfo) error {
+	if err := filesystem.Chmod(path, info.Mode); err != nil {
 		return err
 	}
 
-	return dstFS.Chtimes(dstPath, srcInfo.ModTime, srcInfo.ModTime)
+	return filesystem.Chtimes(path, info.ModTime, info.ModTime)
 }
 
 func CompareFiles(srcFS fs.FileSystem, srcPath string, dstFS fs.FileSystem, dstPath string, useChecksum bool) (bool, error) {
+	diff, err := compareFiles(srcFS, srcPath, dstFS, dstPath, useChecksum, nil)
+	return diff.reason == "", err
+}
+
+// compareFiles returns how the files differ, or a zero difference if they
+// are identical.
+func compareFiles(srcFS fs.FileSystem, srcPath string, dstFS fs.FileSystem, dstPath string, useChecksum bool, wrap readWrapper) (difference, error) {
 	if useChecksum {
-		return CompareByChecksum(srcFS, srcPath, dstFS, dstPath)
+		return compareByChecksum(srcFS, srcPath, dstFS, dstPath, wrap)
 	}
 
-	return CompareByMetadata(srcFS, srcPath, dstFS, dstPath)
+	return compareByMetadata(srcFS, srcPath, dstFS, dstPath)
 }
 
 func CompareByMetadata(srcFS fs.FileSystem, srcPath string, dstFS fs.FileSystem, dstPath string) (bool, error) {
+	diff, err := compareByMetadata(srcFS, srcPath, dstFS, dstPath)
+	return diff.reason == "", err
+}
+
+func compareByMetadata(srcFS fs.FileSystem, srcPath string, dstFS fs.FileSystem, dstPath string) (difference, error) {
 	srcInfo, err := srcFS.Stat(srcPath)
 	if err != nil {
-		return false, err
+		return difference{}, err
 	}
 
 	dstInfo, err := dstFS.Stat(dstPath)
 	if err != nil {
-		return false, err
+		return difference{}, err
 	}
 
-	if srcInfo.Size != dstInfo.Size {
-		return false, nil
+	if !storedSizes(srcFS) && !storedSizes(dstFS) && srcInfo.Size != dstInfo.Size {
+		return difference{ReasonSize, strconv.FormatInt(srcInfo.Size, 10), strconv.FormatInt(dstInfo.Size, 10)}, nil
 	}
 
 	srcModTime := srcInfo.ModTime.Truncate(1e9)
 	dstModTime := dstInfo.ModTime.Truncate(1e9)
 
-	return srcModTime.Equal(dstModTime), nil
+	if !srcModTime.Equal(dstModTime) {
+		return difference{ReasonModTime, srcModTime.Format(time.RFC3339), dstModTime.Format(time.RFC3339)}, nil
+	}
+	return difference{}, nil
+}
+
+// storedSizes reports whether filesystem reports sizes that can't be
+// compared, so files are compared by modification time alone.
+func storedSizes(filesystem fs.FileSystem) bool {
+	sizer, ok := filesystem.(fs.StoredSizer)
+	return ok && sizer.StoredSizes()
 }
 
 func CompareByChecksum(srcFS fs.FileSystem, srcPath string, dstFS fs.FileSystem, dstPath string) (bool, error) {
-	srcChecksum, err := CalculateChecksum(srcFS, srcPath)
+	diff, err := compareByChecksum(srcFS, srcPath, dstFS, dstPath, nil)
+	return diff.reason == "", err
+}
+
+func compareByChecksum(srcFS fs.FileSystem, srcPath string, dstFS fs.FileSystem, dstPath string, wrap readWrapper) (difference, error) {
+	srcChecksum, err := calculateChecksum(srcFS, srcPath, wrap)
 	if err != nil {
-		return false, err
+		return difference{}, err
 	}
 
-	dstChecksum, err := CalculateChecksum(dstFS, dstPath)
+	dstChecksum, err := calculateChecksum(dstFS, dstPath, wrap)
 	if err != nil {
-		return false, err
+		return difference{}, err
 	}
 
-	return srcChecksum == dstChecksum, nil
+	if srcChecksum != dstChecksum {
+		return difference{ReasonChecksum, srcChecksum, dstChecksum}, nil
+	}
+	return difference{}, nil
 }
 
 func CalculateChecksum(filesystem fs.FileSystem, path string) (string, error) {
+	return calculateChecksum(filesystem, path, nil)
+}
+
+func calculateChecksum(filesystem fs.FileSystem, path string, wrap readWrapper) (string, error) {
+	if checksummer, ok := filesystem.(fs.Checksummer); ok {
+		sum, err := checksummer.Checksum(path)
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return sum, err
+		}
+	}
+
 	file, err := filesystem.Open(path)
 	if err != nil {
 		return "", err
@@ -89,7 +185,7 @@ func CalculateChecksum(filesystem fs.FileSystem, path string) (string, error) {
 	defer file.Close()
 
 	hash := sha256.New()
-	if _, err := io.Copy(hash, file); err != nil {
+	if _, err := io.Copy(hash, wrap.reader(file)); err != nil {
 		return "", err
 	}
 
@@ -1,6 +1,7 @@
 package syncer
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
@@ -244,3 +245,166 @@ func TestEnsureDir_Existing(t *testing.T) {
 		t.Fatalf("EnsureDir failed on existing directory: %v", err)
 	}
 }
+
+// copierFS is a LocalFS that records server-side copies.
+type copierFS struct {
+	*fs.LocalFS
+	copies int
+	err    error
+}
+
+func (c *copierFS) Copy(src, dst string) error {
+	c.copies++
+	if c.err != nil {
+		return c.err
+	}
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, data, 0644)
+}
+
+func TestCopyFile_ServerSideCopy(t *testing.T) {
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "src.txt")
+	dstPath := filepath.Join(dir, "dst.txt")
+
+	if err := os.WriteFile(srcPath, []byte("content"), 0600); err != nil {
+		t.Fatalf("failed to create source file: %v", err)
+	}
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(srcPath, modTime, modTime); err != nil {
+		t.Fatalf("failed to set modtime: %v", err)
+	}
+
+	copier := &copierFS{LocalFS: fs.NewLocalFS()}
+	if err := CopyFile(copier, srcPath, copier, dstPath); err != nil {
+		t.Fatalf("CopyFile failed: %v", err)
+	}
+
+	if copier.copies != 1 {
+		t.Errorf("server-side copies = %d, want 1", copier.copies)
+	}
+	info, err := os.Stat(dstPath)
+	if err != nil {
+		t.Fatalf("failed to stat destination: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v, want %v", info.Mode().Perm(), os.FileMode(0600))
+	}
+	if !info.ModTime().Equal(modTime) {
+		t.Errorf("modtime = %v, want %v", info.ModTime(), modTime)
+	}
+}
+
+func TestCopyFile_ServerSideCopyUnsupported(t *testing.T) {
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "src.txt")
+	dstPath := filepath.Join(dir, "dst.txt")
+
+	if err := os.WriteFile(srcPath, []byte("content"), 0644); err != nil {
+		t.Fatalf("failed to create source file: %v", err)
+	}
+
+	copier := &copierFS{LocalFS: fs.NewLocalFS(), err: errors.ErrUnsupported}
+	if err := CopyFile(copier, srcPath, copier, dstPath); err != nil {
+		t.Fatalf("CopyFile failed: %v", err)
+	}
+
+	if content, err := os.ReadFile(dstPath); err != nil || string(content) != "content" {
+		t.Errorf("destination = %q, %v; want %q", content, err, "content")
+	}
+}
+
+func TestCopyFile_NoServerSideCopyAcrossFilesystems(t *testing.T) {
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "src.txt")
+	dstPath := filepath.Join(dir, "dst.txt")
+
+	if err := os.WriteFile(srcPath, []byte("content"), 0644); err != nil {
+		t.Fatalf("failed to create source file: %v", err)
+	}
+
+	src := &copierFS{LocalFS: fs.NewLocalFS()}
+	dst := &copierFS{LocalFS: fs.NewLocalFS()}
+	if err := CopyFile(src, srcPath, dst, dstPath); err != nil {
+		t.Fatalf("CopyFile failed: %v", err)
+	}
+
+	if src.copies+dst.copies != 0 {
+		t.Error("server-side copy must not be used between different filesystems")
+	}
+}
+
+// checksummerFS is a LocalFS that reports a fixed server-side checksum.
+type checksummerFS struct {
+	*fs.LocalFS
+	sum string
+	err error
+}
+
+func (c *checksummerFS) Checksum(path string) (string, error) {
+	return c.sum, c.err
+}
+
+func TestCalculateChecksum_ServerSide(t *testing.T) {
+	filesystem := &checksummerFS{LocalFS: fs.NewLocalFS(), sum: "remote-sum"}
+
+	checksum, err := CalculateChecksum(filesystem, "/not/read/locally")
+	if err != nil {
+		t.Fatalf("CalculateChecksum failed: %v", err)
+	}
+	if checksum != "remote-sum" {
+		t.Errorf("checksum = %s, want remote-sum", checksum)
+	}
+}
+
+func TestCalculateChecksum_ServerSideUnsupported(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.txt")
+
+	if err := os.WriteFile(path, []byte("test"), 0644); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	filesystem := &checksummerFS{LocalFS: fs.NewLocalFS(), err: errors.ErrUnsupported}
+	checksum, err := CalculateChecksum(filesystem, path)
+	if err != nil {
+		t.Fatalf("CalculateChecksum failed: %v", err)
+	}
+
+	expected := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	if checksum != expected {
+		t.Errorf("checksum mismatch: got %s, want %s", checksum, expected)
+	}
+}
+
+func TestCopyFile_MemFS(t *testing.T) {
+	src := fs.NewMemFS()
+	dst := fs.NewMemFSWithSeparator('\\')
+	modTime := time.Date(2024, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	if err := src.WriteFile("/test.txt", []byte("test content"), 0600, modTime); err != nil {
+		t.Fatalf("failed to create source file: %v", err)
+	}
+	if err := CopyFile(src, "/test.txt", dst, `\test.txt`); err != nil {
+		t.Fatalf("CopyFile failed: %v", err)
+	}
+
+	info, err := dst.Stat(`\test.txt`)
+	if err != nil {
+		t.Fatalf("failed to stat destination file: %v", err)
+	}
+	if info.Size != int64(len("test content")) || info.Mode != 0600 || !info.ModTime.Equal(modTime) {
+		t.Errorf("destination = %+v, want size %d, mode 0600, modtime %v", info, len("test content"), modTime)
+	}
+
+	identical, err := CompareByMetadata(src, "/test.txt", dst, `\test.txt`)
+	if err != nil {
+		t.Fatalf("CompareByMetadata failed: %v", err)
+	}
+	if !identical {
+		t.Error("copied file should compare identical")
+	}
+}
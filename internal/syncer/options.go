@@ -0,0 +1,58 @@
+package syncer
+
+import (
+	"github.com/robertgontarski/sync/internal/fs"
+	"github.com/robertgontarski/sync/internal/ratelimit"
+)
+
+// Options configure a Syncer. The zero value copies new and changed files,
+// compared by size and modification time, and deletes nothing.
+type Options struct {
+	// Source and Target are the endpoints Sync opens. SyncFS is given
+	// opened filesystems instead and ignores them.
+	Source Endpoint
+	Target Endpoint
+	// Backend holds the backend settings shared by both endpoints, e.g.
+	// the FTP password or the SSH keepalive. Its SSH port, identity file
+	// and password are replaced with those of each Endpoint.
+	Backend fs.Options
+
+	DeleteMissing bool
+	// MaxDelete stops the run before deleting anything if DeleteMissing
+	// would delete more files than this. 0 means no limit.
+	MaxDelete int
+	// Checksum compares files by their SHA256 checksum instead of their
+	// size and modification time.
+	Checksum bool
+	// CryptNames also encrypts file names on encrypted endpoints.
+	CryptNames bool
+	// Compress is the compression format for files on the target, empty
+	// for none. Decompress reads a source written that way.
+	Compress   string
+	Decompress bool
+	// BWLimit limits the bandwidth of file transfers and checksum reads.
+	// An empty schedule means unlimited.
+	BWLimit ratelimit.Schedule
+	// ListUpToDate also explains files that are already up to date, which
+	// are the bulk of most runs.
+	ListUpToDate bool
+}
+
+// Endpoint is one side of a run started with Sync.
+type Endpoint struct {
+	// Path is the endpoint as accepted by fs.ParsePath, e.g. "/data" or
+	// "user@host:/data".
+	Path string
+	SSH  SSHOptions
+	// CryptKey is the passphrase the endpoint is encrypted with. Empty
+	// means the endpoint is not encrypted.
+	CryptKey string
+}
+
+// SSHOptions holds the SSH settings for a single endpoint. Zero values
+// leave the backend's defaults.
+type SSHOptions struct {
+	Port         int
+	IdentityFile string
+	Password     string
+}
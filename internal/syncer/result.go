@@ -0,0 +1,33 @@
+package syncer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/robertgontarski/sync/internal/progress"
+)
+
+// Result summarizes a sync run.
+type Result struct {
+	// Scanned is the number of files found in the source.
+	Scanned int
+	// Copied files were missing from the target, Updated ones differed
+	// and Skipped ones were already up to date.
+	Copied  int
+	Updated int
+	Skipped int
+	// Deleted files were removed from the target with DeleteMissing.
+	Deleted int
+	// Failed counts files that couldn't be read, compared, copied or
+	// deleted. The run carries on past them.
+	Failed int
+	// BytesSent is the size of the files copied and updated.
+	BytesSent int64
+	Duration  time.Duration
+}
+
+func (r Result) String() string {
+	return fmt.Sprintf("%d scanned, %d copied, %d updated, %d skipped, %d deleted, %d failed, %s sent in %s",
+		r.Scanned, r.Copied, r.Updated, r.Skipped, r.Deleted, r.Failed,
+		progress.FormatBytes(r.BytesSent), r.Duration.Round(time.Millisecond))
+}
@@ -1,95 +1,290 @@
 package syncer
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
-	"os/user"
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
-	"github.com/robertgontarski/sync/internal/cli"
 	"github.com/robertgontarski/sync/internal/fs"
 	"github.com/robertgontarski/sync/internal/logger"
+	"github.com/robertgontarski/sync/internal/metrics"
+	"github.com/robertgontarski/sync/internal/progress"
+	"github.com/robertgontarski/sync/internal/ratelimit"
 )
 
 type Syncer struct {
-	config *cli.Config
+	opts   Options
 	logger *logger.Logger
+	// limiter throttles all file reads to the bandwidth limit; nil when
+	// there is none.
+	limiter *ratelimit.Limiter
+	// progress reports on the run; nil when it isn't shown.
+	progress *progress.Progress
+	// metrics records what the run did; nil when metrics are disabled.
+	metrics *metrics.Metrics
+	// result collects the counters of the current run, failures the files
+	// that failed in it.
+	result   Result
+	failures []Failure
 }
 
-func New(config *cli.Config, log *logger.Logger) *Syncer {
+func New(opts Options, log *logger.Logger) *Syncer {
 	return &Syncer{
-		config: config,
-		logger: log,
+		opts:    opts,
+		logger:  log,
+		limiter: ratelimit.New(opts.BWLimit),
 	}
 }
 
-func createFS(pathInfo fs.PathInfo, config *cli.Config) (fs.FileSystem, error) {
-	if !pathInfo.IsRemote {
-		return fs.NewLocalFS(), nil
+// SetProgress makes the syncer report its progress to p.
+func (s *Syncer) SetProgress(p *progress.Progress) {
+	s.progress = p
+}
+
+// SetMetrics makes the syncer record its files in m, and the runs of Sync,
+// including those that fail before any file is looked at.
+func (s *Syncer) SetMetrics(m *metrics.Metrics) {
+	s.metrics = m
+}
+
+// copyReader returns the wrapper for the streams read while copying files,
+// which count towards the progress. Reads fail once ctx is done, so a
+// cancelled run doesn't wait for a large file to finish.
+func (s *Syncer) copyReader(ctx context.Context) readWrapper {
+	return func(r io.Reader) io.Reader {
+		return &contextReader{ctx: ctx, r: s.progress.Reader(s.limiter.Reader(r))}
 	}
+}
 
-	username := pathInfo.User
-	if username == "" {
-		u, err := user.Current()
-		if err != nil {
-			return nil, fmt.Errorf("cannot determine current user: %w", err)
-		}
-		username = u.Username
+// hashReader is like copyReader for the streams read while hashing files,
+// which are throttled but not counted as transferred.
+func (s *Syncer) hashReader(ctx context.Context) readWrapper {
+	return func(r io.Reader) io.Reader {
+		return &contextReader{ctx: ctx, r: s.limiter.Reader(r)}
 	}
+}
 
-	return fs.NewSFTPFS(fs.SFTPConfig{
-		User:         username,
-		Host:         pathInfo.Host,
-		Port:         config.Port,
-		IdentityFile: config.IdentityFile,
-		Password:     config.Password,
-	})
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
 }
 
-// joinPath joins path elements using the appropriate separator for the filesystem.
-func joinPath(filesystem fs.FileSystem, elem ...string) string {
-	if _, ok := filesystem.(*fs.SFTPFS); ok {
-		return path.Join(elem...)
+// fsOptions returns the backend options for an endpoint with the given SSH
+// settings.
+func (s *Syncer) fsOptions(opts SSHOptions) fs.Options {
+	options := s.opts.Backend
+	options.Port = opts.Port
+	options.IdentityFile = opts.IdentityFile
+	options.Password = opts.Password
+	options.Logger = s.logger
+	if s.metrics != nil {
+		options.OnReconnect = s.metrics.Reconnect
 	}
-	return filepath.Join(elem...)
+	return options
 }
 
-// relPath computes the relative path using the appropriate separator for the filesystem.
+// sameEndpoint reports whether two paths are reached through the same SSH
+// connection settings.
+func sameEndpoint(a fs.PathInfo, aOpts SSHOptions, b fs.PathInfo, bOpts SSHOptions) bool {
+	return a.Scheme == "sftp" && b.Scheme == "sftp" &&
+		a.User == b.User &&
+		a.Host == b.Host &&
+		a.Port == b.Port &&
+		a.Query.Encode() == b.Query.Encode() &&
+		aOpts == bOpts
+}
+
+// toSlash converts p from the filesystem's separator to forward slashes.
+func toSlash(p string, sep byte) string {
+	if sep == '/' {
+		return p
+	}
+	return strings.ReplaceAll(p, string(sep), "/")
+}
+
+// fromSlash converts p from forward slashes to the filesystem's separator.
+func fromSlash(p string, sep byte) string {
+	if sep == '/' {
+		return p
+	}
+	return strings.ReplaceAll(p, "/", string(sep))
+}
+
+// joinPath joins a slash-separated relative path onto root using the
+// appropriate separator for the filesystem.
+func joinPath(filesystem fs.FileSystem, root, rel string) string {
+	sep := fs.PathSeparator(filesystem)
+	if sep == os.PathSeparator {
+		return filepath.Join(root, filepath.FromSlash(rel))
+	}
+	return fromSlash(path.Join(toSlash(root, sep), rel), sep)
+}
+
+// dirPath returns the parent directory using the appropriate separator for the filesystem.
+func dirPath(filesystem fs.FileSystem, p string) string {
+	sep := fs.PathSeparator(filesystem)
+	if sep == os.PathSeparator {
+		return filepath.Dir(p)
+	}
+	return fromSlash(path.Dir(toSlash(p, sep)), sep)
+}
+
+// reportPath returns p relative to root, as paths are reported, or p itself
+// if it isn't below root.
+func reportPath(filesystem fs.FileSystem, root, p string) string {
+	if rel, err := relPath(filesystem, root, p); err == nil {
+		return rel
+	}
+	return p
+}
+
+// relPath computes the path of targpath relative to basepath on the
+// filesystem. The result always uses forward slashes, so it can be joined
+// onto a root on a filesystem with a different separator.
 func relPath(filesystem fs.FileSystem, basepath, targpath string) (string, error) {
-	if _, ok := filesystem.(*fs.SFTPFS); ok {
-		// For SFTP, use forward-slash based relative path computation.
-		if !strings.HasSuffix(basepath, "/") {
-			basepath += "/"
-		}
-		if strings.HasPrefix(targpath, basepath) {
-			return strings.TrimPrefix(targpath, basepath), nil
-		}
-		return "", fmt.Errorf("cannot make %s relative to %s", targpath, basepath)
+	sep := fs.PathSeparator(filesystem)
+	if sep == os.PathSeparator {
+		rel, err := filepath.Rel(basepath, targpath)
+		return filepath.ToSlash(rel), err
+	}
+
+	basepath = toSlash(basepath, sep)
+	targpath = toSlash(targpath, sep)
+	if !strings.HasSuffix(basepath, "/") {
+		basepath += "/"
 	}
-	return filepath.Rel(basepath, targpath)
+	if strings.HasPrefix(targpath, basepath) {
+		return strings.TrimPrefix(targpath, basepath), nil
+	}
+	return "", fmt.Errorf("cannot make %s relative to %s", targpath, basepath)
 }
 
-func (s *Syncer) Sync() error {
-	srcInfo := fs.ParsePath(s.config.SourceDir)
-	dstInfo := fs.ParsePath(s.config.TargetDir)
+// Sync synchronizes the configured source to the target. Files that fail
+// are logged and the run carries on; it then returns a *SyncError listing
+// them. Invalid configuration is reported as a *ConfigError, and other
+// errors stopped the run. Use ExitCode to map the error to an exit code.
+func (s *Syncer) Sync() (result Result, err error) {
+	start := time.Now()
+	defer func() {
+		s.metrics.Run(runResult(err), time.Since(start))
+	}()
+
+	srcInfo, err := fs.ParsePath(s.opts.Source.Path)
+	if err != nil {
+		return Result{}, &ConfigError{fmt.Errorf("source: %w", err)}
+	}
+	dstInfo, err := fs.ParsePath(s.opts.Target.Path)
+	if err != nil {
+		return Result{}, &ConfigError{fmt.Errorf("target: %w", err)}
+	}
+	var compress fs.CompressFormat
+	if s.opts.Compress != "" {
+		if compress, err = fs.ParseCompressFormat(s.opts.Compress); err != nil {
+			return Result{}, &ConfigError{fmt.Errorf("target: %w", err)}
+		}
+	}
+
+	srcOpts := s.opts.Source.SSH
+	dstOpts := s.opts.Target.SSH
 
-	srcFS, err := createFS(srcInfo, s.config)
+	srcFS, err := fs.Open(srcInfo, s.fsOptions(srcOpts))
 	if err != nil {
-		return fmt.Errorf("source: %w", err)
+		return Result{}, fmt.Errorf("source: %w", err)
 	}
 	defer srcFS.Close()
 
-	dstFS, err := createFS(dstInfo, s.config)
-	if err != nil {
-		return fmt.Errorf("target: %w", err)
+	// Both sides on the same account share one connection, which also lets
+	// CopyFile copy on the server instead of through this machine.
+	dstFS := srcFS
+	if !sameEndpoint(srcInfo, srcOpts, dstInfo, dstOpts) {
+		dstFS, err = fs.Open(dstInfo, s.fsOptions(dstOpts))
+		if err != nil {
+			return Result{}, fmt.Errorf("target: %w", err)
+		}
+		// Some targets, e.g. archives, are only written when closed, so a
+		// failure there fails the run.
+		target := dstFS
+		defer func() {
+			if closeErr := target.Close(); closeErr != nil {
+				err = errors.Join(err, fmt.Errorf("target: %w", closeErr))
+			}
+		}()
+	}
+
+	// The wrappers are not closed themselves; closing them would close the
+	// filesystems underneath a second time.
+	if srcFS, err = s.wrapCrypt(srcFS, srcInfo.Path, s.opts.Source.CryptKey); err != nil {
+		return Result{}, &ConfigError{fmt.Errorf("source: %w", err)}
 	}
-	defer dstFS.Close()
+	if dstFS, err = s.wrapCrypt(dstFS, dstInfo.Path, s.opts.Target.CryptKey); err != nil {
+		return Result{}, &ConfigError{fmt.Errorf("target: %w", err)}
+	}
+	// Compression goes on top, as encrypted data doesn't compress. A
+	// compressed target is compared by modification time so its files
+	// aren't opened on every run; a compressed source reports original
+	// sizes, which its files are opened for when copied anyway.
+	if s.opts.Decompress {
+		srcFS = fs.NewCompressFS(srcFS, fs.CompressConfig{ReadHeaders: true})
+	}
+	if s.opts.Compress != "" {
+		dstFS = fs.NewCompressFS(dstFS, fs.CompressConfig{Format: compress})
+	}
+
+	return s.SyncFS(srcFS, srcInfo.Path, dstFS, dstInfo.Path)
+}
+
+// wrapCrypt returns filesystem with the tree below root encrypted with
+// passphrase, or filesystem itself if passphrase is empty.
+func (s *Syncer) wrapCrypt(filesystem fs.FileSystem, root, passphrase string) (fs.FileSystem, error) {
+	if passphrase == "" {
+		return filesystem, nil
+	}
+	return fs.NewCryptFS(filesystem, root, fs.CryptConfig{
+		Passphrase:   passphrase,
+		EncryptNames: s.opts.CryptNames,
+	})
+}
 
-	srcPath := srcInfo.Path
-	dstPath := dstInfo.Path
+// SyncFS synchronizes srcPath on srcFS to dstPath on dstFS using already
+// opened filesystems. The caller keeps ownership of both filesystems.
+func (s *Syncer) SyncFS(srcFS fs.FileSystem, srcPath string, dstFS fs.FileSystem, dstPath string) (Result, error) {
+	return s.SyncFSContext(context.Background(), srcFS, srcPath, dstFS, dstPath)
+}
+
+// SyncFSContext is like SyncFS but stops with ctx's error once ctx is done.
+func (s *Syncer) SyncFSContext(ctx context.Context, srcFS fs.FileSystem, srcPath string, dstFS fs.FileSystem, dstPath string) (Result, error) {
+	s.result = Result{}
+	s.failures = nil
+	start := time.Now()
+	err := s.syncFS(ctx, srcFS, srcPath, dstFS, dstPath)
+	s.result.Duration = time.Since(start)
+	if len(s.failures) > 0 {
+		switch {
+		case err == nil:
+			err = &SyncError{Failures: s.failures}
+		case errors.Is(err, ErrSafetyLimit):
+			// Files that failed before the limit stopped the run are
+			// reported along with it.
+			err = errors.Join(err, &SyncError{Failures: s.failures})
+		}
+	}
+	return s.result, err
+}
 
+func (s *Syncer) syncFS(ctx context.Context, srcFS fs.FileSystem, srcPath string, dstFS fs.FileSystem, dstPath string) error {
 	stat, err := srcFS.Stat(srcPath)
 	if err != nil {
 		return err
@@ -103,12 +298,23 @@ func (s *Syncer) Sync() error {
 		return err
 	}
 
-	if err := s.syncSource(srcFS, srcPath, dstFS, dstPath); err != nil {
+	if s.progress != nil {
+		s.scanTotals(srcFS, srcPath)
+		s.progress.Start()
+		defer s.progress.Stop()
+	}
+
+	if err := s.syncSource(ctx, srcFS, srcPath, dstFS, dstPath); err != nil {
+		return err
+	}
+	// A file interrupted by cancellation is recorded as failed; the run as
+	// a whole still reports the cancellation.
+	if err := ctx.Err(); err != nil {
 		return err
 	}
 
-	if s.config.DeleteMissing {
-		if err := s.deleteOrphans(srcFS, srcPath, dstFS, dstPath); err != nil {
+	if s.opts.DeleteMissing {
+		if err := s.deleteOrphans(ctx, srcFS, srcPath, dstFS, dstPath); err != nil {
 			return err
 		}
 	}
@@ -116,10 +322,42 @@ func (s *Syncer) Sync() error {
 	return nil
 }
 
-func (s *Syncer) syncSource(srcFS fs.FileSystem, srcRoot string, dstFS fs.FileSystem, dstRoot string) error {
+// scanTotals walks the source once up front, so progress can be shown
+// against the number of files and bytes to go through.
+func (s *Syncer) scanTotals(srcFS fs.FileSystem, srcRoot string) {
+	var files int
+	var bytes int64
+	srcFS.Walk(srcRoot, func(_ string, info fs.FileInfo, err error) error {
+		if err == nil && !info.IsDir {
+			files++
+			bytes += info.Size
+		}
+		return nil
+	})
+	s.progress.SetTotal(files, bytes)
+}
+
+// fail logs and records a failure that affects a single file. op completes
+// "failed to ...", e.g. "copy".
+func (s *Syncer) fail(op, path string, err error) {
+	s.result.Failed++
+	s.failures = append(s.failures, Failure{Path: path, Op: op, Err: err})
+	s.metrics.Error(op)
+	if s.logger.JSON() {
+		s.event(ActionFail, path, difference{reason: "failed to " + op}, 0, time.Now(), err)
+		return
+	}
+	s.logger.Error("failed to %s %s: %v", op, path, err)
+}
+
+func (s *Syncer) syncSource(ctx context.Context, srcFS fs.FileSystem, srcRoot string, dstFS fs.FileSystem, dstRoot string) error {
+	wrap, hashWrap := s.copyReader(ctx), s.hashReader(ctx)
 	return srcFS.Walk(srcRoot, func(srcPath string, info fs.FileInfo, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
 		if err != nil {
-			s.logger.Error("failed to access %s: %v", srcPath, err)
+			s.fail("access", reportPath(srcFS, srcRoot, srcPath), err)
 			return nil
 		}
 
@@ -129,50 +367,77 @@ func (s *Syncer) syncSource(srcFS fs.FileSystem, srcRoot string, dstFS fs.FileSy
 
 		rel, err := relPath(srcFS, srcRoot, srcPath)
 		if err != nil {
-			s.logger.Error("failed to get relative path for %s: %v", srcPath, err)
+			s.fail("get relative path for", srcPath, err)
 			return nil
 		}
 
 		dstPath := joinPath(dstFS, dstRoot, rel)
 
+		s.result.Scanned++
+		s.progress.StartFile(rel, info.Size)
+		defer s.progress.EndFile()
+
+		start := time.Now()
 		if _, err := dstFS.Stat(dstPath); err != nil {
 			// File doesn't exist on destination - ensure parent dir and copy.
-			dstDir := filepath.Dir(dstPath)
-			if _, ok := dstFS.(*fs.SFTPFS); ok {
-				dstDir = path.Dir(dstPath)
-			}
-			if err := EnsureDir(dstFS, dstDir); err != nil {
-				s.logger.Error("failed to create directory for %s: %v", rel, err)
+			s.explain(rel, difference{reason: ReasonMissingInTarget})
+			if err := EnsureDir(dstFS, dirPath(dstFS, dstPath)); err != nil {
+				s.fail("create directory for", rel, err)
 				return nil
 			}
-			s.logger.Info("copying %s", rel)
-			if err := CopyFile(srcFS, srcPath, dstFS, dstPath); err != nil {
-				s.logger.Error("failed to copy %s: %v", rel, err)
+			s.announce("copying %s", rel)
+			if err := copyFile(srcFS, srcPath, dstFS, dstPath, wrap); err != nil {
+				s.fail("copy", rel, err)
+				return nil
 			}
+			s.result.Copied++
+			s.result.BytesSent += info.Size
+			s.event(ActionCopy, rel, difference{reason: ReasonMissingInTarget}, info.Size, start, nil)
 			return nil
 		}
 
-		identical, err := CompareFiles(srcFS, srcPath, dstFS, dstPath, s.config.UseChecksum)
+		diff, err := compareFiles(srcFS, srcPath, dstFS, dstPath, s.opts.Checksum, hashWrap)
 		if err != nil {
-			s.logger.Error("failed to compare %s: %v", rel, err)
+			s.fail("compare", rel, err)
 			return nil
 		}
 
-		if !identical {
-			s.logger.Info("updating %s", rel)
-			if err := CopyFile(srcFS, srcPath, dstFS, dstPath); err != nil {
-				s.logger.Error("failed to update %s: %v", rel, err)
+		if diff.reason == "" {
+			// Unchanged files are the bulk of most runs, so they are only
+			// listed at the highest verbosity.
+			if s.opts.ListUpToDate {
+				s.explain(rel, difference{reason: ReasonUpToDate})
 			}
+			s.result.Skipped++
+			s.event(ActionSkip, rel, difference{reason: ReasonUpToDate}, 0, start, nil)
+			return nil
 		}
 
+		s.explain(rel, diff)
+		s.announce("updating %s", rel)
+		if err := copyFile(srcFS, srcPath, dstFS, dstPath, wrap); err != nil {
+			s.fail("update", rel, err)
+			return nil
+		}
+		s.result.Updated++
+		s.result.BytesSent += info.Size
+		s.event(ActionUpdate, rel, diff, info.Size, start, nil)
 		return nil
 	})
 }
 
-func (s *Syncer) deleteOrphans(srcFS fs.FileSystem, srcRoot string, dstFS fs.FileSystem, dstRoot string) error {
-	return dstFS.Walk(dstRoot, func(dstPath string, info fs.FileInfo, err error) error {
+func (s *Syncer) deleteOrphans(ctx context.Context, srcFS fs.FileSystem, srcRoot string, dstFS fs.FileSystem, dstRoot string) error {
+	// Orphans are collected first, so a safety limit stops the run before
+	// anything is deleted.
+	type orphan struct{ rel, dstPath string }
+	var orphans []orphan
+
+	err := dstFS.Walk(dstRoot, func(dstPath string, info fs.FileInfo, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
 		if err != nil {
-			s.logger.Error("failed to access %s: %v", dstPath, err)
+			s.fail("access", reportPath(dstFS, dstRoot, dstPath), err)
 			return nil
 		}
 
@@ -182,19 +447,39 @@ func (s *Syncer) deleteOrphans(srcFS fs.FileSystem, srcRoot string, dstFS fs.Fil
 
 		rel, err := relPath(dstFS, dstRoot, dstPath)
 		if err != nil {
-			s.logger.Error("failed to get relative path for %s: %v", dstPath, err)
+			s.fail("get relative path for", dstPath, err)
 			return nil
 		}
 
 		srcPath := joinPath(srcFS, srcRoot, rel)
 
 		if _, err := srcFS.Stat(srcPath); err != nil {
-			s.logger.Info("deleting %s", rel)
-			if err := dstFS.Remove(dstPath); err != nil {
-				s.logger.Error("failed to delete %s: %v", rel, err)
-			}
+			orphans = append(orphans, orphan{rel, dstPath})
 		}
 
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	if s.opts.MaxDelete > 0 && len(orphans) > s.opts.MaxDelete {
+		return fmt.Errorf("%w: %d files would be deleted, more than the maximum of %d", ErrSafetyLimit, len(orphans), s.opts.MaxDelete)
+	}
+
+	for _, o := range orphans {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		start := time.Now()
+		s.explain(o.rel, difference{reason: ReasonMissingInSource})
+		s.announce("deleting %s", o.rel)
+		if err := dstFS.Remove(o.dstPath); err != nil {
+			s.fail("delete", o.rel, err)
+			continue
+		}
+		s.result.Deleted++
+		s.event(ActionDelete, o.rel, difference{reason: ReasonMissingInSource}, 0, start, nil)
+	}
+	return nil
 }
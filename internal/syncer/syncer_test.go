@@ -2,20 +2,103 @@ package syncer
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/robertgontarski/sync/internal/cli"
+	"github.com/robertgontarski/sync/internal/fs"
 	"github.com/robertgontarski/sync/internal/logger"
+	"github.com/robertgontarski/sync/internal/metrics"
+	"github.com/robertgontarski/sync/internal/progress"
+	"github.com/robertgontarski/sync/internal/ratelimit"
+	"github.com/robertgontarski/sync/internal/sftptest"
 )
 
-func setupTest(t *testing.T) (string, string, *bytes.Buffer) {
-	srcDir := t.TempDir()
-	dstDir := t.TempDir()
-	logBuf := &bytes.Buffer{}
-	return srcDir, dstDir, logBuf
+// syncMode is one local/remote combination the TestSync_* suite runs in.
+type syncMode struct {
+	name      string
+	srcRemote bool
+	dstRemote bool
+}
+
+var syncModes = []syncMode{
+	{name: "local-to-local"},
+	{name: "local-to-remote", dstRemote: true},
+	{name: "remote-to-local", srcRemote: true},
+	{name: "remote-to-remote", srcRemote: true, dstRemote: true},
+}
+
+// syncEnv holds the directories and server of one TestSync_* run. Remote
+// sides are reached through an embedded SFTP server serving the local
+// temporary directories, so files are prepared and checked on disk.
+type syncEnv struct {
+	mode   syncMode
+	srcDir string
+	dstDir string
+	logBuf *bytes.Buffer
+	server *sftptest.Server
+}
+
+// forEachMode runs fn as a subtest for every sync mode.
+func forEachMode(t *testing.T, fn func(t *testing.T, env *syncEnv)) {
+	for _, mode := range syncModes {
+		t.Run(mode.name, func(t *testing.T) {
+			env := &syncEnv{
+				mode:   mode,
+				srcDir: t.TempDir(),
+				dstDir: t.TempDir(),
+				logBuf: &bytes.Buffer{},
+			}
+			if mode.srcRemote || mode.dstRemote {
+				if runtime.GOOS == "windows" {
+					t.Skip("the embedded SFTP server serves POSIX paths")
+				}
+				env.server = sftptest.NewServer(t, sftptest.Config{Exec: true})
+				env.server.SetupHome(t)
+				t.Setenv("SSH_AUTH_SOCK", "")
+			}
+			fn(t, env)
+			if env.server != nil && len(env.server.Auths()) == 0 {
+				t.Error("Sync never connected to the SFTP server")
+			}
+		})
+	}
+}
+
+// options returns Options syncing the local directories src to dst, with
+// each side reached as the mode requires.
+func (e *syncEnv) options(src, dst string) Options {
+	var ssh SSHOptions
+	if e.server != nil {
+		ssh = SSHOptions{Port: e.server.Port, IdentityFile: e.server.KeyFile}
+	}
+	return Options{
+		Source: Endpoint{Path: e.location(src, e.mode.srcRemote), SSH: ssh},
+		Target: Endpoint{Path: e.location(dst, e.mode.dstRemote), SSH: ssh},
+	}
+}
+
+func (e *syncEnv) location(dir string, remote bool) string {
+	if !remote {
+		return dir
+	}
+	return e.server.User + "@" + e.server.Host + ":" + filepath.ToSlash(dir)
+}
+
+func parsePath(t *testing.T, raw string) fs.PathInfo {
+	t.Helper()
+	info, err := fs.ParsePath(raw)
+	if err != nil {
+		t.Fatalf("ParsePath(%q) failed: %v", raw, err)
+	}
+	return info
 }
 
 func createFile(t *testing.T, path string, content string) {
@@ -37,228 +120,1024 @@ func readFile(t *testing.T, path string) string {
 }
 
 func TestSync_NewFiles(t *testing.T) {
-	srcDir, dstDir, logBuf := setupTest(t)
+	forEachMode(t, func(t *testing.T, env *syncEnv) {
+		createFile(t, filepath.Join(env.srcDir, "file1.txt"), "content1")
+		createFile(t, filepath.Join(env.srcDir, "subdir", "file2.txt"), "content2")
+
+		s := New(env.options(env.srcDir, env.dstDir), logger.NewWithWriter(env.logBuf))
+		if _, err := s.Sync(); err != nil {
+			t.Fatalf("Sync failed: %v", err)
+		}
+
+		if content := readFile(t, filepath.Join(env.dstDir, "file1.txt")); content != "content1" {
+			t.Errorf("file1.txt content mismatch: got %q, want %q", content, "content1")
+		}
+		if content := readFile(t, filepath.Join(env.dstDir, "subdir", "file2.txt")); content != "content2" {
+			t.Errorf("subdir/file2.txt content mismatch: got %q, want %q", content, "content2")
+		}
+	})
+}
+
+func TestSync_UpdateChangedFiles(t *testing.T) {
+	forEachMode(t, func(t *testing.T, env *syncEnv) {
+		createFile(t, filepath.Join(env.srcDir, "file.txt"), "new content")
+		createFile(t, filepath.Join(env.dstDir, "file.txt"), "old content")
+
+		oldTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+		if err := os.Chtimes(filepath.Join(env.dstDir, "file.txt"), oldTime, oldTime); err != nil {
+			t.Fatalf("failed to set modtime: %v", err)
+		}
+
+		s := New(env.options(env.srcDir, env.dstDir), logger.NewWithWriter(env.logBuf))
+		if _, err := s.Sync(); err != nil {
+			t.Fatalf("Sync failed: %v", err)
+		}
+
+		if content := readFile(t, filepath.Join(env.dstDir, "file.txt")); content != "new content" {
+			t.Errorf("file.txt content mismatch: got %q, want %q", content, "new content")
+		}
+	})
+}
+
+func TestSync_SkipIdenticalFiles(t *testing.T) {
+	forEachMode(t, func(t *testing.T, env *syncEnv) {
+		content := "same content"
+		modTime := time.Now().Truncate(time.Second)
+
+		createFile(t, filepath.Join(env.srcDir, "file.txt"), content)
+		createFile(t, filepath.Join(env.dstDir, "file.txt"), content)
+
+		if err := os.Chtimes(filepath.Join(env.srcDir, "file.txt"), modTime, modTime); err != nil {
+			t.Fatalf("failed to set modtime: %v", err)
+		}
+		if err := os.Chtimes(filepath.Join(env.dstDir, "file.txt"), modTime, modTime); err != nil {
+			t.Fatalf("failed to set modtime: %v", err)
+		}
+
+		s := New(env.options(env.srcDir, env.dstDir), logger.NewWithWriter(env.logBuf))
+		if _, err := s.Sync(); err != nil {
+			t.Fatalf("Sync failed: %v", err)
+		}
+
+		if bytes.Contains(env.logBuf.Bytes(), []byte("copying")) || bytes.Contains(env.logBuf.Bytes(), []byte("updating")) {
+			t.Error("identical file should not be copied or updated")
+		}
+	})
+}
+
+func TestSync_DeleteMissing(t *testing.T) {
+	forEachMode(t, func(t *testing.T, env *syncEnv) {
+		createFile(t, filepath.Join(env.srcDir, "keep.txt"), "keep")
+		createFile(t, filepath.Join(env.dstDir, "keep.txt"), "keep")
+		createFile(t, filepath.Join(env.dstDir, "orphan.txt"), "orphan")
+
+		modTime := time.Now().Truncate(time.Second)
+		if err := os.Chtimes(filepath.Join(env.srcDir, "keep.txt"), modTime, modTime); err != nil {
+			t.Fatalf("failed to set modtime: %v", err)
+		}
+		if err := os.Chtimes(filepath.Join(env.dstDir, "keep.txt"), modTime, modTime); err != nil {
+			t.Fatalf("failed to set modtime: %v", err)
+		}
+
+		opts := env.options(env.srcDir, env.dstDir)
+		opts.DeleteMissing = true
+
+		s := New(opts, logger.NewWithWriter(env.logBuf))
+		if _, err := s.Sync(); err != nil {
+			t.Fatalf("Sync failed: %v", err)
+		}
+
+		if _, err := os.Stat(filepath.Join(env.dstDir, "keep.txt")); os.IsNotExist(err) {
+			t.Error("keep.txt should exist")
+		}
+		if _, err := os.Stat(filepath.Join(env.dstDir, "orphan.txt")); !os.IsNotExist(err) {
+			t.Error("orphan.txt should be deleted")
+		}
+	})
+}
+
+func TestSync_DeleteMissingDisabled(t *testing.T) {
+	forEachMode(t, func(t *testing.T, env *syncEnv) {
+		createFile(t, filepath.Join(env.srcDir, "keep.txt"), "keep")
+		createFile(t, filepath.Join(env.dstDir, "orphan.txt"), "orphan")
+
+		s := New(env.options(env.srcDir, env.dstDir), logger.NewWithWriter(env.logBuf))
+		if _, err := s.Sync(); err != nil {
+			t.Fatalf("Sync failed: %v", err)
+		}
+
+		if _, err := os.Stat(filepath.Join(env.dstDir, "orphan.txt")); os.IsNotExist(err) {
+			t.Error("orphan.txt should not be deleted when DeleteMissing is false")
+		}
+	})
+}
+
+func TestSync_UseChecksum(t *testing.T) {
+	forEachMode(t, func(t *testing.T, env *syncEnv) {
+		createFile(t, filepath.Join(env.srcDir, "file.txt"), "same content")
+		createFile(t, filepath.Join(env.dstDir, "file.txt"), "same content")
+
+		opts := env.options(env.srcDir, env.dstDir)
+		opts.Checksum = true
 
-	createFile(t, filepath.Join(srcDir, "file1.txt"), "content1")
-	createFile(t, filepath.Join(srcDir, "subdir", "file2.txt"), "content2")
+		s := New(opts, logger.NewWithWriter(env.logBuf))
+		if _, err := s.Sync(); err != nil {
+			t.Fatalf("Sync failed: %v", err)
+		}
 
-	config := &cli.Config{
-		SourceDir:     srcDir,
-		TargetDir:     dstDir,
-		DeleteMissing: false,
-		UseChecksum:   false,
+		if bytes.Contains(env.logBuf.Bytes(), []byte("updating")) {
+			t.Error("files with same checksum should not be updated")
+		}
+	})
+}
+
+func TestSync_SourceNotExists(t *testing.T) {
+	forEachMode(t, func(t *testing.T, env *syncEnv) {
+		s := New(env.options(filepath.Join(env.srcDir, "nonexistent"), env.dstDir), logger.NewWithWriter(env.logBuf))
+		if _, err := s.Sync(); err == nil {
+			t.Error("Sync should fail when source does not exist")
+		}
+	})
+}
+
+func TestSync_SourceIsFile(t *testing.T) {
+	forEachMode(t, func(t *testing.T, env *syncEnv) {
+		srcFile := filepath.Join(env.srcDir, "file.txt")
+		createFile(t, srcFile, "content")
+
+		s := New(env.options(srcFile, env.dstDir), logger.NewWithWriter(env.logBuf))
+		if _, err := s.Sync(); err == nil {
+			t.Error("Sync should fail when source is a file")
+		}
+	})
+}
+
+func TestSync_CreatesTargetDir(t *testing.T) {
+	forEachMode(t, func(t *testing.T, env *syncEnv) {
+		createFile(t, filepath.Join(env.srcDir, "file.txt"), "content")
+
+		newTarget := filepath.Join(env.dstDir, "new", "nested", "target")
+
+		s := New(env.options(env.srcDir, newTarget), logger.NewWithWriter(env.logBuf))
+		if _, err := s.Sync(); err != nil {
+			t.Fatalf("Sync failed: %v", err)
+		}
+
+		if _, err := os.Stat(filepath.Join(newTarget, "file.txt")); os.IsNotExist(err) {
+			t.Error("file should be synced to new target directory")
+		}
+	})
+}
+
+func TestSync_PreservesMetadata(t *testing.T) {
+	forEachMode(t, func(t *testing.T, env *syncEnv) {
+		srcFile := filepath.Join(env.srcDir, "script.sh")
+		createFile(t, srcFile, "#!/bin/sh")
+		modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+		if err := os.Chtimes(srcFile, modTime, modTime); err != nil {
+			t.Fatalf("failed to set modtime: %v", err)
+		}
+		if err := os.Chmod(srcFile, 0750); err != nil {
+			t.Fatalf("failed to set mode: %v", err)
+		}
+
+		s := New(env.options(env.srcDir, env.dstDir), logger.NewWithWriter(env.logBuf))
+		if _, err := s.Sync(); err != nil {
+			t.Fatalf("Sync failed: %v", err)
+		}
+
+		info, err := os.Stat(filepath.Join(env.dstDir, "script.sh"))
+		if err != nil {
+			t.Fatalf("script.sh not synced: %v", err)
+		}
+		if !info.ModTime().Equal(modTime) {
+			t.Errorf("modTime = %v, want %v", info.ModTime(), modTime)
+		}
+		if runtime.GOOS != "windows" && info.Mode().Perm() != 0750 {
+			t.Errorf("mode = %v, want %v", info.Mode().Perm(), os.FileMode(0750))
+		}
+	})
+}
+
+func TestSync_SFTPURL(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the embedded SFTP server serves POSIX paths")
 	}
+	server := sftptest.NewServer(t, sftptest.Config{})
+	server.SetupHome(t)
+	t.Setenv("SSH_AUTH_SOCK", "")
 
-	s := New(config, logger.NewWithWriter(logBuf))
-	if err := s.Sync(); err != nil {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(srcDir, "file.txt"), "content")
+
+	// Port and identity come from the URL alone.
+	target := fmt.Sprintf("sftp://%s@%s:%d%s?identity=%s", server.User, server.Host, server.Port, dstDir, server.KeyFile)
+	s := New(Options{Source: Endpoint{Path: srcDir}, Target: Endpoint{Path: target}}, logger.NewWithWriter(&bytes.Buffer{}))
+	if _, err := s.Sync(); err != nil {
 		t.Fatalf("Sync failed: %v", err)
 	}
+	if content := readFile(t, filepath.Join(dstDir, "file.txt")); content != "content" {
+		t.Errorf("file.txt content = %q, want %q", content, "content")
+	}
+}
 
-	if content := readFile(t, filepath.Join(dstDir, "file1.txt")); content != "content1" {
-		t.Errorf("file1.txt content mismatch: got %q, want %q", content, "content1")
+func TestSync_Archive(t *testing.T) {
+	for _, name := range []string{"out.tar", "out.tar.gz", "out.zip"} {
+		t.Run(name, func(t *testing.T) {
+			srcDir := t.TempDir()
+			archive := filepath.Join(t.TempDir(), name)
+			createFile(t, filepath.Join(srcDir, "a.txt"), "alpha")
+			createFile(t, filepath.Join(srcDir, "sub", "b.txt"), "bravo")
+			modTime := time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC)
+			for _, p := range []string{"a.txt", filepath.Join("sub", "b.txt")} {
+				if err := os.Chtimes(filepath.Join(srcDir, p), modTime, modTime); err != nil {
+					t.Fatalf("failed to set modtime: %v", err)
+				}
+			}
+
+			run := func(src, dst string) {
+				t.Helper()
+				opts := Options{Source: Endpoint{Path: src}, Target: Endpoint{Path: dst}}
+				if _, err := New(opts, logger.NewWithWriter(&bytes.Buffer{})).Sync(); err != nil {
+					t.Fatalf("Sync(%s, %s) failed: %v", src, dst, err)
+				}
+			}
+
+			run(srcDir, archive)
+			first, err := os.ReadFile(archive)
+			if err != nil {
+				t.Fatalf("failed to read archive: %v", err)
+			}
+
+			// An unchanged tree leaves the archive alone.
+			before, _ := os.Stat(archive)
+			time.Sleep(10 * time.Millisecond)
+			run(srcDir, archive)
+			after, _ := os.Stat(archive)
+			if !after.ModTime().Equal(before.ModTime()) {
+				t.Error("archive was rewritten although nothing changed")
+			}
+
+			outDir := t.TempDir()
+			run(archive, outDir)
+			if content := readFile(t, filepath.Join(outDir, "sub", "b.txt")); content != "bravo" {
+				t.Errorf("sub/b.txt content = %q, want %q", content, "bravo")
+			}
+			info, err := os.Stat(filepath.Join(outDir, "a.txt"))
+			if err != nil {
+				t.Fatalf("stat failed: %v", err)
+			}
+			if !info.ModTime().Equal(modTime) {
+				t.Errorf("a.txt modtime = %v, want %v", info.ModTime(), modTime)
+			}
+
+			// Syncing the extracted tree into a new archive reproduces it.
+			second := filepath.Join(t.TempDir(), name)
+			run(outDir, second)
+			data, err := os.ReadFile(second)
+			if err != nil {
+				t.Fatalf("failed to read archive: %v", err)
+			}
+			if !bytes.Equal(first, data) {
+				t.Error("archives of the same tree differ")
+			}
+		})
 	}
-	if content := readFile(t, filepath.Join(dstDir, "subdir", "file2.txt")); content != "content2" {
-		t.Errorf("subdir/file2.txt content mismatch: got %q, want %q", content, "content2")
+}
+
+func TestSync_ArchiveWriteFails(t *testing.T) {
+	srcDir := t.TempDir()
+	createFile(t, filepath.Join(srcDir, "a.txt"), "alpha")
+
+	// The archive is only written on Close, which fails because its
+	// directory doesn't exist.
+	archive := filepath.Join(t.TempDir(), "missing", "out.tar")
+	opts := Options{Source: Endpoint{Path: srcDir}, Target: Endpoint{Path: archive}}
+	_, err := New(opts, logger.NewWithWriter(&bytes.Buffer{})).Sync()
+	if err == nil {
+		t.Fatal("Sync succeeded although the archive couldn't be written")
+	}
+	if code := ExitCode(err); code != cli.ExitFatal {
+		t.Errorf("ExitCode = %d, want %d (%v)", code, cli.ExitFatal, err)
 	}
 }
 
-func TestSync_UpdateChangedFiles(t *testing.T) {
-	srcDir, dstDir, logBuf := setupTest(t)
+func TestSync_Encrypted(t *testing.T) {
+	forEachMode(t, func(t *testing.T, env *syncEnv) {
+		createFile(t, filepath.Join(env.srcDir, "secret.txt"), "top secret")
+		createFile(t, filepath.Join(env.srcDir, "sub", "notes.txt"), "notes")
 
-	createFile(t, filepath.Join(srcDir, "file.txt"), "new content")
-	createFile(t, filepath.Join(dstDir, "file.txt"), "old content")
+		opts := env.options(env.srcDir, env.dstDir)
+		opts.Target.CryptKey = "passphrase"
+		opts.CryptNames = true
+		if _, err := New(opts, logger.NewWithWriter(env.logBuf)).Sync(); err != nil {
+			t.Fatalf("Sync failed: %v", err)
+		}
 
-	oldTime := time.Now().Add(-time.Hour).Truncate(time.Second)
-	if err := os.Chtimes(filepath.Join(dstDir, "file.txt"), oldTime, oldTime); err != nil {
-		t.Fatalf("failed to set modtime: %v", err)
+		filepath.WalkDir(env.dstDir, func(p string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if strings.Contains(p, "secret") || strings.Contains(p, "notes") {
+				t.Errorf("name stored unencrypted: %s", p)
+			}
+			if !d.IsDir() && strings.Contains(readFile(t, p), "secret") {
+				t.Errorf("content stored unencrypted: %s", p)
+			}
+			return nil
+		})
+
+		// Unchanged files are recognized without decrypting them.
+		for _, checksum := range []bool{false, true} {
+			env.logBuf.Reset()
+			opts.Checksum = checksum
+			if _, err := New(opts, logger.NewWithWriter(env.logBuf)).Sync(); err != nil {
+				t.Fatalf("Sync failed: %v", err)
+			}
+			if strings.Contains(env.logBuf.String(), "copying") || strings.Contains(env.logBuf.String(), "updating") {
+				t.Errorf("checksum=%v: unchanged files were copied again:\n%s", checksum, env.logBuf)
+			}
+		}
+
+		outDir := t.TempDir()
+		restore := env.options(env.dstDir, outDir)
+		restore.Source.CryptKey = "passphrase"
+		restore.CryptNames = true
+		if _, err := New(restore, logger.NewWithWriter(env.logBuf)).Sync(); err != nil {
+			t.Fatalf("Sync from encrypted source failed: %v", err)
+		}
+		if content := readFile(t, filepath.Join(outDir, "sub", "notes.txt")); content != "notes" {
+			t.Errorf("sub/notes.txt content = %q, want %q", content, "notes")
+		}
+		if content := readFile(t, filepath.Join(outDir, "secret.txt")); content != "top secret" {
+			t.Errorf("secret.txt content = %q, want %q", content, "top secret")
+		}
+	})
+}
+
+func TestSync_Compressed(t *testing.T) {
+	for _, tt := range []struct {
+		format   string
+		cryptKey string
+	}{{"zstd", ""}, {"gzip", ""}, {"zstd", "passphrase"}} {
+		t.Run(tt.format+"/encrypted="+fmt.Sprint(tt.cryptKey != ""), func(t *testing.T) {
+			srcDir, dstDir, outDir := t.TempDir(), t.TempDir(), t.TempDir()
+			log := strings.Repeat("GET /index.html 200\n", 1000)
+			createFile(t, filepath.Join(srcDir, "access.log"), log)
+			createFile(t, filepath.Join(srcDir, "old", "access.log.1.gz"), "\x1f\x8balready compressed")
+
+			logBuf := &bytes.Buffer{}
+			opts := Options{
+				Source:   Endpoint{Path: srcDir},
+				Target:   Endpoint{Path: dstDir, CryptKey: tt.cryptKey},
+				Compress: tt.format,
+			}
+			for range 2 {
+				logBuf.Reset()
+				if _, err := New(opts, logger.NewWithWriter(logBuf)).Sync(); err != nil {
+					t.Fatalf("Sync failed: %v", err)
+				}
+			}
+			if strings.Contains(logBuf.String(), "copying") || strings.Contains(logBuf.String(), "updating") {
+				t.Errorf("unchanged files were copied again:\n%s", logBuf)
+			}
+
+			info, err := os.Stat(filepath.Join(dstDir, "access.log"))
+			if err != nil {
+				t.Fatalf("stat failed: %v", err)
+			}
+			if info.Size() >= int64(len(log))/10 {
+				t.Errorf("access.log stored in %d bytes, expected it compressed", info.Size())
+			}
+
+			restore := Options{
+				Source:     Endpoint{Path: dstDir, CryptKey: tt.cryptKey},
+				Target:     Endpoint{Path: outDir},
+				Decompress: true,
+			}
+			if _, err := New(restore, logger.NewWithWriter(logBuf)).Sync(); err != nil {
+				t.Fatalf("Sync from compressed source failed: %v", err)
+			}
+			if content := readFile(t, filepath.Join(outDir, "access.log")); content != log {
+				t.Errorf("access.log differs after restore")
+			}
+			if content := readFile(t, filepath.Join(outDir, "old", "access.log.1.gz")); content != "\x1f\x8balready compressed" {
+				t.Errorf("access.log.1.gz content = %q", content)
+			}
+		})
 	}
+}
+
+func TestSync_BandwidthLimit(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(srcDir, "big.bin"), strings.Repeat("x", 1<<20))
 
-	config := &cli.Config{
-		SourceDir:     srcDir,
-		TargetDir:     dstDir,
-		DeleteMissing: false,
-		UseChecksum:   false,
+	opts := Options{Source: Endpoint{Path: srcDir}, Target: Endpoint{Path: dstDir}, BWLimit: ratelimit.Schedule{{Rate: 4 << 20}}}
+	start := time.Now()
+	if _, err := New(opts, logger.NewWithWriter(&bytes.Buffer{})).Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	// 1 MiB at 4 MiB/s takes a quarter second, less the initial burst.
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Sync took %v, expected it to be throttled", elapsed)
+	}
+	if info, err := os.Stat(filepath.Join(dstDir, "big.bin")); err != nil || info.Size() != 1<<20 {
+		t.Errorf("big.bin not copied: %v", err)
 	}
+}
+
+func TestSync_Progress(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	createFile(t, filepath.Join(srcDir, "a.txt"), "alpha")
+	createFile(t, filepath.Join(srcDir, "sub", "b.txt"), "bravo!")
 
-	s := New(config, logger.NewWithWriter(logBuf))
-	if err := s.Sync(); err != nil {
+	out := &bytes.Buffer{}
+	s := New(Options{Source: Endpoint{Path: srcDir}, Target: Endpoint{Path: dstDir}}, logger.NewWithWriter(&bytes.Buffer{}))
+	s.SetProgress(progress.New(out, false, 0))
+	if _, err := s.Sync(); err != nil {
 		t.Fatalf("Sync failed: %v", err)
 	}
+	if !strings.HasPrefix(out.String(), "2/2 files, 11 B/11 B (100%)") {
+		t.Errorf("progress = %q", out.String())
+	}
+}
+
+func TestSameEndpoint(t *testing.T) {
+	opts := SSHOptions{Port: 22}
+
+	tests := []struct {
+		name       string
+		src, dst   fs.PathInfo
+		srcOpts    SSHOptions
+		dstOpts    SSHOptions
+		wantShared bool
+	}{
+		{
+			name:       "same user and host",
+			src:        fs.PathInfo{Scheme: "sftp", IsRemote: true, User: "user", Host: "host", Path: "/a"},
+			dst:        fs.PathInfo{Scheme: "sftp", IsRemote: true, User: "user", Host: "host", Path: "/b"},
+			srcOpts:    opts,
+			dstOpts:    opts,
+			wantShared: true,
+		},
+		{
+			name:    "different hosts",
+			src:     fs.PathInfo{Scheme: "sftp", IsRemote: true, User: "user", Host: "host1", Path: "/a"},
+			dst:     fs.PathInfo{Scheme: "sftp", IsRemote: true, User: "user", Host: "host2", Path: "/b"},
+			srcOpts: opts,
+			dstOpts: opts,
+		},
+		{
+			name:    "different users",
+			src:     fs.PathInfo{Scheme: "sftp", IsRemote: true, User: "alice", Host: "host", Path: "/a"},
+			dst:     fs.PathInfo{Scheme: "sftp", IsRemote: true, User: "bob", Host: "host", Path: "/b"},
+			srcOpts: opts,
+			dstOpts: opts,
+		},
+		{
+			name:    "different ports",
+			src:     fs.PathInfo{Scheme: "sftp", IsRemote: true, User: "user", Host: "host", Path: "/a"},
+			dst:     fs.PathInfo{Scheme: "sftp", IsRemote: true, User: "user", Host: "host", Path: "/b"},
+			srcOpts: opts,
+			dstOpts: SSHOptions{Port: 2222},
+		},
+		{
+			name:    "different ports in URLs",
+			src:     parsePath(t, "sftp://user@host/a"),
+			dst:     parsePath(t, "sftp://user@host:2222/b"),
+			srcOpts: opts,
+			dstOpts: opts,
+		},
+		{
+			name:       "URL and host:path syntax",
+			src:        parsePath(t, "sftp://user@host/a"),
+			dst:        parsePath(t, "user@host:/b"),
+			srcOpts:    opts,
+			dstOpts:    opts,
+			wantShared: true,
+		},
+		{
+			name:    "local paths",
+			src:     fs.PathInfo{Scheme: "file", Path: "/a"},
+			dst:     fs.PathInfo{Scheme: "file", Path: "/b"},
+			srcOpts: opts,
+			dstOpts: opts,
+		},
+	}
 
-	if content := readFile(t, filepath.Join(dstDir, "file.txt")); content != "new content" {
-		t.Errorf("file.txt content mismatch: got %q, want %q", content, "new content")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sameEndpoint(tt.src, tt.srcOpts, tt.dst, tt.dstOpts); got != tt.wantShared {
+				t.Errorf("sameEndpoint = %v, want %v", got, tt.wantShared)
+			}
+		})
 	}
 }
 
-func TestSync_SkipIdenticalFiles(t *testing.T) {
-	srcDir, dstDir, logBuf := setupTest(t)
+func writeMemFile(t *testing.T, m *fs.MemFS, path, content string, modTime time.Time) {
+	t.Helper()
+	if err := m.WriteFile(path, []byte(content), 0644, modTime); err != nil {
+		t.Fatalf("failed to create file %s: %v", path, err)
+	}
+}
+
+func readMemFile(t *testing.T, m *fs.MemFS, path string) string {
+	t.Helper()
+	content, err := m.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read file %s: %v", path, err)
+	}
+	return string(content)
+}
 
-	content := "same content"
+func TestSyncFS_MixedSeparators(t *testing.T) {
+	src := fs.NewMemFSWithSeparator('\\')
+	dst := fs.NewMemFS()
 	modTime := time.Now().Truncate(time.Second)
 
-	createFile(t, filepath.Join(srcDir, "file.txt"), content)
-	createFile(t, filepath.Join(dstDir, "file.txt"), content)
+	writeMemFile(t, src, `\data\file1.txt`, "content1", modTime)
+	writeMemFile(t, src, `\data\sub\deep\file2.txt`, "content2", modTime)
+	writeMemFile(t, dst, "/backup/orphan.txt", "orphan", modTime)
+
+	s := New(Options{DeleteMissing: true}, logger.NewWithWriter(&bytes.Buffer{}))
+	if _, err := s.SyncFS(src, `\data`, dst, "/backup"); err != nil {
+		t.Fatalf("SyncFS failed: %v", err)
+	}
 
-	if err := os.Chtimes(filepath.Join(srcDir, "file.txt"), modTime, modTime); err != nil {
-		t.Fatalf("failed to set modtime: %v", err)
+	if content := readMemFile(t, dst, "/backup/file1.txt"); content != "content1" {
+		t.Errorf("file1.txt content mismatch: got %q, want %q", content, "content1")
 	}
-	if err := os.Chtimes(filepath.Join(dstDir, "file.txt"), modTime, modTime); err != nil {
-		t.Fatalf("failed to set modtime: %v", err)
+	if content := readMemFile(t, dst, "/backup/sub/deep/file2.txt"); content != "content2" {
+		t.Errorf("sub/deep/file2.txt content mismatch: got %q, want %q", content, "content2")
+	}
+	if _, err := dst.Stat("/backup/orphan.txt"); !os.IsNotExist(err) {
+		t.Error("orphan.txt should be deleted")
 	}
 
-	config := &cli.Config{
-		SourceDir:     srcDir,
-		TargetDir:     dstDir,
-		DeleteMissing: false,
-		UseChecksum:   false,
+	info, err := dst.Stat("/backup/sub/deep/file2.txt")
+	if err != nil {
+		t.Fatalf("failed to stat synced file: %v", err)
 	}
+	if !info.ModTime.Equal(modTime) {
+		t.Errorf("modtime = %v, want %v", info.ModTime, modTime)
+	}
+}
 
-	s := New(config, logger.NewWithWriter(logBuf))
-	if err := s.Sync(); err != nil {
-		t.Fatalf("Sync failed: %v", err)
+func TestSyncFS_SlashSourceToBackslashTarget(t *testing.T) {
+	src := fs.NewMemFS()
+	dst := fs.NewMemFSWithSeparator('\\')
+
+	writeMemFile(t, src, "/data/sub/file.txt", "content", time.Now())
+
+	s := New(Options{}, logger.NewWithWriter(&bytes.Buffer{}))
+	if _, err := s.SyncFS(src, "/data", dst, `C:\backup`); err != nil {
+		t.Fatalf("SyncFS failed: %v", err)
 	}
 
-	if bytes.Contains(logBuf.Bytes(), []byte("copying")) || bytes.Contains(logBuf.Bytes(), []byte("updating")) {
-		t.Error("identical file should not be copied or updated")
+	if content := readMemFile(t, dst, `C:\backup\sub\file.txt`); content != "content" {
+		t.Errorf("content mismatch: got %q, want %q", content, "content")
 	}
 }
 
-func TestSync_DeleteMissing(t *testing.T) {
-	srcDir, dstDir, logBuf := setupTest(t)
+func TestSyncFS_ContinuesAfterFailure(t *testing.T) {
+	src := fs.NewMemFS()
+	dst := fs.NewMemFS()
 
-	createFile(t, filepath.Join(srcDir, "keep.txt"), "keep")
-	createFile(t, filepath.Join(dstDir, "keep.txt"), "keep")
-	createFile(t, filepath.Join(dstDir, "orphan.txt"), "orphan")
+	writeMemFile(t, src, "/src/bad.txt", "bad", time.Now())
+	writeMemFile(t, src, "/src/good.txt", "good", time.Now())
+	dst.Fail("Create", "/dst/bad.txt", errors.New("disk full"))
 
-	modTime := time.Now().Truncate(time.Second)
-	if err := os.Chtimes(filepath.Join(srcDir, "keep.txt"), modTime, modTime); err != nil {
-		t.Fatalf("failed to set modtime: %v", err)
+	logBuf := &bytes.Buffer{}
+	s := New(Options{}, logger.NewWithWriter(logBuf))
+	result, err := s.SyncFS(src, "/src", dst, "/dst")
+	var syncErr *SyncError
+	if !errors.As(err, &syncErr) {
+		t.Fatalf("SyncFS = %v, want a *SyncError", err)
+	}
+	if len(syncErr.Failures) != 1 || syncErr.Failures[0].Path != "bad.txt" || syncErr.Failures[0].Op != "copy" {
+		t.Errorf("failures = %v, want the copy of bad.txt", syncErr.Failures)
+	}
+	if ExitCode(err) != cli.ExitPartial {
+		t.Errorf("ExitCode = %d, want %d", ExitCode(err), cli.ExitPartial)
 	}
-	if err := os.Chtimes(filepath.Join(dstDir, "keep.txt"), modTime, modTime); err != nil {
-		t.Fatalf("failed to set modtime: %v", err)
+	if result.Failed != 1 || result.Copied != 1 {
+		t.Errorf("result = %+v, want 1 failed and 1 copied", result)
 	}
 
-	config := &cli.Config{
-		SourceDir:     srcDir,
-		TargetDir:     dstDir,
-		DeleteMissing: true,
-		UseChecksum:   false,
+	if content := readMemFile(t, dst, "/dst/good.txt"); content != "good" {
+		t.Errorf("good.txt content mismatch: got %q, want %q", content, "good")
 	}
+	if !bytes.Contains(logBuf.Bytes(), []byte("failed to copy bad.txt: disk full")) {
+		t.Errorf("log should report the failed copy, got:\n%s", logBuf.String())
+	}
+}
 
-	s := New(config, logger.NewWithWriter(logBuf))
-	if err := s.Sync(); err != nil {
-		t.Fatalf("Sync failed: %v", err)
+func TestSyncFS_AccessFailureIsRelative(t *testing.T) {
+	src := fs.NewMemFS()
+	dst := fs.NewMemFS()
+	writeMemFile(t, src, "/src/sub/bad.txt", "bad", time.Now())
+	writeMemFile(t, dst, "/dst/gone.txt", "gone", time.Now())
+	faultySrc := fs.NewFaultFS(src, fs.FaultRule{Op: "Walk", Path: "bad.txt", Err: errors.New("permission denied")})
+	faultyDst := fs.NewFaultFS(dst, fs.FaultRule{Op: "Walk", Path: "gone.txt", Err: errors.New("permission denied")})
+
+	s := New(Options{DeleteMissing: true}, logger.NewWithWriter(&bytes.Buffer{}))
+	_, err := s.SyncFS(faultySrc, "/src", faultyDst, "/dst")
+	var syncErr *SyncError
+	if !errors.As(err, &syncErr) {
+		t.Fatalf("SyncFS = %v, want a *SyncError", err)
+	}
+	var paths []string
+	for _, f := range syncErr.Failures {
+		paths = append(paths, f.Op+" "+f.Path)
+	}
+	if got, want := strings.Join(paths, ","), "access sub/bad.txt,access gone.txt"; got != want {
+		t.Errorf("failures = %s, want %s", got, want)
 	}
+}
+
+func TestSyncFS_Result(t *testing.T) {
+	src := fs.NewMemFS()
+	dst := fs.NewMemFS()
+
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	writeMemFile(t, src, "/src/new.txt", "new", old)
+	writeMemFile(t, src, "/src/changed.txt", "changed", old)
+	writeMemFile(t, src, "/src/same.txt", "same", old)
+	writeMemFile(t, dst, "/dst/changed.txt", "old", old)
+	writeMemFile(t, dst, "/dst/same.txt", "same", old)
+	writeMemFile(t, dst, "/dst/orphan.txt", "orphan", old)
 
-	if _, err := os.Stat(filepath.Join(dstDir, "keep.txt")); os.IsNotExist(err) {
-		t.Error("keep.txt should exist")
+	s := New(Options{DeleteMissing: true}, logger.NewWithWriter(&bytes.Buffer{}))
+	result, err := s.SyncFS(src, "/src", dst, "/dst")
+	if err != nil {
+		t.Fatalf("SyncFS failed: %v", err)
 	}
-	if _, err := os.Stat(filepath.Join(dstDir, "orphan.txt")); !os.IsNotExist(err) {
-		t.Error("orphan.txt should be deleted")
+
+	want := Result{Scanned: 3, Copied: 1, Updated: 1, Skipped: 1, Deleted: 1, BytesSent: 10}
+	result.Duration = 0
+	if result != want {
+		t.Errorf("result = %+v, want %+v", result, want)
+	}
+	if got := result.String(); got != "3 scanned, 1 copied, 1 updated, 1 skipped, 1 deleted, 0 failed, 10 B sent in 0s" {
+		t.Errorf("String() = %q", got)
+	}
+
+	// Counters start over with each run.
+	result, _ = s.SyncFS(src, "/src", dst, "/dst")
+	if result.Scanned != 3 || result.Skipped != 3 || result.Copied != 0 {
+		t.Errorf("second run result = %+v", result)
 	}
 }
 
-func TestSync_DeleteMissingDisabled(t *testing.T) {
-	srcDir, dstDir, logBuf := setupTest(t)
+func TestSyncFS_JSONOutput(t *testing.T) {
+	src := fs.NewMemFS()
+	dst := fs.NewMemFS()
+	old := time.Now().Add(-time.Hour)
 
-	createFile(t, filepath.Join(srcDir, "keep.txt"), "keep")
-	createFile(t, filepath.Join(dstDir, "orphan.txt"), "orphan")
+	writeMemFile(t, src, "/src/new.txt", "new", old)
+	writeMemFile(t, src, "/src/changed.txt", "changed", old)
+	writeMemFile(t, dst, "/dst/changed.txt", "stale", old)
+	writeMemFile(t, src, "/src/same.txt", "same", old)
+	writeMemFile(t, dst, "/dst/same.txt", "same", old)
+	writeMemFile(t, src, "/src/bad.txt", "bad", old)
+	writeMemFile(t, dst, "/dst/orphan.txt", "orphan", old)
+	dst.Fail("Create", "/dst/bad.txt", errors.New("disk full"))
 
-	config := &cli.Config{
-		SourceDir:     srcDir,
-		TargetDir:     dstDir,
-		DeleteMissing: false,
-		UseChecksum:   false,
+	out := &bytes.Buffer{}
+	s := New(Options{DeleteMissing: true}, logger.NewJSON(out))
+	if _, err := s.SyncFS(src, "/src", dst, "/dst"); ExitCode(err) != cli.ExitPartial {
+		t.Fatalf("SyncFS = %v, want a partial failure", err)
 	}
 
-	s := New(config, logger.NewWithWriter(logBuf))
-	if err := s.Sync(); err != nil {
-		t.Fatalf("Sync failed: %v", err)
+	events := map[string]Event{}
+	dec := json.NewDecoder(out)
+	for dec.More() {
+		var ev Event
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatalf("output is not JSON lines: %v\n%s", err, out.String())
+		}
+		if ev.Type != "file" {
+			t.Errorf("unexpected %s line: %+v", ev.Type, ev)
+		}
+		events[ev.Path] = ev
 	}
 
-	if _, err := os.Stat(filepath.Join(dstDir, "orphan.txt")); os.IsNotExist(err) {
-		t.Error("orphan.txt should not be deleted when DeleteMissing is false")
+	want := map[string]Event{
+		"new.txt":     {Action: ActionCopy, Reason: "missing in target", Bytes: 3},
+		"changed.txt": {Action: ActionUpdate, Reason: ReasonSize, Source: "7", Target: "5", Bytes: 7},
+		"same.txt":    {Action: ActionSkip, Reason: "up to date"},
+		"orphan.txt":  {Action: ActionDelete, Reason: "missing in source"},
+		"bad.txt":     {Action: ActionFail, Reason: "failed to copy", Error: "disk full"},
+	}
+	if len(events) != len(want) {
+		t.Errorf("got %d events, want %d:\n%s", len(events), len(want), out.String())
+	}
+	for p, w := range want {
+		ev := events[p]
+		if ev.Action != w.Action || ev.Reason != w.Reason || ev.Source != w.Source || ev.Target != w.Target || ev.Bytes != w.Bytes || ev.Error != w.Error {
+			t.Errorf("%s: event = %+v, want %+v", p, ev, w)
+		}
 	}
 }
 
-func TestSync_UseChecksum(t *testing.T) {
-	srcDir, dstDir, logBuf := setupTest(t)
+func TestSyncFS_DebugDecisions(t *testing.T) {
+	old := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	newFS := func() (*fs.MemFS, *fs.MemFS) {
+		src, dst := fs.NewMemFS(), fs.NewMemFS()
+		writeMemFile(t, src, "/src/resized.txt", "longer", old)
+		writeMemFile(t, dst, "/dst/resized.txt", "short", old)
+		writeMemFile(t, src, "/src/touched.txt", "same", old.Add(time.Hour))
+		writeMemFile(t, dst, "/dst/touched.txt", "same", old)
+		writeMemFile(t, src, "/src/same.txt", "same", old)
+		writeMemFile(t, dst, "/dst/same.txt", "same", old)
+		return src, dst
+	}
 
-	createFile(t, filepath.Join(srcDir, "file.txt"), "same content")
-	createFile(t, filepath.Join(dstDir, "file.txt"), "same content")
+	tests := []struct {
+		verbosity int
+		want      []string
+		notWant   []string
+	}{
+		{0, nil, []string{"[DEBUG]"}},
+		{1, []string{
+			"resized.txt: size differs: 6 bytes in source, 5 in target",
+			"touched.txt: modification time differs: 2024-05-01T13:00:00Z in source, 2024-05-01T12:00:00Z in target",
+		}, []string{"same.txt"}},
+		{2, []string{"same.txt: up to date"}, nil},
+	}
+	for _, tt := range tests {
+		src, dst := newFS()
+		out := &bytes.Buffer{}
+		log := logger.NewWithWriter(out)
+		if tt.verbosity > 0 {
+			log.SetLevel(logger.DEBUG)
+		}
+		s := New(Options{ListUpToDate: tt.verbosity >= 2}, log)
+		if _, err := s.SyncFS(src, "/src", dst, "/dst"); err != nil {
+			t.Fatalf("SyncFS failed: %v", err)
+		}
+		for _, w := range tt.want {
+			if !strings.Contains(out.String(), w) {
+				t.Errorf("verbosity %d: output lacks %q:\n%s", tt.verbosity, w, out.String())
+			}
+		}
+		for _, w := range tt.notWant {
+			if strings.Contains(out.String(), w) {
+				t.Errorf("verbosity %d: output contains %q:\n%s", tt.verbosity, w, out.String())
+			}
+		}
+	}
 
-	config := &cli.Config{
-		SourceDir:     srcDir,
-		TargetDir:     dstDir,
-		DeleteMissing: false,
-		UseChecksum:   true,
+	// With checksums the decision names both digests.
+	src, dst := newFS()
+	out := &bytes.Buffer{}
+	log := logger.NewWithWriter(out)
+	log.SetLevel(logger.DEBUG)
+	if _, err := New(Options{Checksum: true}, log).SyncFS(src, "/src", dst, "/dst"); err != nil {
+		t.Fatalf("SyncFS failed: %v", err)
 	}
+	if !strings.Contains(out.String(), "resized.txt: checksum differs: ") || strings.Contains(out.String(), "touched.txt:") {
+		t.Errorf("checksum decisions:\n%s", out.String())
+	}
+}
 
-	s := New(config, logger.NewWithWriter(logBuf))
-	if err := s.Sync(); err != nil {
-		t.Fatalf("Sync failed: %v", err)
+func TestSyncFS_Metrics(t *testing.T) {
+	src := fs.NewMemFS()
+	dst := fs.NewMemFS()
+	writeMemFile(t, src, "/src/new.txt", "new", time.Now())
+	writeMemFile(t, src, "/src/bad.txt", "bad", time.Now())
+	dst.Fail("Create", "/dst/bad.txt", errors.New("disk full"))
+
+	m := metrics.New()
+	s := New(Options{}, logger.NewWithWriter(&bytes.Buffer{}))
+	s.SetMetrics(m)
+	s.SyncFS(src, "/src", dst, "/dst")
+
+	out := &bytes.Buffer{}
+	m.WriteTo(out)
+	for _, want := range []string{
+		`sync_files_total{action="copy"} 1`,
+		"sync_bytes_total 3",
+		`sync_errors_total{op="copy"} 1`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("metrics lack %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestSync_MetricsRuns(t *testing.T) {
+	srcDir := t.TempDir()
+	createFile(t, filepath.Join(srcDir, "file.txt"), "content")
+
+	m := metrics.New()
+	for _, source := range []string{
+		srcDir,
+		// Runs that fail before reaching any file count as well.
+		"host:2222:/data",
+		filepath.Join(srcDir, "missing"),
+	} {
+		s := New(Options{Source: Endpoint{Path: source}, Target: Endpoint{Path: t.TempDir()}}, logger.NewWithWriter(&bytes.Buffer{}))
+		s.SetMetrics(m)
+		s.Sync()
 	}
 
-	if bytes.Contains(logBuf.Bytes(), []byte("updating")) {
-		t.Error("files with same checksum should not be updated")
+	out := &bytes.Buffer{}
+	m.WriteTo(out)
+	for _, want := range []string{
+		`sync_runs_total{result="success"} 1`,
+		`sync_runs_total{result="failed"} 2`,
+		"sync_run_duration_seconds_count 3",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("metrics lack %q:\n%s", want, out.String())
+		}
 	}
 }
 
-func TestSync_SourceNotExists(t *testing.T) {
-	_, dstDir, logBuf := setupTest(t)
+func TestNewSummary(t *testing.T) {
+	result := Result{Scanned: 3, Copied: 1, Failed: 1, BytesSent: 2048, Duration: 1500 * time.Millisecond}
+	data, err := json.Marshal(NewSummary(result, &SyncError{Failures: []Failure{{Path: "a", Op: "copy", Err: errors.New("x")}}}))
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	for _, field := range []string{`"type":"summary"`, `"scanned":3`, `"bytes_sent":2048`, `"duration":1.5`, `"error":"1 files failed: copy a: x"`, `"exit_code":3`} {
+		if !bytes.Contains(data, []byte(field)) {
+			t.Errorf("summary %s lacks %s", data, field)
+		}
+	}
+}
+
+func TestSyncFS_MaxDelete(t *testing.T) {
+	src := fs.NewMemFS()
+	dst := fs.NewMemFS()
+	src.MkdirAll("/src", 0755)
+	for i := range 3 {
+		writeMemFile(t, dst, fmt.Sprintf("/dst/orphan%d.txt", i), "orphan", time.Now())
+	}
+
+	s := New(Options{DeleteMissing: true, MaxDelete: 2}, logger.NewWithWriter(&bytes.Buffer{}))
+	_, err := s.SyncFS(src, "/src", dst, "/dst")
+	if !errors.Is(err, ErrSafetyLimit) || ExitCode(err) != cli.ExitSafetyLimit {
+		t.Fatalf("SyncFS = %v, want ErrSafetyLimit", err)
+	}
+	if _, err := dst.Stat("/dst/orphan0.txt"); err != nil {
+		t.Errorf("orphan deleted despite the safety limit: %v", err)
+	}
 
-	config := &cli.Config{
-		SourceDir:     "/nonexistent/path",
-		TargetDir:     dstDir,
-		DeleteMissing: false,
-		UseChecksum:   false,
+	// Files that failed to copy are still reported.
+	writeMemFile(t, src, "/src/bad.txt", "bad", time.Now())
+	dst.Fail("Create", "/dst/bad.txt", errors.New("disk full"))
+	_, err = s.SyncFS(src, "/src", dst, "/dst")
+	var syncErr *SyncError
+	if ExitCode(err) != cli.ExitSafetyLimit || !errors.As(err, &syncErr) || len(syncErr.Failures) != 1 {
+		t.Errorf("SyncFS with a failed copy = %v, want ErrSafetyLimit and the failure", err)
+	}
+	if runResult(err) != "failed" {
+		t.Errorf("runResult = %s, want failed", runResult(err))
 	}
+	src.Remove("/src/bad.txt")
 
-	s := New(config, logger.NewWithWriter(logBuf))
-	if err := s.Sync(); err == nil {
-		t.Error("Sync should fail when source does not exist")
+	s = New(Options{DeleteMissing: true, MaxDelete: 3}, logger.NewWithWriter(&bytes.Buffer{}))
+	result, err := s.SyncFS(src, "/src", dst, "/dst")
+	if err != nil || result.Deleted != 3 {
+		t.Errorf("SyncFS = %+v, %v, want 3 deleted", result, err)
 	}
 }
 
-func TestSync_SourceIsFile(t *testing.T) {
-	srcDir, dstDir, logBuf := setupTest(t)
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"success", nil, cli.ExitOK},
+		{"fatal", errors.New("connection refused"), cli.ExitFatal},
+		{"config", &ConfigError{errors.New("bad path")}, cli.ExitUsage},
+		{"partial", &SyncError{Failures: []Failure{{Path: "a", Op: "copy", Err: errors.New("x")}}}, cli.ExitPartial},
+		{"safety limit", fmt.Errorf("%w: too many", ErrSafetyLimit), cli.ExitSafetyLimit},
+		{"partial and fatal", errors.Join(&SyncError{Failures: []Failure{{Path: "a", Op: "copy", Err: errors.New("x")}}}, errors.New("close")), cli.ExitFatal},
+		{"joined partial", errors.Join(&SyncError{Failures: []Failure{{Path: "a", Op: "copy", Err: errors.New("x")}}}), cli.ExitPartial},
+		{"safety limit and partial", errors.Join(ErrSafetyLimit, &SyncError{Failures: []Failure{{Path: "a", Op: "copy", Err: errors.New("x")}}}), cli.ExitSafetyLimit},
+		{"partial and safety limit", errors.Join(&SyncError{Failures: []Failure{{Path: "a", Op: "copy", Err: errors.New("x")}}}, ErrSafetyLimit), cli.ExitSafetyLimit},
+	}
+	for _, tt := range tests {
+		if got := ExitCode(tt.err); got != tt.want {
+			t.Errorf("%s: ExitCode = %d, want %d", tt.name, got, tt.want)
+		}
+	}
 
-	srcFile := filepath.Join(srcDir, "file.txt")
-	createFile(t, srcFile, "content")
+	s := New(Options{Source: Endpoint{Path: "host:2222:/data"}, Target: Endpoint{Path: t.TempDir()}}, logger.NewWithWriter(&bytes.Buffer{}))
+	if _, err := s.Sync(); ExitCode(err) != cli.ExitUsage {
+		t.Errorf("Sync with an ambiguous source = %v, want a usage error", err)
+	}
+}
 
-	config := &cli.Config{
-		SourceDir:     srcFile,
-		TargetDir:     dstDir,
-		DeleteMissing: false,
-		UseChecksum:   false,
+func TestSyncError_Message(t *testing.T) {
+	var failures []Failure
+	for i := range 12 {
+		failures = append(failures, Failure{Path: fmt.Sprintf("f%d", i), Op: "copy", Err: errors.New("disk full")})
+	}
+	err := &SyncError{Failures: failures}
+	msg := err.Error()
+	if !strings.HasPrefix(msg, "12 files failed: copy f0: disk full; copy f1: disk full;") || !strings.HasSuffix(msg, "; and 2 more") {
+		t.Errorf("Error() = %q", msg)
+	}
+	var failure Failure
+	if !errors.As(err, &failure) || failure.Path != "f0" {
+		t.Errorf("errors.As(Failure) = %v", failure)
+	}
+}
+
+func TestSyncFS_RecoversFromInterruptedCopy(t *testing.T) {
+	src := fs.NewMemFS()
+	dst := fs.NewMemFS()
+
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	writeMemFile(t, src, "/src/big.txt", strings.Repeat("x", 1000), modTime)
+	faulty := fs.NewFaultFS(dst, fs.FaultRule{Op: "Create", Path: "big.txt", Nth: 1, DisconnectAfter: 100})
+
+	logBuf := &bytes.Buffer{}
+	s := New(Options{}, logger.NewWithWriter(logBuf))
+	var syncErr *SyncError
+	if _, err := s.SyncFS(src, "/src", faulty, "/dst"); !errors.As(err, &syncErr) {
+		t.Fatalf("first SyncFS = %v, want a *SyncError", err)
+	}
+	if !bytes.Contains(logBuf.Bytes(), []byte("failed to copy big.txt")) {
+		t.Errorf("log should report the interrupted copy, got:\n%s", logBuf.String())
 	}
 
-	s := New(config, logger.NewWithWriter(logBuf))
-	if err := s.Sync(); err == nil {
-		t.Error("Sync should fail when source is a file")
+	// The partial file left behind must not be taken for an up-to-date copy.
+	if _, err := s.SyncFS(src, "/src", faulty, "/dst"); err != nil {
+		t.Fatalf("second SyncFS failed: %v", err)
+	}
+	if content := readMemFile(t, dst, "/dst/big.txt"); len(content) != 1000 {
+		t.Errorf("big.txt has %d bytes after retry, want 1000", len(content))
+	}
+	info, err := dst.Stat("/dst/big.txt")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if !info.ModTime.Equal(modTime) {
+		t.Errorf("big.txt modTime = %v, want %v", info.ModTime, modTime)
 	}
 }
 
-func TestSync_CreatesTargetDir(t *testing.T) {
-	srcDir, dstDir, logBuf := setupTest(t)
+func TestSyncFS_FlakyStat(t *testing.T) {
+	src := fs.NewMemFS()
+	dst := fs.NewMemFS()
 
-	createFile(t, filepath.Join(srcDir, "file.txt"), "content")
+	for i := range 20 {
+		writeMemFile(t, src, fmt.Sprintf("/src/file%02d.txt", i), "content", time.Now())
+	}
+	faulty := fs.NewFaultFS(dst, fs.FaultRule{Op: "Stat", Path: "file*.txt", Probability: 0.3, Err: errors.New("connection reset")})
+
+	s := New(Options{}, logger.NewWithWriter(&bytes.Buffer{}))
+	for range 10 {
+		var syncErr *SyncError
+		if _, err := s.SyncFS(src, "/src", faulty, "/dst"); err != nil && !errors.As(err, &syncErr) {
+			t.Fatalf("SyncFS failed: %v", err)
+		}
+	}
 
-	newTarget := filepath.Join(dstDir, "new", "nested", "target")
+	for i := range 20 {
+		p := fmt.Sprintf("/dst/file%02d.txt", i)
+		if content := readMemFile(t, dst, p); content != "content" {
+			t.Errorf("%s content = %q, want %q", p, content, "content")
+		}
+	}
+}
 
-	config := &cli.Config{
-		SourceDir:     srcDir,
-		TargetDir:     newTarget,
-		DeleteMissing: false,
-		UseChecksum:   false,
+func TestJoinAndRelPath(t *testing.T) {
+	tests := []struct {
+		name     string
+		fs       fs.FileSystem
+		root     string
+		path     string
+		wantRel  string
+		wantJoin string
+	}{
+		{name: "slash", fs: fs.NewMemFS(), root: "/data", path: "/data/a/b.txt", wantRel: "a/b.txt", wantJoin: "/data/a/b.txt"},
+		{name: "slash root", fs: fs.NewMemFS(), root: "/", path: "/a/b.txt", wantRel: "a/b.txt", wantJoin: "/a/b.txt"},
+		{name: "backslash", fs: fs.NewMemFSWithSeparator('\\'), root: `C:\data`, path: `C:\data\a\b.txt`, wantRel: "a/b.txt", wantJoin: `C:\data\a\b.txt`},
 	}
 
-	s := New(config, logger.NewWithWriter(logBuf))
-	if err := s.Sync(); err != nil {
-		t.Fatalf("Sync failed: %v", err)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rel, err := relPath(tt.fs, tt.root, tt.path)
+			if err != nil {
+				t.Fatalf("relPath failed: %v", err)
+			}
+			if rel != tt.wantRel {
+				t.Errorf("relPath = %q, want %q", rel, tt.wantRel)
+			}
+			if joined := joinPath(tt.fs, tt.root, rel); joined != tt.wantJoin {
+				t.Errorf("joinPath = %q, want %q", joined, tt.wantJoin)
+			}
+		})
 	}
 
-	if _, err := os.Stat(filepath.Join(newTarget, "file.txt")); os.IsNotExist(err) {
-		t.Error("file should be synced to new target directory")
+	if _, err := relPath(fs.NewMemFSWithSeparator('\\'), `C:\data`, `C:\other\file`); err == nil {
+		t.Error("relPath should fail for a path outside the root")
 	}
 }
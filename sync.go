@@ -0,0 +1,195 @@
+// Package sync synchronizes one file tree to another, one way, so Go
+// programs can embed the engine behind the sync command:
+//
+//	src, srcPath, err := fs.Open("/data", fs.Options{})
+//	...
+//	dst, dstPath, err := fs.Open("backup@nas:/volume1/data", fs.Options{})
+//	...
+//	s := sync.New(src, dst, sync.WithPaths(srcPath, dstPath), sync.WithDeleteMissing())
+//	result, err := s.Run(ctx)
+package sync
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/robertgontarski/sync/fs"
+	"github.com/robertgontarski/sync/internal/logger"
+	"github.com/robertgontarski/sync/internal/ratelimit"
+	"github.com/robertgontarski/sync/internal/syncer"
+)
+
+// Result summarizes a run.
+type Result struct {
+	// Scanned is the number of files found in the source.
+	Scanned int
+	// Copied files were missing from the target, Updated ones differed
+	// and Skipped ones were already up to date.
+	Copied  int
+	Updated int
+	Skipped int
+	// Deleted files were removed from the target with WithDeleteMissing.
+	Deleted int
+	// Failed counts files that couldn't be read, compared, copied or
+	// deleted. The run carries on past them.
+	Failed int
+	// BytesSent is the size of the files copied and updated.
+	BytesSent int64
+	Duration  time.Duration
+}
+
+func (r Result) String() string {
+	return syncer.Result(r).String()
+}
+
+// SyncError is returned by a run that finished but failed for some files.
+type SyncError struct {
+	Failures []Failure
+}
+
+func (e *SyncError) Error() string {
+	failures := make([]syncer.Failure, len(e.Failures))
+	for i, f := range e.Failures {
+		failures[i] = syncer.Failure(f)
+	}
+	return (&syncer.SyncError{Failures: failures}).Error()
+}
+
+func (e *SyncError) Unwrap() []error {
+	errs := make([]error, len(e.Failures))
+	for i, f := range e.Failures {
+		errs[i] = f
+	}
+	return errs
+}
+
+// Failure is a file that couldn't be synchronized.
+type Failure struct {
+	// Path is relative to the source or target root, except for a path a
+	// walk returned from outside the root, which is given as it is.
+	Path string
+	// Op is what failed, e.g. "copy" or "delete".
+	Op  string
+	Err error
+}
+
+func (f Failure) Error() string {
+	return syncer.Failure(f).Error()
+}
+
+func (f Failure) Unwrap() error {
+	return f.Err
+}
+
+// ErrSafetyLimit is returned when WithMaxDelete stopped a run before it
+// deleted anything.
+var ErrSafetyLimit = syncer.ErrSafetyLimit
+
+// Syncer synchronizes a source filesystem to a target filesystem.
+type Syncer struct {
+	src, dst         fs.FileSystem
+	srcPath, dstPath string
+	opts             syncer.Options
+	log              *slog.Logger
+}
+
+// Option configures a Syncer.
+type Option func(*Syncer)
+
+// WithPaths sets the directories to synchronize within the source and
+// target filesystems. Both default to "/", the whole filesystem.
+func WithPaths(src, dst string) Option {
+	return func(s *Syncer) {
+		s.srcPath, s.dstPath = src, dst
+	}
+}
+
+// WithDeleteMissing deletes files from the target that aren't in the
+// source.
+func WithDeleteMissing() Option {
+	return func(s *Syncer) {
+		s.opts.DeleteMissing = true
+	}
+}
+
+// WithChecksum compares files by their SHA256 checksum instead of their
+// size and modification time.
+func WithChecksum() Option {
+	return func(s *Syncer) {
+		s.opts.Checksum = true
+	}
+}
+
+// WithMaxDelete stops a run with ErrSafetyLimit, before deleting anything,
+// if WithDeleteMissing would delete more than n files.
+func WithMaxDelete(n int) Option {
+	return func(s *Syncer) {
+		s.opts.MaxDelete = n
+	}
+}
+
+// WithBandwidthLimit limits the data read from either side to
+// bytesPerSecond.
+func WithBandwidthLimit(bytesPerSecond int64) Option {
+	return func(s *Syncer) {
+		s.opts.BWLimit = nil
+		if bytesPerSecond > 0 {
+			s.opts.BWLimit = ratelimit.Schedule{{Rate: bytesPerSecond}}
+		}
+	}
+}
+
+// WithLogger logs what the run does to l, e.g. each file copied at
+// slog.LevelInfo and why it was copied at slog.LevelDebug. Nothing is
+// logged by default.
+func WithLogger(l *slog.Logger) Option {
+	return func(s *Syncer) {
+		s.log = l
+	}
+}
+
+// New returns a Syncer copying from src to dst. The caller keeps
+// ownership of both filesystems.
+func New(src, dst fs.FileSystem, opts ...Option) *Syncer {
+	s := &Syncer{
+		src:     src,
+		dst:     dst,
+		srcPath: "/",
+		dstPath: "/",
+		log:     slog.New(slog.DiscardHandler),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Run synchronizes the source to the target. Files that fail don't stop
+// the run; it then returns a *SyncError listing them. Any other error
+// stopped the run, e.g. ctx's error once ctx is done.
+func (s *Syncer) Run(ctx context.Context) (Result, error) {
+	result, err := syncer.New(s.opts, logger.NewSlog(s.log)).SyncFSContext(ctx, s.src, s.srcPath, s.dst, s.dstPath)
+	return Result(result), publicError(err)
+}
+
+// publicError returns err with the engine's *syncer.SyncError, also when
+// joined with other errors, converted to a *SyncError.
+func publicError(err error) error {
+	switch err := err.(type) {
+	case *syncer.SyncError:
+		failures := make([]Failure, len(err.Failures))
+		for i, f := range err.Failures {
+			failures[i] = Failure(f)
+		}
+		return &SyncError{Failures: failures}
+	case interface{ Unwrap() []error }:
+		var errs []error
+		for _, e := range err.Unwrap() {
+			errs = append(errs, publicError(e))
+		}
+		return errors.Join(errs...)
+	}
+	return err
+}
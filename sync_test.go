@@ -0,0 +1,127 @@
+package sync_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robertgontarski/sync"
+	"github.com/robertgontarski/sync/fs"
+)
+
+func writeFile(t *testing.T, m *fs.MemFS, path, content string) {
+	t.Helper()
+	if err := m.WriteFile(path, []byte(content), 0644, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("WriteFile(%s) failed: %v", path, err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	src, dst := fs.NewMemFS(), fs.NewMemFS()
+	writeFile(t, src, "/data/a.txt", "a")
+	writeFile(t, src, "/data/sub/b.txt", "b")
+	writeFile(t, dst, "/backup/old.txt", "old")
+
+	logs := &bytes.Buffer{}
+	log := slog.New(slog.NewTextHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	s := sync.New(src, dst, sync.WithPaths("/data", "/backup"), sync.WithDeleteMissing(), sync.WithLogger(log))
+	result, err := s.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if result.Copied != 2 || result.Deleted != 1 {
+		t.Errorf("result = %+v, want 2 copied and 1 deleted", result)
+	}
+	if got, err := dst.ReadFile("/backup/sub/b.txt"); err != nil || string(got) != "b" {
+		t.Errorf("b.txt = %q, %v", got, err)
+	}
+	if !strings.Contains(logs.String(), "level=DEBUG msg=\"a.txt: missing in target\"") {
+		t.Errorf("logs lack the debug decision:\n%s", logs.String())
+	}
+
+	// A second run finds everything up to date.
+	if result, err := s.Run(context.Background()); err != nil || result.Skipped != 2 || result.Copied != 0 {
+		t.Errorf("second Run = %+v, %v", result, err)
+	}
+}
+
+func TestRun_MaxDelete(t *testing.T) {
+	src, dst := fs.NewMemFS(), fs.NewMemFS()
+	src.MkdirAll("/data", 0755)
+	writeFile(t, dst, "/backup/a.txt", "a")
+	writeFile(t, dst, "/backup/b.txt", "b")
+
+	s := sync.New(src, dst, sync.WithPaths("/data", "/backup"), sync.WithDeleteMissing(), sync.WithMaxDelete(1))
+	if _, err := s.Run(context.Background()); !errors.Is(err, sync.ErrSafetyLimit) {
+		t.Errorf("Run = %v, want ErrSafetyLimit", err)
+	}
+}
+
+func TestRun_Failures(t *testing.T) {
+	src := fs.NewMemFS()
+	writeFile(t, src, "/bad.txt", "bad")
+	writeFile(t, src, "/good.txt", "good")
+	dst := fs.NewFaultFS(fs.NewMemFS(), fs.FaultRule{Op: "Create", Path: "bad.txt", Err: errors.New("disk full")})
+
+	result, err := sync.New(src, dst).Run(context.Background())
+	var syncErr *sync.SyncError
+	if !errors.As(err, &syncErr) || len(syncErr.Failures) != 1 || syncErr.Failures[0].Path != "bad.txt" {
+		t.Errorf("Run = %v, want a *SyncError for bad.txt", err)
+	}
+	if err.Error() != "1 files failed: copy bad.txt: disk full" || result.Failed != 1 || result.Copied != 1 {
+		t.Errorf("Run = %+v, %q", result, err)
+	}
+}
+
+func TestRun_Disconnect(t *testing.T) {
+	src := fs.NewMemFS()
+	writeFile(t, src, "/big.bin", strings.Repeat("x", 1<<16))
+	dst := fs.NewFaultFS(fs.NewMemFS(), fs.FaultRule{Op: "Create", DisconnectAfter: 100})
+
+	_, err := sync.New(src, dst).Run(context.Background())
+	if !errors.Is(err, fs.ErrInjected) {
+		t.Errorf("Run = %v, want ErrInjected", err)
+	}
+}
+
+// countingFS is a FileSystem implemented outside the module's packages.
+type countingFS struct {
+	fs.FileSystem
+	stats int
+}
+
+func (c *countingFS) Stat(path string) (fs.FileInfo, error) {
+	c.stats++
+	return c.FileSystem.Stat(path)
+}
+
+func TestRun_CustomFileSystem(t *testing.T) {
+	mem := fs.NewMemFS()
+	writeFile(t, mem, "/a.txt", "a")
+	src := &countingFS{FileSystem: mem}
+
+	if _, err := sync.New(src, fs.NewMemFS()).Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if src.stats == 0 {
+		t.Error("the custom filesystem wasn't used")
+	}
+}
+
+func TestRun_Cancelled(t *testing.T) {
+	src, dst := fs.NewMemFS(), fs.NewMemFS()
+	writeFile(t, src, "/a.txt", "a")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := sync.New(src, dst).Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Run = %v, want context.Canceled", err)
+	}
+	if _, err := dst.Stat("/a.txt"); err == nil {
+		t.Error("a cancelled run copied a file")
+	}
+}